@@ -0,0 +1,117 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBootImage(t *testing.T) {
+	images := []*testImage{
+		{name: "one", root: testDir("")},
+		{name: "two", root: testDir("")},
+	}
+	b := buildWIM(t, images...)
+
+	r := mustNewReader(t, b)
+	if img, err := r.BootImage(); img != nil || err != nil || r.BootIndex() != 0 {
+		t.Fatalf("unexpected boot image %v: %v", img, err)
+	}
+	if _, err := r.ReadBootMetadata(); !errors.Is(err, ErrNoBootMetadata) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// Mark the second image bootable, reusing its metadata resource as the
+	// boot metadata, as WIMs produced by Windows do.
+	var hdr wimHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	hdr.BootIndex = 2
+	hdr.BootMetadata = r.Image[1].offset
+	var h bytes.Buffer
+	_ = binary.Write(&h, binary.LittleEndian, &hdr)
+	copy(b, h.Bytes())
+
+	r = mustNewReader(t, b)
+	img, err := r.BootImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.BootIndex() != 2 || img != r.Image[1] {
+		t.Fatalf("got boot index %d and image %v", r.BootIndex(), img)
+	}
+	md, err := r.ReadBootMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := r.BootMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	expected, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(md) == 0 || !bytes.Equal(md, expected) {
+		t.Errorf("unexpected boot metadata of length %d", len(md))
+	}
+}
+
+func TestBootMetadata(t *testing.T) {
+	r := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("")}))
+	if rc, err := r.BootMetadata(); rc != nil || !errors.Is(err, ErrNoBootMetadata) {
+		t.Fatalf("unexpected boot metadata: %v", err)
+	}
+
+	// A Writer compresses metadata resources, so the boot metadata must be
+	// decompressed to match the hash recorded for the image's metadata.
+	var out seekBuffer
+	w := NewWriter(&out)
+	img, err := w.AddImage("boot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := strings.Repeat("boot file. ", 1000)
+	if err := img.AddFile("boot.txt", &FileHeader{Size: int64(len(data))}, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := out.b
+	r = mustNewReader(t, b)
+	var hdr wimHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	hdr.BootIndex = 1
+	hdr.BootMetadata = r.Image[0].offset
+	var h bytes.Buffer
+	_ = binary.Write(&h, binary.LittleEndian, &hdr)
+	copy(b, h.Bytes())
+
+	r = mustNewReader(t, b)
+	if r.Image[0].offset.Flags()&resFlagCompressed == 0 {
+		t.Fatal("metadata was not compressed")
+	}
+	rc, err := r.BootMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	md, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(md)) != hdr.BootMetadata.OriginalSize || sha1Hash(md) != r.Image[0].hash {
+		t.Errorf("unexpected boot metadata of length %d", len(md))
+	}
+}
@@ -0,0 +1,76 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"container/list"
+	"sync"
+)
+
+// chunkKey identifies a decompressed chunk by the offset of its resource in
+// the WIM and its index within the resource.
+type chunkKey struct {
+	offset int64
+	chunk  int
+}
+
+type cachedChunk struct {
+	key  chunkKey
+	data []byte
+}
+
+// chunkCache is a least recently used cache of decompressed chunks, shared by
+// all readers of a Reader's compressed resources. Cached chunks are never
+// modified, so they may be used after they are evicted.
+type chunkCache struct {
+	mu      sync.Mutex
+	max     int64
+	size    int64
+	lru     *list.List // of *cachedChunk, most recently used first
+	entries map[chunkKey]*list.Element
+}
+
+func newChunkCache(max int64) *chunkCache {
+	return &chunkCache{
+		max:     max,
+		lru:     list.New(),
+		entries: make(map[chunkKey]*list.Element),
+	}
+}
+
+func (c *chunkCache) get(key chunkKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedChunk).data, true
+}
+
+// add caches a copy of data, evicting the least recently used chunks to stay
+// within the size limit, and returns the copy.
+func (c *chunkCache) add(key chunkKey, data []byte) []byte {
+	data = append([]byte(nil), data...)
+	if int64(len(data)) > c.max {
+		return data
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		// Another reader decompressed the chunk concurrently.
+		c.lru.MoveToFront(e)
+		return e.Value.(*cachedChunk).data
+	}
+	c.entries[key] = c.lru.PushFront(&cachedChunk{key: key, data: data})
+	c.size += int64(len(data))
+	for c.size > c.max {
+		e := c.lru.Back()
+		cc := c.lru.Remove(e).(*cachedChunk)
+		delete(c.entries, cc.key)
+		c.size -= int64(len(cc.data))
+	}
+	return data
+}
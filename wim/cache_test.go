@@ -0,0 +1,160 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingDecompressor wraps repeatDecompressor, counting its calls.
+type countingDecompressor struct {
+	calls int64
+}
+
+func (d *countingDecompressor) Decompress(src []byte, uncompressedSize int) ([]byte, error) {
+	atomic.AddInt64(&d.calls, 1)
+	return repeatDecompressor{}.Decompress(src, uncompressedSize)
+}
+
+func cacheTestWIM(tb testing.TB) ([]byte, []byte) {
+	tb.Helper()
+
+	var data []byte
+	for _, c := range "abcd" {
+		data = append(data, bytes.Repeat([]byte{byte(c)}, chunkSize)...)
+	}
+	return buildCompressedWIM(tb, hdrFlagCompressLzx, repeatCompress, &testImage{name: "test", root: testDir("",
+		testRegular("file", string(data)),
+	)}), data
+}
+
+func readCacheTestFile(tb testing.TB, r *Reader) []byte {
+	tb.Helper()
+
+	f, err := r.Image[0].OpenFile("file")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+func TestChunkCache(t *testing.T) {
+	b, data := cacheTestWIM(t)
+	for _, tc := range []struct {
+		size  int64
+		calls int64
+	}{
+		{0, 8},
+		{4 * chunkSize, 4},
+		{2 * chunkSize, 8},
+	} {
+		t.Run(fmt.Sprint(tc.size), func(t *testing.T) {
+			d := &countingDecompressor{}
+			opts := &Options{CacheSize: tc.size}
+			r, err := NewReaderWithOptions(bytes.NewReader(b), opts.WithDecompressor(CompressionLZX, d))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The image metadata is not compressed by the test builder, so
+			// only the file's chunks are counted.
+			for i := 0; i < 2; i++ {
+				if got := readCacheTestFile(t, r); !bytes.Equal(got, data) {
+					t.Fatal("unexpected contents")
+				}
+			}
+			if d.calls != tc.calls {
+				t.Errorf("got %d decompressions, expected %d", d.calls, tc.calls)
+			}
+		})
+	}
+}
+
+func TestChunkCacheConcurrent(t *testing.T) {
+	b, data := cacheTestWIM(t)
+	opts := &Options{CacheSize: 2 * chunkSize}
+	r, err := NewReaderWithOptions(bytes.NewReader(b), opts.WithDecompressor(CompressionLZX, repeatDecompressor{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := r.Image[0].OpenFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rc, err := f.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer rc.Close()
+			p := make([]byte, 100)
+			for j := 0; j < 50; j++ {
+				off := int64((i*j*7919)%len(data) - len(p))
+				if off < 0 {
+					off = 0
+				}
+				if _, err := rc.(io.ReaderAt).ReadAt(p, off); err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(p, data[off:off+int64(len(p))]) {
+					t.Errorf("unexpected data at offset %d", off)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// BenchmarkChunkCache reads a small record from each chunk of a file in turn,
+// as random access to a compressed file does.
+func BenchmarkChunkCache(b *testing.B) {
+	wim, _ := cacheTestWIM(b)
+	for _, size := range []int64{0, 4 * chunkSize} {
+		b.Run(fmt.Sprint("CacheSize=", size), func(b *testing.B) {
+			opts := &Options{CacheSize: size}
+			r, err := NewReaderWithOptions(bytes.NewReader(wim), opts.WithDecompressor(CompressionLZX, repeatDecompressor{}))
+			if err != nil {
+				b.Fatal(err)
+			}
+			f, err := r.Image[0].OpenFile("file")
+			if err != nil {
+				b.Fatal(err)
+			}
+			rc, err := f.Open()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer rc.Close()
+			ra := rc.(io.ReaderAt)
+			p := make([]byte, 100)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := ra.ReadAt(p, int64(i%4)*chunkSize); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentReads opens an image and reads its directories and files from
+// several goroutines at once. Run it with the race detector.
+func TestConcurrentReads(t *testing.T) {
+	var dirs []*testFile
+	for i := 0; i < 4; i++ {
+		var files []*testFile
+		for j := 0; j < 8; j++ {
+			files = append(files, testRegular(fmt.Sprint("file", j), fmt.Sprintf("contents of %d/%d", i, j)))
+		}
+		dirs = append(dirs, testDir(fmt.Sprint("dir", i), files...))
+	}
+	img := mustNewReader(t, buildWIM(t, &testImage{
+		name: "test",
+		sds:  [][]byte{[]byte("sd")},
+		root: testDir("", dirs...),
+	})).Image[0]
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			root, err := img.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			i := g % len(dirs)
+			d, err := img.OpenFile(fmt.Sprint("dir", i))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			files, err := d.Readdir()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for j, f := range files {
+				rc, err := f.Open()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				b, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if expected := fmt.Sprintf("contents of %d/%d", i, j); string(b) != expected {
+					t.Errorf("got %q, expected %q", b, expected)
+				}
+			}
+			if _, err := root.SecurityDescriptors(); err != nil {
+				t.Error(err)
+			}
+			if _, err := img.SecurityDescriptorCount(); err != nil {
+				t.Error(err)
+			}
+			if _, err := img.HardLinks(); err != nil {
+				t.Error(err)
+			}
+		}(g)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,53 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"context"
+	"io"
+)
+
+// contextReaderAt fails reads from the underlying reader once ctx is done.
+// Compressed resources are read one chunk per ReadAt call, so ctx is checked
+// at least once per chunk. A read that has already started is not
+// interrupted; OpenTimeout bounds the duration of individual reads.
+type contextReaderAt struct {
+	ctx context.Context
+	r   io.ReaderAt
+}
+
+func (c *contextReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.ReadAt(b, off)
+}
+
+// ReadXMLContext reads and returns the WIM's XML data, which is also available
+// in XMLInfo. It returns ctx.Err() if ctx is done before the data has been
+// read.
+func (r *Reader) ReadXMLContext(ctx context.Context) (string, error) {
+	return r.readXML(&contextReaderAt{ctx: ctx, r: r.r})
+}
+
+// OpenContext is like Open, but reads from the returned reader fail with
+// ctx.Err() once ctx is done. No goroutines are started, so abandoning the
+// reader after cancellation leaks nothing, but it should still be closed.
+func (f *File) OpenContext(ctx context.Context) (io.ReadCloser, error) {
+	rc, err := f.src.resourceReaderAt(&contextReaderAt{ctx: ctx, r: f.src.r}, &f.offset, 0)
+	if err != nil || !f.src.opts.VerifyHashes {
+		return rc, err
+	}
+	return newVerifyReader(rc, f.Name, f.Hash, f.offset.Offset), nil
+}
+
+// OpenContext is like Open, but reads from the returned reader fail with
+// ctx.Err() once ctx is done.
+func (s *Stream) OpenContext(ctx context.Context) (io.ReadCloser, error) {
+	rc, err := s.wim.resourceReaderAt(&contextReaderAt{ctx: ctx, r: s.wim.r}, &s.offset, 0)
+	if err != nil || !s.wim.opts.VerifyHashes {
+		return rc, err
+	}
+	return newVerifyReader(rc, s.Name, s.Hash, s.offset.Offset), nil
+}
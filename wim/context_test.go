@@ -0,0 +1,55 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestOpenContext(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*chunkSize/16)
+	b := buildCompressedWIM(t, hdrFlagCompressLzx, repeatCompress, &testImage{
+		name: "test",
+		root: testDir("", &testFile{name: "big", attr: FILE_ATTRIBUTE_NORMAL, data: data, securityID: 0xffffffff}),
+	})
+	r := mustNewReader(t, b)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if s, err := r.ReadXMLContext(ctx); err != nil || s != r.XMLInfo {
+		t.Fatalf("unexpected XML %q: %v", s, err)
+	}
+	root, err := r.Image[0].OpenContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := root.Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := f[0].OpenContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	buf := make([]byte, chunkSize)
+	if _, err := io.ReadFull(rc, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if _, err := io.ReadFull(rc, buf); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error after cancellation %v", err)
+	}
+	if _, err := r.ReadXMLContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error reading XML %v", err)
+	}
+	if _, err := mustNewReader(t, b).Image[0].OpenContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error opening image %v", err)
+	}
+}
@@ -5,28 +5,228 @@ package wim
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"sync"
+	"time"
 
+	"github.com/Microsoft/go-winio/wim/lzms"
 	"github.com/Microsoft/go-winio/wim/lzx"
+	"github.com/Microsoft/go-winio/wim/xpress"
 )
 
-const chunkSize = 32768 // Compressed resource chunk size
+// chunkSize is the default size of compressed resource chunks, and the only
+// one LZX supports.
+const chunkSize = 32768
 
+// checkChunkSize returns an error if compressed WIMs using kind cannot have
+// chunks of size bytes. Uncompressed WIMs do not use chunks, so any size is
+// accepted. The limits are those of the formats; LZX chunks larger than 32KB
+// are accepted only with a replacement decompressor, as the built-in one does
+// not support them.
+func (o *Options) checkChunkSize(kind CompressionKind, size uint32) error {
+	var min, max uint32
+	switch kind {
+	case CompressionNone:
+		return nil
+	case CompressionXpress:
+		min, max = 1<<12, 1<<16
+	case CompressionLZX:
+		min, max = 1<<15, 1<<21
+		if _, ok := o.decompressors[kind]; !ok {
+			max = chunkSize
+		}
+	case CompressionLZMS:
+		min, max = 1<<15, 1<<30
+	}
+	if size < min || size > max || size&(size-1) != 0 {
+		return fmt.Errorf("%w: chunk size %d", ErrUnsupportedCompression, size)
+	}
+	return nil
+}
+
+// CompressionKind identifies the algorithm used to compress a WIM's resources.
+type CompressionKind int
+
+const (
+	// CompressionNone indicates that resources are stored uncompressed.
+	CompressionNone CompressionKind = iota
+	// CompressionXpress indicates XPRESS (LZ77 + Huffman) compression.
+	CompressionXpress
+	// CompressionLZX indicates LZX compression.
+	CompressionLZX
+	// CompressionLZMS indicates LZMS compression.
+	CompressionLZMS
+)
+
+// CompressionType is an alias of CompressionKind.
+type CompressionType = CompressionKind
+
+func (k CompressionKind) String() string {
+	switch k {
+	case CompressionNone:
+		return "None"
+	case CompressionXpress:
+		return "XPRESS"
+	case CompressionLZX:
+		return "LZX"
+	case CompressionLZMS:
+		return "LZMS"
+	default:
+		return fmt.Sprintf("CompressionKind(%d)", int(k))
+	}
+}
+
+// compressionKind returns the compression algorithm indicated by the header
+// flags. Compressed WIMs that do not name an algorithm are assumed to use LZX.
+func (h *wimHeader) compressionKind() CompressionKind {
+	switch {
+	case h.Flags&hdrFlagCompressed == 0:
+		return CompressionNone
+	case h.Flags&hdrFlagCompressXpress != 0:
+		return CompressionXpress
+	case h.Flags&hdrFlagCompressLzms != 0:
+		return CompressionLZMS
+	default:
+		return CompressionLZX
+	}
+}
+
+// compression returns the compression algorithm of the resource described by
+// rd, which is CompressionNone if the resource is stored uncompressed. Solid
+// resources and the streams packed in them use the algorithm recorded in the
+// solid resource's header.
+func (r *Reader) compression(rd *resourceDescriptor) CompressionKind {
+	if s := r.solidResourceOf(rd); s != nil {
+		return s.compression
+	}
+	if rd.Flags()&resFlagCompressed == 0 {
+		return CompressionNone
+	}
+	return r.hdr.compressionKind()
+}
+
+// SniffCompression reads only the header of the WIM in f and returns the
+// compression algorithm its resources use, or CompressionNone if they are
+// stored uncompressed. The offset table and images are not parsed, so this is
+// much cheaper than NewReader when only the compression type is needed.
+func SniffCompression(f io.ReaderAt) (CompressionKind, error) {
+	var hdr wimHeader
+	if err := readHeader(f, &hdr); err != nil {
+		return CompressionNone, err
+	}
+	return hdr.compressionKind(), nil
+}
+
+// A Decompressor decompresses individual chunks of compressed WIM resources.
+// Implementations may be registered with Options.WithDecompressor to replace
+// the package's pure-Go codecs, for example with an optimized cgo-backed one.
+//
+// A Decompressor may be called concurrently from multiple goroutines.
+type Decompressor interface {
+	// Decompress decompresses src, which holds exactly one compressed chunk,
+	// and returns its contents, which must be exactly uncompressedSize bytes
+	// long. The returned slice is not retained by the caller past the next call
+	// on the same resource and may not alias src.
+	Decompress(src []byte, uncompressedSize int) ([]byte, error)
+}
+
+// WithDecompressor registers d as the Decompressor used for resources
+// compressed with kind, replacing the default implementation if there is one.
+// It returns o to allow chaining.
+func (o *Options) WithDecompressor(kind CompressionKind, d Decompressor) *Options {
+	if o.decompressors == nil {
+		o.decompressors = make(map[CompressionKind]Decompressor)
+	}
+	o.decompressors[kind] = d
+	return o
+}
+
+// defaultDecompressors holds the built-in codecs.
+var defaultDecompressors = map[CompressionKind]Decompressor{
+	CompressionXpress: xpressDecompressor{},
+	CompressionLZX:    lzxDecompressor{},
+	CompressionLZMS:   lzmsDecompressor{},
+}
+
+// decompressor returns the Decompressor to use for kind.
+func (o *Options) decompressor(kind CompressionKind) (Decompressor, error) {
+	if d, ok := o.decompressors[kind]; ok && d != nil {
+		return d, nil
+	}
+	if d, ok := defaultDecompressors[kind]; ok {
+		return d, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedCompression, kind)
+}
+
+type lzxDecompressor struct{}
+
+func (lzxDecompressor) Decompress(src []byte, uncompressedSize int) ([]byte, error) {
+	return lzx.Decompress(src, uncompressedSize)
+}
+
+type xpressDecompressor struct{}
+
+func (xpressDecompressor) Decompress(src []byte, uncompressedSize int) ([]byte, error) {
+	return xpress.Decompress(src, uncompressedSize)
+}
+
+type lzmsDecompressor struct{}
+
+func (lzmsDecompressor) Decompress(src []byte, uncompressedSize int) ([]byte, error) {
+	return lzms.Decompress(src, uncompressedSize)
+}
+
+// compressedReader reads a compressed resource. It decompresses one chunk at
+// a time on demand using the resource's chunk table, so it can seek to and
+// read from any offset without decompressing the chunks before it.
 type compressedReader struct {
 	r            *io.SectionReader
-	d            io.ReadCloser
+	d            Decompressor
+	metrics      *readerMetrics
+	cache        *chunkCache // if set, decompressed chunks are shared through it
+	offset       int64       // offset of the resource in the WIM, identifying it in cache
 	chunks       []int64
-	curChunk     int
+	chunkSize    int64
 	originalSize int64
+	// start and end delimit the part of the uncompressed data that is read,
+	// which is all of it except for streams packed in solid resources.
+	start  int64
+	end    int64
+	pos    int64 // offset of the next Read in the uncompressed data
+	cur    int   // index of the chunk held in buf, or -1
+	src    []byte
+	buf    []byte
+	closed bool
 }
 
-func newCompressedReader(r *io.SectionReader, originalSize int64, offset int64) (*compressedReader, error) {
-	nchunks := (originalSize + chunkSize - 1) / chunkSize
-	var base int64
+func newCompressedReader(r *io.SectionReader, d Decompressor, metrics *readerMetrics, chunkSize, originalSize, offset int64) (*compressedReader, error) {
+	nchunks := originalSize / chunkSize
+	if originalSize%chunkSize != 0 {
+		nchunks++
+	}
+	entrySize := int64(4)
+	if originalSize > 0xffffffff {
+		entrySize = 8
+	}
+	// Check the chunk table against the resource before allocating for it.
+	if nchunks > 0 && (nchunks-1)*entrySize > r.Size() {
+		return nil, fmt.Errorf("chunk table of %d chunks does not fit in %d bytes", nchunks, r.Size())
+	}
+	if nchunks > maxInt/8 {
+		return nil, fmt.Errorf("chunk table of %d chunks is too large for this platform", nchunks)
+	}
 	chunks := make([]int64, nchunks)
-	if originalSize <= 0xffffffff {
+	base := (nchunks - 1) * entrySize
+	switch {
+	case nchunks == 0:
+		// An empty resource has no chunk table.
+		base = 0
+	case entrySize == 4:
 		// 32-bit chunk offsets
-		base = (nchunks - 1) * 4
 		chunks32 := make([]uint32, nchunks-1)
 		err := binary.Read(r, binary.LittleEndian, chunks32)
 		if err != nil {
@@ -35,9 +235,8 @@ func newCompressedReader(r *io.SectionReader, originalSize int64, offset int64)
 		for i, n := range chunks32 {
 			chunks[i+1] = int64(n)
 		}
-	} else {
+	default:
 		// 64-bit chunk offsets
-		base = (nchunks - 1) * 8
 		err := binary.Read(r, binary.LittleEndian, chunks[1:])
 		if err != nil {
 			return nil, err
@@ -50,21 +249,14 @@ func newCompressedReader(r *io.SectionReader, originalSize int64, offset int64)
 
 	cr := &compressedReader{
 		r:            r,
+		d:            d,
+		metrics:      metrics,
 		chunks:       chunks,
+		chunkSize:    chunkSize,
 		originalSize: originalSize,
-	}
-
-	err := cr.reset(int(offset / chunkSize))
-	if err != nil {
-		return nil, err
-	}
-
-	suboff := offset % chunkSize
-	if suboff != 0 {
-		_, err := io.CopyN(io.Discard, cr.d, suboff)
-		if err != nil {
-			return nil, err
-		}
+		end:          originalSize,
+		pos:          offset,
+		cur:          -1,
 	}
 	return cr, nil
 }
@@ -76,64 +268,251 @@ func (r *compressedReader) chunkOffset(n int) int64 {
 	return r.chunks[n]
 }
 
-func (r *compressedReader) chunkSize(n int) int {
-	return int(r.chunkOffset(n+1) - r.chunkOffset(n))
+// compressedSize returns the size of chunk n according to the chunk table. It
+// is negative if the table's offsets are out of order, and may not fit in an
+// int, so it is checked before use.
+func (r *compressedReader) compressedSize(n int) int64 {
+	return r.chunkOffset(n+1) - r.chunkOffset(n)
 }
 
 func (r *compressedReader) uncompressedSize(n int) int {
 	if n < len(r.chunks)-1 {
-		return chunkSize
+		return int(r.chunkSize)
 	}
-	size := int(r.originalSize % chunkSize)
+	size := int(r.originalSize % r.chunkSize)
 	if size == 0 {
-		size = chunkSize
+		size = int(r.chunkSize)
 	}
 	return size
 }
 
-func (r *compressedReader) reset(n int) error {
-	if n >= len(r.chunks) {
-		return io.EOF
+// decodeChunk returns the decompressed contents of chunk n, which may alias
+// *src, from the cache if possible.
+func (r *compressedReader) decodeChunk(n int, src *[]byte) ([]byte, error) {
+	if r.cache == nil {
+		return r.readChunk(n, src)
 	}
-	if r.d != nil {
-		r.d.Close()
+	key := chunkKey{offset: r.offset, chunk: n}
+	if b, ok := r.cache.get(key); ok {
+		return b, nil
 	}
-	r.curChunk = n
-	size := r.chunkSize(n)
+	b, err := r.readChunk(n, src)
+	if err != nil {
+		return nil, err
+	}
+	return r.cache.add(key, b), nil
+}
+
+// readChunk reads chunk n into *src, growing it as needed, and returns its
+// decompressed contents, which may alias *src.
+func (r *compressedReader) readChunk(n int, src *[]byte) ([]byte, error) {
 	uncompressedSize := r.uncompressedSize(n)
-	section := io.NewSectionReader(r.r, r.chunkOffset(n), int64(size))
-	if size != uncompressedSize {
-		d, err := lzx.NewReader(section, uncompressedSize)
-		if err != nil {
-			return err
+	csize := r.compressedSize(n)
+	if csize < 0 || csize > int64(uncompressedSize) {
+		return nil, fmt.Errorf("invalid compressed chunk size %d", csize)
+	}
+	size := int(csize)
+	if cap(*src) < size {
+		*src = make([]byte, size)
+	}
+	b := (*src)[:size]
+	if m, err := r.r.ReadAt(b, r.chunkOffset(n)); m < size {
+		if err == io.EOF { //nolint:errorlint
+			err = io.ErrUnexpectedEOF
 		}
-		r.d = d
-	} else {
-		r.d = io.NopCloser(section)
+		return nil, err
 	}
-
-	return nil
+	if size == uncompressedSize {
+		// Chunks that do not compress are stored as is.
+		return b, nil
+	}
+	var start time.Time
+	if r.metrics != nil {
+		start = time.Now()
+	}
+	out, err := r.d.Decompress(b, uncompressedSize)
+	if err != nil {
+		return nil, err
+	}
+	if r.metrics != nil {
+		r.metrics.add(len(out), time.Since(start))
+	}
+	if len(out) != uncompressedSize {
+		return nil, fmt.Errorf("decompressed chunk is %d bytes, expected %d", len(out), uncompressedSize)
+	}
+	return out, nil
 }
 
 func (r *compressedReader) Read(b []byte) (int, error) {
-	for {
-		n, err := r.d.Read(b)
-		if err != io.EOF { //nolint:errorlint
-			return n, err
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.pos >= r.end {
+		return 0, io.EOF
+	}
+	n := int(r.pos / r.chunkSize)
+	if n != r.cur {
+		buf, err := r.decodeChunk(n, &r.src)
+		if err != nil {
+			r.cur = -1
+			return 0, err
 		}
+		r.buf = buf
+		r.cur = n
+	}
+	m := copy(b, r.view(r.buf, r.pos))
+	r.pos += int64(m)
+	return m, nil
+}
 
-		err = r.reset(r.curChunk + 1)
+// Seek implements io.Seeker. Seeking is cheap; the chunk containing the new
+// offset is only decompressed by the next Read.
+func (r *compressedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos - r.start
+	case io.SeekEnd:
+		offset += r.end - r.start
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = r.start + offset
+	return offset, nil
+}
+
+// ReadAt implements io.ReaderAt. It does not use or change the position used
+// by Read and Seek, and it may be called concurrently.
+func (r *compressedReader) ReadAt(b []byte, off int64) (int, error) {
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	var src []byte
+	read := 0
+	off += r.start
+	for read < len(b) {
+		if off >= r.end {
+			return read, io.EOF
+		}
+		buf, err := r.decodeChunk(int(off/r.chunkSize), &src)
 		if err != nil {
-			return n, err
+			return read, err
 		}
+		m := copy(b[read:], r.view(buf, off))
+		read += m
+		off += int64(m)
 	}
+	return read, nil
+}
+
+// view returns the part of buf, the decompressed chunk holding offset pos of
+// the uncompressed data, from pos up to at most r.end.
+func (r *compressedReader) view(buf []byte, pos int64) []byte {
+	buf = buf[pos%r.chunkSize:]
+	if left := r.end - pos; int64(len(buf)) > left {
+		buf = buf[:left]
+	}
+	return buf
 }
 
 func (r *compressedReader) Close() error {
-	var err error
-	if r.d != nil {
-		err = r.d.Close()
-		r.d = nil
+	r.closed = true
+	r.buf = nil
+	r.cur = -1
+	return nil
+}
+
+// readAheadSize is the size of the window that small sequential reads of
+// uncompressed resources are served from.
+const readAheadSize = 64 * 1024
+
+var readAheadPool = sync.Pool{New: func() interface{} {
+	b := make([]byte, readAheadSize)
+	return &b
+}}
+
+// sectionReadCloser is an uncompressed resource. It supports seeking and
+// random access through the embedded io.SectionReader. Reads smaller than
+// readAheadSize are served from a read-ahead window, so that reading a
+// resource in small pieces, as io.ReadAll and bufio do, issues few large reads
+// against the WIM rather than many small ones.
+type sectionReadCloser struct {
+	*io.SectionReader
+	window *[]byte // pooled read-ahead buffer, or nil
+	ahead  []byte  // unread bytes of window, which end at the SectionReader's position
+}
+
+func newSectionReadCloser(section *io.SectionReader) *sectionReadCloser {
+	return &sectionReadCloser{SectionReader: section}
+}
+
+// Read fills b as far as the end of the resource allows, as
+// io.SectionReader.Read does, refilling the window as needed.
+func (r *sectionReadCloser) Read(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		if len(r.ahead) == 0 {
+			if len(b)-n >= readAheadSize {
+				m, err := r.readSection(b[n:])
+				n += m
+				if n == 0 {
+					return 0, err
+				}
+				break
+			}
+			if r.window == nil {
+				r.window = readAheadPool.Get().(*[]byte)
+			}
+			m, err := r.readSection(*r.window)
+			r.ahead = (*r.window)[:m]
+			if m == 0 {
+				if n == 0 {
+					return 0, err
+				}
+				break
+			}
+		}
+		m := copy(b[n:], r.ahead)
+		r.ahead = r.ahead[m:]
+		n += m
 	}
-	return err
+	return n, nil
+}
+
+// readSection reads from the resource, reporting io.ErrUnexpectedEOF if the
+// WIM ends before the resource does.
+func (r *sectionReadCloser) readSection(b []byte) (int, error) {
+	n, err := r.SectionReader.Read(b)
+	if err == io.EOF { //nolint:errorlint
+		if pos, _ := r.SectionReader.Seek(0, io.SeekCurrent); pos < r.Size() {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+func (r *sectionReadCloser) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekCurrent {
+		offset -= int64(len(r.ahead))
+	}
+	pos, err := r.SectionReader.Seek(offset, whence)
+	if err == nil {
+		r.ahead = nil
+	}
+	return pos, err
+}
+
+func (r *sectionReadCloser) Close() error {
+	if r.window != nil {
+		readAheadPool.Put(r.window)
+		r.window = nil
+		r.ahead = nil
+	}
+	return nil
 }
@@ -0,0 +1,239 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/Microsoft/go-winio/wim/xpress"
+)
+
+// repeatDecompressor expands each chunk to its first byte repeated.
+type repeatDecompressor struct{}
+
+func (repeatDecompressor) Decompress(src []byte, uncompressedSize int) ([]byte, error) {
+	return bytes.Repeat(src[:1], uncompressedSize), nil
+}
+
+func TestCompressedReaderDecompressor(t *testing.T) {
+	// Two compressed chunks followed by a final chunk stored uncompressed.
+	originalSize := int64(2*chunkSize + 3)
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.LittleEndian, []uint32{1, 2})
+	b.WriteString("ab")
+	b.WriteString("xyz")
+	section := io.NewSectionReader(bytes.NewReader(b.Bytes()), 0, int64(b.Len()))
+	m := &readerMetrics{}
+
+	cr, err := newCompressedReader(section, repeatDecompressor{}, m, chunkSize, originalSize, chunkSize-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "a" + string(bytes.Repeat([]byte("b"), chunkSize)) + "xyz"
+	if string(got) != expected {
+		t.Fatalf("unexpected contents of length %d", len(got))
+	}
+	if m.chunks != 2 || m.bytes != 2*chunkSize {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+
+	var o Options
+	o.WithDecompressor(CompressionXpress, repeatDecompressor{})
+	if d, err := o.decompressor(CompressionXpress); err != nil || d != (repeatDecompressor{}) {
+		t.Fatalf("registered decompressor not used: %v", err)
+	}
+	if _, err := new(Options).decompressor(CompressionKind(99)); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Fatal("expected an error for an unsupported compression kind")
+	}
+	if _, err := o.decompressor(CompressionLZMS); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSniffCompression(t *testing.T) {
+	b := buildWIM(t, &testImage{name: "test", root: testDir("")})
+	for _, tc := range []struct {
+		flags hdrFlag
+		kind  CompressionKind
+	}{
+		{0, CompressionNone},
+		{hdrFlagCompressed | hdrFlagCompressXpress, CompressionXpress},
+		{hdrFlagCompressed | hdrFlagCompressLzx, CompressionLZX},
+		{hdrFlagCompressed | hdrFlagCompressLzms, CompressionLZMS},
+	} {
+		binary.LittleEndian.PutUint32(b[16:], uint32(tc.flags))
+		kind, err := SniffCompression(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind != tc.kind {
+			t.Errorf("flags %#x: got %s, expected %s", tc.flags, kind, tc.kind)
+		}
+	}
+
+	if _, err := SniffCompression(bytes.NewReader(make([]byte, len(b)))); !errors.Is(err, ErrNotWIM) {
+		t.Fatalf("unexpected error for a file that is not a WIM: %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	f := testRegular("file", strings.Repeat("a", 100))
+	f.streams = []testStream{{name: "ads", data: []byte("bbbb")}}
+	root := testDir("", f, testRegular("empty", ""))
+	for _, tc := range []struct {
+		b    []byte
+		kind CompressionType
+	}{
+		{buildWIM(t, &testImage{name: "test", root: root}), CompressionNone},
+		{buildCompressedWIM(t, hdrFlagCompressLzx, repeatCompress, &testImage{name: "test", root: root}), CompressionLZX},
+	} {
+		r := mustNewReader(t, tc.b)
+		if k := r.Compression(); k != tc.kind {
+			t.Errorf("reader compression %s, expected %s", k, tc.kind)
+		}
+		file, err := r.Image[0].OpenFile("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k := file.Compression(); k != tc.kind || file.Compressed() != (k != CompressionNone) {
+			t.Errorf("file compression %s, expected %s", k, tc.kind)
+		}
+		if k := file.Streams[0].Compression(); k != tc.kind {
+			t.Errorf("stream compression %s, expected %s", k, tc.kind)
+		}
+		empty, err := r.Image[0].OpenFile("empty")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k := empty.Compression(); k != CompressionNone {
+			t.Errorf("empty file compression %s", k)
+		}
+	}
+}
+
+// repeatCompress compresses chunks consisting of a single repeated byte for
+// use with repeatDecompressor.
+func repeatCompress(chunk []byte) []byte {
+	if len(bytes.Trim(chunk, string(chunk[:1]))) != 0 {
+		return chunk
+	}
+	return chunk[:1]
+}
+
+func TestOpenSeek(t *testing.T) {
+	var data []byte
+	for _, c := range "abc" {
+		data = append(data, bytes.Repeat([]byte{byte(c)}, chunkSize)...)
+	}
+	data = append(data, "final bytes"...)
+	b := buildCompressedWIM(t, hdrFlagCompressLzx, repeatCompress, &testImage{name: "test", root: testDir("",
+		testRegular("file", string(data)),
+	)})
+	r, err := NewReaderWithOptions(bytes.NewReader(b), new(Options).WithDecompressor(CompressionLZX, repeatDecompressor{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := r.Image[0].OpenFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.CompressedSize() >= f.Size {
+		t.Fatalf("file was not compressed: %d >= %d", f.CompressedSize(), f.Size)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	rs := rc.(io.ReadSeeker)
+
+	readAt := func(off int64, whence int, n int) string {
+		t.Helper()
+		if _, err := rs.Seek(off, whence); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(rs, b); err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	if s := readAt(-5, io.SeekEnd, 5); s != "bytes" {
+		t.Errorf("unexpected final bytes %q", s)
+	}
+	if s := readAt(chunkSize-1, io.SeekStart, 2); s != "ab" {
+		t.Errorf("unexpected bytes across a chunk boundary %q", s)
+	}
+	if s := readAt(2*chunkSize-2, io.SeekCurrent, 2); s != "cf" {
+		t.Errorf("unexpected bytes after a relative seek %q", s)
+	}
+	if _, err := rs.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(rs)
+	if err != nil || string(rest) != "nal bytes" {
+		t.Errorf("unexpected remainder %q: %v", rest, err)
+	}
+
+	p := make([]byte, 4)
+	if n, err := rc.(io.ReaderAt).ReadAt(p, int64(len(data))-2); n != 2 || err != io.EOF || string(p[:n]) != "es" { //nolint:errorlint
+		t.Errorf("unexpected ReadAt result %q: %v", p[:n], err)
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	data := bytes.Repeat([]byte("sixty-four kilobyte chunks. "), 8000)
+	build := func(flag hdrFlag, compress func([]byte) []byte, size int) []byte {
+		b := &wimBuilder{seen: make(map[SHA1Hash]bool), compress: compress, chunkSize: size}
+		out := b.build(t, "<WIM></WIM>", &testImage{name: "test", root: testDir("",
+			testRegular("file", string(data)),
+		)})
+		binary.LittleEndian.PutUint32(out[16:], uint32(hdrFlagCompressed|flag))
+		return out
+	}
+
+	r := mustNewReader(t, build(hdrFlagCompressXpress, xpress.Compress, 1<<16))
+	if r.ChunkSize() != 1<<16 {
+		t.Errorf("unexpected chunk size %d", r.ChunkSize())
+	}
+	f, err := r.Image[0].OpenFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := f.ReadString(); err != nil || s != string(data) {
+		t.Fatalf("unexpected contents: %v", err)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b := make([]byte, 10)
+	if _, err := rc.(io.ReaderAt).ReadAt(b, 1<<16-5); err != nil || !bytes.Equal(b, data[1<<16-5:1<<16+5]) {
+		t.Errorf("unexpected bytes across a chunk boundary %q: %v", b, err)
+	}
+
+	// LZX chunks larger than 32KB need a replacement decompressor.
+	lzx := build(hdrFlagCompressLzx, repeatCompress, 1<<16)
+	if _, err := NewReader(bytes.NewReader(lzx)); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := NewReaderWithOptions(bytes.NewReader(lzx), new(Options).WithDecompressor(CompressionLZX, repeatDecompressor{})); err != nil {
+		t.Error(err)
+	}
+	for _, size := range []int{1 << 11, 1 << 17} {
+		if _, err := NewReader(bytes.NewReader(build(hdrFlagCompressXpress, xpress.Compress, size))); !errors.Is(err, ErrUnsupportedCompression) {
+			t.Errorf("chunk size %d: unexpected error %v", size, err)
+		}
+	}
+}
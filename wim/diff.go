@@ -0,0 +1,78 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+// ImageDiff lists the differences between two images. Paths are
+// slash-separated and relative to the image roots, as in Records, and are
+// compared exactly, so a file whose name only changed case is both removed
+// and added.
+type ImageDiff struct {
+	// Added holds the paths of files that are only in the second image, in
+	// its walk order.
+	Added []string
+	// Removed holds the paths of files that are only in the first image, in
+	// its walk order.
+	Removed []string
+	// Changed holds the paths of files in both images that differ, in the
+	// walk order of the second image.
+	Changed []string
+}
+
+// DiffImages compares the trees of images a and b, which may belong to the
+// same or different WIMs, and returns the files that were added, removed, or
+// changed going from a to b. A file has changed if its contents, size,
+// attributes, creation or last write time, or alternate data streams differ.
+// Contents are compared by hash, so no file data is read. Last access times
+// are ignored, since they change without the file being modified.
+func DiffImages(a, b *Image) (*ImageDiff, error) {
+	var order []string
+	files := make(map[string]*File)
+	err := a.walk(func(p string, f *File) error {
+		order = append(order, p)
+		files[p] = f
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	d := &ImageDiff{}
+	err = b.walk(func(p string, f *File) error {
+		old, ok := files[p]
+		if !ok {
+			d.Added = append(d.Added, p)
+			return nil
+		}
+		delete(files, p)
+		if !sameFile(old, f) {
+			d.Changed = append(d.Changed, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range order {
+		if _, ok := files[p]; ok {
+			d.Removed = append(d.Removed, p)
+		}
+	}
+	return d, nil
+}
+
+// sameFile reports whether a and b are the same for DiffImages.
+func sameFile(a, b *File) bool {
+	if a.Hash != b.Hash || a.Size != b.Size || a.Attributes != b.Attributes ||
+		a.CreationTime != b.CreationTime || a.LastWriteTime != b.LastWriteTime ||
+		len(a.Streams) != len(b.Streams) {
+		return false
+	}
+	for _, s := range a.Streams {
+		t, ok := b.Stream(s.Name)
+		if !ok || t.Hash != s.Hash || t.Size != s.Size {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffImages(t *testing.T) {
+	withStream := func(f *testFile, data string) *testFile {
+		f.streams = []testStream{{name: "ads", data: []byte(data)}}
+		return f
+	}
+	withAttr := func(f *testFile, attr uint32) *testFile {
+		f.attr = attr
+		return f
+	}
+	r := mustNewReader(t, buildWIM(t,
+		&testImage{name: "old", root: testDir("",
+			testDir("dir",
+				testRegular("same", "same"),
+				testRegular("edited", "old contents"),
+				testRegular("removed", "removed"),
+			),
+			withStream(testRegular("streams", "data"), "old"),
+			testRegular("hidden", "hidden"),
+			testDir("gone", testRegular("inner", "inner")),
+		)},
+		&testImage{name: "new", root: testDir("",
+			testDir("dir",
+				testRegular("same", "same"),
+				testRegular("edited", "new contents"),
+				testRegular("added", "added"),
+			),
+			withStream(testRegular("streams", "data"), "new"),
+			withAttr(testRegular("hidden", "hidden"), FILE_ATTRIBUTE_HIDDEN),
+			testDir("new", testRegular("inner", "inner")),
+		)},
+	))
+
+	d, err := DiffImages(r.Image[0], r.Image[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &ImageDiff{
+		Added:   []string{"dir/added", "new", "new/inner"},
+		Removed: []string{"dir/removed", "gone", "gone/inner"},
+		Changed: []string{"dir/edited", "streams", "hidden"},
+	}
+	if !reflect.DeepEqual(d, expected) {
+		t.Errorf("unexpected diff %+v", d)
+	}
+
+	d, err = DiffImages(r.Image[0], r.Image[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Added)+len(d.Removed)+len(d.Changed) != 0 {
+		t.Errorf("unexpected diff of an image with itself %+v", d)
+	}
+}
@@ -0,0 +1,68 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// tagExtendedAttributes is the tag of the directory entry tagged item that
+// holds a file's extended attributes.
+const tagExtendedAttributes = 0x00000002
+
+// ExtendedAttribute is an extended attribute (EA) of a file.
+type ExtendedAttribute struct {
+	Name  string
+	Value []byte
+	Flags uint8 // FILE_NEED_EA (0x80) marks EAs that the file cannot be interpreted without
+}
+
+// ExtendedAttributes returns the file's extended attributes, in the order
+// they are stored. It returns nil if the file does not have
+// FILE_ATTRIBUTE_EA set or its entry holds no extended attributes.
+func (f *File) ExtendedAttributes() ([]ExtendedAttribute, error) {
+	if f.Attributes&FILE_ATTRIBUTE_EA == 0 || len(f.eas) == 0 {
+		return nil, nil
+	}
+	eas, err := decodeExtendedAttributes(f.eas)
+	if err != nil {
+		return nil, &ParseError{Oper: "extended attributes", Path: f.Name, Err: err}
+	}
+	return eas, nil
+}
+
+// decodeExtendedAttributes decodes a list of FILE_FULL_EA_INFORMATION
+// structures. Each holds the offset of the next one from its start, which is 0
+// for the last, a flags byte, the lengths of the name and the value, the name
+// with a null terminator, and the value.
+func decodeExtendedAttributes(b []byte) ([]ExtendedAttribute, error) {
+	var eas []ExtendedAttribute
+	for {
+		if len(b) < 8 {
+			return nil, errors.New("extended attribute header truncated")
+		}
+		next := binary.LittleEndian.Uint32(b)
+		nameLen := int(b[5])
+		valueLen := int(binary.LittleEndian.Uint16(b[6:]))
+		if 8+nameLen+1+valueLen > len(b) {
+			return nil, errors.New("extended attribute truncated")
+		}
+		if b[8+nameLen] != 0 {
+			return nil, errors.New("extended attribute name not terminated")
+		}
+		eas = append(eas, ExtendedAttribute{
+			Name:  string(b[8 : 8+nameLen]),
+			Value: append([]byte{}, b[8+nameLen+1:8+nameLen+1+valueLen]...),
+			Flags: b[4],
+		})
+		if next == 0 {
+			return eas, nil
+		}
+		if next < uint32(8+nameLen+1+valueLen) || uint64(next) >= uint64(len(b)) {
+			return nil, errors.New("invalid next extended attribute offset")
+		}
+		b = b[next:]
+	}
+}
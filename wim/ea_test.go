@@ -0,0 +1,78 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// eaBytes encodes eas as a list of FILE_FULL_EA_INFORMATION structures, each
+// aligned to 4 bytes.
+func eaBytes(eas ...ExtendedAttribute) []byte {
+	var b bytes.Buffer
+	for i, ea := range eas {
+		start := b.Len()
+		_ = binary.Write(&b, binary.LittleEndian, uint32(0))
+		b.WriteByte(ea.Flags)
+		b.WriteByte(byte(len(ea.Name)))
+		_ = binary.Write(&b, binary.LittleEndian, uint16(len(ea.Value)))
+		b.WriteString(ea.Name)
+		b.WriteByte(0)
+		b.Write(ea.Value)
+		if i != len(eas)-1 {
+			for b.Len()%4 != 0 {
+				b.WriteByte(0)
+			}
+			binary.LittleEndian.PutUint32(b.Bytes()[start:], uint32(b.Len()-start))
+		}
+	}
+	return b.Bytes()
+}
+
+// taggedItem encodes a directory entry tagged item.
+func taggedItem(tag uint32, data []byte) []byte {
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.LittleEndian, [2]uint32{tag, uint32(len(data))})
+	b.Write(data)
+	pad8(&b)
+	return b.Bytes()
+}
+
+func TestExtendedAttributes(t *testing.T) {
+	eas := []ExtendedAttribute{
+		{Name: "FIRST", Value: []byte("value"), Flags: 0x80},
+		{Name: "$KERNEL.PURGE.X", Value: []byte{1, 2, 3}},
+	}
+	withEAs := testRegular("eas", "a")
+	withEAs.attr |= FILE_ATTRIBUTE_EA
+	withEAs.slack = append(taggedItem(1, make([]byte, 16)), taggedItem(tagExtendedAttributes, eaBytes(eas...))...)
+	noAttr := testRegular("noattr", "b")
+	noAttr.slack = withEAs.slack
+	bad := testRegular("bad", "c")
+	bad.attr |= FILE_ATTRIBUTE_EA
+	bad.slack = taggedItem(tagExtendedAttributes, eaBytes(eas...)[:10])
+
+	r := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("", withEAs, noAttr, bad)}))
+	files, err := mustOpenRoot(t, r.Image[0]).Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := files[0].ExtendedAttributes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, eas) {
+		t.Errorf("got %+v, expected %+v", got, eas)
+	}
+	if got, err := files[1].ExtendedAttributes(); got != nil || err != nil {
+		t.Errorf("unexpected extended attributes %+v: %v", got, err)
+	}
+	if _, err := files[2].ExtendedAttributes(); err == nil {
+		t.Error("expected an error for truncated extended attributes")
+	}
+}
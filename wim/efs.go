@@ -0,0 +1,26 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import "errors"
+
+// ErrEncrypted is returned by File.Extract and File.WriteTo for a file
+// encrypted with the Encrypting File System (EFS). The WIM holds such a file's
+// contents in the raw format of ReadEncryptedFileRaw, which includes the
+// encryption metadata and the ciphertext, so writing them out as the file's
+// contents would produce a corrupt file. File.Open still returns the raw data,
+// which WriteEncryptedFileRaw can restore on Windows.
+var ErrEncrypted = errors.New("file is encrypted with EFS")
+
+// IsEncrypted reports whether the file has FILE_ATTRIBUTE_ENCRYPTED set. For
+// a directory, this only means that files created in it are encrypted by
+// default; its entries are not affected.
+func (f *FileHeader) IsEncrypted() bool {
+	return f.Attributes&FILE_ATTRIBUTE_ENCRYPTED != 0
+}
+
+// isEncryptedFile reports whether f is a file whose contents are raw EFS data.
+func (f *FileHeader) isEncryptedFile() bool {
+	return f.IsEncrypted() && f.Attributes&FILE_ATTRIBUTE_DIRECTORY == 0
+}
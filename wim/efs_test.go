@@ -0,0 +1,57 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractEncrypted(t *testing.T) {
+	secret := testRegular("secret.txt", "raw EFS data")
+	secret.attr |= FILE_ATTRIBUTE_ENCRYPTED
+	dir := testDir("dir", secret, testRegular("plain.txt", "plain"))
+	dir.attr |= FILE_ATTRIBUTE_ENCRYPTED
+	img := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("", dir)})).Image[0]
+
+	f, err := img.OpenFile("dir/secret.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.IsEncrypted() {
+		t.Error("file not reported as encrypted")
+	}
+	if _, err := f.WriteTo(new(bytes.Buffer)); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("unexpected WriteTo error %v", err)
+	}
+	// The raw data is still available.
+	if s, err := f.ReadString(); err != nil || s != "raw EFS data" {
+		t.Errorf("unexpected contents %q: %v", s, err)
+	}
+
+	root := mustOpenRoot(t, img)
+	dest := filepath.Join(t.TempDir(), "out")
+	err = root.Extract(dest, nil)
+	var xerr *ExtractError
+	if !errors.Is(err, ErrEncrypted) || !errors.As(err, &xerr) || xerr.Path != "dir/secret.txt" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "dir", "secret.txt")); !os.IsNotExist(err) {
+		t.Errorf("encrypted file was written: %v", err)
+	}
+
+	dest = filepath.Join(t.TempDir(), "out")
+	if err := root.Extract(dest, &ExtractOptions{SkipEncrypted: true}); err != nil {
+		t.Fatal(err)
+	}
+	if s := readTestFile(t, filepath.Join(dest, "dir", "plain.txt")); s != "plain" {
+		t.Errorf("unexpected contents %q", s)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "dir", "secret.txt")); !os.IsNotExist(err) {
+		t.Errorf("encrypted file was written: %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+//go:build go1.18 && (windows || linux)
+// +build go1.18
+// +build windows linux
+
+package wim
+
+import (
+	"runtime"
+	"testing"
+)
+
+// FuzzReadNextEntry parses random metadata resources, which must fail with an
+// error rather than panic or allocate excessively.
+func FuzzReadNextEntry(f *testing.F) {
+	b := &wimBuilder{seen: make(map[SHA1Hash]bool)}
+	f.Add(b.metadata(&testImage{root: testDir("", testRegular("file", ""))}))
+	f.Add(b.metadata(&testImage{sds: [][]byte{{1, 2, 3}}, root: testDir("",
+		testDir("dir", &testFile{name: "ads", shortName: "ADS~1", attr: FILE_ATTRIBUTE_NORMAL, securityID: 0,
+			streams: []testStream{{name: "s"}}}),
+	)}))
+
+	f.Fuzz(func(t *testing.T, md []byte) {
+		if len(md) == 0 {
+			return
+		}
+		r := mustNewReader(t, buildWIM(t, &testImage{name: "fuzz", metadata: md}))
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_ = readTree(r.Image[0], 4)
+		_ = r.Image[0].WalkInto(nil, func(*WalkEntry) error { return nil })
+		runtime.ReadMemStats(&after)
+		if n := after.TotalAlloc - before.TotalAlloc; n > 64<<20 {
+			t.Fatalf("parsing %d bytes of metadata allocated %d bytes", len(md), n)
+		}
+	})
+}
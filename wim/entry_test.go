@@ -0,0 +1,95 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// readTree reads the directories of img up to the given depth, returning the
+// first error.
+func readTree(img *Image, depth int) error {
+	root, err := img.Open()
+	if err != nil {
+		return err
+	}
+	dirs := []*File{root}
+	for ; depth > 0 && len(dirs) > 0; depth-- {
+		var next []*File
+		for _, d := range dirs {
+			files, err := d.Readdir()
+			if err != nil {
+				return err
+			}
+			for _, f := range files {
+				if f.IsDir() {
+					next = append(next, f)
+				}
+			}
+		}
+		dirs = next
+	}
+	return nil
+}
+
+func TestEntryBounds(t *testing.T) {
+	valid := (&wimBuilder{seen: make(map[SHA1Hash]bool)}).metadata(&testImage{root: testDir("",
+		&testFile{name: "ads", attr: FILE_ATTRIBUTE_NORMAL, securityID: 0xffffffff, streams: []testStream{{name: "s"}}},
+	)})
+	// The root entry follows the 8-byte security table header, and the
+	// entries of the root directory follow its terminator.
+	root := int64(securityblockDiskSize)
+	rootLen := int64(binary.LittleEndian.Uint64(valid[root:]))
+	child := root + rootLen + 8
+	childLen := int64(binary.LittleEndian.Uint64(valid[child:]))
+	stream := child + childLen
+
+	corrupt := func(off int64, v interface{}) []byte {
+		b := append([]byte(nil), valid...)
+		var buf bytes.Buffer
+		_ = binary.Write(&buf, binary.LittleEndian, v)
+		copy(b[off:], buf.Bytes())
+		return b
+	}
+	for _, tc := range []struct {
+		name string
+		md   []byte
+		// scanned is set if WalkInto, which ignores security IDs, also
+		// detects the corruption.
+		scanned bool
+	}{
+		{"huge entry length", corrupt(child, int64(1)<<40), true},
+		{"entry past end", corrupt(child, int64(len(valid))-child+8), true},
+		{"huge stream length", corrupt(stream, int64(1)<<40), true},
+		{"odd name length", corrupt(child+8+92, uint16(3)), true},
+		{"negative stream name length", corrupt(stream+8+28, int16(-2)), true},
+		{"security ID out of range", corrupt(child+8+4, uint32(3)), false},
+		{"huge security table", corrupt(0, securityblockDisk{TotalLength: 16, NumEntries: 0xffffffff}), true},
+		{"security table past end", corrupt(0, securityblockDisk{TotalLength: 0xfffffff0}), true},
+	} {
+		r := mustNewReader(t, buildWIM(t, &testImage{name: "test", metadata: tc.md}))
+		var pe *ParseError
+		if err := readTree(r.Image[0], 2); !errors.As(err, &pe) {
+			t.Errorf("%s: expected a ParseError, got %v", tc.name, err)
+		}
+		if err := r.Image[0].WalkInto(nil, func(*WalkEntry) error { return nil }); tc.scanned && err == nil {
+			t.Errorf("%s: expected an error from WalkInto", tc.name)
+		}
+	}
+
+	r := mustNewReader(t, buildWIM(t, &testImage{name: "test", metadata: valid}))
+	if err := readTree(r.Image[0], 2); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReaderWithOptions(bytes.NewReader(buildWIM(t, &testImage{name: "test", metadata: valid})), &Options{MaxEntryLength: rootLen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := readTree(r.Image[0], 2); err == nil {
+		t.Error("expected an error for an entry longer than MaxEntryLength")
+	}
+}
@@ -0,0 +1,177 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+// ExportImage adds a copy of src to dst, as imagex /export does: the image's
+// directory tree, its metadata, and its IMAGE element in the XML data are
+// copied, along with the file and stream contents it references. Contents
+// already in dst are shared rather than copied again. Contents stored as dst
+// would store them, uncompressed or compressed with dst's format in 32KB
+// chunks, are copied exactly as stored, without decompressing them; others are
+// decompressed and stored as dst stores new contents.
+//
+// Extended attributes and other tagged data of directory entries, which
+// Writer does not support, are not copied.
+func ExportImage(dst *Writer, src *Image) error {
+	return exportImage(dst, src, dst.kind, false)
+}
+
+// TranscodeImage adds a copy of src to dst like ExportImage, but decompresses
+// the contents of every file and stream of the image and compresses them again
+// with algo, rather than copying them as they are stored. A WIM's compressed
+// resources share one format, so algo must be the one dst was created with,
+// or CompressionNone to store the contents uncompressed. Contents already in
+// dst are shared, as they are by ExportImage.
+func TranscodeImage(src *Image, dst *Writer, algo CompressionKind) error {
+	switch algo {
+	case CompressionNone, CompressionXpress, CompressionLZX:
+	default:
+		return fmt.Errorf("%w: writing %s", ErrUnsupportedCompression, algo)
+	}
+	if algo != CompressionNone && algo != dst.kind {
+		return fmt.Errorf("cannot transcode to %s in a WIM written with %s", algo, dst.kind)
+	}
+	return exportImage(dst, src, algo, true)
+}
+
+// exportImage implements ExportImage and, if recompress is set, TranscodeImage.
+// Contents that are not copied as stored are compressed with kind.
+func exportImage(dst *Writer, src *Image, kind CompressionKind, recompress bool) error {
+	img, err := dst.AddImage(src.Name)
+	if err != nil {
+		return err
+	}
+	img.xml = src.rawXML()
+	return src.walkTree(false, func(p string, f *File) error {
+		hdr := f.FileHeader
+		if p == "." {
+			p = ""
+			if err := img.AddDir(p, &hdr); err != nil {
+				return err
+			}
+		} else if f.IsDir() {
+			hdr.Size = 0
+			if err := img.add(p, &hdr, nil); err != nil {
+				return err
+			}
+		} else {
+			err := img.add(p, &hdr, func() (SHA1Hash, error) {
+				return dst.copyResource(f.src, &f.offset, f.Hash, kind, recompress)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, s := range f.Streams {
+			s := s
+			err := img.addStream(p, s.Name, s.Size, func() (SHA1Hash, error) {
+				return dst.copyResource(s.wim, &s.offset, s.Hash, kind, recompress)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// rawXML returns the contents of the image's IMAGE element in the WIM's XML
+// data, matched as by NewReader, or "" if there is none.
+func (img *Image) rawXML() string {
+	var doc struct {
+		Image []struct {
+			Index int    `xml:"INDEX,attr"`
+			Inner string `xml:",innerxml"`
+		} `xml:"IMAGE"`
+	}
+	if err := xml.Unmarshal([]byte(img.wim.XMLInfo), &doc); err != nil {
+		return ""
+	}
+	for j, e := range doc.Image {
+		if e.Index == img.Index || (e.Index == 0 && j == img.Index-1) {
+			return e.Inner
+		}
+	}
+	return ""
+}
+
+// copyResource adds the resource rd of src, whose contents have the given
+// hash, to the WIM, unless the WIM already holds those contents, and returns
+// the hash. Unless recompress is set, the stored bytes are copied unchanged if
+// they are stored as the WIM would store them; otherwise they are compressed
+// with kind.
+func (w *Writer) copyResource(src *Reader, rd *resourceDescriptor, hash SHA1Hash, kind CompressionKind, recompress bool) (SHA1Hash, error) {
+	if hash == (SHA1Hash{}) {
+		return hash, nil
+	}
+	if i, ok := w.byHash[hash]; ok {
+		w.resources[i].RefCount++
+		return hash, nil
+	}
+
+	// Streams packed in solid resources are not stored separately, so they
+	// are always decompressed and written again.
+	stored := src.compression(rd)
+	asStored := !recompress && rd.Flags()&resFlagSolid == 0 && stored == w.kind &&
+		(stored == CompressionNone || src.hdr.CompressionSize == chunkSize)
+	if !asStored {
+		rc, err := src.resourceReader(rd)
+		if err != nil {
+			return SHA1Hash{}, err
+		}
+		defer rc.Close()
+		return w.writeCheckedResource(rc, rd.OriginalSize, 0, kind, func(got SHA1Hash) error {
+			if got != hash {
+				return &HashMismatchError{Expected: hash, Actual: got, Offset: rd.Offset}
+			}
+			return nil
+		})
+	}
+
+	rc, size, _, err := src.rawResourceReader(rd)
+	if err != nil {
+		return SHA1Hash{}, err
+	}
+	defer rc.Close()
+	start := w.pos
+	if cap(w.buf) < chunkSize {
+		w.buf = make([]byte, chunkSize)
+	}
+	for left := size; left > 0 && w.err == nil; {
+		b := w.buf[:chunkSize]
+		if left < chunkSize {
+			b = b[:left]
+		}
+		if _, err := io.ReadFull(rc, b); err != nil {
+			w.discard(start)
+			if err == io.EOF { //nolint:errorlint
+				err = io.ErrUnexpectedEOF
+			}
+			return SHA1Hash{}, err
+		}
+		w.write(b)
+		left -= int64(len(b))
+	}
+	if w.err != nil {
+		return SHA1Hash{}, w.err
+	}
+	w.resources = append(w.resources, streamDescriptor{
+		resourceDescriptor: resourceDescriptor{
+			FlagsAndCompressedSize: uint64(size) | uint64(rd.Flags()&resFlagCompressed)<<56,
+			Offset:                 start,
+			OriginalSize:           rd.OriginalSize,
+		},
+		PartNumber: 1,
+		RefCount:   1,
+		Hash:       hash,
+	})
+	w.byHash[hash] = len(w.resources) - 1
+	return hash, nil
+}
@@ -0,0 +1,366 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"crypto/sha1" //nolint:gosec // not used for secure application
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Microsoft/go-winio/wim/lzx"
+	"github.com/Microsoft/go-winio/wim/xpress"
+)
+
+// exportTo exports img into a new WIM written by a Writer with opts, after
+// adding an image holding extra, and returns a Reader for the result.
+func exportTo(t *testing.T, img *Image, opts *WriterOptions, extra string) *Reader {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "dst.wim")
+	out, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	w, err := NewWriterWithOptions(out, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := w.AddImage("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.AddFile("extra", &FileHeader{Size: int64(len(extra))}, strings.NewReader(extra)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExportImage(w, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestExportImage(t *testing.T) {
+	data := strings.Repeat("exported contents. ", 5000)
+	sd := sdBytes(0, sidBytes(5, 18), nil, nil, nil)
+	file := testRegular("file.txt", data)
+	file.securityID = 0
+	file.streams = []testStream{{name: "ads", data: []byte("stream")}}
+	l1 := testRegular("l1", "linked")
+	l1.linkID = 9
+	l2 := testRegular("l2", "linked")
+	l2.linkID = 9
+	root := testDir("", testDir("dir", file, l1, l2), testRegular("shared", "shared"), testJunction("j", `\??\C:\dir`))
+	xml := `<WIM><IMAGE INDEX="1"><NAME>skipped</NAME></IMAGE>` +
+		`<IMAGE INDEX="2"><NAME>src</NAME><DESCRIPTION>kept &amp; copied</DESCRIPTION><FILECOUNT>5</FILECOUNT></IMAGE></WIM>`
+	src := mustNewReader(t, buildWIMWithXML(t, xml,
+		&testImage{name: "skipped", root: testDir("", testRegular("x", "skipped"))},
+		&testImage{name: "src", sds: [][]byte{sd}, root: root},
+	))
+
+	for _, opts := range []*WriterOptions{nil, {Compression: CompressionXpress}, {Compression: CompressionLZX}} {
+		r := exportTo(t, src.Image[1], opts, "shared")
+		if len(r.Image) != 2 {
+			t.Fatalf("unexpected images %v", r.Image)
+		}
+		img := r.Image[1]
+		if img.Name != "src" || img.Description != "kept & copied" || img.NumFiles != 5 {
+			t.Errorf("unexpected image info %+v", img.ImageInfo)
+		}
+		if _, err := img.OpenFile("x"); err == nil {
+			t.Error("found a file of another image")
+		}
+
+		f, err := img.OpenFile("dir/file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s, err := f.ReadString(); err != nil || s != data {
+			t.Errorf("unexpected contents: %v", err)
+		}
+		if !bytes.Equal(f.SecurityDescriptor, sd) || len(f.Streams) != 1 || f.Streams[0].Name != "ads" {
+			t.Errorf("unexpected file %+v", f.FileHeader)
+		}
+		if opts != nil && !f.Compressed() {
+			t.Error("contents were not compressed for the destination")
+		}
+		l, err := img.OpenFile("dir/l2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.LinkID != 9 {
+			t.Errorf("unexpected link ID %d", l.LinkID)
+		}
+		j, err := img.OpenFile("j")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rp, err := j.ReparsePoint(); err != nil || rp.SubstituteName != `\??\C:\dir` {
+			t.Errorf("unexpected reparse point %+v: %v", rp, err)
+		}
+
+		// Contents already in the destination are shared.
+		shared, err := img.OpenFile("shared")
+		if err != nil {
+			t.Fatal(err)
+		}
+		extra, err := r.Image[0].OpenFile("extra")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shared.offset != extra.offset {
+			t.Error("shared contents were copied again")
+		}
+	}
+}
+
+func TestExportImageRaw(t *testing.T) {
+	data := strings.Repeat("stored as is. ", 10000)
+	// Chunks that do not shrink are stored as is, so the source holds a
+	// compressed resource that recompressing would make smaller.
+	store := func(b []byte) []byte { return b }
+	b := buildCompressedWIM(t, hdrFlagCompressXpress, store, &testImage{name: "src", root: testDir("",
+		testRegular("file", data),
+	)})
+	src := mustNewReader(t, b)
+	sf, err := src.Image[0].OpenFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := exportTo(t, src.Image[0], &WriterOptions{Compression: CompressionXpress}, "")
+	f, err := r.Image[1].OpenFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := f.ReadString(); err != nil || s != data {
+		t.Fatalf("unexpected contents: %v", err)
+	}
+	a, _, _, err := sf.OpenRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	c, _, _, err := f.OpenRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ab, _ := io.ReadAll(a)
+	cb, _ := io.ReadAll(c)
+	if !f.Compressed() || !bytes.Equal(ab, cb) {
+		t.Error("compressed contents were not copied as stored")
+	}
+}
+
+// transcodeTo transcodes img with algo into a new WIM written with the
+// compression format kind and returns a Reader for the result.
+func transcodeTo(t *testing.T, img *Image, kind, algo CompressionKind) *Reader {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "dst.wim")
+	out, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	w, err := NewWriterWithOptions(out, &WriterOptions{Compression: kind})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := TranscodeImage(img, w, algo); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestTranscodeImage(t *testing.T) {
+	file := testRegular("file.txt", strings.Repeat("transcoded contents. ", 5000))
+	file.streams = []testStream{{name: "ads", data: []byte(strings.Repeat("stream ", 1000))}}
+	l1 := testRegular("l1", "linked")
+	l1.linkID = 9
+	l2 := testRegular("l2", "linked")
+	l2.linkID = 9
+	src := &testImage{name: "src", root: testDir("",
+		testDir("dir", file, l1, l2, testRegular("empty", "")),
+		testRegular("small", "small"),
+		testJunction("j", `\??\C:\dir`),
+	)}
+	// Chunks that do not shrink are stored as is, so that sources built with
+	// store hold resources that recompressing makes smaller.
+	store := func(b []byte) []byte { return b }
+	none := buildWIM(t, src)
+	xpressWIM := buildCompressedWIM(t, hdrFlagCompressXpress, xpress.Compress, src)
+	lzxWIM := buildCompressedWIM(t, hdrFlagCompressLzx, lzx.Compress, src)
+
+	for _, tc := range []struct {
+		name string
+		wim  []byte
+		kind CompressionKind // the compression format of the destination
+		algo CompressionKind
+	}{
+		{"none to XPRESS", none, CompressionXpress, CompressionXpress},
+		{"none to LZX", none, CompressionLZX, CompressionLZX},
+		{"XPRESS to none", xpressWIM, CompressionNone, CompressionNone},
+		{"XPRESS to XPRESS", buildCompressedWIM(t, hdrFlagCompressXpress, store, src), CompressionXpress, CompressionXpress},
+		{"XPRESS to LZX", xpressWIM, CompressionLZX, CompressionLZX},
+		{"LZX to XPRESS", lzxWIM, CompressionXpress, CompressionXpress},
+		{"LZX to LZX", buildCompressedWIM(t, hdrFlagCompressLzx, store, src), CompressionLZX, CompressionLZX},
+		{"LZX to none in an LZX WIM", lzxWIM, CompressionLZX, CompressionNone},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			img := mustNewReader(t, tc.wim).Image[0]
+			want, err := img.Records()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := transcodeTo(t, img, tc.kind, tc.algo)
+			got, err := r.Image[0].Records()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("got %d records, expected %d", len(got), len(want))
+			}
+			for i := range want {
+				g, w := got[i], want[i]
+				if g.Path != w.Path || g.Hash != w.Hash || g.Size != w.Size || g.Attributes != w.Attributes ||
+					g.LinkID != w.LinkID || g.ReparseTag != w.ReparseTag || len(g.Streams) != len(w.Streams) {
+					t.Errorf("got %+v, expected %+v", g, w)
+				}
+			}
+
+			// Re-read every file and stream and check it against its hash.
+			err = r.Image[0].Walk(func(p string, f *File, err error) error {
+				if err != nil {
+					return err
+				}
+				check := func(name string, open func() (io.ReadCloser, error), hash SHA1Hash) {
+					rc, err := open()
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer rc.Close()
+					h := sha1.New() //nolint:gosec // not used for secure application
+					if _, err := io.Copy(h, rc); err != nil {
+						t.Fatal(err)
+					}
+					var got SHA1Hash
+					copy(got[:], h.Sum(nil))
+					if hash != (SHA1Hash{}) && got != hash {
+						t.Errorf("%s: SHA1 %x, expected %x", name, got, hash)
+					}
+				}
+				if !f.IsDir() {
+					check(p, f.Open, f.Hash)
+				}
+				for _, s := range f.Streams {
+					check(p+":"+s.Name, s.Open, s.Hash)
+				}
+				if f.Size > 1000 && f.Compression() != tc.algo {
+					t.Errorf("%s: unexpected compression %s", p, f.Compression())
+				}
+				if tc.algo != CompressionNone && f.Size > 1000 && f.CompressedSize() > f.Size/4 {
+					t.Errorf("%s: %d bytes were not recompressed", p, f.CompressedSize())
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestTranscodeImageErrors(t *testing.T) {
+	img := mustNewReader(t, buildWIM(t, &testImage{name: "src", root: testDir("")})).Image[0]
+	out, err := os.Create(filepath.Join(t.TempDir(), "dst.wim"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	w, err := NewWriterWithOptions(out, &WriterOptions{Compression: CompressionXpress})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := TranscodeImage(img, w, CompressionLZMS); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := TranscodeImage(img, w, CompressionLZX); err == nil {
+		t.Error("expected an error for a format other than the WIM's")
+	}
+}
+
+func TestTranscodeImageHashMismatch(t *testing.T) {
+	data := strings.Repeat("a", 1000)
+	b := buildWIM(t, &testImage{name: "src", root: testDir("", testRegular("bad", data))})
+	// Change the stored contents without updating their hash.
+	i := bytes.Index(b, []byte(data))
+	b[i] = 'b'
+	tampered := string(b[i : i+len(data)])
+	img := mustNewReader(t, b).Image[0]
+
+	p := filepath.Join(t.TempDir(), "dst.wim")
+	out, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	w, err := NewWriterWithOptions(out, &WriterOptions{Compression: CompressionXpress})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := w.pos
+	err = TranscodeImage(img, w, CompressionXpress)
+	var herr *HashMismatchError
+	if !errors.As(err, &herr) || herr.Expected != sha1Hash([]byte(data)) || herr.Actual != sha1Hash([]byte(tampered)) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(w.resources) != 0 || len(w.byHash) != 0 || w.pos != start {
+		t.Fatalf("mismatched contents were kept: %+v", w.resources)
+	}
+
+	// Contents that really have the hash of the tampered data are written
+	// again rather than shared with the discarded resource.
+	iw, err := w.AddImage("dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.AddFile("f", &FileHeader{Size: int64(len(tampered))}, strings.NewReader(tampered)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	f, err := r.Image[1].OpenFile("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := f.ReadString(); err != nil || s != tampered {
+		t.Errorf("unexpected contents %q: %v", s, err)
+	}
+}
@@ -0,0 +1,385 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// CollisionPolicy determines what File.Extract does when two entries in the
+// same directory have names that differ only by case, and so would overwrite
+// each other on a case-insensitive file system.
+type CollisionPolicy int
+
+const (
+	// CollisionIgnore does not check for collisions. On a case-insensitive
+	// file system, the later entry overwrites the earlier one.
+	CollisionIgnore CollisionPolicy = iota
+	// CollisionError fails the extraction.
+	CollisionError
+	// CollisionSkip skips the later entry.
+	CollisionSkip
+	// CollisionRename extracts the later entry under a new name formed by
+	// adding a numeric suffix, such as "name (1).txt", before the extension.
+	CollisionRename
+)
+
+// ExtractOptions controls how File.Extract writes files to the local file
+// system. A nil *ExtractOptions is equivalent to the zero value.
+type ExtractOptions struct {
+	// Filter, if set, is called for each entry below the extraction root with
+	// its slash-separated path relative to that root. Entries for which it
+	// returns false are not extracted; for directories this skips the whole
+	// subtree.
+	Filter func(path string, f *File) bool
+
+	// PruneEmptyDirs skips creating directories that end up with no extracted
+	// children, whether because they were empty in the image or because all of
+	// their children were filtered out. By default every directory that is
+	// encountered is created.
+	PruneEmptyDirs bool
+
+	// PreserveTimes re-applies the creation, last access, and last write times
+	// recorded in the image to each extracted file and directory after its
+	// contents have been written, so that the extracted tree matches the image
+	// exactly. On Linux the creation time cannot be set and is ignored.
+	PreserveTimes bool
+
+	// Collision determines how entries whose names collide under case folding
+	// are handled.
+	Collision CollisionPolicy
+
+	// OnCollision, if set, is called for each collision detected under a
+	// policy other than CollisionIgnore, with the slash-separated paths of the
+	// entry that was extracted first and of the colliding entry.
+	OnCollision func(existing, colliding string)
+
+	// Streams recreates each file's named alternate data streams. Linux has
+	// no equivalent of alternate data streams, so there they are skipped.
+	Streams bool
+
+	// RestoreSecurity applies each file's security descriptor after its
+	// contents and times have been written. Setting the owner or the system
+	// ACL generally requires the restore privilege. On Linux it is ignored.
+	RestoreSecurity bool
+
+	// SkipEncrypted skips files encrypted with EFS, whose contents cannot be
+	// written out as plain data. By default they fail the extraction with
+	// ErrEncrypted.
+	SkipEncrypted bool
+}
+
+// ExtractError is returned by File.Extract when extraction stops partway
+// through. Everything counted in Files and Bytes was written before the error
+// occurred and is left in place.
+type ExtractError struct {
+	Path  string // the slash-separated path, relative to the extraction root, of the failing entry
+	Files int    // the number of files written, including hard links
+	Bytes int64  // the number of bytes of file and stream contents written
+	Err   error
+}
+
+func (e *ExtractError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("WIM extract failed after %d files: %s", e.Files, e.Err)
+	}
+	return fmt.Sprintf("WIM extract of %s failed after %d files: %s", e.Path, e.Files, e.Err)
+}
+
+func (e *ExtractError) Unwrap() error { return e.Err }
+
+// Extract writes the file to destPath on the local file system. If f is a
+// directory, the tree rooted at f is recreated under destPath.
+//
+// Files that share a LinkID are extracted as hard links to the first of them
+// that was written, falling back to a separate copy if the link cannot be
+// created. Reparse points are not extracted, except for WOF-backed files
+// whose contents are in the WIM, which are extracted as regular files. Files
+// encrypted with EFS fail the extraction with ErrEncrypted unless
+// ExtractOptions.SkipEncrypted is set.
+//
+// If extraction fails, the returned error is an *ExtractError describing how
+// far it got.
+func (f *File) Extract(destPath string, opts *ExtractOptions) error {
+	if opts == nil {
+		opts = &ExtractOptions{}
+	}
+	x := &extractor{opts: opts, links: make(map[int64]string), active: make(map[int64]bool)}
+	var err error
+	if f.IsDir() {
+		_, err = x.extractDir(f, "", destPath)
+	} else {
+		_, err = x.extractFile(f, "", destPath)
+	}
+	if err != nil {
+		return &ExtractError{Path: x.cur, Files: x.files, Bytes: x.bytes, Err: err}
+	}
+	return nil
+}
+
+type extractor struct {
+	opts  *ExtractOptions
+	links map[int64]string // the destination of the first file written for each LinkID
+	cur   string           // the path of the entry being extracted
+	files int
+	bytes int64
+	// active holds the subdirectory offsets of the directories being
+	// extracted, so that corrupt metadata cannot lead back to one of them.
+	active map[int64]bool
+}
+
+// extractDir recreates the directory d at dest, returning whether anything was
+// created.
+func (x *extractor) extractDir(d *File, p, dest string) (bool, error) {
+	x.cur = p
+	if !x.opts.PruneEmptyDirs {
+		//nolint:gosec // G301: extracted directories are subject to the umask, like os.MkdirAll
+		if err := os.Mkdir(dest, 0777); err != nil && !errors.Is(err, os.ErrExist) {
+			return false, err
+		}
+	}
+
+	if x.active[d.subdirOffset] {
+		return false, &ParseError{Oper: "extract", Path: p, Err: errDirectoryCycle}
+	}
+	x.active[d.subdirOffset] = true
+	defer delete(x.active, d.subdirOffset)
+	files, err := d.Readdir()
+	if err != nil {
+		return false, err
+	}
+
+	created := !x.opts.PruneEmptyDirs
+	names := make(map[string]string)
+	for _, f := range files {
+		fp := path.Join(p, f.Name)
+		x.cur = fp
+		if !validName(f.Name) {
+			return created, &ParseError{Oper: "extract", Path: fp, Err: errors.New("invalid file name")}
+		}
+		if x.opts.Filter != nil && !x.opts.Filter(fp, f) {
+			continue
+		}
+
+		name := f.Name
+		if x.opts.Collision != CollisionIgnore {
+			key := foldName(name)
+			if existing, ok := names[key]; ok {
+				if x.opts.OnCollision != nil {
+					x.opts.OnCollision(path.Join(p, existing), fp)
+				}
+				switch x.opts.Collision {
+				case CollisionSkip:
+					continue
+				case CollisionRename:
+					name, key = renameCollision(name, names)
+				default:
+					return created, &ParseError{Oper: "extract", Path: fp, Err: fmt.Errorf("name collides with %s", existing)}
+				}
+			}
+			names[key] = name
+		}
+
+		target := filepath.Join(dest, name)
+		var ok bool
+		if f.IsDir() {
+			ok, err = x.extractDir(f, fp, target)
+		} else {
+			ok, err = x.extractFile(f, fp, target)
+		}
+		if err != nil {
+			return created, err
+		}
+		created = created || ok
+	}
+
+	if created {
+		x.cur = p
+		if err := x.finish(d, dest); err != nil {
+			return created, err
+		}
+	}
+	return created, nil
+}
+
+// extractFile writes the contents of f to dest, or links dest to an earlier
+// file with the same LinkID, returning whether a file was created.
+func (x *extractor) extractFile(f *File, p, dest string) (bool, error) {
+	x.cur = p
+	open := f.Open
+	if f.IsWOF() {
+		// WOF-backed files are regular files whose contents are kept
+		// elsewhere, which can be extracted if the WIM holds them.
+		rc, err := f.OpenWOF()
+		if errors.Is(err, ErrWOFUnavailable) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		rc.Close()
+		open = f.OpenWOF
+	} else if f.Attributes&FILE_ATTRIBUTE_REPARSE_POINT != 0 {
+		return false, nil
+	}
+	if f.isEncryptedFile() {
+		if x.opts.SkipEncrypted {
+			return false, nil
+		}
+		return false, ErrEncrypted
+	}
+
+	if x.opts.PruneEmptyDirs {
+		//nolint:gosec // G301: extracted directories are subject to the umask
+		if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+			return false, err
+		}
+	}
+
+	if f.LinkID != 0 {
+		if first, ok := x.links[f.LinkID]; ok {
+			// The link shares the first file's contents, times, and
+			// security, so there is nothing more to apply.
+			if err := os.Link(first, dest); err == nil {
+				x.files++
+				return true, nil
+			}
+		} else {
+			x.links[f.LinkID] = dest
+		}
+	}
+
+	if err := x.copyData(open, dest, f.IsSparse()); err != nil {
+		return true, err
+	}
+	if x.opts.Streams {
+		for _, s := range f.Streams {
+			sp, ok := streamPath(dest, s.Name)
+			if !ok {
+				break
+			}
+			if err := x.copyData(s.Open, sp, false); err != nil {
+				return true, err
+			}
+		}
+	}
+	x.files++
+
+	return true, x.finish(f, dest)
+}
+
+// copyData writes the contents returned by open to dest. If sparse is set,
+// dest is made a sparse file and blocks of zeros are left as holes.
+func (x *extractor) copyData(open func() (io.ReadCloser, error), dest string, sparse bool) error {
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	//nolint:gosec // G302: extracted files are subject to the umask, like os.Create
+	w, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	var n int64
+	if sparse {
+		// A file system that does not support sparse files still gets the
+		// right contents, with the skipped blocks filled with zeros.
+		_ = setSparse(w)
+		n, err = copySparse(w, r)
+	} else {
+		n, err = io.Copy(w, r)
+	}
+	x.bytes += n
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// finish applies the times and security descriptor of f to dest, once dest's
+// contents are complete. Security is applied last, since it may deny the
+// access needed to set the times.
+func (x *extractor) finish(f *File, dest string) error {
+	if x.opts.PreserveTimes {
+		if err := setFileTimes(dest, f); err != nil {
+			return err
+		}
+	}
+	if x.opts.RestoreSecurity && len(f.SecurityDescriptor) != 0 {
+		if err := setSecurity(dest, f.SecurityDescriptor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameCollision returns a variant of name, and its folded form, that does not
+// collide with any of the folded names in names.
+func renameCollision(name string, names map[string]string) (string, string) {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		n := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		key := foldName(n)
+		if _, ok := names[key]; !ok {
+			return n, key
+		}
+	}
+}
+
+// CheckNameCollisions reads the directory and returns the groups of its
+// entries whose names are equal when compared case-insensitively, which cannot
+// all be extracted to a case-insensitive file system under their own names.
+// Names are compared as by NTFS, by upcasing each character, so non-ASCII
+// names such as "Ä" and "ä" collide. Groups are returned in the order of their
+// first entry, and entries within a group in directory order. A directory
+// without collisions returns no groups.
+func (f *File) CheckNameCollisions() ([][]*File, error) {
+	files, err := f.Readdir()
+	if err != nil {
+		return nil, err
+	}
+	var groups [][]*File
+	index := make(map[string]int)
+	for _, e := range files {
+		key := foldName(e.Name)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], e)
+	}
+	n := 0
+	for _, g := range groups {
+		if len(g) > 1 {
+			groups[n] = g
+			n++
+		}
+	}
+	return groups[:n], nil
+}
+
+// foldName returns the form of name used to compare names case-insensitively.
+// Like NTFS, it upcases each character individually.
+func foldName(name string) string {
+	return strings.Map(unicode.ToUpper, name)
+}
+
+// validName reports whether name can safely be used as a single path element
+// on the local file system.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
@@ -0,0 +1,50 @@
+//go:build linux
+// +build linux
+
+package wim
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// setFileTimes applies the last access and last write times of f to path.
+// Linux has no portable way to set a file's creation time, so it is ignored.
+// Times that f does not have are left unchanged.
+func setFileTimes(path string, f *File) error {
+	if !f.HasLastAccessTime() && !f.HasLastWriteTime() {
+		return nil
+	}
+	atime, mtime := f.LastAccessTime.Time(), f.LastWriteTime.Time()
+	if atime.IsZero() || mtime.IsZero() {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if mtime.IsZero() {
+			mtime = fi.ModTime()
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && atime.IsZero() {
+			atime = time.Unix(st.Atim.Unix())
+		}
+	}
+	return os.Chtimes(path, atime, mtime)
+}
+
+// streamPath reports that alternate data streams cannot be extracted on Linux.
+func streamPath(string, string) (string, bool) {
+	return "", false
+}
+
+// setSparse does nothing, since Linux file systems create holes wherever a
+// file is seeked past without being written.
+func setSparse(*os.File) error {
+	return nil
+}
+
+// setSecurity does nothing, since Windows security descriptors have no Linux
+// equivalent.
+func setSecurity(string, []byte) error {
+	return nil
+}
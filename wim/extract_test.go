@@ -0,0 +1,367 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testExtractImage(t *testing.T) *Image {
+	t.Helper()
+
+	r := mustNewReader(t, buildWIM(t, &testImage{
+		name: "test",
+		root: testDir("",
+			testDir("empty"),
+			testDir("docs",
+				testRegular("a.txt", "hello"),
+				testDir("nested", testDir("deeper")),
+			),
+			testDir("logs", testRegular("x.log", "log data")),
+			testRegular("root.txt", "root file"),
+		),
+	}))
+	return r.Image[0]
+}
+
+func readTestFile(t *testing.T, p string) string {
+	t.Helper()
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestExtractPreservesEmptyDirectories(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "out")
+	root := mustOpenRoot(t, testExtractImage(t))
+
+	noLogs := func(p string, _ *File) bool { return !strings.HasSuffix(p, ".log") }
+	if err := root.Extract(dest, &ExtractOptions{Filter: noLogs}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []string{"empty", "docs/nested/deeper", "logs"} {
+		fi, err := os.Stat(filepath.Join(dest, filepath.FromSlash(d)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.IsDir() {
+			t.Errorf("%s is not a directory", d)
+		}
+	}
+	if s := readTestFile(t, filepath.Join(dest, "docs", "a.txt")); s != "hello" {
+		t.Errorf("unexpected contents %q", s)
+	}
+	if s := readTestFile(t, filepath.Join(dest, "root.txt")); s != "root file" {
+		t.Errorf("unexpected contents %q", s)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "logs", "x.log")); !os.IsNotExist(err) {
+		t.Errorf("filtered file was extracted: %v", err)
+	}
+}
+
+func TestExtractPruneEmptyDirectories(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "out")
+	root := mustOpenRoot(t, testExtractImage(t))
+
+	noLogs := func(p string, _ *File) bool { return !strings.HasSuffix(p, ".log") }
+	if err := root.Extract(dest, &ExtractOptions{Filter: noLogs, PruneEmptyDirs: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []string{"empty", "docs/nested", "logs"} {
+		if _, err := os.Stat(filepath.Join(dest, filepath.FromSlash(d))); !os.IsNotExist(err) {
+			t.Errorf("%s was not pruned: %v", d, err)
+		}
+	}
+	if s := readTestFile(t, filepath.Join(dest, "docs", "a.txt")); s != "hello" {
+		t.Errorf("unexpected contents %q", s)
+	}
+}
+
+func TestExtractCollisions(t *testing.T) {
+	r := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		testRegular("readme.txt", "first"),
+		testRegular("README.TXT", "second"),
+		testRegular("ÄBC", "third"),
+		testRegular("äbc", "fourth"),
+	)}))
+	root := mustOpenRoot(t, r.Image[0])
+
+	var collisions []string
+	onCollision := func(existing, colliding string) {
+		collisions = append(collisions, existing+"="+colliding)
+	}
+	err := root.Extract(filepath.Join(t.TempDir(), "err"), &ExtractOptions{Collision: CollisionError, OnCollision: onCollision})
+	if err == nil {
+		t.Fatal("expected a collision error")
+	}
+
+	dest := filepath.Join(t.TempDir(), "skip")
+	collisions = nil
+	if err := root.Extract(dest, &ExtractOptions{Collision: CollisionSkip, OnCollision: onCollision}); err != nil {
+		t.Fatal(err)
+	}
+	if len(collisions) != 2 || collisions[0] != "readme.txt=README.TXT" || collisions[1] != "ÄBC=äbc" {
+		t.Errorf("unexpected collisions %q", collisions)
+	}
+	if s := readTestFile(t, filepath.Join(dest, "readme.txt")); s != "first" {
+		t.Errorf("unexpected contents %q", s)
+	}
+
+	dest = filepath.Join(t.TempDir(), "rename")
+	if err := root.Extract(dest, &ExtractOptions{Collision: CollisionRename}); err != nil {
+		t.Fatal(err)
+	}
+	if s := readTestFile(t, filepath.Join(dest, "README (1).TXT")); s != "second" {
+		t.Errorf("unexpected contents %q", s)
+	}
+	if s := readTestFile(t, filepath.Join(dest, "äbc (1)")); s != "fourth" {
+		t.Errorf("unexpected contents %q", s)
+	}
+}
+
+func TestCheckNameCollisions(t *testing.T) {
+	r := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		testRegular("readme.txt", "1"),
+		testRegular("ÄBC", "2"),
+		testRegular("other", "3"),
+		testRegular("README.TXT", "4"),
+		testRegular("äbc", "5"),
+		testRegular("ΟΔΟΣ", "6"),
+		testRegular("οδος", "7"),
+		testRegular("οδοσ", "8"),
+		// Like NTFS, characters are upcased individually, so ß does not
+		// match SS.
+		testRegular("straße", "9"),
+		testRegular("STRASSE", "10"),
+		testDir("dir", testRegular("readme.txt", "11")),
+	)}))
+	root := mustOpenRoot(t, r.Image[0])
+	groups, err := root.CheckNameCollisions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, g := range groups {
+		var names []string
+		for _, f := range g {
+			names = append(names, f.Name)
+		}
+		got = append(got, names)
+	}
+	expected := [][]string{
+		{"readme.txt", "README.TXT"},
+		{"ÄBC", "äbc"},
+		{"ΟΔΟΣ", "οδος", "οδοσ"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected collisions %q", got)
+	}
+
+	dir, err := r.Image[0].OpenFile("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups, err := dir.CheckNameCollisions(); err != nil || len(groups) != 0 {
+		t.Errorf("unexpected collisions %v: %v", groups, err)
+	}
+	f, err := r.Image[0].OpenFile("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.CheckNameCollisions(); err == nil {
+		t.Error("expected an error for a file that is not a directory")
+	}
+}
+
+func TestExtractHardLinks(t *testing.T) {
+	a := testRegular("a", "linked")
+	a.linkID = 7
+	b := testRegular("b", "linked")
+	b.linkID = 7
+	c := testRegular("c", "linked")
+	r := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("", a, testDir("sub", b), c)}))
+	root := mustOpenRoot(t, r.Image[0])
+
+	dest := filepath.Join(t.TempDir(), "out")
+	if err := root.Extract(dest, &ExtractOptions{Streams: true, RestoreSecurity: true}); err != nil {
+		t.Fatal(err)
+	}
+	stat := func(p string) os.FileInfo {
+		t.Helper()
+		fi, err := os.Stat(filepath.Join(dest, filepath.FromSlash(p)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+	if !os.SameFile(stat("a"), stat("sub/b")) {
+		t.Error("files with the same LinkID were not linked")
+	}
+	if os.SameFile(stat("a"), stat("c")) {
+		t.Error("files without a LinkID were linked")
+	}
+	if s := readTestFile(t, filepath.Join(dest, "sub", "b")); s != "linked" {
+		t.Errorf("unexpected contents %q", s)
+	}
+}
+
+func TestExtractError(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "out")
+	root := mustOpenRoot(t, testExtractImage(t))
+
+	// A file where a directory belongs stops the extraction partway.
+	if err := os.MkdirAll(dest, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dest, "logs"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	err := root.Extract(dest, nil)
+	var xerr *ExtractError
+	if !errors.As(err, &xerr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if xerr.Path != "logs/x.log" {
+		t.Errorf("unexpected failing path %q", xerr.Path)
+	}
+	if xerr.Files != 1 || xerr.Bytes != int64(len("hello")) {
+		t.Errorf("unexpected progress %d files, %d bytes", xerr.Files, xerr.Bytes)
+	}
+}
+
+func TestExtractCycle(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "out")
+	root := mustOpenRoot(t, mustNewReader(t, cyclicWIM(t)).Image[0])
+	err := root.Extract(dest, nil)
+	var xerr *ExtractError
+	if !errors.As(err, &xerr) || !isDirectoryCycle(err) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if xerr.Path != "parent/loop" || xerr.Files != 1 {
+		t.Errorf("unexpected error %+v", xerr)
+	}
+}
+
+func TestExtractUnsetTimes(t *testing.T) {
+	var ft Filetime
+	if !ft.IsZero() || !ft.Time().IsZero() {
+		t.Fatalf("zero Filetime converts to %v", ft.Time())
+	}
+
+	img := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		testRegular("file", "data"),
+	)})).Image[0]
+	f, err := img.OpenFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.HasCreationTime() || f.HasLastAccessTime() || f.HasLastWriteTime() {
+		t.Fatalf("unexpected times %+v", f.FileHeader)
+	}
+
+	// The file keeps the time it was extracted at, rather than getting a
+	// time in 1601.
+	start := time.Now().Add(-time.Minute)
+	dest := filepath.Join(t.TempDir(), "file")
+	if err := f.Extract(dest, &ExtractOptions{PreserveTimes: true}); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.ModTime().Before(start) {
+		t.Errorf("unexpected modification time %v", fi.ModTime())
+	}
+}
+
+func TestExtractPreserveTimes(t *testing.T) {
+	at := func(year int) Filetime { return timeToFiletime(time.Date(year, 1, 2, 3, 4, 5, 600, time.UTC)) }
+	times := map[string][2]Filetime{ // last access and last write times
+		"":               {at(2001), at(2002)},
+		"dir":            {at(2003), at(2004)},
+		"dir/sub":        {at(2005), at(2006)},
+		"dir/sub/file":   {at(2007), at(2008)},
+		"dir/other.txt":  {at(2009), at(2010)},
+		"top.txt":        {at(2011), at(2012)},
+		"dir/sub/nested": {at(2013), at(2014)},
+	}
+
+	p := filepath.Join(t.TempDir(), "times.wim")
+	out, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	w := NewWriter(out)
+	img, err := w.AddImage("times")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := func(name string, size int64) *FileHeader {
+		return &FileHeader{LastAccessTime: times[name][0], LastWriteTime: times[name][1], Size: size}
+	}
+	// Directories are added before their children, so each directory's
+	// times are only right if they are applied after its contents are
+	// written.
+	for _, err := range []error{
+		img.AddDir("", hdr("", 0)),
+		img.AddDir("dir", hdr("dir", 0)),
+		img.AddDir("dir/sub", hdr("dir/sub", 0)),
+		img.AddFile("dir/sub/file", hdr("dir/sub/file", 4), strings.NewReader("file")),
+		img.AddDir("dir/sub/nested", hdr("dir/sub/nested", 0)),
+		img.AddFile("dir/other.txt", hdr("dir/other.txt", 5), strings.NewReader("other")),
+		img.AddFile("top.txt", hdr("top.txt", 3), strings.NewReader("top")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	root := mustOpenRoot(t, r.Image[0])
+
+	for _, preserve := range []bool{false, true} {
+		dest := filepath.Join(t.TempDir(), "out")
+		start := time.Now().Add(-time.Minute)
+		if err := root.Extract(dest, &ExtractOptions{PreserveTimes: preserve}); err != nil {
+			t.Fatal(err)
+		}
+		for name, ft := range times {
+			fi, err := os.Stat(filepath.Join(dest, filepath.FromSlash(name)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !preserve {
+				if fi.ModTime().Before(start) {
+					t.Errorf("%q: modification time %v was applied", name, fi.ModTime())
+				}
+				continue
+			}
+			if want := ft[1].Time(); !fi.ModTime().Equal(want) {
+				t.Errorf("%q: modification time %v, expected %v", name, fi.ModTime(), want)
+			}
+			if atime, ok := accessTime(fi); ok && !atime.Equal(ft[0].Time()) {
+				t.Errorf("%q: access time %v, expected %v", name, atime, ft[0].Time())
+			}
+		}
+	}
+}
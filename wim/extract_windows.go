@@ -0,0 +1,125 @@
+//go:build windows
+// +build windows
+
+package wim
+
+import (
+	"errors"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// setFileTimes applies the creation, last access, and last write times of f to
+// path. Times that f does not have are left unchanged.
+func setFileTimes(path string, f *File) error {
+	if !f.HasCreationTime() && !f.HasLastAccessTime() && !f.HasLastWriteTime() {
+		return nil
+	}
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	h, err := windows.CreateFile(p,
+		windows.FILE_WRITE_ATTRIBUTES,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil,
+		windows.OPEN_EXISTING,
+		windows.FILE_FLAG_BACKUP_SEMANTICS|windows.FILE_FLAG_OPEN_REPARSE_POINT,
+		0)
+	if err != nil {
+		return &os.PathError{Op: "CreateFile", Path: path, Err: err}
+	}
+	defer windows.CloseHandle(h) //nolint:errcheck
+
+	// SetFileTime leaves the times passed as nil unchanged.
+	filetime := func(ft Filetime) *windows.Filetime {
+		if ft.IsZero() {
+			return nil
+		}
+		wft := windows.Filetime(ft)
+		return &wft
+	}
+	if err := windows.SetFileTime(h, filetime(f.CreationTime), filetime(f.LastAccessTime), filetime(f.LastWriteTime)); err != nil {
+		return &os.PathError{Op: "SetFileTime", Path: path, Err: err}
+	}
+	return nil
+}
+
+// streamPath returns the path of the alternate data stream name of the file at
+// path.
+func streamPath(path, name string) (string, bool) {
+	return path + ":" + name, true
+}
+
+// setSparse marks f as a sparse file, so that ranges seeked past without being
+// written are not allocated.
+func setSparse(f *os.File) error {
+	var n uint32
+	err := windows.DeviceIoControl(windows.Handle(f.Fd()), windows.FSCTL_SET_SPARSE, nil, 0, nil, 0, &n, nil)
+	if err != nil {
+		return &os.PathError{Op: "DeviceIoControl", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+// setSecurity applies the self-relative security descriptor sd to path. Only
+// the parts present in sd are set.
+func setSecurity(path string, sd []byte) error {
+	// Copy the descriptor into suitably aligned memory.
+	buf := make([]uint64, (len(sd)+7)/8)
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&buf[0])), len(sd)), sd)
+	d := (*windows.SECURITY_DESCRIPTOR)(unsafe.Pointer(&buf[0]))
+	if !d.IsValid() || int(d.Length()) > len(sd) {
+		return &os.PathError{Op: "SetNamedSecurityInfo", Path: path, Err: errors.New("invalid security descriptor")}
+	}
+
+	var info windows.SECURITY_INFORMATION
+	owner, _, err := d.Owner()
+	if err != nil {
+		return err
+	}
+	if owner != nil {
+		info |= windows.OWNER_SECURITY_INFORMATION
+	}
+	group, _, err := d.Group()
+	if err != nil {
+		return err
+	}
+	if group != nil {
+		info |= windows.GROUP_SECURITY_INFORMATION
+	}
+	// A DACL or SACL that is present but nil is a null ACL, which is applied
+	// too.
+	dacl, _, err := d.DACL()
+	if err == nil {
+		info |= windows.DACL_SECURITY_INFORMATION
+	} else if !errors.Is(err, windows.ERROR_OBJECT_NOT_FOUND) {
+		return err
+	}
+	sacl, _, err := d.SACL()
+	if err == nil {
+		info |= windows.SACL_SECURITY_INFORMATION
+	} else if !errors.Is(err, windows.ERROR_OBJECT_NOT_FOUND) {
+		return err
+	}
+	control, _, err := d.Control()
+	if err != nil {
+		return err
+	}
+	if control&windows.SE_DACL_PROTECTED != 0 {
+		info |= windows.PROTECTED_DACL_SECURITY_INFORMATION
+	}
+	if control&windows.SE_SACL_PROTECTED != 0 {
+		info |= windows.PROTECTED_SACL_SECURITY_INFORMATION
+	}
+	if info == 0 {
+		return nil
+	}
+
+	if err := windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, info, owner, group, dacl, sacl); err != nil {
+		return &os.PathError{Op: "SetNamedSecurityInfo", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+// Header holds the public fields of a WIM's header.
+type Header struct {
+	// GUID identifies the WIM. All parts of a split WIM share the same GUID.
+	GUID string
+	// Version is the WIM format version, such as 0x10d00 for version 1.13.
+	Version uint32
+	// Flags holds the raw WIM header flags.
+	Flags uint32
+	// CompressionSize is the size of compressed resource chunks.
+	CompressionSize uint32
+	// PartNumber is the 1-based number of this part of a split WIM, and
+	// TotalParts the number of parts. Both are 1 for WIMs that are not split.
+	PartNumber uint16
+	TotalParts uint16
+	// ImageCount is the number of images in the WIM.
+	ImageCount int
+	// BootIndex is the 1-based index of the bootable image, or 0 if there is
+	// none.
+	BootIndex int
+}
+
+// Header returns a copy of the WIM's header fields.
+func (r *Reader) Header() Header {
+	return Header{
+		GUID:            r.hdr.WIMGuid.String(),
+		Version:         r.hdr.Version,
+		Flags:           uint32(r.hdr.Flags),
+		CompressionSize: r.hdr.CompressionSize,
+		PartNumber:      r.hdr.PartNumber,
+		TotalParts:      r.hdr.TotalParts,
+		ImageCount:      int(r.hdr.ImageCount),
+		BootIndex:       int(r.hdr.BootIndex),
+	}
+}
+
+// GUID returns the WIM's GUID in its canonical string form.
+func (r *Reader) GUID() string {
+	return r.hdr.WIMGuid.String()
+}
+
+// Version returns the WIM format version from the header.
+func (r *Reader) Version() uint32 {
+	return r.hdr.Version
+}
+
+// ChunkSize returns the size in bytes of the chunks that compressed resources
+// are divided into, as recorded in the header. Uncompressed WIMs do not use
+// chunks, and their chunk size may be zero.
+func (r *Reader) ChunkSize() int {
+	return int(r.hdr.CompressionSize)
+}
+
+// Compression returns the compression algorithm indicated by the header, which
+// compressed resources use. Individual resources may still be stored
+// uncompressed; File.Compression reports how a file's data is stored.
+func (r *Reader) Compression() CompressionKind {
+	return r.hdr.compressionKind()
+}
+
+// ImageCount returns the number of images recorded in the header.
+func (r *Reader) ImageCount() int {
+	return int(r.hdr.ImageCount)
+}
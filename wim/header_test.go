@@ -0,0 +1,115 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// headerOnlyWIM returns a WIM with no images whose header is hdr, completed
+// with the locations of an empty offset table and of the XML data.
+func headerOnlyWIM(hdr wimHeader) []byte {
+	var xml bytes.Buffer
+	_ = binary.Write(&xml, binary.LittleEndian, utf16.Encode([]rune("\ufeff<WIM></WIM>")))
+	hdr.XMLData = resourceDescriptor{
+		FlagsAndCompressedSize: uint64(xml.Len()),
+		Offset:                 int64(wimHeaderSize),
+		OriginalSize:           int64(xml.Len()),
+	}
+	hdr.OffsetTable = resourceDescriptor{Offset: int64(wimHeaderSize) + int64(xml.Len())}
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.LittleEndian, &hdr)
+	b.Write(xml.Bytes())
+	return b.Bytes()
+}
+
+func TestHeaderValidation(t *testing.T) {
+	valid := wimHeader{
+		ImageTag:        wimImageTag,
+		Size:            wimHeaderSize,
+		Version:         0x10d00,
+		CompressionSize: 0x8000,
+		PartNumber:      1,
+		TotalParts:      1,
+	}
+	for _, tc := range []struct {
+		name    string
+		corrupt func(h *wimHeader)
+		bad     string // the implausible field reported, or empty if the header is valid
+	}{
+		{"valid", func(*wimHeader) {}, ""},
+		{"solid version", func(h *wimHeader) { h.Version = wimVersionSolid }, ""},
+		{"byte-swapped image tag", func(h *wimHeader) {
+			for i, j := 0, len(h.ImageTag)-1; i < j; i, j = i+1, j-1 {
+				h.ImageTag[i], h.ImageTag[j] = h.ImageTag[j], h.ImageTag[i]
+			}
+		}, "image tag"},
+		{"size", func(h *wimHeader) { h.Size += 8 }, "header size"},
+		{"version", func(h *wimHeader) { h.Version = 0x20d00 }, "version"},
+		{"image count", func(h *wimHeader) { h.ImageCount = maxImageCount + 1 }, "image count"},
+		{"compression size", func(h *wimHeader) { h.CompressionSize = 0x6000 }, "compression size"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hdr := valid
+			tc.corrupt(&hdr)
+			_, err := NewReader(bytes.NewReader(headerOnlyWIM(hdr)))
+			var perr *ParseError
+			switch tc.bad {
+			case "":
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+			case "image tag":
+				if !errors.As(err, &perr) || perr.Oper != "image tag" {
+					t.Fatalf("unexpected error %v", err)
+				}
+			default:
+				if !errors.As(err, &perr) || perr.Oper != "header" ||
+					!strings.Contains(err.Error(), "header fields implausible ("+tc.bad) {
+					t.Fatalf("unexpected error %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestHasIntegrityTable(t *testing.T) {
+	hdr := wimHeader{
+		ImageTag:        wimImageTag,
+		Size:            wimHeaderSize,
+		Version:         0x10d00,
+		CompressionSize: 0x8000,
+		PartNumber:      1,
+		TotalParts:      1,
+	}
+	r, err := NewReader(bytes.NewReader(headerOnlyWIM(hdr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.HasIntegrityTable() {
+		t.Error("expected no integrity table")
+	}
+
+	// An integrity table of no entries after the rest of the WIM.
+	b := headerOnlyWIM(hdr)
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	hdr.Integrity = resourceDescriptor{FlagsAndCompressedSize: 12, Offset: int64(len(b)), OriginalSize: 12}
+	var h bytes.Buffer
+	_ = binary.Write(&h, binary.LittleEndian, &hdr)
+	b = append(append(h.Bytes(), b[h.Len():]...), make([]byte, 12)...)
+	r, err = NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.HasIntegrityTable() {
+		t.Error("expected an integrity table")
+	}
+}
@@ -0,0 +1,100 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// attributeNames names the FILE_ATTRIBUTE_* constants, in bit order.
+var attributeNames = []struct {
+	bit  uint32
+	name string
+}{
+	{FILE_ATTRIBUTE_READONLY, "READONLY"},
+	{FILE_ATTRIBUTE_HIDDEN, "HIDDEN"},
+	{FILE_ATTRIBUTE_SYSTEM, "SYSTEM"},
+	{FILE_ATTRIBUTE_DIRECTORY, "DIRECTORY"},
+	{FILE_ATTRIBUTE_ARCHIVE, "ARCHIVE"},
+	{FILE_ATTRIBUTE_DEVICE, "DEVICE"},
+	{FILE_ATTRIBUTE_NORMAL, "NORMAL"},
+	{FILE_ATTRIBUTE_TEMPORARY, "TEMPORARY"},
+	{FILE_ATTRIBUTE_SPARSE_FILE, "SPARSE_FILE"},
+	{FILE_ATTRIBUTE_REPARSE_POINT, "REPARSE_POINT"},
+	{FILE_ATTRIBUTE_COMPRESSED, "COMPRESSED"},
+	{FILE_ATTRIBUTE_OFFLINE, "OFFLINE"},
+	{FILE_ATTRIBUTE_NOT_CONTENT_INDEXED, "NOT_CONTENT_INDEXED"},
+	{FILE_ATTRIBUTE_ENCRYPTED, "ENCRYPTED"},
+	{FILE_ATTRIBUTE_INTEGRITY_STREAM, "INTEGRITY_STREAM"},
+	{FILE_ATTRIBUTE_VIRTUAL, "VIRTUAL"},
+	{FILE_ATTRIBUTE_NO_SCRUB_DATA, "NO_SCRUB_DATA"},
+	{FILE_ATTRIBUTE_EA, "EA"},
+}
+
+// AttributesString renders the attributes set in attr as the names of their
+// FILE_ATTRIBUTE_* constants without the prefix, separated by "|" in bit
+// order, such as "READONLY|DIRECTORY|REPARSE_POINT". Bits without a constant
+// are rendered together in hexadecimal at the end, and no attributes as "0".
+func AttributesString(attr uint32) string {
+	if attr == 0 {
+		return "0"
+	}
+	var names []string
+	for _, a := range attributeNames {
+		if attr&a.bit != 0 {
+			names = append(names, a.name)
+			attr &^= a.bit
+		}
+	}
+	if attr != 0 {
+		names = append(names, fmt.Sprintf("%#x", attr))
+	}
+	return strings.Join(names, "|")
+}
+
+// AttributesString renders the file's attributes as AttributesString does.
+func (f *FileHeader) AttributesString() string {
+	return AttributesString(f.Attributes)
+}
+
+// Info returns an fs.FileInfo describing the file, so that it can be used with
+// standard tooling. Its Sys method returns the file's *FileHeader.
+func (f *File) Info() fs.FileInfo {
+	return fileInfo{&f.FileHeader}
+}
+
+type fileInfo struct {
+	hdr *FileHeader
+}
+
+func (fi fileInfo) Name() string       { return fi.hdr.Name }
+func (fi fileInfo) Size() int64        { return fi.hdr.Size }
+func (fi fileInfo) ModTime() time.Time { return fi.hdr.LastWriteTime.Time() }
+func (fi fileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi fileInfo) Sys() interface{}   { return fi.hdr }
+
+// Mode translates the file's attributes as os.Stat does on Windows: read-only
+// files lack write permission, and directories are executable. Reparse points,
+// such as symbolic links and junctions, are reported as symbolic links rather
+// than directories, and devices and files encrypted with EFS, whose contents are
+// not plain data, as irregular files.
+func (fi fileInfo) Mode() fs.FileMode {
+	attr := fi.hdr.Attributes
+	m := fs.FileMode(0o666)
+	if attr&FILE_ATTRIBUTE_READONLY != 0 {
+		m = 0o444
+	}
+	switch {
+	case attr&FILE_ATTRIBUTE_REPARSE_POINT != 0:
+		m |= fs.ModeSymlink
+	case attr&FILE_ATTRIBUTE_DIRECTORY != 0:
+		m |= fs.ModeDir | 0o111
+	case attr&(FILE_ATTRIBUTE_DEVICE|FILE_ATTRIBUTE_ENCRYPTED) != 0:
+		m |= fs.ModeIrregular
+	}
+	return m
+}
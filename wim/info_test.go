@@ -0,0 +1,109 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestFileInfo(t *testing.T) {
+	img := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		testDir("dir"),
+		testRegular("file", "contents"),
+		&testFile{name: "readonly", attr: FILE_ATTRIBUTE_READONLY, securityID: 0xffffffff},
+		&testFile{name: "device", attr: FILE_ATTRIBUTE_DEVICE, securityID: 0xffffffff},
+		&testFile{name: "encrypted", attr: FILE_ATTRIBUTE_ENCRYPTED, securityID: 0xffffffff},
+		testJunction("junction", `\??\C:\dir`),
+	)})).Image[0]
+
+	for _, tc := range []struct {
+		path string
+		mode fs.FileMode
+		size int64
+	}{
+		{"dir", fs.ModeDir | 0o777, 0},
+		{"file", 0o666, 8},
+		{"readonly", 0o444, 0},
+		{"device", fs.ModeIrregular | 0o666, 0},
+		{"encrypted", fs.ModeIrregular | 0o666, 0},
+		{"junction", fs.ModeSymlink | 0o666, -1},
+	} {
+		f, err := img.OpenFile(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi := f.Info()
+		if fi.Name() != tc.path || fi.Mode() != tc.mode || fi.IsDir() != tc.mode.IsDir() {
+			t.Errorf("%s: got name %q, mode %v", tc.path, fi.Name(), fi.Mode())
+		}
+		if tc.size >= 0 && fi.Size() != tc.size {
+			t.Errorf("%s: got size %d", tc.path, fi.Size())
+		}
+		if !fi.ModTime().Equal(f.LastWriteTime.Time()) || fi.Sys() != &f.FileHeader {
+			t.Errorf("%s: unexpected ModTime or Sys", tc.path)
+		}
+	}
+}
+
+func TestAttributesString(t *testing.T) {
+	// Each defined bit is rendered as the name of its constant.
+	var all uint32
+	var names []string
+	for bit, name := range map[uint32]string{
+		FILE_ATTRIBUTE_READONLY:            "READONLY",
+		FILE_ATTRIBUTE_HIDDEN:              "HIDDEN",
+		FILE_ATTRIBUTE_SYSTEM:              "SYSTEM",
+		FILE_ATTRIBUTE_DIRECTORY:           "DIRECTORY",
+		FILE_ATTRIBUTE_ARCHIVE:             "ARCHIVE",
+		FILE_ATTRIBUTE_DEVICE:              "DEVICE",
+		FILE_ATTRIBUTE_NORMAL:              "NORMAL",
+		FILE_ATTRIBUTE_TEMPORARY:           "TEMPORARY",
+		FILE_ATTRIBUTE_SPARSE_FILE:         "SPARSE_FILE",
+		FILE_ATTRIBUTE_REPARSE_POINT:       "REPARSE_POINT",
+		FILE_ATTRIBUTE_COMPRESSED:          "COMPRESSED",
+		FILE_ATTRIBUTE_OFFLINE:             "OFFLINE",
+		FILE_ATTRIBUTE_NOT_CONTENT_INDEXED: "NOT_CONTENT_INDEXED",
+		FILE_ATTRIBUTE_ENCRYPTED:           "ENCRYPTED",
+		FILE_ATTRIBUTE_INTEGRITY_STREAM:    "INTEGRITY_STREAM",
+		FILE_ATTRIBUTE_VIRTUAL:             "VIRTUAL",
+		FILE_ATTRIBUTE_NO_SCRUB_DATA:       "NO_SCRUB_DATA",
+		FILE_ATTRIBUTE_EA:                  "EA",
+	} {
+		if s := AttributesString(bit); s != name {
+			t.Errorf("%#x: got %q, expected %q", bit, s, name)
+		}
+		all |= bit
+		names = append(names, name)
+	}
+
+	// All of them together split back into the same names, in bit order.
+	parts := strings.Split(AttributesString(all), "|")
+	if len(parts) != len(names) {
+		t.Fatalf("unexpected names %v", parts)
+	}
+	var got uint32
+	for _, p := range parts {
+		for _, a := range attributeNames {
+			if a.name == p {
+				if a.bit <= got {
+					t.Errorf("%s is out of order", p)
+				}
+				got |= a.bit
+			}
+		}
+	}
+	if got != all {
+		t.Errorf("round trip gave %#x, expected %#x", got, all)
+	}
+
+	hdr := FileHeader{Attributes: FILE_ATTRIBUTE_READONLY | FILE_ATTRIBUTE_DIRECTORY | 0x80000000}
+	if s := hdr.AttributesString(); s != "READONLY|DIRECTORY|0x80000000" {
+		t.Errorf("unexpected string %q", s)
+	}
+	if s := AttributesString(0); s != "0" {
+		t.Errorf("unexpected string %q", s)
+	}
+}
@@ -0,0 +1,146 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"crypto/sha1" //nolint:gosec // not used for secure application
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// integrityTableHeader is the header of the integrity table, which is followed
+// by NumEntries SHA1 hashes of consecutive ChunkSize-byte chunks of the WIM,
+// starting after the WIM header and ending with the offset table.
+type integrityTableHeader struct {
+	Size       uint32
+	NumEntries uint32
+	ChunkSize  uint32
+}
+
+var integrityTableHeaderSize = int64(binary.Size(integrityTableHeader{}))
+
+// ErrNoIntegrityTable is returned by Reader.VerifyIntegrity when the WIM does
+// not have an integrity table.
+var ErrNoIntegrityTable = errors.New("WIM has no integrity table")
+
+// IntegrityError is returned by Reader.VerifyIntegrity when a chunk of the WIM
+// does not match its hash in the integrity table.
+type IntegrityError struct {
+	// Chunk is the index of the chunk in the integrity table.
+	Chunk int
+	// Offset and Size locate the chunk in the WIM file.
+	Offset   int64
+	Size     int64
+	Expected SHA1Hash
+	Actual   SHA1Hash
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity check failed for chunk %d (%d bytes at offset %d): expected %x, got %x",
+		e.Chunk, e.Size, e.Offset, e.Expected, e.Actual)
+}
+
+// readIntegrityTableHeader reads and validates the integrity table header.
+func (r *Reader) readIntegrityTableHeader() (*integrityTableHeader, error) {
+	rsrc, err := r.resourceReader(&r.hdr.Integrity)
+	if err != nil {
+		return nil, err
+	}
+	defer rsrc.Close()
+
+	var ith integrityTableHeader
+	if err := binary.Read(rsrc, binary.LittleEndian, &ith); err != nil {
+		return nil, &ParseError{Oper: "integrity table", Err: err}
+	}
+
+	checked := r.hdr.OffsetTable.Offset + r.hdr.OffsetTable.CompressedSize() - int64(wimHeaderSize)
+	switch {
+	case checked <= 0:
+		err = errors.New("offset table does not follow the header")
+	case ith.ChunkSize == 0:
+		err = errors.New("zero chunk size")
+	case int64(ith.Size) != integrityTableHeaderSize+int64(ith.NumEntries)*int64(len(SHA1Hash{})):
+		err = errors.New("size does not match entry count")
+	case int64(ith.NumEntries) != (checked+int64(ith.ChunkSize)-1)/int64(ith.ChunkSize):
+		err = errors.New("entry count does not cover the WIM")
+	}
+	if err != nil {
+		return nil, &ParseError{Oper: "integrity table", Err: err}
+	}
+	return &ith, nil
+}
+
+// IsFinalized reports whether the WIM was completely written: its header does
+// not have the write-in-progress flag set and, if it has an integrity table,
+// the table is consistent with the size of the WIM. It does not verify the
+// integrity hashes themselves.
+func (r *Reader) IsFinalized() bool {
+	if r.hdr.Flags&hdrFlagWriteInProgress != 0 {
+		return false
+	}
+	if r.HasIntegrityTable() {
+		if _, err := r.readIntegrityTableHeader(); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyIntegrity checks the WIM file against its integrity table, which holds
+// the SHA1 hashes of consecutive chunks of the file from the end of the header
+// through the end of the offset table. It returns ErrNoIntegrityTable if the
+// WIM does not have one, and an *IntegrityError, wrapped in a ParseError, for
+// the first chunk that does not match.
+func (r *Reader) VerifyIntegrity() error {
+	if !r.HasIntegrityTable() {
+		return ErrNoIntegrityTable
+	}
+	ith, err := r.readIntegrityTableHeader()
+	if err != nil {
+		return err
+	}
+	table, err := r.readResource(&r.hdr.Integrity)
+	if err != nil {
+		return &ParseError{Oper: "integrity table", Err: err}
+	}
+	if int64(len(table)) < int64(ith.Size) {
+		return &ParseError{Oper: "integrity table", Err: errors.New("table is truncated")}
+	}
+	hashes := table[integrityTableHeaderSize:]
+
+	start := int64(wimHeaderSize)
+	end := r.hdr.OffsetTable.Offset + r.hdr.OffsetTable.CompressedSize()
+	chunk := int64(ith.ChunkSize)
+	if chunk > end-start {
+		chunk = end - start
+	}
+	buf := make([]byte, chunk)
+	for i := 0; i < int(ith.NumEntries); i++ {
+		off := start + int64(i)*int64(ith.ChunkSize)
+		b := buf
+		if n := end - off; n < int64(len(b)) {
+			b = b[:n]
+		}
+		if n, err := r.r.ReadAt(b, off); n < len(b) {
+			if err == io.EOF { //nolint:errorlint
+				err = io.ErrUnexpectedEOF
+			}
+			return &ParseError{Oper: "integrity check", Err: err}
+		}
+		var expected SHA1Hash
+		copy(expected[:], hashes[i*len(expected):])
+		if actual := SHA1Hash(sha1.Sum(b)); actual != expected { //nolint:gosec // not used for secure application
+			return &ParseError{Oper: "integrity check", Err: &IntegrityError{
+				Chunk:    i,
+				Offset:   off,
+				Size:     int64(len(b)),
+				Expected: expected,
+				Actual:   actual,
+			}}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"crypto/sha1" //nolint:gosec // not used for secure application
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestIsFinalized(t *testing.T) {
+	b := buildWIM(t, &testImage{name: "test", root: testDir("")})
+	if !mustNewReader(t, b).IsFinalized() {
+		t.Error("expected WIM to be finalized")
+	}
+
+	binary.LittleEndian.PutUint32(b[16:], uint32(hdrFlagWriteInProgress))
+	if mustNewReader(t, b).IsFinalized() {
+		t.Error("expected WIM with write in progress not to be finalized")
+	}
+}
+
+// addIntegrityTable appends an integrity table with the given chunk size to
+// the WIM in b.
+func addIntegrityTable(tb testing.TB, b []byte, chunkSize uint32) []byte {
+	tb.Helper()
+
+	var hdr wimHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+		tb.Fatal(err)
+	}
+	body := b[wimHeaderSize : hdr.OffsetTable.Offset+hdr.OffsetTable.CompressedSize()]
+	var hashes bytes.Buffer
+	n := 0
+	for off := 0; off < len(body); off += int(chunkSize) {
+		end := off + int(chunkSize)
+		if end > len(body) {
+			end = len(body)
+		}
+		h := sha1.Sum(body[off:end]) //nolint:gosec // not used for secure application
+		hashes.Write(h[:])
+		n++
+	}
+	var table bytes.Buffer
+	_ = binary.Write(&table, binary.LittleEndian, &integrityTableHeader{
+		Size:       uint32(integrityTableHeaderSize) + uint32(hashes.Len()),
+		NumEntries: uint32(n),
+		ChunkSize:  chunkSize,
+	})
+	table.Write(hashes.Bytes())
+
+	hdr.Integrity = resourceDescriptor{
+		FlagsAndCompressedSize: uint64(table.Len()),
+		Offset:                 int64(len(b)),
+		OriginalSize:           int64(table.Len()),
+	}
+	out := append(append([]byte(nil), b...), table.Bytes()...)
+	var h bytes.Buffer
+	_ = binary.Write(&h, binary.LittleEndian, &hdr)
+	copy(out, h.Bytes())
+	return out
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	b := buildWIM(t, &testImage{name: "test", root: testDir("",
+		testRegular("a", strings.Repeat("a", 300)),
+		testRegular("b", strings.Repeat("b", 300)),
+	)})
+	if err := mustNewReader(t, b).VerifyIntegrity(); !errors.Is(err, ErrNoIntegrityTable) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	b = addIntegrityTable(t, b, 256)
+	r := mustNewReader(t, b)
+	if !r.IsFinalized() {
+		t.Error("expected WIM with a valid integrity table to be finalized")
+	}
+	if err := r.VerifyIntegrity(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the data of file b, which follows the header and file a.
+	start := int(wimHeaderSize)
+	off := start + 300 + 10
+	b[off] ^= 0xff
+	var ie *IntegrityError
+	if err := mustNewReader(t, b).VerifyIntegrity(); !errors.As(err, &ie) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if ie.Chunk != (off-start)/256 || ie.Offset != int64(start+ie.Chunk*256) || ie.Size != 256 {
+		t.Errorf("unexpected error %+v", ie)
+	}
+}
+
+func TestIntegrityTableBeforeOffsetTable(t *testing.T) {
+	// A WIM whose offset table is empty and at offset 0, so that there is
+	// nothing to check, with an integrity table of no entries.
+	b := buildWIM(t)
+	var hdr wimHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	hdr.OffsetTable = resourceDescriptor{}
+	var table bytes.Buffer
+	_ = binary.Write(&table, binary.LittleEndian, &integrityTableHeader{
+		Size:      uint32(integrityTableHeaderSize),
+		ChunkSize: 1024,
+	})
+	hdr.Integrity = resourceDescriptor{
+		FlagsAndCompressedSize: uint64(table.Len()),
+		Offset:                 int64(len(b)),
+		OriginalSize:           int64(table.Len()),
+	}
+	b = append(b, table.Bytes()...)
+	var h bytes.Buffer
+	_ = binary.Write(&h, binary.LittleEndian, &hdr)
+	copy(b, h.Bytes())
+
+	r := mustNewReader(t, b)
+	if r.IsFinalized() {
+		t.Error("expected WIM with an inconsistent integrity table not to be finalized")
+	}
+	var perr *ParseError
+	if err := r.VerifyIntegrity(); !errors.As(err, &perr) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
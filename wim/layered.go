@@ -0,0 +1,114 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"fmt"
+	"io"
+)
+
+// NewLayeredReader returns a Reader whose images are those of overlay, but
+// whose file and stream data may also come from bases. This supports delta
+// WIMs, whose offset tables only hold the resources that changed relative to
+// a base WIM: a resource is looked up by hash in overlay first and then in
+// each base in order, and File.Open and Stream.Open read it from whichever
+// Reader holds it.
+//
+// The returned Reader shares the underlying files of overlay and bases, which
+// must remain open while it is in use. Its images are distinct from those of
+// overlay, so the two may be used independently.
+func NewLayeredReader(overlay *Reader, bases ...*Reader) *Reader {
+	r := &Reader{
+		hdr:       overlay.hdr,
+		r:         overlay.r,
+		opts:      overlay.opts,
+		fileData:  overlay.fileData,
+		refCount:  overlay.refCount,
+		resources: overlay.resources,
+		solid:     overlay.solid,
+		metrics:   overlay.metrics,
+		bases:     append(append([]*Reader(nil), overlay.bases...), bases...),
+		XMLInfo:   overlay.XMLInfo,
+	}
+	for _, img := range overlay.Image {
+		r.Image = append(r.Image, &Image{
+			wim:       r,
+			offset:    img.offset,
+			hash:      img.hash,
+			ImageInfo: img.ImageInfo,
+		})
+	}
+	return r
+}
+
+// ResourceRefCount returns the reference count recorded in the offset table
+// for the resource with the given hash: the number of directory entries and
+// stream entries, across all images, whose data it holds. It reports false if
+// there is no such resource. Comparing the counts with the resource sizes
+// shows how much space deduplication saves. Base WIMs are searched as for
+// File.Open.
+func (r *Reader) ResourceRefCount(hash SHA1Hash) (uint32, bool) {
+	src, _, ok := r.lookupResource(hash)
+	if !ok {
+		return 0, false
+	}
+	return src.refCount[hash], true
+}
+
+// OpenResource returns a reader for the contents of the resource with the
+// given hash, together with their uncompressed size, without going through
+// the directory entries that refer to it. Base WIMs are searched as for
+// File.Open, and the contents are verified if Options.VerifyHashes is set. The
+// zero hash, which WIMs record for empty contents, yields an empty reader. If
+// no resource has the hash, the error wraps ErrResourceNotFound.
+func (r *Reader) OpenResource(hash SHA1Hash) (io.ReadCloser, int64, error) {
+	var src *Reader
+	var rd resourceDescriptor
+	if hash != (SHA1Hash{}) {
+		var ok bool
+		src, rd, ok = r.lookupResource(hash)
+		if !ok {
+			return nil, 0, fmt.Errorf("resource %x: %w", hash, ErrResourceNotFound)
+		}
+	} else {
+		src = r
+	}
+	rc, err := src.resourceReader(&rd)
+	if err != nil {
+		return nil, 0, err
+	}
+	if src.opts.VerifyHashes {
+		rc = newVerifyReader(rc, fmt.Sprintf("resource %x", hash), hash, rd.Offset)
+	}
+	return rc, rd.OriginalSize, nil
+}
+
+// RefCount returns the reference count of the resource holding the file's
+// unnamed data stream, as Reader.ResourceRefCount does, or 0 if the file has
+// no data.
+func (f *File) RefCount() uint32 {
+	n, _ := f.src.ResourceRefCount(f.Hash)
+	return n
+}
+
+// RefCount returns the reference count of the resource holding the stream's
+// data, or 0 if the stream is empty.
+func (s *Stream) RefCount() uint32 {
+	n, _ := s.wim.ResourceRefCount(s.Hash)
+	return n
+}
+
+// lookupResource returns the Reader holding the resource with the given hash
+// and its descriptor, searching r before its bases.
+func (r *Reader) lookupResource(hash SHA1Hash) (*Reader, resourceDescriptor, bool) {
+	if rd, ok := r.fileData[hash]; ok {
+		return r, rd, true
+	}
+	for _, b := range r.bases {
+		if src, rd, ok := b.lookupResource(hash); ok {
+			return src, rd, true
+		}
+	}
+	return nil, resourceDescriptor{}, false
+}
@@ -0,0 +1,91 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestLayeredReader(t *testing.T) {
+	base := mustNewReader(t, buildWIM(t, &testImage{name: "base", root: testDir("",
+		testRegular("shared.txt", "shared"),
+	)}))
+	f := testRegular("new.txt", "new")
+	f.streams = []testStream{{name: "ads", data: []byte("shared")}}
+	overlay := mustNewReader(t, buildWIM(t, &testImage{name: "delta", root: testDir("",
+		f,
+		testRegular("shared.txt", "shared"),
+	)}))
+	// Drop the shared resource from the overlay, as a delta WIM would.
+	delete(overlay.fileData, sha1Hash([]byte("shared")))
+
+	if _, err := overlay.Image[0].Records(); err == nil {
+		t.Fatal("expected the overlay alone to be missing a resource")
+	}
+
+	r := NewLayeredReader(overlay, base)
+	if len(r.Image) != 1 || r.Image[0].Name != "delta" {
+		t.Fatalf("unexpected images %+v", r.Image)
+	}
+	for _, p := range []string{"new.txt", "shared.txt"} {
+		f, err := r.Image[0].FindByPath(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := f.ReadString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != p[:len(p)-4] {
+			t.Errorf("%s: unexpected contents %q", p, s)
+		}
+		if p == "new.txt" && f.Streams[0].wim != base {
+			t.Error("stream data was not taken from the base")
+		}
+	}
+}
+
+func TestOpenResource(t *testing.T) {
+	b := buildWIM(t, &testImage{name: "test", root: testDir("", testRegular("file", "file contents"))})
+	r := mustNewReader(t, b)
+	for _, tc := range []struct {
+		hash SHA1Hash
+		data string
+	}{
+		{sha1Hash([]byte("file contents")), "file contents"},
+		{SHA1Hash{}, ""},
+	} {
+		rc, size, err := r.OpenResource(tc.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(data) != tc.data || size != int64(len(tc.data)) {
+			t.Errorf("unexpected contents %q (%d bytes): %v", data, size, err)
+		}
+	}
+	if _, _, err := r.OpenResource(sha1Hash([]byte("missing"))); !errors.Is(err, ErrResourceNotFound) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// The contents are verified if requested.
+	b[bytes.Index(b, []byte("file contents"))] = 'F'
+	r, err := NewReaderWithOptions(bytes.NewReader(b), &Options{VerifyHashes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, _, err := r.OpenResource(sha1Hash([]byte("file contents")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	var mismatch *HashMismatchError
+	if _, err := io.ReadAll(rc); !errors.As(err, &mismatch) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
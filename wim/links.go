@@ -0,0 +1,35 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+// HardLinks returns the image's files grouped by LinkID, in the order they are
+// found walking the tree. Files with a LinkID of 0 are not hard links and are
+// omitted. Junctions are not followed, so each file appears once.
+//
+// The tree is walked on the first call and the groups are cached for
+// subsequent calls; each call returns a new map that the caller may modify.
+func (img *Image) HardLinks() (map[int64][]*File, error) {
+	img.statsMu.Lock()
+	defer img.statsMu.Unlock()
+
+	if img.cachedLinks == nil {
+		links := make(map[int64][]*File)
+		err := img.walkTree(false, func(_ string, f *File) error {
+			if f.LinkID != 0 {
+				links[f.LinkID] = append(links[f.LinkID], f)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		img.cachedLinks = links
+	}
+
+	links := make(map[int64][]*File, len(img.cachedLinks))
+	for id, files := range img.cachedLinks {
+		links[id] = append([]*File(nil), files...)
+	}
+	return links, nil
+}
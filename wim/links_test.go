@@ -0,0 +1,35 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import "testing"
+
+func TestHardLinks(t *testing.T) {
+	link := func(name string, id int64) *testFile {
+		f := testRegular(name, "shared")
+		f.linkID = id
+		return f
+	}
+	img := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		link("a", 7),
+		testDir("dir", link("b", 7), link("c", 9)),
+		testRegular("plain", "plain"),
+	)})).Image[0]
+
+	for pass := 0; pass < 2; pass++ {
+		links, err := img.HardLinks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(links) != 2 || len(links[7]) != 2 || len(links[9]) != 1 {
+			t.Fatalf("unexpected groups %v", links)
+		}
+		if links[7][0].Name != "a" || links[7][1].Name != "b" || links[9][0].Name != "c" {
+			t.Errorf("unexpected files %s %s %s", links[7][0].Name, links[7][1].Name, links[9][0].Name)
+		}
+		// Modifying the result must not affect later calls.
+		delete(links, 7)
+		links[9][0] = nil
+	}
+}
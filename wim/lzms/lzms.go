@@ -0,0 +1,728 @@
+// Package lzms implements a decompressor for the LZMS compression algorithm,
+// which is used by WIMs captured with /compress:recovery and by solid
+// resources.
+//
+// Each LZMS block consists of two streams that share one buffer. A range coder
+// reads adaptive binary decisions from the front of the buffer and selects the
+// type of each item: a literal, an LZ77 match, or a delta match, possibly
+// reusing a recently used offset. The literals, lengths and offsets themselves
+// are read with adaptive Huffman codes from a bitstream that runs backwards
+// from the end of the buffer. Finally, the output is passed through a filter
+// that undoes the translation of relative x86 call and jump targets.
+package lzms
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+const (
+	numLZReps    = 3
+	numDeltaReps = 3
+
+	numMainProbs     = 16
+	numMatchProbs    = 32
+	numLZProbs       = 64
+	numLZRepProbs    = 64
+	numDeltaProbs    = 64
+	numDeltaRepProbs = 64
+
+	probabilityBits        = 6
+	probabilityDenominator = 1 << probabilityBits
+	initialProbability     = 48
+	initialRecentBits      = 0x0000000055555555
+
+	numLiteralSyms    = 256
+	numLengthSyms     = 54
+	numDeltaPowerSyms = 8
+	maxNumOffsetSyms  = 799
+	maxCodewordLength = 15
+
+	literalRebuildFreq     = 1024
+	lzOffsetRebuildFreq    = 1024
+	lengthRebuildFreq      = 512
+	deltaOffsetRebuildFreq = 1024
+	deltaPowerRebuildFreq  = 512
+
+	x86IDWindowSize         = 65535
+	x86MaxTranslationOffset = 1023
+)
+
+// The offset and length slot bases are stored as run lengths of the
+// differences between consecutive bases, which double after each run.
+var (
+	offsetSlotRunLens = []uint8{
+		9, 0, 9, 7, 10, 15, 15, 20,
+		20, 30, 33, 40, 42, 45, 60, 73,
+		80, 85, 95, 105, 6,
+	}
+	lengthSlotRunLens = []uint8{
+		27, 4, 6, 4, 5, 2, 1, 1,
+		1, 1, 1, 0, 0, 0, 0, 0,
+		1,
+	}
+)
+
+var (
+	offsetSlotBase  [maxNumOffsetSyms + 1]uint32
+	extraOffsetBits [maxNumOffsetSyms]uint8
+	lengthSlotBase  [numLengthSyms + 1]uint32
+	extraLengthBits [numLengthSyms]uint8
+)
+
+func init() {
+	decodeSlotBases(offsetSlotBase[:], extraOffsetBits[:], offsetSlotRunLens, 0x7fffffff)
+	decodeSlotBases(lengthSlotBase[:], extraLengthBits[:], lengthSlotRunLens, 0x400108ab)
+}
+
+func decodeSlotBases(base []uint32, extra []uint8, runLens []uint8, final uint32) {
+	var (
+		order uint8
+		delta uint32 = 1
+		b     uint32
+		slot  int
+	)
+	for _, n := range runLens {
+		for ; n > 0; n-- {
+			b += delta
+			if slot > 0 {
+				extra[slot-1] = order
+			}
+			base[slot] = b
+			slot++
+		}
+		delta <<= 1
+		order++
+	}
+	base[slot] = final
+	extra[slot-1] = uint8(bits.Len32(final-base[slot-1]) - 1)
+}
+
+// numOffsetSlots returns the number of offset symbols needed to reach any
+// position in a block of the given size.
+func numOffsetSlots(size int) int {
+	if size < 2 {
+		return 1
+	}
+	return sort.Search(maxNumOffsetSyms, func(i int) bool { return offsetSlotBase[i+1] > uint32(size-1) }) + 1
+}
+
+var errCorrupt = errors.New("LZMS data corrupt")
+
+// probEntry tracks the probability that the next bit decoded in some context
+// is zero, based on the last 64 bits decoded in that context.
+type probEntry struct {
+	zeros  uint32
+	recent uint64
+}
+
+func (p *probEntry) probability() uint32 {
+	prob := p.zeros
+	// 0% and 100% are not allowed.
+	if prob == 0 {
+		prob = 1
+	} else if prob == probabilityDenominator {
+		prob = probabilityDenominator - 1
+	}
+	return prob
+}
+
+func (p *probEntry) update(bit uint32) {
+	p.zeros = uint32(int32(p.zeros) + int32(p.recent>>63) - int32(bit))
+	p.recent = p.recent<<1 | uint64(bit)
+}
+
+func initProbs(probs []probEntry) {
+	for i := range probs {
+		probs[i] = probEntry{zeros: initialProbability, recent: initialRecentBits}
+	}
+}
+
+// rangeDecoder reads 16-bit little-endian words from the front of the input.
+type rangeDecoder struct {
+	rng  uint32
+	code uint32
+	in   []byte
+	pos  int
+}
+
+func (rd *rangeDecoder) init(in []byte) {
+	rd.rng = 0xffffffff
+	rd.code = uint32(binary.LittleEndian.Uint16(in))<<16 | uint32(binary.LittleEndian.Uint16(in[2:]))
+	rd.in = in
+	rd.pos = 4
+}
+
+// decodeBit decodes a bit using the probability entry selected by *state, then
+// shifts the bit into *state.
+func (rd *rangeDecoder) decodeBit(state *uint32, probs []probEntry) uint32 {
+	p := &probs[*state]
+	*state = (*state << 1) & uint32(len(probs)-1)
+	prob := p.probability()
+	if rd.rng&0xffff0000 == 0 {
+		rd.rng <<= 16
+		rd.code <<= 16
+		if rd.pos+2 <= len(rd.in) {
+			rd.code |= uint32(binary.LittleEndian.Uint16(rd.in[rd.pos:]))
+			rd.pos += 2
+		}
+	}
+	bound := (rd.rng >> probabilityBits) * prob
+	if rd.code < bound {
+		rd.rng = bound
+		p.update(0)
+		return 0
+	}
+	rd.rng -= bound
+	rd.code -= bound
+	p.update(1)
+	*state |= 1
+	return 1
+}
+
+// bitReader reads 16-bit little-endian words backwards from the end of the
+// input, most significant bit first. Past the start of the input it reads
+// zeros.
+type bitReader struct {
+	buf  uint64
+	left uint
+	in   []byte
+	pos  int
+}
+
+func (br *bitReader) init(in []byte) {
+	*br = bitReader{in: in, pos: len(in)}
+}
+
+func (br *bitReader) ensure(n uint) {
+	for br.left < n {
+		if br.pos >= 2 {
+			br.pos -= 2
+			br.buf |= uint64(binary.LittleEndian.Uint16(br.in[br.pos:])) << (64 - 16 - br.left)
+		}
+		br.left += 16
+	}
+}
+
+func (br *bitReader) readBits(n uint) uint32 {
+	if n == 0 {
+		return 0
+	}
+	br.ensure(n)
+	v := uint32(br.buf >> (64 - n))
+	br.buf <<= n
+	br.left -= n
+	return v
+}
+
+// huffmanCode is an adaptive canonical Huffman code. The code is rebuilt from
+// the symbol frequencies after every rebuildFreq symbols, after which the
+// frequencies are halved.
+type huffmanCode struct {
+	freqs        []uint32
+	lens         []uint8
+	counts       [maxCodewordLength + 1]uint16
+	syms         []uint16 // symbols sorted by codeword length, then value
+	rebuildFreq  int
+	untilRebuild int
+	scratch      []uint32
+}
+
+func (c *huffmanCode) init(numSyms, rebuildFreq int) {
+	if cap(c.freqs) < numSyms {
+		c.freqs = make([]uint32, numSyms)
+		c.lens = make([]uint8, numSyms)
+		c.syms = make([]uint16, numSyms)
+	}
+	c.freqs = c.freqs[:numSyms]
+	c.lens = c.lens[:numSyms]
+	for i := range c.freqs {
+		c.freqs[i] = 1
+	}
+	c.rebuildFreq = rebuildFreq
+	c.rebuild()
+}
+
+func (c *huffmanCode) rebuild() {
+	c.scratch = buildCodewordLengths(c.freqs, c.lens, c.scratch)
+	c.counts = [maxCodewordLength + 1]uint16{}
+	for _, l := range c.lens {
+		c.counts[l]++
+	}
+	c.counts[0] = 0
+	var offs [maxCodewordLength + 1]uint16
+	for l := 1; l < maxCodewordLength; l++ {
+		offs[l+1] = offs[l] + c.counts[l]
+	}
+	c.syms = c.syms[:cap(c.syms)]
+	for sym, l := range c.lens {
+		if l != 0 {
+			c.syms[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+	for i := range c.freqs {
+		c.freqs[i] = c.freqs[i]>>1 + 1
+	}
+	c.untilRebuild = c.rebuildFreq
+}
+
+// used records an occurrence of sym, rebuilding the code when due.
+func (c *huffmanCode) used(sym int) {
+	c.freqs[sym]++
+	c.untilRebuild--
+	if c.untilRebuild == 0 {
+		c.rebuild()
+	}
+}
+
+func (c *huffmanCode) decode(br *bitReader) (int, error) {
+	br.ensure(maxCodewordLength)
+	v := uint32(br.buf >> (64 - maxCodewordLength))
+	code, first, index := 0, 0, 0
+	for l := uint(1); l <= maxCodewordLength; l++ {
+		code |= int(v>>(maxCodewordLength-l)) & 1
+		count := int(c.counts[l])
+		if code-count < first {
+			sym := int(c.syms[index+code-first])
+			br.buf <<= l
+			br.left -= l
+			c.used(sym)
+			return sym, nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, errCorrupt
+}
+
+const (
+	numSymbolBits = 10
+	symbolMask    = 1<<numSymbolBits - 1
+)
+
+// buildCodewordLengths computes the codeword lengths of a length-limited
+// Huffman code for freqs. LZMS requires the decoder to build exactly the code
+// the encoder built, so the tie-breaking rules here are part of the format:
+// symbols are ordered by frequency and then by value, and the tree is built
+// preferring leaves over internal nodes of equal frequency.
+func buildCodewordLengths(freqs []uint32, lens []uint8, a []uint32) []uint32 {
+	a = a[:0]
+	for sym, f := range freqs {
+		lens[sym] = 0
+		if f != 0 {
+			a = append(a, f<<numSymbolBits|uint32(sym))
+		}
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i] < a[j] })
+
+	switch len(a) {
+	case 0:
+		return a
+	case 1:
+		sym := a[0] & symbolMask
+		other := uint32(1)
+		if sym != 0 {
+			other = 0
+		}
+		lens[sym] = 1
+		if int(other) < len(lens) {
+			lens[other] = 1
+		}
+		return a
+	}
+
+	// Build the tree in place. Internal nodes replace the entries of a from
+	// the start; each entry ends up holding the index of its parent in its
+	// upper bits, while the lower bits keep the sorted symbols.
+	n := len(a)
+	i, b, e := 0, 0, 0
+	for {
+		var m, k int
+		if i != n && (b == e || a[i]>>numSymbolBits <= a[b]>>numSymbolBits) {
+			m = i
+			i++
+		} else {
+			m = b
+			b++
+		}
+		if i != n && (b == e || a[i]>>numSymbolBits <= a[b]>>numSymbolBits) {
+			k = i
+			i++
+		} else {
+			k = b
+			b++
+		}
+		freq := a[m]&^symbolMask + a[k]&^symbolMask
+		a[m] = a[m]&symbolMask | uint32(e)<<numSymbolBits
+		a[k] = a[k]&symbolMask | uint32(e)<<numSymbolBits
+		a[e] = a[e]&symbolMask | freq
+		e++
+		if n-e <= 1 {
+			break
+		}
+	}
+
+	// Compute the number of codewords of each length by walking the internal
+	// nodes from the root, replacing parent indices with depths. Nodes deeper
+	// than the limit are moved up to the deepest level that has room.
+	var counts [maxCodewordLength + 1]int
+	counts[1] = 2
+	root := n - 2
+	a[root] &= symbolMask
+	for node := root - 1; node >= 0; node-- {
+		parent := a[node] >> numSymbolBits
+		depth := a[parent]>>numSymbolBits + 1
+		a[node] = a[node]&symbolMask | depth<<numSymbolBits
+		l := int(depth)
+		if l >= maxCodewordLength {
+			l = maxCodewordLength
+			for {
+				l--
+				if counts[l] != 0 {
+					break
+				}
+			}
+		}
+		counts[l]--
+		counts[l+1] += 2
+	}
+
+	// Assign the longest codewords to the least frequent symbols.
+	j := 0
+	for l := maxCodewordLength; l >= 1; l-- {
+		for c := counts[l]; c > 0; c-- {
+			lens[a[j]&symbolMask] = uint8(l)
+			j++
+		}
+	}
+	return a
+}
+
+type decoder struct {
+	rd rangeDecoder
+	br bitReader
+
+	mainProbs     [numMainProbs]probEntry
+	matchProbs    [numMatchProbs]probEntry
+	lzProbs       [numLZProbs]probEntry
+	deltaProbs    [numDeltaProbs]probEntry
+	lzRepProbs    [numLZReps - 1][numLZRepProbs]probEntry
+	deltaRepProbs [numDeltaReps - 1][numDeltaRepProbs]probEntry
+
+	literalCode     huffmanCode
+	lzOffsetCode    huffmanCode
+	lengthCode      huffmanCode
+	deltaOffsetCode huffmanCode
+	deltaPowerCode  huffmanCode
+
+	lastTargetUsages [65536]int32
+}
+
+var decoderPool = sync.Pool{New: func() interface{} { return new(decoder) }}
+
+func (d *decoder) init(in []byte, size int) {
+	d.rd.init(in)
+	d.br.init(in)
+	d.reset(size)
+}
+
+// reset initializes the adaptive state for a block of the given size.
+func (d *decoder) reset(size int) {
+	initProbs(d.mainProbs[:])
+	initProbs(d.matchProbs[:])
+	initProbs(d.lzProbs[:])
+	initProbs(d.deltaProbs[:])
+	for i := range d.lzRepProbs {
+		initProbs(d.lzRepProbs[i][:])
+	}
+	for i := range d.deltaRepProbs {
+		initProbs(d.deltaRepProbs[i][:])
+	}
+	nslots := numOffsetSlots(size)
+	d.literalCode.init(numLiteralSyms, literalRebuildFreq)
+	d.lzOffsetCode.init(nslots, lzOffsetRebuildFreq)
+	d.lengthCode.init(numLengthSyms, lengthRebuildFreq)
+	d.deltaOffsetCode.init(nslots, deltaOffsetRebuildFreq)
+	d.deltaPowerCode.init(numDeltaPowerSyms, deltaPowerRebuildFreq)
+}
+
+func (d *decoder) decodeOffset(c *huffmanCode) (uint32, error) {
+	slot, err := c.decode(&d.br)
+	if err != nil {
+		return 0, err
+	}
+	return offsetSlotBase[slot] + d.br.readBits(uint(extraOffsetBits[slot])), nil
+}
+
+func (d *decoder) decodeLength() (int, error) {
+	slot, err := d.lengthCode.decode(&d.br)
+	if err != nil {
+		return 0, err
+	}
+	return int(lengthSlotBase[slot] + d.br.readBits(uint(extraLengthBits[slot]))), nil
+}
+
+// decodeRep decodes which of the recent offsets a repeat match uses.
+func (d *decoder) decodeRep(states []uint32, probs [][64]probEntry) int {
+	for i := range states {
+		if d.rd.decodeBit(&states[i], probs[i][:]) == 0 {
+			return i
+		}
+	}
+	return len(states)
+}
+
+func (d *decoder) decompress(out []byte) error {
+	var (
+		// Updates to the queues of recent offsets are delayed by one item. The
+		// queues therefore have an extra entry: when the previous item was a
+		// match of the same kind, its offset is at index 0 but not yet
+		// available for reuse, and the queue starts at index 1.
+		recentLZ    [numLZReps + 1]uint32
+		recentDelta [numDeltaReps + 1]uint64
+		prevItem    int // 0: literal, 1: LZ match, 2: delta match
+
+		mainState, matchState, lzState, deltaState uint32
+		lzRepStates                                [numLZReps - 1]uint32
+		deltaRepStates                             [numDeltaReps - 1]uint32
+	)
+	for i := range recentLZ {
+		recentLZ[i] = uint32(i + 1)
+		recentDelta[i] = uint64(i + 1)
+	}
+
+	pos := 0
+	for pos < len(out) {
+		if d.rd.decodeBit(&mainState, d.mainProbs[:]) == 0 {
+			sym, err := d.literalCode.decode(&d.br)
+			if err != nil {
+				return err
+			}
+			out[pos] = byte(sym)
+			pos++
+			prevItem = 0
+			continue
+		}
+
+		if d.rd.decodeBit(&matchState, d.matchProbs[:]) == 0 {
+			var offset uint32
+			if d.rd.decodeBit(&lzState, d.lzProbs[:]) == 0 {
+				var err error
+				offset, err = d.decodeOffset(&d.lzOffsetCode)
+				if err != nil {
+					return err
+				}
+				copy(recentLZ[1:], recentLZ[:numLZReps])
+			} else {
+				rep := d.decodeRep(lzRepStates[:], d.lzRepProbs[:])
+				i := rep + prevItem&1
+				offset = recentLZ[i]
+				recentLZ[i] = recentLZ[rep]
+				copy(recentLZ[1:rep+1], recentLZ[:rep])
+			}
+			recentLZ[0] = offset
+			prevItem = 1
+
+			length, err := d.decodeLength()
+			if err != nil {
+				return err
+			}
+			if length > len(out)-pos || int64(offset) > int64(pos) {
+				return errCorrupt
+			}
+			src := pos - int(offset)
+			for j := 0; j < length; j++ {
+				out[pos+j] = out[src+j]
+			}
+			pos += length
+			continue
+		}
+
+		var power, rawOffset uint32
+		if d.rd.decodeBit(&deltaState, d.deltaProbs[:]) == 0 {
+			sym, err := d.deltaPowerCode.decode(&d.br)
+			if err != nil {
+				return err
+			}
+			power = uint32(sym)
+			rawOffset, err = d.decodeOffset(&d.deltaOffsetCode)
+			if err != nil {
+				return err
+			}
+			copy(recentDelta[1:], recentDelta[:numDeltaReps])
+		} else {
+			rep := d.decodeRep(deltaRepStates[:], d.deltaRepProbs[:])
+			i := rep + prevItem>>1
+			v := recentDelta[i]
+			recentDelta[i] = recentDelta[rep]
+			copy(recentDelta[1:rep+1], recentDelta[:rep])
+			power = uint32(v >> 32)
+			rawOffset = uint32(v)
+		}
+		recentDelta[0] = uint64(power)<<32 | uint64(rawOffset)
+		prevItem = 2
+
+		length, err := d.decodeLength()
+		if err != nil {
+			return err
+		}
+		if power >= 32 {
+			return errCorrupt
+		}
+		span := int64(1) << power
+		offset := int64(rawOffset) << power
+		if offset+span > int64(pos) || length > len(out)-pos {
+			return errCorrupt
+		}
+		src := pos - int(offset)
+		s := int(span)
+		for j := 0; j < length; j++ {
+			out[pos+j] = out[src+j] + out[pos+j-s] - out[src+j-s]
+		}
+		pos += length
+	}
+
+	x86Filter(out, &d.lastTargetUsages, true)
+	return nil
+}
+
+// Decompress decompresses an LZMS block that expands to exactly
+// uncompressedSize bytes.
+func Decompress(src []byte, uncompressedSize int) ([]byte, error) {
+	if len(src) < 4 || len(src)%2 != 0 {
+		return nil, errCorrupt
+	}
+	if uncompressedSize < 0 {
+		return nil, errors.New("invalid uncompressed size")
+	}
+	out := make([]byte, uncompressedSize)
+	d := decoderPool.Get().(*decoder)
+	d.init(src, uncompressedSize)
+	err := d.decompress(out)
+	d.rd.in, d.br.in = nil, nil
+	decoderPool.Put(d)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// NewReader returns a new io.ReadCloser that decompresses an LZMS block,
+// read in its entirety from r, which expands to uncompressedSize bytes.
+func NewReader(r io.Reader, uncompressedSize int) (io.ReadCloser, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	b, err := Decompress(src, uncompressedSize)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&byteReader{b: b}), nil
+}
+
+type byteReader struct {
+	b []byte
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+// x86Filter translates the targets of likely x86 relative call, jump and load
+// instructions between relative and absolute form, or back if undo is set.
+// Regions that look like x86 code are detected by finding two references to
+// the same target address within a window, comparing only the low 16 bits of
+// each target.
+func x86Filter(data []byte, lastTargetUsages *[65536]int32, undo bool) {
+	if len(data) <= 17 {
+		return
+	}
+	for i := range lastTargetUsages {
+		lastTargetUsages[i] = -x86IDWindowSize - 1
+	}
+	// The filter looks at most 16 bytes ahead and ignores the last 16 bytes.
+	tail := int32(len(data) - 16)
+	lastX86Pos := int32(-x86MaxTranslationOffset - 1)
+
+	// The first byte is never translated.
+	for i := int32(0); ; {
+		i++
+		if i >= tail {
+			break
+		}
+		maxTransOffset := int32(x86MaxTranslationOffset)
+		var opcodeLen int32
+		switch data[i] {
+		case 0x48:
+			if data[i+1] == 0x8b {
+				if data[i+2] == 0x5 || data[i+2] == 0xd {
+					// Load relative (x86-64)
+					opcodeLen = 3
+				}
+			} else if data[i+1] == 0x8d {
+				if data[i+2]&0x7 == 0x5 {
+					// Load effective address relative (x86-64)
+					opcodeLen = 3
+				}
+			}
+		case 0x4c:
+			if data[i+1] == 0x8d && data[i+2]&0x7 == 0x5 {
+				// Load effective address relative (x86-64)
+				opcodeLen = 3
+			}
+		case 0xe8:
+			// Call relative. This is translated only in regions that are
+			// more certainly x86 code.
+			opcodeLen = 1
+			maxTransOffset /= 2
+		case 0xe9:
+			// Jump relative; skip the operand.
+			i += 4
+		case 0xf0:
+			if data[i+1] == 0x83 && data[i+2] == 0x05 {
+				// Lock add relative
+				opcodeLen = 3
+			}
+		case 0xff:
+			if data[i+1] == 0x15 {
+				// Call indirect relative
+				opcodeLen = 2
+			}
+		}
+		if opcodeLen == 0 {
+			continue
+		}
+
+		p := data[i+opcodeLen:]
+		var target16 uint16
+		if undo {
+			if i-lastX86Pos <= maxTransOffset {
+				binary.LittleEndian.PutUint32(p, binary.LittleEndian.Uint32(p)-uint32(i))
+			}
+			target16 = uint16(i) + binary.LittleEndian.Uint16(p)
+		} else {
+			target16 = uint16(i) + binary.LittleEndian.Uint16(p)
+			if i-lastX86Pos <= maxTransOffset {
+				binary.LittleEndian.PutUint32(p, binary.LittleEndian.Uint32(p)+uint32(i))
+			}
+		}
+		i += opcodeLen + 4 - 1
+		if i-lastTargetUsages[target16] <= x86IDWindowSize {
+			lastX86Pos = i
+		}
+		lastTargetUsages[target16] = i
+	}
+}
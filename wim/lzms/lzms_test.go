@@ -0,0 +1,435 @@
+package lzms
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1" //nolint:gosec // not used for secure application
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// rangeEncoder is the inverse of rangeDecoder.
+type rangeEncoder struct {
+	low       uint64
+	rng       uint32
+	cache     uint16
+	cacheSize int
+	started   bool
+	out       []uint16
+}
+
+func (rc *rangeEncoder) shiftLow() {
+	if uint32(rc.low) < 0xffff0000 || rc.low>>32 != 0 {
+		carry := uint16(rc.low >> 32)
+		w := rc.cache
+		for {
+			// The first word only holds a carry that cannot occur.
+			if rc.started {
+				rc.out = append(rc.out, w+carry)
+			}
+			rc.started = true
+			w = 0xffff
+			rc.cacheSize--
+			if rc.cacheSize == 0 {
+				break
+			}
+		}
+		rc.cache = uint16(rc.low >> 16)
+	}
+	rc.cacheSize++
+	rc.low = (rc.low & 0xffff) << 16
+}
+
+func (rc *rangeEncoder) encodeBit(state *uint32, probs []probEntry, bit uint32) {
+	p := &probs[*state]
+	*state = (*state<<1)&uint32(len(probs)-1) | bit
+	prob := p.probability()
+	if rc.rng&0xffff0000 == 0 {
+		rc.rng <<= 16
+		rc.shiftLow()
+	}
+	bound := (rc.rng >> probabilityBits) * prob
+	if bit == 0 {
+		rc.rng = bound
+	} else {
+		rc.low += uint64(bound)
+		rc.rng -= bound
+	}
+	p.update(bit)
+}
+
+func (rc *rangeEncoder) flush() {
+	for i := 0; i < 4; i++ {
+		rc.shiftLow()
+	}
+}
+
+// bitWriter is the inverse of bitReader. Words are stored in the order they
+// are written and must be reversed when placed at the end of the output.
+type bitWriter struct {
+	buf   uint64
+	n     uint
+	words []uint16
+}
+
+func (bw *bitWriter) write(v uint32, n uint) {
+	bw.buf = bw.buf<<n | uint64(v)
+	bw.n += n
+	for bw.n >= 16 {
+		bw.n -= 16
+		bw.words = append(bw.words, uint16(bw.buf>>bw.n))
+	}
+}
+
+func (bw *bitWriter) flush() {
+	if bw.n != 0 {
+		bw.words = append(bw.words, uint16(bw.buf<<(16-bw.n)))
+		bw.n = 0
+	}
+}
+
+// encoder is a simple LZMS compressor that mirrors the decoder's state.
+type encoder struct {
+	rc rangeEncoder
+	bw bitWriter
+	m  decoder
+
+	mainState, matchState, lzState, deltaState uint32
+	lzRepStates                                [numLZReps - 1]uint32
+	deltaRepStates                             [numDeltaReps - 1]uint32
+
+	recentLZ    [numLZReps + 1]uint32
+	recentDelta [numDeltaReps + 1]uint64
+	prevItem    int
+}
+
+func newEncoder(size int) *encoder {
+	e := &encoder{rc: rangeEncoder{rng: 0xffffffff, cacheSize: 1}}
+	e.m.reset(size)
+	for i := range e.recentLZ {
+		e.recentLZ[i] = uint32(i + 1)
+		e.recentDelta[i] = uint64(i + 1)
+	}
+	return e
+}
+
+func (e *encoder) encodeSym(c *huffmanCode, sym int) {
+	var counts, next [maxCodewordLength + 1]uint32
+	for _, l := range c.lens {
+		counts[l]++
+	}
+	counts[0] = 0
+	for l := 2; l <= maxCodewordLength; l++ {
+		next[l] = (next[l-1] + counts[l-1]) << 1
+	}
+	for s := 0; s < sym; s++ {
+		next[c.lens[s]]++
+	}
+	e.bw.write(next[c.lens[sym]], uint(c.lens[sym]))
+	c.used(sym)
+}
+
+func (e *encoder) encodeSlot(c *huffmanCode, v uint32, base []uint32, extra []uint8) {
+	slot := sort.Search(len(extra), func(i int) bool { return base[i+1] > v })
+	e.encodeSym(c, slot)
+	e.bw.write(v-base[slot], uint(extra[slot]))
+}
+
+func (e *encoder) encodeRep(states []uint32, probs [][64]probEntry, rep int) {
+	for i := range states {
+		if i == rep {
+			e.rc.encodeBit(&states[i], probs[i][:], 0)
+			return
+		}
+		e.rc.encodeBit(&states[i], probs[i][:], 1)
+	}
+}
+
+func (e *encoder) literal(b byte) {
+	e.rc.encodeBit(&e.mainState, e.m.mainProbs[:], 0)
+	e.encodeSym(&e.m.literalCode, int(b))
+	e.prevItem = 0
+}
+
+func (e *encoder) lzMatch(offset uint32, length int) {
+	e.rc.encodeBit(&e.mainState, e.m.mainProbs[:], 1)
+	e.rc.encodeBit(&e.matchState, e.m.matchProbs[:], 0)
+	rep := -1
+	for r := 0; r < numLZReps; r++ {
+		if e.recentLZ[r+e.prevItem&1] == offset {
+			rep = r
+			break
+		}
+	}
+	if rep < 0 {
+		e.rc.encodeBit(&e.lzState, e.m.lzProbs[:], 0)
+		e.encodeSlot(&e.m.lzOffsetCode, offset, offsetSlotBase[:], extraOffsetBits[:])
+		copy(e.recentLZ[1:], e.recentLZ[:numLZReps])
+	} else {
+		e.rc.encodeBit(&e.lzState, e.m.lzProbs[:], 1)
+		e.encodeRep(e.lzRepStates[:], e.m.lzRepProbs[:], rep)
+		i := rep + e.prevItem&1
+		e.recentLZ[i] = e.recentLZ[rep]
+		copy(e.recentLZ[1:rep+1], e.recentLZ[:rep])
+	}
+	e.recentLZ[0] = offset
+	e.prevItem = 1
+	e.encodeSlot(&e.m.lengthCode, uint32(length), lengthSlotBase[:], extraLengthBits[:])
+}
+
+func (e *encoder) deltaMatch(power, rawOffset uint32, length int) {
+	e.rc.encodeBit(&e.mainState, e.m.mainProbs[:], 1)
+	e.rc.encodeBit(&e.matchState, e.m.matchProbs[:], 1)
+	pair := uint64(power)<<32 | uint64(rawOffset)
+	rep := -1
+	for r := 0; r < numDeltaReps; r++ {
+		if e.recentDelta[r+e.prevItem>>1] == pair {
+			rep = r
+			break
+		}
+	}
+	if rep < 0 {
+		e.rc.encodeBit(&e.deltaState, e.m.deltaProbs[:], 0)
+		e.encodeSym(&e.m.deltaPowerCode, int(power))
+		e.encodeSlot(&e.m.deltaOffsetCode, rawOffset, offsetSlotBase[:], extraOffsetBits[:])
+		copy(e.recentDelta[1:], e.recentDelta[:numDeltaReps])
+	} else {
+		e.rc.encodeBit(&e.deltaState, e.m.deltaProbs[:], 1)
+		e.encodeRep(e.deltaRepStates[:], e.m.deltaRepProbs[:], rep)
+		i := rep + e.prevItem>>1
+		e.recentDelta[i] = e.recentDelta[rep]
+		copy(e.recentDelta[1:rep+1], e.recentDelta[:rep])
+	}
+	e.recentDelta[0] = pair
+	e.prevItem = 2
+	e.encodeSlot(&e.m.lengthCode, uint32(length), lengthSlotBase[:], extraLengthBits[:])
+}
+
+func (e *encoder) finish() []byte {
+	e.rc.flush()
+	e.bw.flush()
+	var b []byte
+	for _, w := range e.rc.out {
+		b = appendUint16(b, w)
+	}
+	for i := len(e.bw.words) - 1; i >= 0; i-- {
+		b = appendUint16(b, e.bw.words[i])
+	}
+	return b
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func matchLen(data []byte, pos, offset int) int {
+	n := 0
+	for pos+n < len(data) && data[pos+n] == data[pos+n-offset] {
+		n++
+	}
+	return n
+}
+
+func deltaLen(data []byte, pos, offset, span int) int {
+	n := 0
+	for pos+n < len(data) && data[pos+n] == data[pos+n-offset]+data[pos+n-span]-data[pos+n-offset-span] {
+		n++
+	}
+	return n
+}
+
+// compress greedily encodes data with LZ matches, preferring recently used
+// offsets, delta matches, and literals.
+func compress(data []byte) []byte {
+	filtered := append([]byte(nil), data...)
+	var usages [65536]int32
+	x86Filter(filtered, &usages, false)
+
+	e := newEncoder(len(data))
+	for pos := 0; pos < len(filtered); {
+		bestOff, bestLen := 0, 0
+		for _, off := range e.recentLZ {
+			if int(off) <= pos {
+				if n := matchLen(filtered, pos, int(off)); n > bestLen {
+					bestOff, bestLen = int(off), n
+				}
+			}
+		}
+		for off := 1; off <= pos && off <= 4096; off++ {
+			if n := matchLen(filtered, pos, off); n > bestLen+1 {
+				bestOff, bestLen = off, n
+			}
+		}
+		if bestLen >= 3 {
+			e.lzMatch(uint32(bestOff), bestLen)
+			pos += bestLen
+			continue
+		}
+
+		var bestPower, bestRaw uint32
+		for power := uint32(0); power < 3; power++ {
+			for raw := uint32(1); raw <= 8; raw++ {
+				span, off := 1<<power, int(raw)<<power
+				if off+span > pos {
+					continue
+				}
+				if n := deltaLen(filtered, pos, off, span); n > bestLen {
+					bestPower, bestRaw, bestLen = power, raw, n
+				}
+			}
+		}
+		if bestLen >= 4 {
+			e.deltaMatch(bestPower, bestRaw, bestLen)
+			pos += bestLen
+			continue
+		}
+
+		e.literal(filtered[pos])
+		pos++
+	}
+	return e.finish()
+}
+
+func testInputs() map[string][]byte {
+	rng := rand.New(rand.NewSource(1))
+	inputs := make(map[string][]byte)
+
+	words := []string{"the ", "quick ", "brown ", "fox ", "jumps ", "over ", "lazy ", "dog ", "WIM ", "image "}
+	var text []byte
+	for len(text) < 32768 {
+		text = append(text, words[rng.Intn(len(words))]...)
+		if rng.Intn(50) == 0 {
+			text = append(text, bytes.Repeat([]byte{'='}, rng.Intn(400))...)
+		}
+	}
+	inputs["text"] = text[:32768]
+
+	var table []byte
+	for i := 0; len(table) < 20000; i++ {
+		table = appendUint16(table, uint16(i*3))
+		table = appendUint16(table, uint16(1000-i*7))
+	}
+	inputs["delta"] = table
+
+	code := make([]byte, 30000)
+	rng.Read(code)
+	for i := 0; i+5 < len(code); i += 5 + rng.Intn(20) {
+		code[i] = 0xe8
+		binary.LittleEndian.PutUint32(code[i+1:], uint32(0x1000*rng.Intn(8)-i))
+	}
+	inputs["x86"] = code
+
+	random := make([]byte, 32768)
+	rng.Read(random)
+	inputs["random"] = random
+
+	inputs["short"] = []byte("abc")
+	inputs["one"] = []byte{'x'}
+	return inputs
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, data := range testInputs() {
+		t.Run(name, func(t *testing.T) {
+			c := compress(data)
+			b, err := Decompress(c, len(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, data) {
+				t.Fatal("data mismatch")
+			}
+
+			r, err := NewReader(bytes.NewReader(c), len(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if _, err := buf.ReadFrom(r); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Fatal("data mismatch from NewReader")
+			}
+		})
+	}
+}
+
+// TestVectors decompresses chunks compressed by wimlib, which
+// testdata/README.md describes how to generate, and checks their SHA1s.
+func TestVectors(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "vectors.txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		t.Skip("testdata/vectors.txt is not present; see testdata/README.md")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 3 {
+			t.Fatalf("malformed vector %q", sc.Text())
+		}
+		size, err := strconv.Atoi(fields[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := hex.DecodeString(fields[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(fields[0], func(t *testing.T) {
+			src, err := os.ReadFile(filepath.Join("testdata", fields[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := Decompress(src, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sha1.Sum(b); !bytes.Equal(got[:], want) { //nolint:gosec // not used for secure application
+				t.Errorf("SHA1 %x, expected %x", got, want)
+			}
+		})
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestX86Filter(t *testing.T) {
+	data := testInputs()["x86"]
+	b := append([]byte(nil), data...)
+	var usages [65536]int32
+	x86Filter(b, &usages, false)
+	if bytes.Equal(b, data) {
+		t.Fatal("filter did not translate any instructions")
+	}
+	x86Filter(b, &usages, true)
+	if !bytes.Equal(b, data) {
+		t.Fatal("filter did not round trip")
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	if _, err := Decompress([]byte{1, 2, 3}, 10); err == nil {
+		t.Error("expected error for odd-length input")
+	}
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 200; i++ {
+		src := make([]byte, 2*(2+rng.Intn(100)))
+		rng.Read(src)
+		// Errors are expected; the decoder must not panic or overrun.
+		_, _ = Decompress(src, rng.Intn(4096))
+	}
+}
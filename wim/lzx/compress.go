@@ -0,0 +1,454 @@
+package lzx
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	minMatchLen   = 2
+	maxMatchLen   = 257
+	hashBits      = 15
+	maxChainDepth = 32
+)
+
+// Compress compresses src, which may be at most 32KB, as a single verbatim
+// block found with greedy LZ77 parsing. The x86 call translation that the
+// decompressor reverses is applied first. The result may be larger than src,
+// in which case WIM writers store the chunk uncompressed instead.
+func Compress(src []byte) []byte {
+	if len(src) > windowSize {
+		panic("lzx: chunk larger than 32KB")
+	}
+	b := append([]byte(nil), src...)
+	encodeE8(b)
+	e := newEncoder()
+	e.writeBlock(verbatimBlock, parse(b))
+	return e.w.flush()
+}
+
+// parse splits src into literals and matches, finding matches of at least 3
+// bytes with hash chains.
+func parse(src []byte) []lzItem {
+	var head [1 << hashBits]int32
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(src))
+	hash := func(i int) uint32 {
+		v := uint32(src[i]) | uint32(src[i+1])<<8 | uint32(src[i+2])<<16
+		return (v * 0x9e3779b1) >> (32 - hashBits)
+	}
+	insert := func(i int) {
+		if i+3 <= len(src) {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+
+	var items []lzItem
+	for i := 0; i < len(src); {
+		limit := len(src) - i
+		if limit > maxMatchLen {
+			limit = maxMatchLen
+		}
+		bestLen, bestOff := 0, 0
+		if limit >= 3 {
+			cand := head[hash(i)]
+			for depth := 0; cand >= 0 && depth < maxChainDepth; depth++ {
+				n := 0
+				for n < limit && src[int(cand)+n] == src[i+n] {
+					n++
+				}
+				if n > bestLen {
+					bestLen, bestOff = n, i-int(cand)
+					if n == limit {
+						break
+					}
+				}
+				cand = prev[cand]
+			}
+		}
+		if bestLen >= 3 {
+			items = append(items, lzItem{length: bestLen, offset: bestOff})
+			for j := 0; j < bestLen; j++ {
+				insert(i + j)
+			}
+			i += bestLen
+		} else {
+			items = append(items, lzItem{lit: src[i]})
+			insert(i)
+			i++
+		}
+	}
+	return items
+}
+
+// bitWriter writes an LZX bitstream: bits are packed most significant first
+// into 16-bit little-endian words.
+type bitWriter struct {
+	out []byte
+	acc uint32
+	n   uint
+}
+
+// writeBits writes the low n bits of v, where n is at most 16.
+func (w *bitWriter) writeBits(v uint32, n uint) {
+	w.acc = w.acc<<n | v&(1<<n-1)
+	w.n += n
+	if w.n >= 16 {
+		w.n -= 16
+		word := uint16(w.acc >> w.n)
+		w.out = append(w.out, byte(word), byte(word>>8))
+	}
+}
+
+// align pads the bitstream to the next word boundary, writing a whole word of
+// padding if it is already aligned, as uncompressed blocks require.
+func (w *bitWriter) align() {
+	w.writeBits(0, 16-w.n)
+}
+
+func (w *bitWriter) flush() []byte {
+	if w.n > 0 {
+		w.align()
+	}
+	return w.out
+}
+
+// lzItem is a literal, if length is 0, or a match.
+type lzItem struct {
+	lit    byte
+	length int
+	offset int
+}
+
+// huffmanLengths returns the codeword lengths of a Huffman code for freqs of
+// at most maxLen bits. Unused symbols get no codeword, but at least two
+// symbols are given one if any is used, so that the code is complete. If the
+// lengths of an optimal code are too long, the frequencies are flattened and
+// the code rebuilt.
+func huffmanLengths(freqs []int, maxLen byte) []byte {
+	f := append([]int(nil), freqs...)
+	used := 0
+	for _, v := range f {
+		if v != 0 {
+			used++
+		}
+	}
+	if used == 0 {
+		return make([]byte, len(f))
+	}
+	for i := 0; used < 2; i++ {
+		if f[i] == 0 {
+			f[i] = 1
+			used++
+		}
+	}
+	for {
+		lens := buildLengths(f)
+		ok := true
+		for _, l := range lens {
+			if l > maxLen {
+				ok = false
+			}
+		}
+		if ok {
+			return lens
+		}
+		for i, v := range f {
+			if v != 0 {
+				f[i] = v/2 + 1
+			}
+		}
+	}
+}
+
+// buildLengths returns the depths of the leaves of a Huffman tree for the
+// symbols with nonzero frequencies.
+func buildLengths(f []int) []byte {
+	type node struct{ weight, parent int }
+	var leaves []int
+	for sym, v := range f {
+		if v != 0 {
+			leaves = append(leaves, sym)
+		}
+	}
+	sort.SliceStable(leaves, func(i, j int) bool { return f[leaves[i]] < f[leaves[j]] })
+
+	// Leaves are nodes 0..n-1 in order of weight, and internal nodes are
+	// created in order of nondecreasing weight, so two queues suffice.
+	n := len(leaves)
+	nodes := make([]node, n, 2*n-1)
+	for i, sym := range leaves {
+		nodes[i] = node{f[sym], -1}
+	}
+	nextLeaf, nextInternal := 0, n
+	pop := func() int {
+		if nextLeaf < n && (nextInternal >= len(nodes) || nodes[nextLeaf].weight <= nodes[nextInternal].weight) {
+			nextLeaf++
+			return nextLeaf - 1
+		}
+		nextInternal++
+		return nextInternal - 1
+	}
+	for len(nodes) < 2*n-1 {
+		a, b := pop(), pop()
+		nodes = append(nodes, node{nodes[a].weight + nodes[b].weight, -1})
+		nodes[a].parent = len(nodes) - 1
+		nodes[b].parent = len(nodes) - 1
+	}
+
+	depth := make([]byte, len(nodes))
+	for i := len(nodes) - 2; i >= 0; i-- {
+		depth[i] = depth[nodes[i].parent] + 1
+	}
+	lens := make([]byte, len(f))
+	for i, sym := range leaves {
+		lens[sym] = depth[i]
+	}
+	return lens
+}
+
+// canonicalCodes assigns codewords to the symbols with the given lengths in
+// the order the decoder expects: by length, then by symbol.
+func canonicalCodes(lens []byte) []uint32 {
+	codes := make([]uint32, len(lens))
+	code := uint32(0)
+	for l := byte(1); l <= maxTreePathLen; l++ {
+		code <<= 1
+		for sym, sl := range lens {
+			if sl == l {
+				codes[sym] = code
+				code++
+			}
+		}
+	}
+	return codes
+}
+
+type presym struct {
+	sym    int
+	extra  uint32
+	nextra uint
+	delta  int // the delta following a run of the same length, or -1
+}
+
+// writeLengths writes the code lengths lens, which replace prev, preceded by
+// the pretree that encodes them. Runs of zeros and of equal lengths use the
+// run codes.
+func (e *encoder) writeLengths(prev, lens []byte) {
+	delta := func(i int) int { return int((prev[i] + 17 - lens[i]) % 17) }
+	run := func(i int) int {
+		n := 1
+		for i+n < len(lens) && lens[i+n] == lens[i] {
+			n++
+		}
+		return n
+	}
+	var syms []presym
+	for i := 0; i < len(lens); {
+		n := run(i)
+		switch {
+		case lens[i] == 0 && n >= 20:
+			if n > 51 {
+				n = 51
+			}
+			syms = append(syms, presym{18, uint32(n - 20), 5, -1})
+		case lens[i] == 0 && n >= 4:
+			if n > 19 {
+				n = 19
+			}
+			syms = append(syms, presym{17, uint32(n - 4), 4, -1})
+		case n >= 4:
+			if n > 5 {
+				n = 5
+			}
+			d := delta(i)
+			if d == 0 {
+				d = e.sameDelta
+			}
+			syms = append(syms, presym{19, uint32(n - 4), 1, d})
+		default:
+			n = 1
+			syms = append(syms, presym{delta(i), 0, 0, -1})
+		}
+		i += n
+	}
+
+	freqs := make([]int, 20)
+	for _, s := range syms {
+		freqs[s.sym]++
+		if s.delta >= 0 {
+			freqs[s.delta]++
+		}
+	}
+	plens := huffmanLengths(freqs, 15)
+	codes := canonicalCodes(plens)
+	for _, l := range plens {
+		e.w.writeBits(uint32(l), 4)
+	}
+	for _, s := range syms {
+		e.w.writeBits(codes[s.sym], uint(plens[s.sym]))
+		e.w.writeBits(s.extra, s.nextra)
+		if s.delta >= 0 {
+			e.w.writeBits(codes[s.delta], uint(plens[s.delta]))
+		}
+	}
+}
+
+// encodedMatch is a match as it is written: its main and length symbols and
+// its offset bits.
+type encodedMatch struct {
+	main, length int
+	extra        uint32
+	nextra       uint
+}
+
+// encoder holds the state that persists between the blocks of a chunk.
+type encoder struct {
+	w        bitWriter
+	lru      [3]int
+	mainlens [maincodecount]byte
+	lenlens  [lencodecount]byte
+	// sameDelta is the delta written after a run of lengths that do not
+	// change, 0 or 17, which mean the same.
+	sameDelta int
+}
+
+func newEncoder() *encoder {
+	return &encoder{lru: [3]int{1, 1, 1}}
+}
+
+// encodeMatch returns the symbols for a match and updates the recent offsets.
+func (e *encoder) encodeMatch(it lzItem) encodedMatch {
+	var slot int
+	var extra uint32
+	switch it.offset {
+	case e.lru[0]:
+		slot = 0
+	case e.lru[1]:
+		slot = 1
+		e.lru[0], e.lru[1] = e.lru[1], e.lru[0]
+	case e.lru[2]:
+		slot = 2
+		e.lru[0], e.lru[2] = e.lru[2], e.lru[0]
+	default:
+		formatted := it.offset + 2
+		for slot = len(basePosition) - 1; int(basePosition[slot]) > formatted; slot-- {
+		}
+		extra = uint32(formatted - int(basePosition[slot]))
+		e.lru[2], e.lru[1], e.lru[0] = e.lru[1], e.lru[0], it.offset
+	}
+	m := encodedMatch{length: -1, extra: extra, nextra: uint(footerBits[slot])}
+	header := it.length - minMatchLen
+	if header >= 7 {
+		m.length = header - 7
+		header = 7
+	}
+	m.main = maincodesplit + slot*8 + header
+	return m
+}
+
+// writeBlockHeader writes the type and size of a block.
+func (e *encoder) writeBlockHeader(typ, size int) {
+	e.w.writeBits(uint32(typ), 3)
+	if size == maxBlockSize {
+		e.w.writeBits(1, 1)
+	} else {
+		e.w.writeBits(0, 1)
+		e.w.writeBits(uint32(size), 16)
+	}
+}
+
+// writeBlock writes a verbatim or aligned offset block holding items.
+func (e *encoder) writeBlock(typ int, items []lzItem) {
+	size := 0
+	for _, it := range items {
+		if it.length == 0 {
+			size++
+		} else {
+			size += it.length
+		}
+	}
+	e.writeBlockHeader(typ, size)
+
+	// Encode the matches once to count the symbols, then write them.
+	aligned := typ == alignedOffsetBlock
+	lru := e.lru
+	mainFreqs := make([]int, maincodecount)
+	lenFreqs := make([]int, lencodecount)
+	alignedFreqs := make([]int, 8)
+	for _, it := range items {
+		if it.length == 0 {
+			mainFreqs[it.lit]++
+			continue
+		}
+		m := e.encodeMatch(it)
+		mainFreqs[m.main]++
+		if m.length >= 0 {
+			lenFreqs[m.length]++
+		}
+		if aligned && m.nextra >= 3 {
+			alignedFreqs[m.extra&7]++
+		}
+	}
+	e.lru = lru
+
+	mainlens := huffmanLengths(mainFreqs, maxTreePathLen)
+	lenlens := huffmanLengths(lenFreqs, maxTreePathLen)
+	alignedlens := huffmanLengths(alignedFreqs, 7)
+	if aligned {
+		for _, l := range alignedlens {
+			e.w.writeBits(uint32(l), 3)
+		}
+	}
+	e.writeLengths(e.mainlens[:maincodesplit], mainlens[:maincodesplit])
+	e.writeLengths(e.mainlens[maincodesplit:], mainlens[maincodesplit:])
+	e.writeLengths(e.lenlens[:], lenlens)
+	copy(e.mainlens[:], mainlens)
+	copy(e.lenlens[:], lenlens)
+
+	mainCodes := canonicalCodes(mainlens)
+	lenCodes := canonicalCodes(lenlens)
+	alignedCodes := canonicalCodes(alignedlens)
+	for _, it := range items {
+		if it.length == 0 {
+			e.w.writeBits(mainCodes[it.lit], uint(mainlens[it.lit]))
+			continue
+		}
+		m := e.encodeMatch(it)
+		e.w.writeBits(mainCodes[m.main], uint(mainlens[m.main]))
+		if m.length >= 0 {
+			e.w.writeBits(lenCodes[m.length], uint(lenlens[m.length]))
+		}
+		if aligned && m.nextra >= 3 {
+			e.w.writeBits(m.extra>>3, m.nextra-3)
+			sym := m.extra & 7
+			e.w.writeBits(alignedCodes[sym], uint(alignedlens[sym]))
+		} else {
+			e.w.writeBits(m.extra, m.nextra)
+		}
+	}
+}
+
+// encodeE8 applies the x86 call translation that precedes compression, which
+// decodeE8 reverses.
+func encodeE8(b []byte) {
+	for i := 0; i < len(b)-10; i++ {
+		if b[i] != 0xe8 {
+			continue
+		}
+		pos := int32(i)
+		rel := int32(binary.LittleEndian.Uint32(b[i+1:]))
+		if rel >= -pos && rel < e8filesize {
+			abs := rel - e8filesize
+			if rel < e8filesize-pos {
+				abs = rel + pos
+			}
+			binary.LittleEndian.PutUint32(b[i+1:], uint32(abs))
+		}
+		i += 4
+	}
+}
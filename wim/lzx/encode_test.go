@@ -0,0 +1,115 @@
+package lzx
+
+import (
+	"encoding/binary"
+	"math/rand"
+)
+
+// This file extends the encoder used by Compress to write given sequences of
+// literals and matches as verbatim, aligned offset, or uncompressed blocks, so
+// that the decoder can be tested on every block type.
+
+// testBlock is a block to encode: its type and the items producing its
+// output, which for uncompressed blocks must all be literals.
+type testBlock struct {
+	typ   int
+	items []lzItem
+}
+
+// writeTestBlock writes b, which may also be an uncompressed block.
+func (e *encoder) writeTestBlock(b testBlock) {
+	if b.typ != uncompressedBlock {
+		e.writeBlock(b.typ, b.items)
+		return
+	}
+	e.writeBlockHeader(b.typ, len(b.items))
+	e.w.align()
+	var lru [12]byte
+	for i, r := range e.lru {
+		binary.LittleEndian.PutUint32(lru[4*i:], uint32(r))
+	}
+	e.w.out = append(e.w.out, lru[:]...)
+	for _, it := range b.items {
+		e.w.out = append(e.w.out, it.lit)
+	}
+	if len(b.items)%2 != 0 {
+		e.w.out = append(e.w.out, 0)
+	}
+}
+
+// encode returns a chunk holding blocks.
+func encode(blocks []testBlock) []byte {
+	e := newEncoder()
+	// Write an unchanged length in a run as a delta of 17 rather than 0 to
+	// check that the decoder accepts both.
+	e.sameDelta = 17
+	for _, b := range blocks {
+		e.writeTestBlock(b)
+	}
+	return e.w.flush()
+}
+
+// expand returns the output of blocks before the E8 translation is undone.
+func expand(blocks []testBlock) []byte {
+	var out []byte
+	for _, b := range blocks {
+		for _, it := range b.items {
+			if it.length == 0 {
+				out = append(out, it.lit)
+				continue
+			}
+			for i := 0; i < it.length; i++ {
+				out = append(out, out[len(out)-it.offset])
+			}
+		}
+	}
+	return out
+}
+
+// randomBlocks returns blocks of the given types that together produce size
+// bytes, made of literals from a small alphabet that includes 0xe8 and of
+// matches that often reuse recent offsets.
+func randomBlocks(rng *rand.Rand, size int, types ...int) []testBlock {
+	alphabet := []byte{0xe8, 0, 1, 'a', 'b', 'c', 0xff}
+	var blocks []testBlock
+	pos := 0
+	lru := [3]int{1, 1, 1}
+	for i, typ := range types {
+		end := size
+		if i < len(types)-1 {
+			end = pos + (size-pos)/(len(types)-i) + rng.Intn(7) - 3
+		}
+		b := testBlock{typ: typ}
+		for pos < end {
+			n := 2 + rng.Intn(12)
+			if rng.Intn(8) == 0 {
+				n = 2 + rng.Intn(256)
+			}
+			if n > end-pos {
+				n = end - pos
+			}
+			if typ == uncompressedBlock || pos == 0 || n < 2 || rng.Intn(3) == 0 {
+				b.items = append(b.items, lzItem{lit: alphabet[rng.Intn(len(alphabet))]})
+				pos++
+				continue
+			}
+			off := lru[rng.Intn(3)]
+			if rng.Intn(2) == 0 || off > pos {
+				off = 1 + rng.Intn(pos)
+			}
+			switch off {
+			case lru[0]:
+			case lru[1]:
+				lru[0], lru[1] = lru[1], lru[0]
+			case lru[2]:
+				lru[0], lru[2] = lru[2], lru[0]
+			default:
+				lru[2], lru[1], lru[0] = lru[1], lru[0], off
+			}
+			b.items = append(b.items, lzItem{length: n, offset: off})
+			pos += n
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
@@ -1,5 +1,5 @@
-// Package lzx implements a decompressor for the the WIM variant of the
-// LZX compression algorithm.
+// Package lzx implements a compressor and a decompressor for the WIM variant
+// of the LZX compression algorithm.
 //
 // The LZX algorithm is an earlier variant of LZX DELTA, which is documented
 // at https://msdn.microsoft.com/en-us/library/cc483133(v=exchg.80).aspx.
@@ -267,6 +267,9 @@ func (f *decompressor) readTree(lens []byte) error {
 		return f.err
 	}
 	h := buildTable(pretreeLen[:])
+	if h == nil {
+		return errCorrupt
+	}
 
 	// The lengths are encoded as a series of huffman codes
 	// encoded by the pre-tree.
@@ -302,8 +305,10 @@ func (f *decompressor) readTree(lens []byte) error {
 			if i+same > len(lens) {
 				return errCorrupt
 			}
+			// The delta that follows may be 17, which like 0 leaves
+			// the length unchanged.
 			c = byte(f.getCode(h))
-			if c > 16 {
+			if c > 17 {
 				return errCorrupt
 			}
 			l := (lens[i] + 17 - c) % 17
@@ -507,6 +512,9 @@ func (f *decompressor) readBlock(start uint16) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	if int(start)+int(size) > windowSize {
+		return 0, errCorrupt
+	}
 
 	if blockType == uncompressedBlock {
 		if size%2 == 1 {
@@ -588,6 +596,9 @@ func NewReader(r io.Reader, uncompressedSize int) (io.ReadCloser, error) {
 	if uncompressedSize > windowSize {
 		return nil, errors.New("uncompressed size is limited to 32KB")
 	}
+	if uncompressedSize < 0 {
+		return nil, errors.New("invalid uncompressed size")
+	}
 	f := &decompressor{
 		lru:          [3]uint16{1, 1, 1},
 		uncompressed: uncompressedSize,
@@ -596,3 +607,21 @@ func NewReader(r io.Reader, uncompressedSize int) (io.ReadCloser, error) {
 	}
 	return f, nil
 }
+
+// Decompress decompresses a WIM LZX chunk that expands to exactly
+// uncompressedSize bytes, which may be at most 32KB.
+func Decompress(src []byte, uncompressedSize int) ([]byte, error) {
+	d, err := NewReader(bytes.NewReader(src), uncompressedSize)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	b := make([]byte, uncompressedSize)
+	if _, err := io.ReadFull(d, b); err != nil {
+		if err == io.EOF { //nolint:errorlint
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,212 @@
+package lzx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+// uncompressed returns an uncompressed LZX block holding data.
+func uncompressed(data []byte) []byte {
+	// The block type, a clear "full block" bit, and the block size fill the
+	// top 20 bits of two 16-bit words; the rest pad to the word boundary.
+	v := uint32(uncompressedBlock)<<29 | uint32(len(data))<<12
+	out := []byte{byte(v >> 16), byte(v >> 24), byte(v), byte(v >> 8)}
+	var lru [12]byte
+	for i := 0; i < 3; i++ {
+		binary.LittleEndian.PutUint32(lru[4*i:], 1)
+	}
+	out = append(out, lru[:]...)
+	out = append(out, data...)
+	if len(data)%2 != 0 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+func TestDecompressUncompressed(t *testing.T) {
+	data := bytes.Repeat([]byte("uncompressed LZX data. "), 100)
+	// An odd-sized first block makes the second start after a pad byte.
+	src := append(uncompressed(data[:501]), uncompressed(data[501:])...)
+	b, err := Decompress(src, len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Error("data mismatch")
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	data := bytes.Repeat([]byte("abc"), 10000)
+	src := uncompressed(data[:20000])
+	if _, err := Decompress(src[:100], 20000); err == nil {
+		t.Error("expected an error for truncated data")
+	}
+	if _, err := Decompress(append(src, uncompressed(data[20000:])...), len(data)); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := Decompress(append(src, uncompressed(data[:20000])...), windowSize); err == nil {
+		t.Error("expected an error for a block extending past the window")
+	}
+	if _, err := Decompress(src, -1); err == nil {
+		t.Error("expected an error for a negative size")
+	}
+	if _, err := Decompress(src, windowSize+1); err == nil {
+		t.Error("expected an error for an oversized chunk")
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		src := make([]byte, 2+rng.Intn(300))
+		rng.Read(src)
+		// Errors are expected; the decoder must not panic or overrun.
+		_, _ = Decompress(src, rng.Intn(windowSize+1))
+	}
+}
+
+// roundTrip encodes blocks and checks that the chunk decompresses to their
+// output with the x86 call translation reversed.
+func roundTrip(t *testing.T, blocks []testBlock) {
+	t.Helper()
+	want := expand(blocks)
+	b, err := Decompress(encode(blocks), len(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodeE8(b)
+	if !bytes.Equal(b, want) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func TestDecompressBlockTypes(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		types []int
+	}{
+		{"verbatim", []int{verbatimBlock}},
+		{"aligned", []int{alignedOffsetBlock}},
+		{"uncompressed", []int{uncompressedBlock}},
+		{"verbatim then aligned", []int{verbatimBlock, alignedOffsetBlock, verbatimBlock}},
+		// An uncompressed block after a compressed one starts in the middle
+		// of the bitstream, possibly with a word already read ahead.
+		{"compressed then uncompressed", []int{verbatimBlock, uncompressedBlock, alignedOffsetBlock, uncompressedBlock}},
+		{"mixed", []int{alignedOffsetBlock, uncompressedBlock, uncompressedBlock, verbatimBlock, uncompressedBlock, alignedOffsetBlock}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			for i := 0; i < 50; i++ {
+				size := len(tc.types) + rng.Intn(3000)
+				if i == 0 {
+					size = windowSize
+				}
+				roundTrip(t, randomBlocks(rng, size, tc.types...))
+			}
+		})
+	}
+}
+
+func TestDecompressE8(t *testing.T) {
+	data := make([]byte, 64)
+	// A call at offset 16 to absolute address 0x1000, and one at offset 32
+	// that was translated to a negative address.
+	data[16] = 0xe8
+	binary.LittleEndian.PutUint32(data[17:], 0x1000)
+	data[32] = 0xe8
+	binary.LittleEndian.PutUint32(data[33:], uint32(0xfffffff0))
+	// Calls in the last 10 bytes are not translated.
+	data[60] = 0xe8
+	binary.LittleEndian.PutUint32(data[54:], 0x100)
+	data[53] = 0xe8
+	var items []lzItem
+	for _, c := range data {
+		items = append(items, lzItem{lit: c})
+	}
+	b, err := Decompress(encode([]testBlock{{verbatimBlock, items}}), len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(want[17:], 0x1000-16)
+	binary.LittleEndian.PutUint32(want[33:], uint32(e8filesize-16))
+	binary.LittleEndian.PutUint32(want[54:], 0x100-53)
+	if !bytes.Equal(b, want) {
+		t.Errorf("got %x, want %x", b, want)
+	}
+}
+
+func TestDecompressWindowReset(t *testing.T) {
+	// Each chunk is compressed independently with a fresh 32KB window, so a
+	// match cannot reach back into a previous chunk.
+	rng := rand.New(rand.NewSource(2))
+	first := randomBlocks(rng, windowSize, verbatimBlock, alignedOffsetBlock)
+	roundTrip(t, first)
+	second := []testBlock{{verbatimBlock, []lzItem{{lit: 'x'}, {length: 100, offset: 1}}}}
+	roundTrip(t, second)
+	second[0].items[1].offset = 2
+	if _, err := Decompress(encode(second), 101); err == nil {
+		t.Error("expected an error for a match before the start of the chunk")
+	}
+}
+
+func TestCompress(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	random := make([]byte, windowSize)
+	rng.Read(random)
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 800)[:windowSize]
+	// Bytes from a small alphabet holding 0xe8 exercise the x86 call
+	// translation and give calls whose targets are in and out of range.
+	calls := make([]byte, 20000)
+	for i := range calls {
+		calls[i] = []byte{0xe8, 0, 0xff, 'a', 0x10}[rng.Intn(5)]
+	}
+	skewed := make([]byte, windowSize)
+	for i := range skewed {
+		// Very uneven frequencies force codeword lengths to be limited.
+		n := 0
+		for v := rng.Uint32() | rng.Uint32()<<8; v != 0; v &= v - 1 {
+			n++
+		}
+		skewed[i] = byte(n)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		shrink bool // whether the data must compress to less than a tenth
+	}{
+		{"empty", nil, false},
+		{"one byte", []byte{0xe8}, false},
+		{"zeros", make([]byte, windowSize), true},
+		{"text", text, true},
+		{"random", random, false},
+		{"calls", calls, false},
+		{"skewed", skewed, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Compress(tc.data)
+			got, err := Decompress(c, len(tc.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.data) {
+				t.Fatal("data mismatch")
+			}
+			if tc.shrink && len(c) > len(tc.data)/10 {
+				t.Errorf("compressed %d bytes to %d", len(tc.data), len(c))
+			}
+		})
+	}
+	for i := 0; i < 200; i++ {
+		data := make([]byte, rng.Intn(windowSize+1))
+		alphabet := 1 + rng.Intn(256)
+		for j := range data {
+			data[j] = byte(rng.Intn(alphabet))
+		}
+		if got, err := Decompress(Compress(data), len(data)); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes from %d symbols: data mismatch: %v", len(data), alphabet, err)
+		}
+	}
+}
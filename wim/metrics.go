@@ -0,0 +1,49 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics holds counters describing the decompression work done by a Reader.
+// They are only collected if the Reader was opened with Options.CollectMetrics.
+type Metrics struct {
+	// BytesDecompressed is the number of bytes produced by decompressing
+	// chunks. Chunks that are stored uncompressed are not included.
+	BytesDecompressed int64
+	// Chunks is the number of compressed chunks that were decompressed.
+	Chunks int64
+	// DecompressTime is the cumulative wall time spent decompressing chunks,
+	// summed across goroutines.
+	DecompressTime time.Duration
+}
+
+// readerMetrics holds the counters of a Reader. It is updated atomically since
+// resources may be read concurrently.
+type readerMetrics struct {
+	bytes  int64
+	chunks int64
+	nanos  int64
+}
+
+func (m *readerMetrics) add(n int, d time.Duration) {
+	atomic.AddInt64(&m.bytes, int64(n))
+	atomic.AddInt64(&m.chunks, 1)
+	atomic.AddInt64(&m.nanos, int64(d))
+}
+
+// Metrics returns a snapshot of the Reader's decompression counters. If the
+// Reader was not opened with Options.CollectMetrics, it returns the zero value.
+func (r *Reader) Metrics() Metrics {
+	if r.metrics == nil {
+		return Metrics{}
+	}
+	return Metrics{
+		BytesDecompressed: atomic.LoadInt64(&r.metrics.bytes),
+		Chunks:            atomic.LoadInt64(&r.metrics.chunks),
+		DecompressTime:    time.Duration(atomic.LoadInt64(&r.metrics.nanos)),
+	}
+}
@@ -0,0 +1,98 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// OpenMmap is like Open, but it maps the file into memory and reads it through
+// the mapping, which avoids a system call for each read when many files are
+// read in random order. If the file cannot be mapped, for example because it
+// is empty or too large for the address space of a 32-bit process, OpenMmap
+// falls back to reading it as Open does. Close unmaps the file; reads through
+// readers still open after Close fail rather than fault.
+func OpenMmap(name string) (*Reader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	m, err := mapFile(f)
+	if err != nil {
+		return newFileReader(f)
+	}
+	// The mapping remains valid after the file is closed.
+	f.Close()
+	r, err := NewReader(m)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	r.mapping = m
+	return r, nil
+}
+
+// mmapReaderAt is an io.ReaderAt over a read-only mapping of a file.
+type mmapReaderAt struct {
+	m    sync.RWMutex // guards data against being unmapped during a read
+	data []byte
+}
+
+// mapFile maps all of f into memory.
+func mapFile(f *os.File) (*mmapReaderAt, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 || size > maxInt {
+		return nil, errors.New("file size cannot be mapped")
+	}
+	data, err := mmap(f, int(size))
+	if err != nil {
+		return nil, err
+	}
+	return &mmapReaderAt{data: data}, nil
+}
+
+func (m *mmapReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	if m.data == nil {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, m.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Size returns the size of the mapped file.
+func (m *mmapReaderAt) Size() int64 {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	return int64(len(m.data))
+}
+
+// Close unmaps the file. It waits for reads in progress to finish.
+func (m *mmapReaderAt) Close() error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return munmap(data)
+}
@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package wim
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmap maps the first size bytes of f read-only.
+func mmap(f *os.File, size int) ([]byte, error) {
+	b, err := syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	return b, nil
+}
+
+func munmap(b []byte) error {
+	return os.NewSyscallError("munmap", syscall.Munmap(b))
+}
@@ -0,0 +1,114 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestWIM(tb testing.TB, b []byte) string {
+	tb.Helper()
+	p := filepath.Join(tb.TempDir(), "test.wim")
+	if err := os.WriteFile(p, b, 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	return p
+}
+
+func TestOpenMmap(t *testing.T) {
+	p := writeTestWIM(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		testRegular("a", "contents of a"),
+		testRegular("b", strings.Repeat("b", 3*chunkSize)),
+	)}))
+	r, err := OpenMmap(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.mapping == nil {
+		t.Fatal("file was not mapped")
+	}
+	a, err := r.Image[0].OpenFile("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := a.ReadString(); err != nil || s != "contents of a" {
+		t.Fatalf("unexpected contents %q: %v", s, err)
+	}
+	b, err := r.Image[0].OpenFile("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := b.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Reads after Close fail instead of touching the unmapped memory.
+	if _, err := io.ReadAll(rc); err == nil {
+		t.Error("read after Close succeeded")
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	if _, err := OpenMmap(writeTestWIM(t, nil)); err == nil {
+		t.Error("expected an error for an empty file")
+	}
+}
+
+// BenchmarkRandomRead reads small files in random order from a WIM opened with
+// Open and with OpenMmap.
+func BenchmarkRandomRead(b *testing.B) {
+	root := testDir("")
+	for i := 0; i < 2000; i++ {
+		root.children = append(root.children, testRegular(fmt.Sprintf("file%05d.txt", i), strings.Repeat(fmt.Sprint(i%10), 3000+i)))
+	}
+	p := writeTestWIM(b, buildWIM(b, &testImage{name: "small", root: root}))
+
+	for _, open := range []struct {
+		name string
+		fn   func(string) (*Reader, error)
+	}{
+		{"Open", Open},
+		{"OpenMmap", OpenMmap},
+	} {
+		b.Run(open.name, func(b *testing.B) {
+			r, err := open.fn(p)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer r.Close()
+			dir, err := r.Image[0].Open()
+			if err != nil {
+				b.Fatal(err)
+			}
+			files, err := dir.Readdir()
+			if err != nil {
+				b.Fatal(err)
+			}
+			rng := rand.New(rand.NewSource(1))
+			buf := make([]byte, 512)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rc, err := files[rng.Intn(len(files))].Open()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(rc, buf); err != nil {
+					b.Fatal(err)
+				}
+				rc.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import "encoding/binary"
+
+// tagObjectID is the tag of the directory entry tagged item that holds a
+// file's NTFS object ID. WIMGAPI captures object IDs since Windows 8; the item
+// holds the 16-byte object ID, optionally followed by the 48 bytes of extended
+// information (birth volume ID, birth object ID, and domain ID) of a
+// FILE_OBJECTID_BUFFER.
+const tagObjectID = 0x00000001
+
+// ObjectID returns the file's NTFS object ID, formatted as a GUID, and whether
+// its directory entry records one.
+func (f *File) ObjectID() (string, bool) {
+	if len(f.objectID) < 16 {
+		return "", false
+	}
+	b := f.objectID
+	id := guid{
+		Data1: binary.LittleEndian.Uint32(b),
+		Data2: binary.LittleEndian.Uint16(b[4:]),
+		Data3: binary.LittleEndian.Uint16(b[6:]),
+	}
+	copy(id.Data4[:], b[8:16])
+	return id.String(), true
+}
+
+// ObjectIDBuffer returns a copy of the raw object ID item of the file's
+// directory entry, which is laid out as the start of a FILE_OBJECTID_BUFFER,
+// or nil if there is none.
+func (f *File) ObjectIDBuffer() []byte {
+	if len(f.objectID) == 0 {
+		return nil
+	}
+	return append([]byte{}, f.objectID...)
+}
+
+// Reserved returns the directory entry fields that have no known meaning, for
+// tools that need to inspect every byte of an entry. Bytes 0-7 and 8-15 are
+// the two 8-byte fields that follow the subdirectory offset, and bytes 16-19
+// are the 4-byte field that follows the hash. No known version of WIMGAPI or
+// wimlib stores data in them, and both write zeros, so nonzero values
+// (reported by RawDirEntry.NonzeroPadding for the last field) may indicate
+// that the metadata was modified after capture. Object IDs are not stored
+// here but in a tagged item; see File.ObjectID. Reserved returns zeros for a
+// FileHeader that was not read from a WIM.
+func (hdr *FileHeader) Reserved() [20]byte {
+	return hdr.reserved
+}
@@ -0,0 +1,48 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestObjectID(t *testing.T) {
+	id := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	full := append(append([]byte{}, id...), bytes.Repeat([]byte{0xaa}, 48)...)
+	short := testRegular("short", "a")
+	short.slack = taggedItem(tagObjectID, id)
+	long := testRegular("long", "b")
+	long.slack = append(taggedItem(tagExtendedAttributes, make([]byte, 12)), taggedItem(tagObjectID, full)...)
+	none := testRegular("none", "c")
+	none.unused = [2]int64{0x0807060504030201, -1}
+	none.padding = 0xdeadbeef
+
+	r := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("", short, long, none)}))
+	files, err := mustOpenRoot(t, r.Image[0]).Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const want = "03020100-0504-0706-0809-0a0b0c0d0e0f"
+	for _, f := range files[:2] {
+		if s, ok := f.ObjectID(); !ok || s != want {
+			t.Errorf("%s: unexpected object ID %q %v", f.Name, s, ok)
+		}
+	}
+	if b := files[1].ObjectIDBuffer(); !bytes.Equal(b, full) {
+		t.Errorf("unexpected object ID buffer %x", b)
+	}
+	if _, ok := files[2].ObjectID(); ok || files[2].ObjectIDBuffer() != nil {
+		t.Error("unexpected object ID")
+	}
+
+	if res := files[0].Reserved(); res != ([20]byte{}) {
+		t.Errorf("unexpected reserved bytes %x", res)
+	}
+	expected := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xef, 0xbe, 0xad, 0xde}
+	if res := files[2].Reserved(); res != expected {
+		t.Errorf("unexpected reserved bytes %x", res)
+	}
+}
@@ -0,0 +1,75 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OpenFile returns the file or directory at the slash- or backslash-separated
+// path p relative to the image root. The root itself is returned for "" or ".".
+// Names are compared case-insensitively, as on NTFS, unless the Reader was
+// opened with Options.CaseSensitive. If any component does not exist, the
+// returned error satisfies errors.Is(err, os.ErrNotExist); if an intermediate
+// component is not a directory, a ParseError is returned.
+//
+// If the Reader was opened with Options.FollowReparse, junctions in the
+// intermediate components of p whose targets lie within the image are
+// followed. The final component is never followed, so a junction named by p
+// is returned as is.
+func (img *Image) OpenFile(p string) (*File, error) {
+	return img.findByPath(p, 0)
+}
+
+// FindByPath is equivalent to OpenFile.
+func (img *Image) FindByPath(p string) (*File, error) {
+	return img.findByPath(p, 0)
+}
+
+func (img *Image) findByPath(p string, follows int) (*File, error) {
+	if follows > maxReparseFollows {
+		return nil, &ParseError{Oper: "find", Path: p, Err: errReparseLoop}
+	}
+	f, err := img.Open()
+	if err != nil {
+		return nil, err
+	}
+	elems := strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' })
+	for i, name := range elems {
+		if name == "." {
+			continue
+		}
+		if img.wim.opts.FollowReparse {
+			d, err := f.resolveJunction(follows)
+			if err != nil {
+				return nil, err
+			}
+			if d != nil {
+				f = d
+			}
+		}
+		if !f.IsDir() {
+			return nil, &ParseError{Oper: "find", Path: strings.Join(elems[:i], "/"), Err: errors.New("not a directory")}
+		}
+		var next *File
+		err := f.Range(func(c *File) error {
+			if img.wim.opts.namesEqual(c.Name, name) {
+				next = c
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			return nil, &ParseError{Oper: "find", Path: strings.Join(elems[:i+1], "/"), Err: os.ErrNotExist}
+		}
+		f = next
+	}
+	return f, nil
+}
@@ -0,0 +1,56 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestOpenFile(t *testing.T) {
+	b := buildWIM(t, &testImage{name: "test", root: testDir("",
+		testDir("Windows", testDir("System32", testRegular("Config.txt", "config"))),
+		testRegular("file", "data"),
+	)})
+	img := mustNewReader(t, b).Image[0]
+
+	for _, p := range []string{"", ".", "/"} {
+		f, err := img.OpenFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !f.IsDir() || f.Name != "" {
+			t.Errorf("%q: expected the root, got %q", p, f.Name)
+		}
+	}
+	for _, p := range []string{"Windows/System32/Config.txt", `windows\system32\CONFIG.TXT`, "/windows/./system32/config.txt"} {
+		f, err := img.OpenFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name != "Config.txt" {
+			t.Errorf("%q: found %q", p, f.Name)
+		}
+	}
+	if _, err := img.OpenFile("Windows/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("unexpected error for a missing file: %v", err)
+	}
+	var perr *ParseError
+	if _, err := img.OpenFile("file/child"); !errors.As(err, &perr) || errors.Is(err, os.ErrNotExist) {
+		t.Errorf("unexpected error for a non-directory: %v", err)
+	}
+
+	r, err := NewReaderWithOptions(bytes.NewReader(b), &Options{CaseSensitive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Image[0].OpenFile("Windows/System32/Config.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Image[0].OpenFile("windows/system32/config.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("case-insensitive match with CaseSensitive set: %v", err)
+	}
+}
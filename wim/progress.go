@@ -0,0 +1,53 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import "io"
+
+// progressReader calls fn each time the bytes read cross a chunk boundary,
+// and once more when the end of the data is reached.
+type progressReader struct {
+	rc       io.ReadCloser
+	fn       func(read, total int64)
+	read     int64
+	total    int64
+	reported int64 // the count last passed to fn, or -1
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.rc.Read(b)
+	prev := p.read
+	p.read += int64(n)
+	if p.read/chunkSize != prev/chunkSize || (err == io.EOF && p.reported != p.read) { //nolint:errorlint
+		p.reported = p.read
+		p.fn(p.read, p.total)
+	}
+	return n, err
+}
+
+func (p *progressReader) Close() error {
+	return p.rc.Close()
+}
+
+// OpenWithProgress is like Open, but calls fn as the contents are read with
+// the number of bytes read so far and the file's size. It is called each time
+// another 32 KiB has been read and once when the end is reached, rather than
+// on every Read. The returned reader does not support seeking.
+func (f *File) OpenWithProgress(fn func(read, total int64)) (io.ReadCloser, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	return &progressReader{rc: rc, fn: fn, total: f.Size, reported: -1}, nil
+}
+
+// OpenWithProgress is like Open, but calls fn as the contents are read, as
+// File.OpenWithProgress does.
+func (s *Stream) OpenWithProgress(fn func(read, total int64)) (io.ReadCloser, error) {
+	rc, err := s.Open()
+	if err != nil {
+		return nil, err
+	}
+	return &progressReader{rc: rc, fn: fn, total: s.Size, reported: -1}, nil
+}
@@ -0,0 +1,47 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestOpenWithProgress(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 2*chunkSize+100)
+	// Reads of 1000 bytes cross the first chunk boundary at 33000, and the
+	// second one in the final read.
+	f := mustOpenRoot(t, mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		testRegular("file", string(data)),
+	)})).Image[0])
+	files, err := f.Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls [][2]int64
+	rc, err := files[0].OpenWithProgress(func(read, total int64) {
+		calls = append(calls, [2]int64{read, total})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	buf := make([]byte, 1000)
+	if _, err := io.CopyBuffer(struct{ io.Writer }{io.Discard}, struct{ io.Reader }{rc}, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	total := int64(len(data))
+	expected := [][2]int64{{33000, total}, {total, total}}
+	if len(calls) != len(expected) {
+		t.Fatalf("got calls %v, expected %v", calls, expected)
+	}
+	for i := range calls {
+		if calls[i] != expected[i] {
+			t.Errorf("call %d: got %v, expected %v", i, calls[i], expected[i])
+		}
+	}
+}
@@ -0,0 +1,169 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// RawDirEntry describes a directory entry together with the on-disk fields
+// that File interprets on the caller's behalf.
+type RawDirEntry struct {
+	*File
+
+	// SecurityID is the index of the entry's security descriptor in the image's
+	// security table, or 0xffffffff if it has none.
+	SecurityID uint32
+
+	// SubdirOffset is the offset of the entry's children within the image's
+	// metadata resource, or 0 if it is not a directory.
+	SubdirOffset int64
+
+	// ReparseHardLink is the raw value of the overloaded 8-byte field that
+	// holds either a hard link ID or a reparse tag. For reparse points, the low
+	// 32 bits are the reparse tag and the high 32 bits are the reparse
+	// reserved field; otherwise the whole value is the hard link ID. The
+	// decoded values are available as File.LinkID, File.ReparseTag, and
+	// File.ReparseReserved, only one of which is set depending on whether
+	// IsReparsePoint is true.
+	ReparseHardLink uint64
+
+	// IsReparsePoint reports whether the entry has FILE_ATTRIBUTE_REPARSE_POINT
+	// set, which determines how ReparseHardLink is interpreted.
+	IsReparsePoint bool
+
+	// NonzeroPadding reports whether the entry's reserved padding field, the
+	// short name terminator, or the alignment bytes following its names were
+	// not zero. Well-formed WIMs always zero them, so this may indicate that
+	// the metadata was modified after capture.
+	NonzeroPadding bool
+
+	// HasSlack reports whether the entry's length is larger than needed for its
+	// fields and names rounded up to an 8-byte boundary. The excess may hold
+	// tagged items, such as object IDs or extended attributes, or hidden data.
+	HasSlack bool
+}
+
+// ReaddirRaw reads the directory entries along with their raw on-disk fields.
+func (f *File) ReaddirRaw() ([]*RawDirEntry, error) {
+	if !f.IsDir() {
+		return nil, errors.New("not a directory")
+	}
+
+	var entries []*RawDirEntry
+	err := f.img.readdirFunc(f.subdirOffset, func(e *File, dentry *rawDirent) error {
+		nonzero, slack := dentry.inspectPadding()
+		entries = append(entries, &RawDirEntry{
+			File:            e,
+			SecurityID:      dentry.SecurityID,
+			SubdirOffset:    dentry.SubdirOffset,
+			ReparseHardLink: uint64(dentry.ReparseHardLink),
+			IsReparsePoint:  dentry.Attributes&FILE_ATTRIBUTE_REPARSE_POINT != 0,
+			NonzeroPadding:  nonzero,
+			HasSlack:        slack,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// inspectPadding reports whether the padding within the entry is nonzero and
+// whether the entry has slack beyond its 8-byte aligned fields and names.
+func (d *rawDirent) inspectPadding() (nonzero, slack bool) {
+	needed := d.neededLength()
+	extra := d.extra.Bytes()
+	pad := d.padLength()
+	nonzero = d.Padding != 0
+	for _, b := range extra[:pad] {
+		if b != 0 {
+			nonzero = true
+		}
+	}
+	return nonzero, d.Length > needed
+}
+
+// neededLength returns the length of the entry's fixed fields and names,
+// rounded up to 8 bytes. Any bytes beyond this hold tagged items.
+func (d *rawDirent) neededLength() int64 {
+	needed := direntrySize
+	if d.FileNameLength > 0 || d.terminatedEmptyName {
+		needed += int64(d.FileNameLength) + 2
+	}
+	if d.ShortNameLength > 0 {
+		needed += int64(d.ShortNameLength) + 2
+	}
+	return (needed + 7) &^ 7
+}
+
+// padLength returns the number of bytes at the start of d.extra that precede
+// the first tagged item.
+func (d *rawDirent) padLength() int64 {
+	// The extra bytes start after the names read by readNextEntry.
+	start := direntrySize + d.nameBytes
+	pad := d.neededLength() - start
+	if pad < 0 {
+		pad = 0
+	}
+	if n := int64(d.extra.Len()); pad > n {
+		pad = n
+	}
+	return pad
+}
+
+// taggedItem returns a copy of the data of the first tagged item with the
+// given tag in the extra bytes of the entry, or nil if there is none. Each
+// item is a 4-byte tag and a 4-byte length followed by its data, padded to 8
+// bytes. Scanning stops at the first item that does not fit in the entry.
+func (d *rawDirent) taggedItem(tag uint32) []byte {
+	b := d.extra.Bytes()[d.padLength():]
+	for len(b) >= 8 {
+		t := binary.LittleEndian.Uint32(b)
+		n := uint64(binary.LittleEndian.Uint32(b[4:]))
+		if n > uint64(len(b)-8) {
+			return nil
+		}
+		if t == tag {
+			return append([]byte{}, b[8:8+n]...)
+		}
+		n = (8 + n + 7) &^ 7
+		if n > uint64(len(b)) {
+			return nil
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// rawResourceReader returns a reader for the on-disk bytes of the resource
+// described by hdr, along with their length and the compression they use.
+func (r *Reader) rawResourceReader(hdr *resourceDescriptor) (io.ReadCloser, int64, CompressionKind, error) {
+	if err := hdr.checkReadable(); err != nil {
+		return nil, 0, CompressionNone, err
+	}
+	kind := r.compression(hdr)
+	size := hdr.CompressedSize()
+	return newSectionReadCloser(io.NewSectionReader(r.r, hdr.Offset, size)), size, kind, nil
+}
+
+// OpenRaw returns a reader for the file's data exactly as it is stored in the
+// WIM, without decompressing it, together with the number of bytes it yields,
+// which is CompressedSize, and the compression used, which is CompressionNone
+// if the data is stored uncompressed. Compressed data starts with the chunk
+// table and can be copied unchanged into another WIM that uses the same
+// compression and chunk size; its uncompressed size is Size.
+//
+// Options.VerifyHashes does not apply to the returned reader.
+func (f *File) OpenRaw() (io.ReadCloser, int64, CompressionKind, error) {
+	return f.src.rawResourceReader(&f.offset)
+}
+
+// OpenRaw is like File.OpenRaw, for the stream's data.
+func (s *Stream) OpenRaw() (io.ReadCloser, int64, CompressionKind, error) {
+	return s.wim.rawResourceReader(&s.offset)
+}
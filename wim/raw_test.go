@@ -0,0 +1,127 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestReaddirRaw(t *testing.T) {
+	link := testRegular("link", "data")
+	link.linkID = 0x1234
+	rp := testRegular("reparse", "reparse data")
+	rp.attr |= FILE_ATTRIBUTE_REPARSE_POINT
+	rp.reparseTag = 0xa000000c
+
+	r := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("", link, rp)}))
+	entries, err := mustOpenRoot(t, r.Image[0]).ReaddirRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+
+	e := entries[0]
+	if e.IsReparsePoint || e.ReparseHardLink != 0x1234 || e.LinkID != 0x1234 || e.ReparseTag != 0 {
+		t.Errorf("unexpected hard link entry %+v", e)
+	}
+	e = entries[1]
+	if !e.IsReparsePoint || e.ReparseHardLink != 0xa000000c || e.LinkID != 0 || e.ReparseTag != 0xa000000c {
+		t.Errorf("unexpected reparse point entry %+v", e)
+	}
+	if e.SecurityID != 0xffffffff {
+		t.Errorf("unexpected security ID %#x", e.SecurityID)
+	}
+}
+
+func TestReaddirRawPadding(t *testing.T) {
+	plain := testRegular("plain", "a")
+	plain.shortName = "PLAIN~1"
+	padded := testRegular("padded", "b")
+	padded.padding = 1
+	slack := testRegular("slack", "c")
+	slack.slack = []byte("hidden")
+
+	r := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("", plain, padded, slack)}))
+	entries, err := mustOpenRoot(t, r.Image[0]).ReaddirRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []struct{ nonzero, slack bool }{{false, false}, {true, false}, {false, true}} {
+		e := entries[i]
+		if e.NonzeroPadding != expected.nonzero || e.HasSlack != expected.slack {
+			t.Errorf("%s: NonzeroPadding %t, HasSlack %t", e.Name, e.NonzeroPadding, e.HasSlack)
+		}
+	}
+}
+
+func TestOpenRaw(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 2*chunkSize)
+	small := testRegular("small", "not compressible")
+	small.streams = []testStream{{name: "ads", data: bytes.Repeat([]byte("s"), chunkSize+1)}}
+	b := buildCompressedWIM(t, hdrFlagCompressLzx, repeatCompress, &testImage{name: "test", root: testDir("",
+		testRegular("big", string(data)),
+		small,
+	)})
+	r, err := NewReaderWithOptions(bytes.NewReader(b), new(Options).WithDecompressor(CompressionLZX, repeatDecompressor{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := mustOpenRoot(t, r.Image[0]).Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		open     func() (io.ReadCloser, int64, CompressionKind, error)
+		original []byte
+		size     int64
+	}{
+		{"big", files[0].OpenRaw, data, files[0].CompressedSize()},
+		{"small", files[1].OpenRaw, []byte("not compressible"), files[1].CompressedSize()},
+		{"stream", files[1].Streams[0].OpenRaw, small.streams[0].data, files[1].Streams[0].offset.CompressedSize()},
+	} {
+		rc, size, kind, err := tc.open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != tc.size || int64(len(raw)) != size {
+			t.Errorf("%s: got %d bytes and size %d, expected %d", tc.name, len(raw), size, tc.size)
+		}
+		if kind != CompressionLZX {
+			t.Errorf("%s: unexpected compression %s", tc.name, kind)
+		}
+		section := io.NewSectionReader(bytes.NewReader(raw), 0, size)
+		cr, err := newCompressedReader(section, repeatDecompressor{}, nil, chunkSize, int64(len(tc.original)), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := io.ReadAll(cr); err != nil || !bytes.Equal(got, tc.original) {
+			t.Errorf("%s: raw data does not decompress to the original: %v", tc.name, err)
+		}
+	}
+
+	plain := mustOpenRoot(t, mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("", testRegular("f", "plain"))})).Image[0])
+	files, err = plain.Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, size, kind, err := files[0].OpenRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if got, err := io.ReadAll(rc); err != nil || string(got) != "plain" || size != 5 || kind != CompressionNone {
+		t.Errorf("unexpected uncompressed raw data %q, size %d, compression %s: %v", got, size, kind, err)
+	}
+}
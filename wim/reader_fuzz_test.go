@@ -0,0 +1,81 @@
+//go:build go1.18 && (windows || linux)
+// +build go1.18
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"runtime"
+	"testing"
+
+	"github.com/Microsoft/go-winio/wim/xpress"
+)
+
+// checkAllocs fails t if fn allocates more than 64MB, which would let a small
+// malformed WIM exhaust memory.
+func checkAllocs(t *testing.T, n int, fn func()) {
+	t.Helper()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+	if a := after.TotalAlloc - before.TotalAlloc; a > 64<<20 {
+		t.Fatalf("parsing %d bytes allocated %d bytes", n, a)
+	}
+}
+
+// FuzzNewReader parses random WIM files, which must fail with an error rather
+// than panic or allocate excessively.
+func FuzzNewReader(f *testing.F) {
+	root := testDir("", testRegular("file", "contents"), testDir("dir", testRegular("inner", "inner")))
+	f.Add(buildWIM(f, &testImage{name: "test", root: root}))
+	f.Add(buildCompressedWIM(f, hdrFlagCompressXpress, xpress.Compress, &testImage{name: "test", root: root}))
+	// A directory whose subdirectory offset is negative as an int64.
+	neg := buildWIM(f, &testImage{name: "test", root: root})
+	binary.LittleEndian.PutUint64(neg[bytes.Index(neg, utf16Bytes("dir"))-int(direntrySize)+16:], 1<<63)
+	f.Add(neg)
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		checkAllocs(t, len(b), func() {
+			r, err := NewReader(bytes.NewReader(b))
+			if err != nil {
+				return
+			}
+			for _, img := range r.Image {
+				_ = readTree(img, 4)
+			}
+		})
+	})
+}
+
+// FuzzReadXML parses WIMs whose XML data resource holds random bytes, of
+// random declared size.
+func FuzzReadXML(f *testing.F) {
+	f.Add([]byte("\xff\xfe<\x00W\x00I\x00M\x00>\x00<\x00/\x00W\x00I\x00M\x00>\x00"), int64(-1))
+	f.Add([]byte{}, int64(0))
+	f.Add([]byte{0xff}, int64(1))
+	f.Add([]byte{0xff, 0xfe}, int64(1)<<40)
+
+	f.Fuzz(func(t *testing.T, data []byte, size int64) {
+		b := buildWIM(t, &testImage{name: "test", root: testDir("")})
+		// Replace the XML data, which is at the end of the file, and its
+		// descriptor in the header.
+		var hdr wimHeader
+		if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+			t.Fatal(err)
+		}
+		b = append(b[:hdr.XMLData.Offset], data...)
+		if size < 0 {
+			size = int64(len(data))
+		}
+		rd := resourceDescriptor{FlagsAndCompressedSize: uint64(len(data)), Offset: hdr.XMLData.Offset, OriginalSize: size}
+		var desc bytes.Buffer
+		_ = binary.Write(&desc, binary.LittleEndian, &rd)
+		copy(b[72:], desc.Bytes()) // the offset of XMLData in the header
+		checkAllocs(t, len(data), func() {
+			_, _ = NewReader(bytes.NewReader(b))
+		})
+	})
+}
@@ -0,0 +1,75 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// RecompressAlgo identifies the compression format produced by
+// File.OpenRecompressed.
+type RecompressAlgo int
+
+const (
+	// RecompressGzip produces a gzip (RFC 1952) stream.
+	RecompressGzip RecompressAlgo = iota
+)
+
+func (a RecompressAlgo) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch a {
+	case RecompressGzip:
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unknown recompression algorithm %d", a)
+	}
+}
+
+// OpenRecompressed returns an io.ReadCloser that yields the file's contents
+// compressed with algo. The WIM resource is decompressed and recompressed on
+// the fly, so the uncompressed contents are never held in memory in full.
+//
+// Closing the returned reader stops the compression and releases the
+// underlying file reader.
+func (f *File) OpenRecompressed(algo RecompressAlgo) (io.ReadCloser, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	w, err := algo.newWriter(pw)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	rr := &recompressReader{pr: pr, done: make(chan struct{})}
+	go func() {
+		defer close(rr.done)
+		_, err := io.Copy(w, r)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		r.Close()
+		pw.CloseWithError(err)
+	}()
+	return rr, nil
+}
+
+type recompressReader struct {
+	pr   *io.PipeReader
+	done chan struct{}
+}
+
+func (r *recompressReader) Read(b []byte) (int, error) {
+	return r.pr.Read(b)
+}
+
+// Close closes the pipe and waits for the compressing goroutine to exit.
+func (r *recompressReader) Close() error {
+	err := r.pr.Close()
+	<-r.done
+	return err
+}
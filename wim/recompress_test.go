@@ -0,0 +1,114 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestOpenRecompressed(t *testing.T) {
+	data := bytes.Repeat([]byte("recompressed file contents. "), 1000)
+	r := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("", testRegular("file", string(data)))}))
+	f, err := r.Image[0].OpenFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := f.OpenRecompressed(RecompressGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Error("data mismatch")
+	}
+	if err := zr.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := f.OpenRecompressed(RecompressAlgo(-1)); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+}
+
+func TestOpenRecompressedClose(t *testing.T) {
+	// Random data does not compress, so the output is too large to have been
+	// produced in full before it is read.
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	r := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("", testRegular("file", string(data)))}))
+	f, err := r.Image[0].OpenFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := f.OpenRecompressed(RecompressGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(rc, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Close waits for the compressing goroutine, which has therefore exited.
+	select {
+	case <-rc.(*recompressReader).done:
+	default:
+		t.Fatal("compressing goroutine still running after Close")
+	}
+}
+
+// failingReaderAt fails reads that overlap [from, to) once failing is set.
+type failingReaderAt struct {
+	r        *bytes.Reader
+	from, to int64
+	failing  bool
+}
+
+func (f *failingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if f.failing && off < f.to && off+int64(len(b)) > f.from {
+		return 0, errBoom
+	}
+	return f.r.ReadAt(b, off)
+}
+
+func TestOpenRecompressedReadError(t *testing.T) {
+	data := bytes.Repeat([]byte("recompressed file contents. "), 1000)
+	b := buildWIM(t, &testImage{name: "test", root: testDir("", testRegular("file", string(data)))})
+	ra := &failingReaderAt{r: bytes.NewReader(b)}
+	r, err := NewReader(ra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := r.Image[0].OpenFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra.from, ra.to, ra.failing = f.offset.Offset, f.offset.Offset+f.offset.CompressedSize(), true
+
+	rc, err := f.OpenRecompressed(RecompressGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(rc); !errors.Is(err, errBoom) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,249 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	reparseTagMountPoint = 0xA0000003
+	reparseTagSymlink    = 0xA000000C
+
+	symlinkFlagRelative = 1
+
+	// reparseFlagNotFixed is set in the high 16 bits of a reparse point's
+	// ReparseReserved field when RP_FIX was in effect at capture but the
+	// link's target was left unchanged because it did not point into the
+	// captured tree.
+	reparseFlagNotFixed = 1
+
+	// maxReparseDataSize is the largest reparse buffer NTFS allows.
+	maxReparseDataSize = 16 * 1024
+
+	// maxReparseFollows bounds the number of junctions followed while
+	// resolving a single path, as Windows does for symbolic links.
+	maxReparseFollows = 63
+)
+
+// errReparseLoop is returned by OpenFile when resolving a path requires
+// following too many junctions.
+var errReparseLoop = errors.New("too many levels of junctions")
+
+// ReparsePoint describes the reparse data of a file.
+type ReparsePoint struct {
+	// Tag is the reparse tag, such as 0xA000000C for a symbolic link.
+	Tag uint32
+	// SubstituteName and PrintName are the target of a symbolic link or
+	// junction, as an NT path and in a form suitable for display. They are
+	// empty for other tags.
+	SubstituteName string
+	PrintName      string
+	// IsRelative reports whether a symbolic link's target is relative to the
+	// directory containing the link.
+	IsRelative bool
+	// Fixed reports whether SubstituteName was rewritten at capture because
+	// the WIM was captured with reparse point fixups (see
+	// Reader.ReparseFixup). RestoreTarget reverses the rewrite.
+	Fixed bool
+	// WOF describes the backing of a file with the tag IO_REPARSE_TAG_WOF,
+	// and is nil for other tags.
+	WOF *WOFInfo
+	// Data holds the reparse buffer as stored in the WIM, which omits the
+	// 8-byte REPARSE_DATA_BUFFER header.
+	Data []byte
+}
+
+// IsSymlink reports whether rp is a symbolic link.
+func (rp *ReparsePoint) IsSymlink() bool {
+	return rp.Tag == reparseTagSymlink
+}
+
+// IsMountPoint reports whether rp is a junction or volume mount point.
+func (rp *ReparsePoint) IsMountPoint() bool {
+	return rp.Tag == reparseTagMountPoint
+}
+
+// ReparseFixup reports whether the WIM was captured with reparse point fixups
+// (the RP_FIX header flag), in which case the absolute targets of symbolic
+// links and junctions that pointed into the captured directory tree were
+// rewritten to be relative to the root of the tree. ReparsePoint.Fixed
+// reports which links were rewritten.
+func (r *Reader) ReparseFixup() bool {
+	return r.hdr.Flags&hdrFlagRpFix != 0
+}
+
+// RestoreTarget returns the substitute name that a fixed link should have when
+// the image is applied to the directory root, such as D:\apply. For links
+// that were not fixed, SubstituteName is returned unchanged.
+//
+// A fixed link's substitute name keeps the NT prefix and drive letter of its
+// original target, such as \??\C:, but the path of the captured directory is
+// removed from what follows: a link to C:\capture\Windows\notepad.exe captured
+// from C:\capture is stored as \??\C:\Windows\notepad.exe. RestoreTarget
+// replaces the prefix and drive letter with root, giving
+// \??\D:\apply\Windows\notepad.exe. Print names are not rewritten at capture.
+func (rp *ReparsePoint) RestoreTarget(root string) string {
+	if !rp.Fixed {
+		return rp.SubstituteName
+	}
+	p, ok := junctionPath(rp.SubstituteName)
+	if !ok {
+		return rp.SubstituteName
+	}
+	root = strings.TrimRight(root, `\`)
+	if !strings.HasPrefix(root, `\??\`) && !strings.HasPrefix(root, `\\?\`) {
+		root = `\??\` + root
+	}
+	if p == "" {
+		return root + `\`
+	}
+	return root + `\` + strings.ReplaceAll(p, "/", `\`)
+}
+
+// decodeReparsePoint parses the reparse buffer b of a file with the given tag.
+// The names are only decoded for symbolic links and mount points, and the
+// backing only for WOF-backed files.
+func decodeReparsePoint(tag uint32, b []byte) (*ReparsePoint, error) {
+	rp := &ReparsePoint{Tag: tag, Data: b}
+	header := 8
+	switch tag {
+	case reparseTagMountPoint:
+	case reparseTagSymlink:
+		header = 12
+	case reparseTagWOF:
+		var err error
+		rp.WOF, err = decodeWOF(b)
+		if err != nil {
+			return nil, err
+		}
+		return rp, nil
+	default:
+		return rp, nil
+	}
+	if len(b) < header {
+		return nil, errors.New("reparse buffer too short")
+	}
+	if tag == reparseTagSymlink {
+		rp.IsRelative = binary.LittleEndian.Uint32(b[8:])&symlinkFlagRelative != 0
+	}
+	names := b[header:]
+	var err error
+	rp.SubstituteName, err = decodeReparseName(names, binary.LittleEndian.Uint16(b[0:]), binary.LittleEndian.Uint16(b[2:]))
+	if err != nil {
+		return nil, err
+	}
+	rp.PrintName, err = decodeReparseName(names, binary.LittleEndian.Uint16(b[4:]), binary.LittleEndian.Uint16(b[6:]))
+	if err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+func decodeReparseName(b []byte, off, n uint16) (string, error) {
+	if off%2 != 0 || n%2 != 0 || int(off)+int(n) > len(b) {
+		return "", errors.New("invalid reparse point name")
+	}
+	u := make([]uint16, n/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[int(off)+i*2:])
+	}
+	return string(utf16.Decode(u)), nil
+}
+
+// ReparseData reads the reparse data of f verbatim, without parsing it. As in
+// ReparsePoint.Data, the 8-byte REPARSE_DATA_BUFFER header is omitted, since
+// the WIM stores the tag in the directory entry as ReparseTag. It returns an
+// error if f is not a reparse point.
+func (f *File) ReparseData() ([]byte, error) {
+	if !f.IsReparsePoint() {
+		return nil, &ParseError{Oper: "reparse point", Path: f.Name, Err: errors.New("not a reparse point")}
+	}
+	if f.Size > maxReparseDataSize {
+		return nil, &ParseError{Oper: "reparse point", Path: f.Name, Err: errors.New("reparse buffer too large")}
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// ReparsePoint reads and parses the reparse data of f. The substitute and
+// print names are decoded for symbolic links and junctions; for other tags
+// only Tag and Data are set. If the WIM was captured with reparse point
+// fixups, Fixed is set for absolute links whose targets were rewritten.
+func (f *File) ReparsePoint() (*ReparsePoint, error) {
+	b, err := f.ReparseData()
+	if err != nil {
+		return nil, err
+	}
+	rp, err := decodeReparsePoint(f.ReparseTag, b)
+	if err != nil {
+		return nil, &ParseError{Oper: "reparse point", Path: f.Name, Err: err}
+	}
+	if (rp.IsSymlink() || rp.IsMountPoint()) && !rp.IsRelative && f.img.wim.ReparseFixup() {
+		rp.Fixed = (f.ReparseReserved>>16)&reparseFlagNotFixed == 0
+	}
+	return rp, nil
+}
+
+// junctionPath converts the substitute name of a junction to a slash-separated
+// path relative to the image root. Junction targets are absolute NT paths such
+// as \??\C:\Windows; the NT prefix and drive letter are removed so that the
+// target is interpreted relative to the root of the captured volume. Targets
+// that do not name a drive letter path, such as volume GUID paths, are not
+// considered to be inside the image.
+func junctionPath(target string) (string, bool) {
+	for _, prefix := range []string{`\??\`, `\\?\`} {
+		target = strings.TrimPrefix(target, prefix)
+	}
+	if len(target) >= 2 && target[1] == ':' {
+		target = target[2:]
+	}
+	if !strings.HasPrefix(target, `\`) {
+		return "", false
+	}
+	return strings.Trim(strings.ReplaceAll(target, `\`, "/"), "/"), true
+}
+
+// isJunction returns whether f is a directory junction.
+func (f *File) isJunction() bool {
+	return f.Attributes&(FILE_ATTRIBUTE_DIRECTORY|FILE_ATTRIBUTE_REPARSE_POINT) ==
+		FILE_ATTRIBUTE_DIRECTORY|FILE_ATTRIBUTE_REPARSE_POINT && f.ReparseTag == reparseTagMountPoint
+}
+
+// resolveJunction returns the directory within the image that the junction f
+// points to. It returns nil if f is not a junction or its target does not
+// resolve to a directory in the image.
+func (f *File) resolveJunction(follows int) (*File, error) {
+	if !f.isJunction() || f.Size > maxReparseDataSize {
+		return nil, nil
+	}
+	rp, err := f.ReparsePoint()
+	if err != nil {
+		return nil, err
+	}
+	p, ok := junctionPath(rp.SubstituteName)
+	if !ok {
+		return nil, nil
+	}
+	d, err := f.img.findByPath(p, follows+1)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !d.IsDir() {
+		return nil, nil
+	}
+	return d, nil
+}
@@ -0,0 +1,260 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// testJunction returns a directory junction pointing at target.
+func testJunction(name, target string) *testFile {
+	sub := utf16Bytes(target)
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.LittleEndian, []uint16{0, uint16(len(sub)), uint16(len(sub) + 2), 0})
+	b.Write(sub)
+	b.Write([]byte{0, 0, 0, 0})
+	return &testFile{
+		name:       name,
+		attr:       FILE_ATTRIBUTE_DIRECTORY | FILE_ATTRIBUTE_REPARSE_POINT,
+		data:       b.Bytes(),
+		securityID: 0xffffffff,
+		reparseTag: reparseTagMountPoint,
+	}
+}
+
+func testJunctionWIM(t *testing.T) []byte {
+	t.Helper()
+
+	return buildWIM(t, &testImage{name: "test", root: testDir("",
+		testJunction("link", `\??\C:\target`),
+		testJunction("loop", `\??\C:\`),
+		testDir("target", testRegular("inner.txt", "inner")),
+		testJunction("volume", `\??\Volume{00000000-0000-0000-0000-000000000000}\`),
+	)})
+}
+
+func TestFindByPath(t *testing.T) {
+	img := mustNewReader(t, testJunctionWIM(t)).Image[0]
+
+	f, err := img.FindByPath(`TARGET\Inner.txt`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := f.ReadString(); err != nil || s != "inner" {
+		t.Fatalf("unexpected contents %q: %v", s, err)
+	}
+	if f, err := img.FindByPath("link"); err != nil || !f.isJunction() {
+		t.Fatalf("expected the junction itself: %v", err)
+	}
+	if _, err := img.FindByPath("link/inner.txt"); err == nil {
+		t.Fatal("junction was followed without FollowReparse")
+	}
+	if _, err := img.FindByPath("target/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestFollowReparse(t *testing.T) {
+	r, err := NewReaderWithOptions(bytes.NewReader(testJunctionWIM(t)), &Options{FollowReparse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := r.Image[0]
+
+	for _, p := range []string{"link/inner.txt", "loop/loop/link/inner.txt"} {
+		f, err := img.FindByPath(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name != "inner.txt" {
+			t.Errorf("%s: found %s", p, f.Name)
+		}
+	}
+	if _, err := img.FindByPath("volume/x"); err == nil {
+		t.Fatal("junction outside the image was followed")
+	}
+
+	records, err := img.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, rec := range records {
+		paths = append(paths, rec.Path)
+	}
+	expected := []string{".", "link", "link/inner.txt", "loop", "target", "target/inner.txt", "volume"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("unexpected paths %q", paths)
+	}
+
+	if n, err := img.FileCount(); err != nil || n != 4 {
+		t.Fatalf("unexpected file count %d: %v", n, err)
+	}
+}
+
+// testSymlink returns a symbolic link to target.
+func testSymlink(name, target string, relative bool) *testFile {
+	sub := utf16Bytes(target)
+	var flags uint32
+	if relative {
+		flags = symlinkFlagRelative
+	}
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.LittleEndian, []uint16{uint16(len(sub)), uint16(len(sub)), 0, uint16(len(sub))})
+	_ = binary.Write(&b, binary.LittleEndian, flags)
+	b.Write(sub)
+	b.Write(sub)
+	return &testFile{
+		name:       name,
+		attr:       FILE_ATTRIBUTE_REPARSE_POINT,
+		data:       b.Bytes(),
+		securityID: 0xffffffff,
+		reparseTag: reparseTagSymlink,
+	}
+}
+
+func TestReparsePoint(t *testing.T) {
+	unknown := &testFile{
+		name:       "dedup",
+		attr:       FILE_ATTRIBUTE_REPARSE_POINT,
+		data:       []byte("opaque"),
+		securityID: 0xffffffff,
+		reparseTag: 0x80000013,
+	}
+	img := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		testJunction("junction", `\??\C:\target`),
+		testSymlink("abs", `\??\C:\Windows\notepad.exe`, false),
+		testSymlink("rel", `..\file.txt`, true),
+		unknown,
+		testRegular("file.txt", "data"),
+	)})).Image[0]
+
+	for _, tc := range []struct {
+		path     string
+		expected ReparsePoint
+	}{
+		{"junction", ReparsePoint{Tag: reparseTagMountPoint, SubstituteName: `\??\C:\target`}},
+		{"abs", ReparsePoint{Tag: reparseTagSymlink, SubstituteName: `\??\C:\Windows\notepad.exe`, PrintName: `\??\C:\Windows\notepad.exe`}},
+		{"rel", ReparsePoint{Tag: reparseTagSymlink, SubstituteName: `..\file.txt`, PrintName: `..\file.txt`, IsRelative: true}},
+		{"dedup", ReparsePoint{Tag: 0x80000013}},
+	} {
+		f, err := img.OpenFile(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rp, err := f.ReparsePoint()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.path, err)
+		}
+		if int64(len(rp.Data)) != f.Size {
+			t.Errorf("%s: got %d bytes of reparse data, expected %d", tc.path, len(rp.Data), f.Size)
+		}
+		rp.Data = nil
+		if !reflect.DeepEqual(*rp, tc.expected) {
+			t.Errorf("%s: got %+v, expected %+v", tc.path, *rp, tc.expected)
+		}
+	}
+
+	f, err := img.OpenFile("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ReparsePoint(); err == nil {
+		t.Fatal("expected an error for a file that is not a reparse point")
+	}
+}
+
+func TestReparseData(t *testing.T) {
+	junction := testJunction("junction", `\??\C:\target`)
+	unknown := &testFile{
+		name:       "dedup",
+		attr:       FILE_ATTRIBUTE_REPARSE_POINT,
+		data:       []byte("opaque"),
+		securityID: 0xffffffff,
+		reparseTag: 0x80000013,
+	}
+	img := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		junction,
+		unknown,
+		testRegular("file.txt", "data"),
+	)})).Image[0]
+
+	for _, tf := range []*testFile{junction, unknown} {
+		f, err := img.OpenFile(tf.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !f.IsReparsePoint() {
+			t.Errorf("%s: not a reparse point", tf.name)
+		}
+		b, err := f.ReparseData()
+		if err != nil {
+			t.Fatalf("%s: %v", tf.name, err)
+		}
+		if !bytes.Equal(b, tf.data) {
+			t.Errorf("%s: unexpected reparse data %x", tf.name, b)
+		}
+	}
+
+	f, err := img.OpenFile("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.IsReparsePoint() {
+		t.Error("regular file is a reparse point")
+	}
+	if _, err := f.ReparseData(); err == nil {
+		t.Fatal("expected an error for a file that is not a reparse point")
+	}
+}
+
+func TestReparseFixup(t *testing.T) {
+	notFixed := testJunction("outside", `\??\E:\elsewhere`)
+	notFixed.reparseReserved = reparseFlagNotFixed << 16
+	b := buildWIM(t, &testImage{name: "test", root: testDir("",
+		testJunction("junction", `\??\C:\target\dir`),
+		testSymlink("abs", `\??\C:\Windows\notepad.exe`, false),
+		testSymlink("rel", `..\file.txt`, true),
+		notFixed,
+	)})
+	if mustNewReader(t, b).ReparseFixup() {
+		t.Fatal("RP_FIX reported without the header flag")
+	}
+	binary.LittleEndian.PutUint32(b[16:], uint32(hdrFlagRpFix))
+	r := mustNewReader(t, b)
+	if !r.ReparseFixup() {
+		t.Fatal("RP_FIX not reported")
+	}
+
+	for _, tc := range []struct {
+		path     string
+		fixed    bool
+		expected string
+	}{
+		{"junction", true, `\??\D:\apply\target\dir`},
+		{"abs", true, `\??\D:\apply\Windows\notepad.exe`},
+		{"rel", false, `..\file.txt`},
+		{"outside", false, `\??\E:\elsewhere`},
+	} {
+		f, err := r.Image[0].OpenFile(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rp, err := f.ReparsePoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rp.Fixed != tc.fixed {
+			t.Errorf("%s: Fixed is %v", tc.path, rp.Fixed)
+		}
+		if s := rp.RestoreTarget(`D:\apply\`); s != tc.expected {
+			t.Errorf("%s: restored %q, expected %q", tc.path, s, tc.expected)
+		}
+	}
+}
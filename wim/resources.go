@@ -0,0 +1,65 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+// ResourceInfo describes an entry of a WIM's offset table.
+type ResourceInfo struct {
+	// Hash is the SHA1 hash of the resource's uncompressed contents.
+	Hash SHA1Hash
+	// Offset is the offset of the resource in the WIM file, CompressedSize
+	// the number of bytes it occupies there, and OriginalSize its size once
+	// decompressed. For a stream packed in a solid resource, Offset is
+	// instead its offset in the uncompressed data of all of the WIM's solid
+	// resources taken end to end in table order. For a solid resource
+	// itself, OriginalSize holds a marker value rather than a size.
+	Offset         int64
+	CompressedSize int64
+	OriginalSize   int64
+	// PartNumber is the 1-based number of the part of a split WIM that holds
+	// the resource.
+	PartNumber uint16
+	// RefCount is the number of directory and stream entries, across all
+	// images, that the offset table records as referring to the resource.
+	RefCount uint32
+	// Compression is the algorithm the resource is compressed with, or
+	// CompressionNone if it is stored as is.
+	Compression CompressionKind
+	// Flags holds the raw resource flags, which the fields below decode.
+	Flags uint8
+	// Free marks an entry for a deleted resource, Metadata a resource holding
+	// an image's metadata, Spanned a resource continued in the next part of a
+	// split WIM, and Solid a solid resource or a stream packed in one.
+	Free     bool
+	Metadata bool
+	Spanned  bool
+	Solid    bool
+}
+
+// Resources returns a description of each entry of the WIM's offset table, in
+// table order. Unlike the lookups made when opening files, it includes
+// entries that no directory entry refers to, metadata resources, free entries,
+// and entries for resources held in other parts of a split WIM. For a Reader
+// returned by NewLayeredReader, only the overlay's table is described.
+func (r *Reader) Resources() []ResourceInfo {
+	infos := make([]ResourceInfo, len(r.resources))
+	for i := range r.resources {
+		res := &r.resources[i]
+		flags := res.Flags()
+		infos[i] = ResourceInfo{
+			Hash:           res.Hash,
+			Offset:         res.Offset,
+			CompressedSize: res.CompressedSize(),
+			OriginalSize:   res.OriginalSize,
+			PartNumber:     res.PartNumber,
+			RefCount:       res.RefCount,
+			Compression:    r.compression(&res.resourceDescriptor),
+			Flags:          uint8(flags),
+			Free:           flags&resFlagFree != 0,
+			Metadata:       flags&resFlagMetadata != 0,
+			Spanned:        flags&resFlagSpanned != 0,
+			Solid:          flags&resFlagSolid != 0,
+		}
+	}
+	return infos
+}
@@ -0,0 +1,44 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/Microsoft/go-winio/wim/xpress"
+)
+
+func TestResources(t *testing.T) {
+	data := strings.Repeat("compressible ", 1000)
+	b := &wimBuilder{seen: make(map[SHA1Hash]bool), compress: xpress.Compress}
+	orphan := b.addResource([]byte("orphaned contents"), 0)
+	free := b.addResource([]byte("deleted contents"), resFlagFree)
+	w := b.build(t, "<WIM></WIM>", &testImage{name: "test", root: testDir("",
+		testRegular("a", data),
+		testRegular("b", data),
+	)})
+	binary.LittleEndian.PutUint32(w[16:], uint32(hdrFlagCompressed|hdrFlagCompressXpress))
+	r := mustNewReader(t, w)
+
+	res := r.Resources()
+	if len(res) != 4 {
+		t.Fatalf("got %d resources, expected 4", len(res))
+	}
+	md, o, f, a := res[0], res[1], res[2], res[3]
+	if !md.Metadata || md.Hash != r.Image[0].hash || md.Offset != r.Image[0].offset.Offset {
+		t.Errorf("unexpected metadata resource %+v", md)
+	}
+	if o.Hash != orphan || o.Metadata || o.Free || o.RefCount != 1 || o.PartNumber != 1 {
+		t.Errorf("unexpected orphaned resource %+v", o)
+	}
+	if f.Hash != free || !f.Free || f.Flags != uint8(resFlagFree|resFlagCompressed) {
+		t.Errorf("unexpected free resource %+v", f)
+	}
+	if a.Hash != sha1Hash([]byte(data)) || a.RefCount != 2 || a.OriginalSize != int64(len(data)) ||
+		a.Compression != CompressionXpress || a.CompressedSize >= a.OriginalSize {
+		t.Errorf("unexpected file resource %+v", a)
+	}
+}
@@ -0,0 +1,389 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Security descriptor control flags.
+const (
+	seDACLPresent         = 0x0004
+	seSACLPresent         = 0x0010
+	seDACLAutoInheritReq  = 0x0100
+	seSACLAutoInheritReq  = 0x0200
+	seDACLAutoInherited   = 0x0400
+	seSACLAutoInherited   = 0x0800
+	seDACLProtected       = 0x1000
+	seSACLProtected       = 0x2000
+	seSelfRelative        = 0x8000
+	securityDescriptorLen = 20
+	aclHeaderLen          = 8
+	aceHeaderLen          = 4
+)
+
+// ACE types whose layout is understood.
+const (
+	aceTypeAccessAllowed       = 0x0
+	aceTypeAccessDenied        = 0x1
+	aceTypeSystemAudit         = 0x2
+	aceTypeSystemAlarm         = 0x3
+	aceTypeAccessAllowedObject = 0x5
+	aceTypeAccessDeniedObject  = 0x6
+	aceTypeSystemAuditObject   = 0x7
+	aceTypeSystemAlarmObject   = 0x8
+	aceTypeMandatoryLabel      = 0x11
+)
+
+// Object ACE flags, which record which of the GUIDs are present.
+const (
+	aceObjectTypePresent          = 0x1
+	aceInheritedObjectTypePresent = 0x2
+)
+
+// SecurityDescriptor is a parsed self-relative Windows security descriptor.
+// SIDs are in their string form, such as "S-1-5-18".
+type SecurityDescriptor struct {
+	Revision uint8
+	Control  uint16
+	Owner    string // empty if the descriptor has no owner
+	Group    string // empty if the descriptor has no group
+	DACL     *ACL   // nil if the descriptor has no DACL or a null DACL
+	SACL     *ACL   // nil if the descriptor has no SACL or a null SACL
+}
+
+// ACL is an access control list.
+type ACL struct {
+	Revision uint8
+	ACEs     []ACE
+}
+
+// ACE is an access control entry. For ACE types whose layout is not known,
+// only Type, Flags, and Data are set.
+type ACE struct {
+	Type                uint8
+	Flags               uint8
+	Mask                uint32
+	SID                 string
+	ObjectType          string // for object ACEs, the GUID of the object type, if any
+	InheritedObjectType string // for object ACEs, the GUID of the inherited object type, if any
+	Data                []byte // the body of an ACE of unknown type
+}
+
+// HasDACL reports whether the descriptor has a DACL. A descriptor with a
+// null DACL, which grants everyone full access, has a DACL but a nil DACL
+// field.
+func (sd *SecurityDescriptor) HasDACL() bool {
+	return sd.Control&seDACLPresent != 0
+}
+
+// HasSACL reports whether the descriptor has a SACL.
+func (sd *SecurityDescriptor) HasSACL() bool {
+	return sd.Control&seSACLPresent != 0
+}
+
+// ParseSecurityDescriptor parses a self-relative security descriptor, such as
+// FileHeader.SecurityDescriptor. It is a pure-Go parser, so it gives the same
+// results on every platform.
+func ParseSecurityDescriptor(b []byte) (*SecurityDescriptor, error) {
+	if len(b) < securityDescriptorLen {
+		return nil, errors.New("security descriptor too short")
+	}
+	sd := &SecurityDescriptor{
+		Revision: b[0],
+		Control:  binary.LittleEndian.Uint16(b[2:]),
+	}
+	if sd.Revision != 1 {
+		return nil, fmt.Errorf("unsupported security descriptor revision %d", sd.Revision)
+	}
+	if sd.Control&seSelfRelative == 0 {
+		return nil, errors.New("security descriptor is not self-relative")
+	}
+	offOwner := binary.LittleEndian.Uint32(b[4:])
+	offGroup := binary.LittleEndian.Uint32(b[8:])
+	offSACL := binary.LittleEndian.Uint32(b[12:])
+	offDACL := binary.LittleEndian.Uint32(b[16:])
+
+	var err error
+	if offOwner != 0 {
+		if sd.Owner, err = parseSIDAt(b, offOwner); err != nil {
+			return nil, fmt.Errorf("owner: %w", err)
+		}
+	}
+	if offGroup != 0 {
+		if sd.Group, err = parseSIDAt(b, offGroup); err != nil {
+			return nil, fmt.Errorf("group: %w", err)
+		}
+	}
+	if sd.HasDACL() && offDACL != 0 {
+		if sd.DACL, err = parseACLAt(b, offDACL); err != nil {
+			return nil, fmt.Errorf("DACL: %w", err)
+		}
+	}
+	if sd.HasSACL() && offSACL != 0 {
+		if sd.SACL, err = parseACLAt(b, offSACL); err != nil {
+			return nil, fmt.Errorf("SACL: %w", err)
+		}
+	}
+	return sd, nil
+}
+
+// parseSIDAt parses the SID at offset off of b.
+func parseSIDAt(b []byte, off uint32) (string, error) {
+	if uint64(off) >= uint64(len(b)) {
+		return "", errors.New("offset out of range")
+	}
+	s, _, err := parseSID(b[off:])
+	return s, err
+}
+
+// parseSID parses the SID at the start of b, returning its string form and
+// length.
+func parseSID(b []byte) (string, int, error) {
+	if len(b) < 8 {
+		return "", 0, errors.New("SID too short")
+	}
+	if b[0] != 1 {
+		return "", 0, fmt.Errorf("unsupported SID revision %d", b[0])
+	}
+	n := 8 + 4*int(b[1])
+	if len(b) < n {
+		return "", 0, errors.New("SID too short")
+	}
+	var auth uint64
+	for _, c := range b[2:8] {
+		auth = auth<<8 | uint64(c)
+	}
+	var s strings.Builder
+	if auth < 1<<32 {
+		fmt.Fprintf(&s, "S-1-%d", auth)
+	} else {
+		fmt.Fprintf(&s, "S-1-0x%012X", auth)
+	}
+	for i := 8; i < n; i += 4 {
+		fmt.Fprintf(&s, "-%d", binary.LittleEndian.Uint32(b[i:]))
+	}
+	return s.String(), n, nil
+}
+
+// parseACLAt parses the ACL at offset off of b.
+func parseACLAt(b []byte, off uint32) (*ACL, error) {
+	if uint64(off)+aclHeaderLen > uint64(len(b)) {
+		return nil, errors.New("offset out of range")
+	}
+	b = b[off:]
+	size := int(binary.LittleEndian.Uint16(b[2:]))
+	count := int(binary.LittleEndian.Uint16(b[4:]))
+	if size < aclHeaderLen || size > len(b) {
+		return nil, fmt.Errorf("invalid ACL size %d", size)
+	}
+	acl := &ACL{Revision: b[0]}
+	b = b[aclHeaderLen:size]
+	for i := 0; i < count; i++ {
+		if len(b) < aceHeaderLen {
+			return nil, errors.New("ACE truncated")
+		}
+		aceSize := int(binary.LittleEndian.Uint16(b[2:]))
+		if aceSize < aceHeaderLen || aceSize > len(b) {
+			return nil, fmt.Errorf("invalid ACE size %d", aceSize)
+		}
+		ace, err := parseACE(b[:aceSize])
+		if err != nil {
+			return nil, fmt.Errorf("ACE %d: %w", i, err)
+		}
+		acl.ACEs = append(acl.ACEs, ace)
+		b = b[aceSize:]
+	}
+	return acl, nil
+}
+
+// parseACE parses an ACE, including its header.
+func parseACE(b []byte) (ACE, error) {
+	ace := ACE{Type: b[0], Flags: b[1]}
+	body := b[aceHeaderLen:]
+	switch ace.Type {
+	case aceTypeAccessAllowed, aceTypeAccessDenied, aceTypeSystemAudit, aceTypeSystemAlarm, aceTypeMandatoryLabel:
+		if len(body) < 4 {
+			return ace, errors.New("ACE too short")
+		}
+		ace.Mask = binary.LittleEndian.Uint32(body)
+		sid, _, err := parseSID(body[4:])
+		if err != nil {
+			return ace, err
+		}
+		ace.SID = sid
+	case aceTypeAccessAllowedObject, aceTypeAccessDeniedObject, aceTypeSystemAuditObject, aceTypeSystemAlarmObject:
+		if len(body) < 8 {
+			return ace, errors.New("ACE too short")
+		}
+		ace.Mask = binary.LittleEndian.Uint32(body)
+		flags := binary.LittleEndian.Uint32(body[4:])
+		body = body[8:]
+		for _, g := range []struct {
+			flag uint32
+			p    *string
+		}{
+			{aceObjectTypePresent, &ace.ObjectType},
+			{aceInheritedObjectTypePresent, &ace.InheritedObjectType},
+		} {
+			if flags&g.flag == 0 {
+				continue
+			}
+			if len(body) < 16 {
+				return ace, errors.New("ACE too short")
+			}
+			id := guid{
+				Data1: binary.LittleEndian.Uint32(body),
+				Data2: binary.LittleEndian.Uint16(body[4:]),
+				Data3: binary.LittleEndian.Uint16(body[6:]),
+			}
+			copy(id.Data4[:], body[8:16])
+			*g.p = id.String()
+			body = body[16:]
+		}
+		sid, _, err := parseSID(body)
+		if err != nil {
+			return ace, err
+		}
+		ace.SID = sid
+	default:
+		ace.Data = append([]byte(nil), body...)
+	}
+	return ace, nil
+}
+
+// sddlSIDs maps well-known SIDs to their SDDL abbreviations.
+var sddlSIDs = map[string]string{
+	"S-1-1-0":      "WD",
+	"S-1-3-0":      "CO",
+	"S-1-3-1":      "CG",
+	"S-1-5-2":      "NU",
+	"S-1-5-4":      "IU",
+	"S-1-5-6":      "SU",
+	"S-1-5-7":      "AN",
+	"S-1-5-11":     "AU",
+	"S-1-5-18":     "SY",
+	"S-1-5-19":     "LS",
+	"S-1-5-20":     "NS",
+	"S-1-5-32-544": "BA",
+	"S-1-5-32-545": "BU",
+	"S-1-5-32-546": "BG",
+	"S-1-5-32-547": "PU",
+	"S-1-15-2-1":   "AC",
+	"S-1-16-4096":  "LW",
+	"S-1-16-8192":  "ME",
+	"S-1-16-12288": "HI",
+	"S-1-16-16384": "SI",
+}
+
+// sddlACETypes maps ACE types to their SDDL abbreviations.
+var sddlACETypes = map[uint8]string{
+	aceTypeAccessAllowed:       "A",
+	aceTypeAccessDenied:        "D",
+	aceTypeSystemAudit:         "AU",
+	aceTypeSystemAlarm:         "AL",
+	aceTypeAccessAllowedObject: "OA",
+	aceTypeAccessDeniedObject:  "OD",
+	aceTypeSystemAuditObject:   "OU",
+	aceTypeSystemAlarmObject:   "OL",
+	aceTypeMandatoryLabel:      "ML",
+}
+
+// sddlACEFlags lists the SDDL abbreviations of ACE flags in the order they
+// are written.
+var sddlACEFlags = []struct {
+	flag uint8
+	s    string
+}{
+	{0x01, "OI"},
+	{0x02, "CI"},
+	{0x04, "NP"},
+	{0x08, "IO"},
+	{0x10, "ID"},
+	{0x40, "SA"},
+	{0x80, "FA"},
+}
+
+// sddlSID returns the SDDL form of a SID string.
+func sddlSID(sid string) string {
+	if s, ok := sddlSIDs[sid]; ok {
+		return s
+	}
+	return sid
+}
+
+// SDDL returns the descriptor in the Security Descriptor Definition
+// Language. SIDs with a well-known abbreviation are abbreviated, and access
+// masks are written as hexadecimal numbers, so the result is valid SDDL that
+// may be spelled differently from what Windows produces for the same
+// descriptor. It fails for ACE types that SDDL cannot express.
+func (sd *SecurityDescriptor) SDDL() (string, error) {
+	var s strings.Builder
+	if sd.Owner != "" {
+		s.WriteString("O:" + sddlSID(sd.Owner))
+	}
+	if sd.Group != "" {
+		s.WriteString("G:" + sddlSID(sd.Group))
+	}
+	for _, a := range []struct {
+		prefix                       string
+		present                      bool
+		acl                          *ACL
+		protected, inherited, inhReq uint16
+	}{
+		{"D:", sd.HasDACL(), sd.DACL, seDACLProtected, seDACLAutoInherited, seDACLAutoInheritReq},
+		{"S:", sd.HasSACL(), sd.SACL, seSACLProtected, seSACLAutoInherited, seSACLAutoInheritReq},
+	} {
+		if !a.present {
+			continue
+		}
+		s.WriteString(a.prefix)
+		if sd.Control&a.protected != 0 {
+			s.WriteString("P")
+		}
+		if sd.Control&a.inhReq != 0 {
+			s.WriteString("AR")
+		}
+		if sd.Control&a.inherited != 0 {
+			s.WriteString("AI")
+		}
+		if a.acl == nil {
+			s.WriteString("NO_ACCESS_CONTROL")
+			continue
+		}
+		for _, ace := range a.acl.ACEs {
+			t, ok := sddlACETypes[ace.Type]
+			if !ok {
+				return "", fmt.Errorf("ACE type %#x cannot be expressed in SDDL", ace.Type)
+			}
+			s.WriteString("(" + t + ";")
+			for _, f := range sddlACEFlags {
+				if ace.Flags&f.flag != 0 {
+					s.WriteString(f.s)
+				}
+			}
+			fmt.Fprintf(&s, ";0x%x;", ace.Mask)
+			s.WriteString(ace.ObjectType + ";" + ace.InheritedObjectType + ";" + sddlSID(ace.SID) + ")")
+		}
+	}
+	return s.String(), nil
+}
+
+// SecurityDescriptorString returns the file's security descriptor in the
+// Security Descriptor Definition Language, as described for
+// SecurityDescriptor.SDDL. It returns an empty string if the file has no
+// security descriptor.
+func (f *FileHeader) SecurityDescriptorString() (string, error) {
+	if len(f.SecurityDescriptor) == 0 {
+		return "", nil
+	}
+	sd, err := ParseSecurityDescriptor(f.SecurityDescriptor)
+	if err != nil {
+		return "", &ParseError{Oper: "security descriptor", Path: f.Name, Err: err}
+	}
+	return sd.SDDL()
+}
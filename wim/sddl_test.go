@@ -0,0 +1,120 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// sidBytes encodes a SID with the given identifier authority and
+// subauthorities.
+func sidBytes(auth uint8, subs ...uint32) []byte {
+	b := []byte{1, byte(len(subs)), 0, 0, 0, 0, 0, auth}
+	for _, s := range subs {
+		b = append(b, maskBytes(s)...)
+	}
+	return b
+}
+
+// aceBytes encodes an ACE with the given header and body.
+func aceBytes(typ, flags uint8, body ...[]byte) []byte {
+	data := bytes.Join(body, nil)
+	b := []byte{typ, flags, 0, 0}
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(b)+len(data)))
+	return append(b, data...)
+}
+
+// aclBytes encodes an ACL holding aces.
+func aclBytes(aces ...[]byte) []byte {
+	data := bytes.Join(aces, nil)
+	b := []byte{2, 0, 0, 0, byte(len(aces)), 0, 0, 0}
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(b)+len(data)))
+	return append(b, data...)
+}
+
+// sdBytes encodes a self-relative security descriptor. Nil parts are absent.
+func sdBytes(control uint16, owner, group, sacl, dacl []byte) []byte {
+	b := make([]byte, securityDescriptorLen)
+	b[0] = 1
+	binary.LittleEndian.PutUint16(b[2:], control|seSelfRelative)
+	for i, part := range [][]byte{owner, group, sacl, dacl} {
+		if part != nil {
+			binary.LittleEndian.PutUint32(b[4+4*i:], uint32(len(b)))
+			b = append(b, part...)
+		}
+	}
+	return b
+}
+
+// maskBytes encodes a 32-bit value, such as an access mask.
+func maskBytes(m uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, m)
+	return b
+}
+
+func TestParseSecurityDescriptor(t *testing.T) {
+	objectBody := append(maskBytes(0x10), maskBytes(aceObjectTypePresent)...)
+	objectBody = append(objectBody, 0x78, 0x56, 0x34, 0x12, 0x34, 0x12, 0x78, 0x56, 1, 2, 3, 4, 5, 6, 7, 8)
+	objectBody = append(objectBody, sidBytes(5, 11)...)
+
+	dacl := aclBytes(
+		aceBytes(aceTypeAccessAllowed, 0x13, maskBytes(0x1f01ff), sidBytes(5, 18)),
+		aceBytes(aceTypeAccessDenied, 0, maskBytes(0x2), sidBytes(5, 21, 1, 2, 3, 1001)),
+		aceBytes(aceTypeAccessAllowedObject, 0, objectBody),
+	)
+	sacl := aclBytes(aceBytes(aceTypeMandatoryLabel, 0, maskBytes(1), sidBytes(16, 12288)))
+	b := sdBytes(seDACLPresent|seDACLProtected|seDACLAutoInherited|seSACLPresent, sidBytes(5, 32, 544), sidBytes(5, 18), sacl, dacl)
+
+	sd, err := ParseSecurityDescriptor(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &SecurityDescriptor{
+		Revision: 1,
+		Control:  seSelfRelative | seDACLPresent | seDACLProtected | seDACLAutoInherited | seSACLPresent,
+		Owner:    "S-1-5-32-544",
+		Group:    "S-1-5-18",
+		DACL: &ACL{Revision: 2, ACEs: []ACE{
+			{Type: aceTypeAccessAllowed, Flags: 0x13, Mask: 0x1f01ff, SID: "S-1-5-18"},
+			{Type: aceTypeAccessDenied, Mask: 0x2, SID: "S-1-5-21-1-2-3-1001"},
+			{Type: aceTypeAccessAllowedObject, Mask: 0x10, SID: "S-1-5-11", ObjectType: "12345678-1234-5678-0102-030405060708"},
+		}},
+		SACL: &ACL{Revision: 2, ACEs: []ACE{
+			{Type: aceTypeMandatoryLabel, Mask: 1, SID: "S-1-16-12288"},
+		}},
+	}
+	if !reflect.DeepEqual(sd, expected) {
+		t.Fatalf("got %+v, expected %+v", sd, expected)
+	}
+
+	sddl, err := sd.SDDL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expectedSDDL = "O:BAG:SYD:PAI(A;OICIID;0x1f01ff;;;SY)(D;;0x2;;;S-1-5-21-1-2-3-1001)" +
+		"(OA;;0x10;12345678-1234-5678-0102-030405060708;;AU)S:(ML;;0x1;;;HI)"
+	if sddl != expectedSDDL {
+		t.Errorf("got SDDL %s, expected %s", sddl, expectedSDDL)
+	}
+
+	null := sdBytes(seDACLPresent, nil, nil, nil, nil)
+	f := &FileHeader{SecurityDescriptor: null}
+	if s, err := f.SecurityDescriptorString(); err != nil || s != "D:NO_ACCESS_CONTROL" {
+		t.Errorf("unexpected SDDL %q for a null DACL: %v", s, err)
+	}
+	if s, err := (&FileHeader{}).SecurityDescriptorString(); err != nil || s != "" {
+		t.Errorf("unexpected SDDL %q without a descriptor: %v", s, err)
+	}
+
+	// The DACL is last, so every truncation cuts into something.
+	for i := 0; i < len(b); i++ {
+		if _, err := ParseSecurityDescriptor(b[:i]); err == nil {
+			t.Errorf("no error for a descriptor truncated to %d bytes", i)
+		}
+	}
+}
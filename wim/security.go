@@ -0,0 +1,25 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+// noSecurityID is the security ID of entries without a security descriptor.
+const noSecurityID = 0xffffffff
+
+// SecurityDescriptors walks the tree rooted at f, including f itself, and
+// returns the distinct security descriptors referenced by it, keyed by their
+// index in the image's security table. Entries without a security descriptor
+// are ignored. Junctions are not followed.
+func (f *File) SecurityDescriptors() (map[uint32][]byte, error) {
+	sds := make(map[uint32][]byte)
+	w := walker{fn: stopOnError(func(_ string, f *File) error {
+		if f.securityID != noSecurityID {
+			sds[f.securityID] = f.SecurityDescriptor
+		}
+		return nil
+	})}
+	if err := w.walk(f, f.Name); err != nil {
+		return nil, err
+	}
+	return sds, nil
+}
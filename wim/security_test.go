@@ -0,0 +1,99 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSecurityDescriptors(t *testing.T) {
+	withSD := func(f *testFile, id uint32) *testFile {
+		f.securityID = id
+		return f
+	}
+	sds := [][]byte{[]byte("sd0"), []byte("sd1"), []byte("sd2"), []byte("sd3")}
+	img := mustNewReader(t, buildWIM(t, &testImage{name: "test", sds: sds, root: withSD(testDir("",
+		withSD(testDir("sub",
+			withSD(testRegular("a", "a"), 2),
+			withSD(testDir("deeper", withSD(testRegular("b", "b"), 2)), 3),
+			testRegular("c", "c"),
+		), 1),
+		withSD(testRegular("other", "other"), 0),
+	), 0)})).Image[0]
+
+	sub, err := img.FindByPath("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := sub.SecurityDescriptors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[uint32][]byte{1: sds[1], 2: sds[2], 3: sds[3]}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected descriptors %q", got)
+	}
+}
+
+func TestSkipSecurity(t *testing.T) {
+	sds := [][]byte{[]byte("sd0"), []byte("sd1")}
+	root := testDir("", testRegular("a", "a"), testRegular("bad", "b"))
+	root.securityID = 1
+	root.children[0].securityID = 0
+	b := buildWIM(t, &testImage{name: "test", sds: sds, root: root})
+
+	r, err := NewReaderWithOptions(bytes.NewReader(b), &Options{SkipSecurity: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := r.Image[0]
+	dir := mustOpenRoot(t, img)
+	files, err := dir.Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir.SecurityDescriptor != nil || files[0].SecurityDescriptor != nil {
+		t.Error("security descriptors were loaded")
+	}
+	if a, err := files[0].ReadString(); err != nil || a != "a" {
+		t.Errorf("unexpected contents %q: %v", a, err)
+	}
+	if n, err := img.SecurityDescriptorCount(); err != nil || n != len(sds) {
+		t.Errorf("unexpected descriptor count %d: %v", n, err)
+	}
+
+	// Security IDs are still checked.
+	root.children[1].securityID = 2
+	r, err = NewReaderWithOptions(bytes.NewReader(buildWIM(t, &testImage{name: "test", sds: sds, root: root})), &Options{SkipSecurity: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mustOpenRoot(t, r.Image[0]).Readdir(); err == nil {
+		t.Error("expected an error for an out of range security ID")
+	}
+}
+
+func TestSecurityDescriptorCount(t *testing.T) {
+	sds := [][]byte{[]byte("sd0"), []byte("sd1"), []byte("sd2")}
+	root := testDir("", testRegular("a", "a"))
+	root.securityID = 2
+	r := mustNewReader(t, buildWIM(t,
+		&testImage{name: "none", root: testDir("", testRegular("a", "a"))},
+		&testImage{name: "three", sds: sds, root: root},
+	))
+	for i, want := range []int{0, len(sds)} {
+		img := r.Image[i]
+		// The count is read from the table header, and then from the
+		// descriptors parsed when the image is opened.
+		if n, err := img.SecurityDescriptorCount(); err != nil || n != want {
+			t.Errorf("%s: got %d descriptors, expected %d: %v", img.Name, n, want, err)
+		}
+		mustOpenRoot(t, img)
+		if n, err := img.SecurityDescriptorCount(); err != nil || n != want {
+			t.Errorf("%s: got %d descriptors after opening, expected %d: %v", img.Name, n, want, err)
+		}
+	}
+}
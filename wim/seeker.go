@@ -0,0 +1,52 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"io"
+	"sync"
+)
+
+// seekerReaderAt adapts an io.ReadSeeker to io.ReaderAt. Each ReadAt seeks
+// and reads under a lock, so concurrent readers of a WIM are serialized.
+type seekerReaderAt struct {
+	m  sync.Mutex
+	rs io.ReadSeeker
+}
+
+func (s *seekerReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, err := s.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s.rs, b)
+	if err == io.ErrUnexpectedEOF { //nolint:errorlint
+		err = io.EOF
+	}
+	return n, err
+}
+
+// ReaderAtFromSeeker returns an io.ReaderAt that reads from rs, for use with
+// NewReaderWithOptions and NewReaderFromParts. If rs already implements
+// io.ReaderAt, it is returned as is. Otherwise each read seeks rs and then
+// reads from it while holding a lock, so reads of the WIM from multiple
+// goroutines are serialized, and rs must not be used by anything else while
+// the Reader is in use.
+func ReaderAtFromSeeker(rs io.ReadSeeker) io.ReaderAt {
+	if ra, ok := rs.(io.ReaderAt); ok {
+		return ra
+	}
+	return &seekerReaderAt{rs: rs}
+}
+
+// NewReaderFromSeeker returns a Reader for the WIM in rs, for sources that
+// can seek but do not implement io.ReaderAt. See ReaderAtFromSeeker for the
+// restrictions this places on rs. A source that cannot seek at all, such as a
+// network stream, can be copied to a temporary file first and read with
+// NewReader.
+func NewReaderFromSeeker(rs io.ReadSeeker) (*Reader, error) {
+	return NewReader(ReaderAtFromSeeker(rs))
+}
@@ -0,0 +1,56 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// readSeekerOnly hides the io.ReaderAt implementation of the reader it wraps.
+type readSeekerOnly struct {
+	io.ReadSeeker
+}
+
+func TestNewReaderFromSeeker(t *testing.T) {
+	root := testDir("")
+	for i := 0; i < 8; i++ {
+		root.children = append(root.children, testRegular(fmt.Sprint(i), strings.Repeat(fmt.Sprint(i), 1000*(i+1))))
+	}
+	rs := readSeekerOnly{bytes.NewReader(buildWIM(t, &testImage{name: "test", root: root}))}
+	if _, ok := ReaderAtFromSeeker(rs).(*seekerReaderAt); !ok {
+		t.Fatal("expected an adapter")
+	}
+	r, err := NewReaderFromSeeker(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := mustOpenRoot(t, r.Image[0]).Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i, f := range files {
+		wg.Add(1)
+		go func(i int, f *File) {
+			defer wg.Done()
+			if s, err := f.ReadString(); err != nil || s != strings.Repeat(f.Name, 1000*(i+1)) {
+				t.Errorf("unexpected contents of %s: %v", f.Name, err)
+			}
+		}(i, f)
+	}
+	wg.Wait()
+
+	// Reads past the end report io.EOF, as io.ReaderAt requires.
+	ra := ReaderAtFromSeeker(readSeekerOnly{strings.NewReader("abc")})
+	b := make([]byte, 4)
+	if n, err := ra.ReadAt(b, 1); n != 2 || err != io.EOF { //nolint:errorlint
+		t.Errorf("unexpected read of %d bytes: %v", n, err)
+	}
+}
@@ -0,0 +1,219 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Solid resources, which ESD files and WIMs captured with solid compression
+// use, pack the contents of many streams end to end into one compressed
+// resource, so that small files compress well together. The offset table
+// describes each solid resource with an entry flagged resFlagSolid whose
+// original size is solidResourceMagic. The entries for the streams packed in
+// solid resources, also flagged resFlagSolid, follow those of the resources.
+// A stream's offset is relative to the start of the uncompressed data of the
+// group of consecutive solid resource entries preceding it, taken end to end,
+// and its size is its uncompressed size.
+//
+// A solid resource starts with a solidHeader, which gives its uncompressed
+// size and its own chunk size and compression algorithm, independent of those
+// in the WIM header. The header is followed by the 32-bit compressed sizes of
+// all of its chunks and then by the chunks themselves. As in other compressed
+// resources, a chunk that does not compress is stored as is.
+
+// solidHeader is the header at the start of a solid resource.
+type solidHeader struct {
+	OriginalSize int64
+	ChunkSize    uint32
+	Compression  uint32 // a CompressionKind
+}
+
+var solidHeaderSize = int64(binary.Size(solidHeader{}))
+
+// solidResource describes a solid resource. Once the offset table is read, the
+// Offset of each stream packed in a solid resource is that of the stream in
+// the solid space, in which the uncompressed data of all of the WIM's solid
+// resources lie end to end in table order, so that it identifies the stream's
+// solid resource, which base locates in that space.
+type solidResource struct {
+	rd          resourceDescriptor
+	base        int64
+	size        int64
+	chunkSize   int64
+	compression CompressionKind
+	chunks      []int64 // offsets of the chunks from the start of the resource
+	end         int64   // offset of the end of the last chunk
+}
+
+// readSolidResource reads the header and chunk table of the solid resource
+// described by rd.
+func (r *Reader) readSolidResource(rd *resourceDescriptor) (*solidResource, error) {
+	size := rd.CompressedSize()
+	if size < solidHeaderSize {
+		return nil, fmt.Errorf("%s is too small for a solid resource header", rd)
+	}
+	var hdr solidHeader
+	if err := binary.Read(io.NewSectionReader(r.r, rd.Offset, solidHeaderSize), binary.LittleEndian, &hdr); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if hdr.OriginalSize < 0 {
+		return nil, fmt.Errorf("invalid solid resource size %d", hdr.OriginalSize)
+	}
+	if hdr.Compression > uint32(CompressionLZMS) {
+		return nil, fmt.Errorf("%w: solid resource compression format %d", ErrUnsupportedCompression, hdr.Compression)
+	}
+	kind := CompressionKind(hdr.Compression)
+	if hdr.ChunkSize == 0 || hdr.ChunkSize&(hdr.ChunkSize-1) != 0 {
+		return nil, fmt.Errorf("invalid solid resource chunk size %d", hdr.ChunkSize)
+	}
+	if err := r.opts.checkChunkSize(kind, hdr.ChunkSize); err != nil {
+		return nil, err
+	}
+
+	s := &solidResource{
+		rd:          *rd,
+		size:        hdr.OriginalSize,
+		chunkSize:   int64(hdr.ChunkSize),
+		compression: kind,
+	}
+	nchunks := s.size / s.chunkSize
+	if s.size%s.chunkSize != 0 {
+		nchunks++
+	}
+	// Check the chunk table against the resource before allocating for it.
+	if nchunks > (size-solidHeaderSize)/4 {
+		return nil, fmt.Errorf("chunk table of %d chunks does not fit in %d bytes", nchunks, size)
+	}
+	if nchunks > maxInt/8 {
+		return nil, fmt.Errorf("chunk table of %d chunks is too large for this platform", nchunks)
+	}
+	sizes := make([]uint32, nchunks)
+	table := io.NewSectionReader(r.r, rd.Offset+solidHeaderSize, 4*nchunks)
+	if err := binary.Read(table, binary.LittleEndian, sizes); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	s.chunks = make([]int64, nchunks)
+	s.end = solidHeaderSize + 4*nchunks
+	for i, n := range sizes {
+		chunk := s.chunkSize
+		if i == len(sizes)-1 && s.size%s.chunkSize != 0 {
+			chunk = s.size % s.chunkSize
+		}
+		if kind == CompressionNone && int64(n) != chunk {
+			return nil, fmt.Errorf("chunk %d of an uncompressed solid resource is %d bytes, expected %d", i, n, chunk)
+		}
+		s.chunks[i] = s.end
+		s.end += int64(n)
+	}
+	if s.end > size {
+		return nil, fmt.Errorf("chunks of %d bytes do not fit in %s", s.end, rd)
+	}
+	return s, nil
+}
+
+// addSolidResource reads the solid resource described by the offset table
+// entry rd and places it in the solid space after the solid resources before
+// it.
+func (r *Reader) addSolidResource(rd *resourceDescriptor) (*solidResource, error) {
+	if err := r.checkBounds(rd); err != nil {
+		return nil, err
+	}
+	s, err := r.readSolidResource(rd)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(r.solid); n > 0 {
+		last := r.solid[n-1]
+		s.base = last.base + last.size
+	}
+	if s.size > math.MaxInt64-s.base {
+		return nil, errors.New("solid resources are too large")
+	}
+	r.solid = append(r.solid, s)
+	return s, nil
+}
+
+// locateSolidStream rewrites the offset of rd, the entry of a stream packed in
+// the group of solid resources group, from the offset in the group's data to
+// the offset in the solid space. The stream must lie within one resource.
+func locateSolidStream(rd *resourceDescriptor, group []*solidResource) error {
+	if len(group) == 0 {
+		return errors.New("stream in a solid resource is not preceded by the solid resource")
+	}
+	off, size := rd.Offset, rd.OriginalSize
+	if off < 0 || size < 0 {
+		return fmt.Errorf("invalid location of stream in a solid resource (%d bytes at %d)", size, off)
+	}
+	for _, s := range group {
+		if size <= s.size && off <= s.size-size {
+			rd.Offset = s.base + off
+			return nil
+		}
+		if off < s.size {
+			return fmt.Errorf("stream of %d bytes at %d extends past the end of its solid resource", size, rd.Offset)
+		}
+		off -= s.size
+	}
+	return fmt.Errorf("stream of %d bytes at %d extends past the end of its solid resources", size, rd.Offset)
+}
+
+// solidResourceOf returns the solid resource described by rd, or that holding
+// the stream described by rd once it has been located, or nil if there is none.
+func (r *Reader) solidResourceOf(rd *resourceDescriptor) *solidResource {
+	if rd.Flags()&resFlagSolid == 0 {
+		return nil
+	}
+	if rd.OriginalSize == solidResourceMagic {
+		for _, s := range r.solid {
+			if s.rd.Offset == rd.Offset {
+				return s
+			}
+		}
+		return nil
+	}
+	i := sort.Search(len(r.solid), func(i int) bool { return r.solid[i].base+r.solid[i].size > rd.Offset })
+	if i == len(r.solid) || rd.Offset < r.solid[i].base {
+		return nil
+	}
+	return r.solid[i]
+}
+
+// solidStreamReader returns a reader for the stream packed in a solid resource
+// that rd describes, starting at offset within the stream, whose contents are
+// read through ra. The chunks of the solid resource are decompressed as needed,
+// as for other compressed resources.
+func (r *Reader) solidStreamReader(ra io.ReaderAt, rd *resourceDescriptor, offset int64) (io.ReadCloser, error) {
+	s := r.solidResourceOf(rd)
+	if s == nil || rd.OriginalSize < 0 || rd.OriginalSize > s.base+s.size-rd.Offset {
+		return nil, fmt.Errorf("stream (%s) is not in a solid resource of the WIM", rd)
+	}
+	var d Decompressor
+	if s.compression != CompressionNone {
+		var err error
+		if d, err = r.opts.decompressor(s.compression); err != nil {
+			return nil, err
+		}
+	}
+	start := rd.Offset - s.base
+	return &compressedReader{
+		r:            io.NewSectionReader(ra, s.rd.Offset, s.end),
+		d:            d,
+		metrics:      r.metrics,
+		cache:        r.cache,
+		offset:       s.rd.Offset,
+		chunks:       s.chunks,
+		chunkSize:    s.chunkSize,
+		originalSize: s.size,
+		start:        start,
+		end:          start + rd.OriginalSize,
+		pos:          start + offset,
+		cur:          -1,
+	}, nil
+}
@@ -0,0 +1,400 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1" //nolint:gosec // not used for secure application
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Microsoft/go-winio/wim/xpress"
+)
+
+// solidBuilder packs the file data of a wimBuilder into solid resources.
+type solidBuilder struct {
+	chunkSize   int
+	compression CompressionKind
+	compress    func(chunk []byte) []byte // used unless compression is CompressionNone
+	// size is the size at which a new solid resource is started, or zero
+	// to use a single one.
+	size int
+	data [][]byte
+	all  int
+}
+
+// pack adds data to the last solid resource and returns the entry for it.
+func (s *solidBuilder) pack(data []byte) resourceDescriptor {
+	if len(s.data) == 0 || s.size != 0 && len(s.data[len(s.data)-1]) >= s.size {
+		s.data = append(s.data, nil)
+	}
+	s.data[len(s.data)-1] = append(s.data[len(s.data)-1], data...)
+	rd := resourceDescriptor{
+		FlagsAndCompressedSize: uint64(len(data)) | uint64(resFlagSolid)<<56,
+		Offset:                 int64(s.all),
+		OriginalSize:           int64(len(data)),
+	}
+	s.all += len(data)
+	return rd
+}
+
+// write writes the solid resources to b and returns their entries.
+func (s *solidBuilder) write(b *wimBuilder) []streamDescriptor {
+	var entries []streamDescriptor
+	for _, data := range s.data {
+		var res, body bytes.Buffer
+		_ = binary.Write(&res, binary.LittleEndian, &solidHeader{
+			OriginalSize: int64(len(data)),
+			ChunkSize:    uint32(s.chunkSize),
+			Compression:  uint32(s.compression),
+		})
+		for off := 0; off < len(data); off += s.chunkSize {
+			chunk := data[off:]
+			if len(chunk) > s.chunkSize {
+				chunk = chunk[:s.chunkSize]
+			}
+			if s.compression != CompressionNone {
+				if c := s.compress(chunk); len(c) < len(chunk) {
+					chunk = c
+				}
+			}
+			_ = binary.Write(&res, binary.LittleEndian, uint32(len(chunk)))
+			body.Write(chunk)
+		}
+		res.Write(body.Bytes())
+		rd := b.write(res.Bytes(), resFlagSolid|resFlagCompressed)
+		rd.OriginalSize = solidResourceMagic
+		entries = append(entries, streamDescriptor{resourceDescriptor: rd, PartNumber: 1})
+	}
+	return entries
+}
+
+// buildSolidWIM returns a WIM holding images whose file data is packed into
+// solid resources by s.
+func buildSolidWIM(t *testing.T, s *solidBuilder, images ...*testImage) []byte {
+	t.Helper()
+	b := &wimBuilder{seen: make(map[SHA1Hash]bool), solid: s}
+	out := b.build(t, "<WIM></WIM>", images...)
+	binary.LittleEndian.PutUint32(out[12:], wimVersionSolid)
+	return out
+}
+
+// solidTestImage returns an image whose files hold contents: text that
+// compresses well, data that does not, and data spanning many chunks.
+func solidTestImage() (*testImage, map[string]string) {
+	random := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(random)
+	contents := map[string]string{
+		"a.txt":     "contents of a",
+		"b.txt":     strings.Repeat("contents of b. ", 100),
+		"random":    string(random),
+		"large.txt": strings.Repeat("a large file spanning several chunks. ", 2000),
+		"empty":     "",
+	}
+	root := testDir("")
+	for _, name := range []string{"a.txt", "b.txt", "random", "large.txt", "empty"} {
+		root.children = append(root.children, testRegular(name, contents[name]))
+	}
+	root.children[0].streams = []testStream{{name: "ads", data: []byte("stream of a")}}
+	return &testImage{name: "test", root: root}, contents
+}
+
+func TestSolidResourceCount(t *testing.T) {
+	img, _ := solidTestImage()
+	r := mustNewReader(t, buildWIM(t, img))
+	if r.HasSolidResources() || r.SolidResourceCount() != 0 {
+		t.Errorf("got %d solid resources in a WIM without any", r.SolidResourceCount())
+	}
+
+	for _, tc := range []struct {
+		name string
+		img  *testImage
+		s    *solidBuilder
+		min  int // the number of solid resources the builder must make
+	}{
+		// A WIM of the solid version whose files are all empty has nothing
+		// to pack.
+		{"no resources", &testImage{name: "empty", root: testDir("", testRegular("empty", ""))}, &solidBuilder{chunkSize: 4096}, 0},
+		{"one resource", img, &solidBuilder{chunkSize: 4096}, 1},
+		{"several resources", img, &solidBuilder{chunkSize: 4096, size: 1000}, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := mustNewReader(t, buildSolidWIM(t, tc.s, tc.img))
+			want := len(tc.s.data)
+			if want < tc.min {
+				t.Fatalf("built %d solid resources", want)
+			}
+			if r.HasSolidResources() != (want != 0) || r.SolidResourceCount() != want {
+				t.Errorf("got %v and %d solid resources, expected %d", r.HasSolidResources(), r.SolidResourceCount(), want)
+			}
+		})
+	}
+}
+
+func TestSolid(t *testing.T) {
+	img, contents := solidTestImage()
+	for _, tc := range []struct {
+		name string
+		s    *solidBuilder
+	}{
+		{"XPRESS", &solidBuilder{chunkSize: 4096, compression: CompressionXpress, compress: xpress.Compress, size: 20000}},
+		{"None", &solidBuilder{chunkSize: 4096, compression: CompressionNone}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := buildSolidWIM(t, tc.s, img)
+			for _, opts := range []*Options{nil, {CacheSize: 1 << 20, VerifyHashes: true}} {
+				r, err := NewReaderWithOptions(bytes.NewReader(b), opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !r.HasSolidResources() || r.SolidResourceCount() != len(tc.s.data) {
+					t.Errorf("unexpected solid resource count %d", r.SolidResourceCount())
+				}
+				for name, want := range contents {
+					f, err := r.Image[0].OpenFile(name)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if s, err := f.ReadString(); err != nil || s != want {
+						t.Errorf("%s: unexpected contents (%d bytes): %v", name, len(s), err)
+					}
+					if name != "empty" && (f.Compressed() != (tc.s.compression != CompressionNone) || f.Compression() != tc.s.compression) {
+						t.Errorf("%s: unexpected compression %s", name, f.Compression())
+					}
+				}
+				a, err := r.Image[0].OpenFile("a.txt")
+				if err != nil {
+					t.Fatal(err)
+				}
+				rc, err := a.Streams[0].Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if s, err := io.ReadAll(rc); err != nil || string(s) != "stream of a" {
+					t.Errorf("unexpected stream contents %q: %v", s, err)
+				}
+				rc.Close()
+				if mismatches, err := r.Image[0].VerifyContents(); err != nil || len(mismatches) != 0 {
+					t.Errorf("unexpected mismatches %v: %v", mismatches, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSolidRandomAccess(t *testing.T) {
+	img, contents := solidTestImage()
+	b := buildSolidWIM(t, &solidBuilder{chunkSize: 4096, compression: CompressionXpress, compress: xpress.Compress, size: 20000}, img)
+	f, err := mustNewReader(t, b).Image[0].OpenFile("large.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := contents["large.txt"]
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	// The reader covers only the file, not the rest of its solid resource.
+	ra := rc.(io.ReaderAt)
+	buf := make([]byte, 100)
+	if n, err := ra.ReadAt(buf, int64(len(want))-50); n != 50 || err != io.EOF || string(buf[:n]) != want[len(want)-50:] { //nolint:errorlint
+		t.Errorf("unexpected ReadAt at the end: %d, %v", n, err)
+	}
+	if n, err := ra.ReadAt(buf, 5000); n != len(buf) || err != nil || string(buf) != want[5000:5100] {
+		t.Errorf("unexpected ReadAt across chunks: %d, %v", n, err)
+	}
+	rs := rc.(io.ReadSeeker)
+	if pos, err := rs.Seek(-10, io.SeekEnd); err != nil || pos != int64(len(want))-10 {
+		t.Fatalf("unexpected seek to %d: %v", pos, err)
+	}
+	if rest, err := io.ReadAll(rs); err != nil || string(rest) != want[len(want)-10:] {
+		t.Errorf("unexpected data after seeking %q: %v", rest, err)
+	}
+
+	// A reader opened at an offset starts there.
+	rc, err = f.src.resourceReaderWithOffset(&f.offset, 12345)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if rest, err := io.ReadAll(rc); err != nil || string(rest) != want[12345:] {
+		t.Errorf("unexpected data from offset: %v", err)
+	}
+}
+
+func TestSolidResources(t *testing.T) {
+	img, _ := solidTestImage()
+	s := &solidBuilder{chunkSize: 4096, compression: CompressionXpress, compress: xpress.Compress, size: 20000}
+	r := mustNewReader(t, buildSolidWIM(t, s, img))
+	var resources, streams int
+	for _, res := range r.Resources() {
+		if res.Metadata {
+			continue
+		}
+		if !res.Solid || res.Compression != CompressionXpress {
+			t.Errorf("unexpected resource %+v", res)
+		}
+		if res.OriginalSize == solidResourceMagic {
+			resources++
+		} else {
+			streams++
+		}
+	}
+	if resources != len(s.data) || streams != 5 {
+		t.Errorf("found %d solid resources and %d streams", resources, streams)
+	}
+
+	f, err := r.Image[0].OpenFile("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := f.OpenRaw(); err == nil {
+		t.Error("expected an error reading the raw data of a stream in a solid resource")
+	}
+
+	// Exporting decompresses the streams and stores them separately.
+	dst := exportTo(t, r.Image[0], &WriterOptions{Compression: CompressionXpress}, "extra")
+	if dst.HasSolidResources() {
+		t.Error("exported WIM has solid resources")
+	}
+	g, err := dst.Image[1].OpenFile("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := g.ReadString(); err != nil || s != strings.Repeat("contents of b. ", 100) {
+		t.Errorf("unexpected exported contents: %v", err)
+	}
+}
+
+func TestSolidCorrupt(t *testing.T) {
+	img, _ := solidTestImage()
+	build := func() []byte {
+		return buildSolidWIM(t, &solidBuilder{chunkSize: 4096, compression: CompressionXpress, compress: xpress.Compress}, img)
+	}
+	// entry returns the offset of entry i of the offset table, of which the
+	// metadata resource is first and the solid resource second.
+	entry := func(b []byte, i int) int {
+		return int(binary.LittleEndian.Uint64(b[56:])) + i*binary.Size(streamDescriptor{})
+	}
+	solidOffset := func(b []byte) int {
+		return int(binary.LittleEndian.Uint64(b[entry(b, 1)+8:]))
+	}
+
+	for _, tc := range []struct {
+		name    string
+		corrupt func(b []byte)
+		is      error
+	}{
+		{"chunk size", func(b []byte) {
+			binary.LittleEndian.PutUint32(b[solidOffset(b)+8:], 1000)
+		}, nil},
+		{"compression format", func(b []byte) {
+			binary.LittleEndian.PutUint32(b[solidOffset(b)+12:], 7)
+		}, ErrUnsupportedCompression},
+		{"size", func(b []byte) {
+			binary.LittleEndian.PutUint64(b[solidOffset(b):], 1<<40)
+		}, nil},
+		{"chunk table", func(b []byte) {
+			binary.LittleEndian.PutUint32(b[solidOffset(b)+16:], 1<<30)
+		}, nil},
+		{"stream past the end", func(b []byte) {
+			e := entry(b, 3)
+			binary.LittleEndian.PutUint64(b[e+8:], binary.LittleEndian.Uint64(b[e+8:])+1<<20)
+		}, nil},
+		{"stream before its resource", func(b []byte) {
+			// Swap the solid resource's entry with the first stream's.
+			table := binary.Size(streamDescriptor{})
+			first, second := entry(b, 1), entry(b, 2)
+			tmp := append([]byte(nil), b[first:first+table]...)
+			copy(b[first:], b[second:second+table])
+			copy(b[second:], tmp)
+		}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := build()
+			tc.corrupt(b)
+			_, err := NewReader(bytes.NewReader(b))
+			var perr *ParseError
+			if !errors.As(err, &perr) || tc.is != nil && !errors.Is(err, tc.is) {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+
+	// A corrupt chunk is detected when it is read.
+	b := build()
+	nchunks := (binary.LittleEndian.Uint64(b[solidOffset(b):]) + 4095) / 4096
+	data := solidOffset(b) + int(solidHeaderSize) + 4*int(nchunks) + 1000
+	for i := data; i < data+100; i++ {
+		b[i] ^= 0xff
+	}
+	mismatches, err := mustNewReader(t, b).Image[0].VerifyContents()
+	if err == nil && len(mismatches) == 0 {
+		t.Error("expected corrupt data to be detected")
+	}
+}
+
+// TestSolidFixture extracts a WIM with a solid LZMS resource captured by
+// wimlib, as described in testdata/README.md, and checks the extracted files
+// against the SHA1s of the captured tree.
+func TestSolidFixture(t *testing.T) {
+	r, err := Open(filepath.Join("testdata", "solid.wim"))
+	if errors.Is(err, os.ErrNotExist) {
+		t.Skip("testdata/solid.wim is not present; see testdata/README.md")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if !r.HasSolidResources() {
+		t.Fatal("fixture has no solid resources")
+	}
+	manifest, err := os.Open(filepath.Join("testdata", "solid.sha1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifest.Close()
+
+	dest := filepath.Join(t.TempDir(), "out")
+	if err := mustOpenRoot(t, r.Image[0]).Extract(dest, nil); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	sc := bufio.NewScanner(manifest)
+	for sc.Scan() {
+		fields := strings.SplitN(sc.Text(), "  ", 2)
+		if len(fields) != 2 {
+			t.Fatalf("malformed manifest line %q", sc.Text())
+		}
+		want, err := hex.DecodeString(fields[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(fields[1])))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got := sha1.Sum(b); !bytes.Equal(got[:], want) { //nolint:gosec // not used for secure application
+			t.Errorf("%s: SHA1 %x, expected %x", fields[1], got, want)
+		}
+		n++
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := r.Image[0].FileCount(); err != nil || files != n {
+		t.Errorf("image has %d files, manifest %d: %v", files, n, err)
+	}
+}
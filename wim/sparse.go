@@ -0,0 +1,87 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"io"
+)
+
+// sparseBlockSize is the granularity at which WriteTo looks for runs of zeros
+// to skip. It is a multiple of the allocation unit of common file systems, so
+// that skipped blocks can become holes.
+const sparseBlockSize = 64 * 1024
+
+var zeroBlock [sparseBlockSize]byte
+
+// IsSparse reports whether the file has FILE_ATTRIBUTE_SPARSE_FILE set, so
+// that its contents likely contain long runs of zeros.
+func (f *FileHeader) IsSparse() bool {
+	return f.Attributes&FILE_ATTRIBUTE_SPARSE_FILE != 0
+}
+
+// WriteTo writes the contents of the file's unnamed data stream to w,
+// implementing io.WriterTo. If the file is sparse and w is an io.WriteSeeker,
+// such as an *os.File, blocks of 64KB of zeros are skipped by seeking past
+// them rather than written, so that a file system that supports sparse files
+// can leave holes in their place. Blocks are aligned to the position of w when
+// WriteTo is called, which should be the start of a new file. The returned
+// count includes the skipped bytes. WriteTo returns ErrEncrypted for a file
+// encrypted with EFS, whose contents are not plain data.
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	if f.isEncryptedFile() {
+		return 0, ErrEncrypted
+	}
+	r, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	if ws, ok := w.(io.WriteSeeker); ok && f.IsSparse() {
+		return copySparse(ws, r)
+	}
+	return io.Copy(w, r)
+}
+
+// copySparse copies r to w, seeking over blocks of zeros instead of writing
+// them.
+func copySparse(w io.WriteSeeker, r io.Reader) (int64, error) {
+	buf := make([]byte, sparseBlockSize)
+	var n int64
+	hole := false
+	for {
+		m, err := io.ReadFull(r, buf)
+		if m > 0 {
+			if bytes.Equal(buf[:m], zeroBlock[:m]) {
+				if _, err := w.Seek(int64(m), io.SeekCurrent); err != nil {
+					return n, err
+				}
+				hole = true
+			} else {
+				if _, err := w.Write(buf[:m]); err != nil {
+					return n, err
+				}
+				hole = false
+			}
+			n += int64(m)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF { //nolint:errorlint
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	if hole {
+		// Seeking past the end of a file does not extend it, so write the
+		// final zero.
+		if _, err := w.Seek(-1, io.SeekCurrent); err != nil {
+			return n, err
+		}
+		if _, err := w.Write(zeroBlock[:1]); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
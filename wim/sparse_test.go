@@ -0,0 +1,100 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// seekBuffer is an in-memory io.WriteSeeker that counts the bytes written to
+// it.
+type seekBuffer struct {
+	b       []byte
+	pos     int
+	written int
+}
+
+func (s *seekBuffer) Write(p []byte) (int, error) {
+	if end := s.pos + len(p); end > len(s.b) {
+		s.b = append(s.b, make([]byte, end-len(s.b))...)
+	}
+	copy(s.b[s.pos:], p)
+	s.pos += len(p)
+	s.written += len(p)
+	return len(p), nil
+}
+
+func (s *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		s.pos = int(offset)
+	case io.SeekCurrent:
+		s.pos += int(offset)
+	case io.SeekEnd:
+		s.pos = len(s.b) + int(offset)
+	}
+	return int64(s.pos), nil
+}
+
+func TestWriteToSparse(t *testing.T) {
+	var data []byte
+	data = append(data, bytes.Repeat([]byte("x"), 100)...)
+	data = append(data, make([]byte, 3*sparseBlockSize)...)
+	data = append(data, bytes.Repeat([]byte("y"), sparseBlockSize)...)
+	data = append(data, make([]byte, sparseBlockSize+10)...)
+	sparse := testRegular("sparse", string(data))
+	sparse.attr |= FILE_ATTRIBUTE_SPARSE_FILE
+	img := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		sparse,
+		testRegular("dense", string(data)),
+	)})).Image[0]
+
+	for _, tc := range []struct {
+		name    string
+		written int
+	}{
+		// The first block holds the x's, so two zero blocks are skipped
+		// in the middle. At the end, all but the final byte is skipped.
+		{"sparse", 3*sparseBlockSize + 1},
+		{"dense", len(data)},
+	} {
+		f, err := img.OpenFile(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var w seekBuffer
+		n, err := f.WriteTo(&w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(data)) || !bytes.Equal(w.b, data) {
+			t.Errorf("%s: unexpected contents of %d bytes", tc.name, n)
+		}
+		if w.written != tc.written {
+			t.Errorf("%s: wrote %d bytes, expected %d", tc.name, w.written, tc.written)
+		}
+
+		// Writers that cannot seek get every byte.
+		var buf bytes.Buffer
+		if n, err := f.WriteTo(&buf); err != nil || n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("%s: unexpected result writing %d bytes to a buffer: %v", tc.name, n, err)
+		}
+	}
+
+	dest := t.TempDir()
+	if err := mustOpenRoot(t, img).Extract(dest, nil); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dest, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Error("unexpected contents of extracted sparse file")
+	}
+}
@@ -0,0 +1,51 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// NewReaderFromParts returns a Reader for a split WIM, such as a set of .swm
+// files, given all of its parts in any order. The parts must share the WIM
+// GUID and each part number must appear exactly once.
+//
+// The images come from the first part, which holds their metadata. Each
+// part's offset table lists the resources stored in that part, and File.Open
+// and Stream.Open read a resource from the part recorded in its offset table
+// entry.
+func NewReaderFromParts(parts []io.ReaderAt) (*Reader, error) {
+	if len(parts) == 0 {
+		return nil, errors.New("no WIM parts given")
+	}
+	readers := make([]*Reader, len(parts))
+	var first *Reader
+	for _, f := range parts {
+		r, err := newReader(f, nil, true)
+		if err != nil {
+			return nil, err
+		}
+		n := int(r.hdr.PartNumber)
+		switch {
+		case int(r.hdr.TotalParts) != len(parts):
+			return nil, fmt.Errorf("WIM part %d is one of %d parts, but %d were given", n, r.hdr.TotalParts, len(parts))
+		case n < 1 || n > len(parts):
+			return nil, fmt.Errorf("invalid WIM part number %d", n)
+		case readers[n-1] != nil:
+			return nil, fmt.Errorf("WIM part %d given more than once", n)
+		case first != nil && r.hdr.WIMGuid != first.hdr.WIMGuid:
+			return nil, fmt.Errorf("WIM part %d has GUID %s, expected %s", n, r.hdr.WIMGuid, first.hdr.WIMGuid)
+		}
+		if first == nil {
+			first = r
+		}
+		readers[n-1] = r
+	}
+
+	r := readers[0]
+	r.bases = readers[1:]
+	return r, nil
+}
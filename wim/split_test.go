@@ -0,0 +1,134 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// buildSplitWIM returns the n parts of a split WIM containing images. File
+// resources are assigned to the parts in turn, and each part's offset table
+// lists only the resources in that part. Every part holds a copy of the whole
+// WIM body, but the resources of other parts are overwritten, so reads from
+// the wrong part are detected.
+func buildSplitWIM(tb testing.TB, n int, images ...*testImage) [][]byte {
+	tb.Helper()
+
+	b := &wimBuilder{seen: make(map[SHA1Hash]bool)}
+	whole := b.build(tb, "<WIM></WIM>", images...)
+	r := mustNewReader(tb, whole)
+
+	var hdr wimHeader
+	if err := binary.Read(bytes.NewReader(whole), binary.LittleEndian, &hdr); err != nil {
+		tb.Fatal(err)
+	}
+	hdr.Flags |= hdrFlagSpanned
+	hdr.TotalParts = uint16(n)
+	hdr.WIMGuid.Data1 = 0x12345678
+
+	var parts [][]byte
+	for part := 1; part <= n; part++ {
+		out := append([]byte(nil), whole...)
+		var table bytes.Buffer
+		if part == 1 {
+			for _, img := range r.Image {
+				_ = binary.Write(&table, binary.LittleEndian, &streamDescriptor{
+					resourceDescriptor: img.offset,
+					PartNumber:         1,
+					RefCount:           1,
+					Hash:               img.hash,
+				})
+			}
+		}
+		for i, res := range b.resources {
+			if i%n == part-1 {
+				res.PartNumber = uint16(part)
+				_ = binary.Write(&table, binary.LittleEndian, &res)
+			} else {
+				copy(out[res.Offset:res.Offset+res.CompressedSize()], bytes.Repeat([]byte{0xaa}, int(res.CompressedSize())))
+			}
+		}
+
+		phdr := hdr
+		phdr.PartNumber = uint16(part)
+		phdr.OffsetTable = resourceDescriptor{
+			FlagsAndCompressedSize: uint64(table.Len()),
+			Offset:                 int64(len(out)),
+			OriginalSize:           int64(table.Len()),
+		}
+		out = append(out, table.Bytes()...)
+		var h bytes.Buffer
+		_ = binary.Write(&h, binary.LittleEndian, &phdr)
+		copy(out, h.Bytes())
+		parts = append(parts, out)
+	}
+	return parts
+}
+
+func readerAts(parts ...[]byte) []io.ReaderAt {
+	var ras []io.ReaderAt
+	for _, p := range parts {
+		ras = append(ras, bytes.NewReader(p))
+	}
+	return ras
+}
+
+func TestNewReaderFromParts(t *testing.T) {
+	var files []*testFile
+	for i := 0; i < 6; i++ {
+		files = append(files, testRegular(fmt.Sprint("file", i), fmt.Sprint("contents of file ", i)))
+	}
+	parts := buildSplitWIM(t, 3, &testImage{name: "split", root: testDir("", files...)})
+
+	if _, err := NewReader(bytes.NewReader(parts[0])); !errors.Is(err, ErrMultiPartUnsupported) || !strings.Contains(err.Error(), "NewReaderFromParts") {
+		t.Fatalf("unexpected error opening a single part: %v", err)
+	}
+
+	r, err := NewReaderFromParts(readerAts(parts[2], parts[0], parts[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Image) != 1 {
+		t.Fatalf("got %d images", len(r.Image))
+	}
+	for i := range files {
+		f, err := r.Image[0].OpenFile(fmt.Sprint("file", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprint("contents of file ", i); string(b) != expected {
+			t.Errorf("%s: got %q, expected %q", f.Name, b, expected)
+		}
+	}
+
+	badGUID := append([]byte(nil), parts[1]...)
+	badGUID[24]++
+	for _, tc := range []struct {
+		name  string
+		parts [][]byte
+	}{
+		{"missing part", [][]byte{parts[0], parts[1]}},
+		{"duplicate part", [][]byte{parts[0], parts[1], parts[1]}},
+		{"mismatched GUID", [][]byte{parts[0], badGUID, parts[2]}},
+	} {
+		if _, err := NewReaderFromParts(readerAts(tc.parts...)); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import "fmt"
+
+// imageStats holds statistics computed by walking an image's directory tree.
+type imageStats struct {
+	files int
+	dirs  int
+
+	// fileBytes is the total size of the data streams of every file, counting
+	// hard-linked files once.
+	fileBytes int64
+	// uniqueBytes is the total size of the distinct resources referenced by
+	// the image.
+	uniqueBytes int64
+}
+
+// stats returns the image's tree statistics, walking the tree on first use and
+// caching the result for subsequent calls.
+func (img *Image) stats() (*imageStats, error) {
+	img.statsMu.Lock()
+	defer img.statsMu.Unlock()
+
+	if img.cachedStats != nil {
+		return img.cachedStats, nil
+	}
+	st := &imageStats{}
+	links := make(map[int64]bool)
+	resources := make(map[SHA1Hash]bool)
+	// Junctions are never followed, so that each entry is counted once.
+	err := img.walkTree(false, func(_ string, f *File) error {
+		if f.IsDir() {
+			st.dirs++
+		} else {
+			st.files++
+		}
+
+		linked := f.LinkID != 0 && links[f.LinkID]
+		links[f.LinkID] = true
+		add := func(hash SHA1Hash, size int64) {
+			if !linked {
+				st.fileBytes += size
+			}
+			if hash != (SHA1Hash{}) && !resources[hash] {
+				resources[hash] = true
+				st.uniqueBytes += size
+			}
+		}
+		add(f.Hash, f.Size)
+		for _, s := range f.Streams {
+			add(s.Hash, s.Size)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	img.cachedStats = st
+	return st, nil
+}
+
+// FileCount returns the number of non-directory entries in the image, counting
+// each hard link separately. The tree is walked on the first call to FileCount
+// or DirCount and the counts are cached for subsequent calls.
+func (img *Image) FileCount() (int, error) {
+	st, err := img.stats()
+	if err != nil {
+		return 0, err
+	}
+	return st.files, nil
+}
+
+// DirCount returns the number of directories in the image, including the root
+// directory. The tree is walked on the first call to FileCount or DirCount and
+// the counts are cached for subsequent calls.
+func (img *Image) DirCount() (int, error) {
+	st, err := img.stats()
+	if err != nil {
+		return 0, err
+	}
+	return st.dirs, nil
+}
+
+// TotalSize returns the number of bytes that extracting the image writes: the
+// total size of the data streams of its files, including alternate data
+// streams, counting hard-linked files once. If the image's XML information
+// declares a nonzero TOTALBYTES, that is returned without walking the tree;
+// otherwise the tree is walked on first use, as for FileCount. The declared
+// size may count identical contents in distinct files only once, depending on
+// the writer; VerifyDeclaredSize checks it against the tree.
+func (img *Image) TotalSize() (int64, error) {
+	if img.TotalBytes > 0 {
+		return img.TotalBytes, nil
+	}
+	st, err := img.stats()
+	if err != nil {
+		return 0, err
+	}
+	return st.fileBytes, nil
+}
+
+// VerifyDeclaredSize checks the total size declared by the TOTALBYTES element
+// of the image's XML information against the data actually referenced by its
+// directory tree. Writers differ in whether identical contents in distinct
+// files are counted once or for each file, so the declared size must lie
+// between the size of the distinct resources referenced by the image and the
+// total size of its files, counting hard links once. An image whose XML omits
+// TOTALBYTES is treated as declaring zero bytes.
+func (img *Image) VerifyDeclaredSize() error {
+	st, err := img.stats()
+	if err != nil {
+		return err
+	}
+	if img.TotalBytes < st.uniqueBytes || img.TotalBytes > st.fileBytes {
+		return &ParseError{
+			Oper: "declared size",
+			Err: fmt.Errorf("XML declares %d bytes but the image references %d bytes (%d bytes distinct)",
+				img.TotalBytes, st.fileBytes, st.uniqueBytes),
+		}
+	}
+	return nil
+}
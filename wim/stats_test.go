@@ -0,0 +1,85 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFileAndDirCount(t *testing.T) {
+	r := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		testDir("a", testRegular("1", "1"), testRegular("2", "2")),
+		testDir("b", testDir("c")),
+		testRegular("3", "3"),
+	)}))
+	img := r.Image[0]
+
+	for i := 0; i < 2; i++ {
+		files, err := img.FileCount()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs, err := img.DirCount()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files != 3 || dirs != 4 {
+			t.Errorf("got %d files and %d dirs", files, dirs)
+		}
+	}
+	if img.cachedStats == nil {
+		t.Error("expected counts to be cached")
+	}
+}
+
+func TestVerifyDeclaredSize(t *testing.T) {
+	a := testRegular("a", "shared")
+	b := testRegular("b", "shared")
+	c := testRegular("c", "unique!")
+	c.streams = []testStream{{name: "ads", data: []byte("ads")}}
+	images := []*testImage{{name: "test", root: testDir("", a, b, c)}}
+
+	for _, tc := range []struct {
+		total int64
+		ok    bool
+	}{
+		{6 + 7 + 3, true},      // distinct resources only
+		{6 + 6 + 7 + 3, true},  // every file
+		{6 + 7, false},         // too small
+		{6 + 6 + 7 + 4, false}, // too large
+	} {
+		xml := fmt.Sprintf(`<WIM><IMAGE INDEX="1"><NAME>test</NAME><TOTALBYTES>%d</TOTALBYTES></IMAGE></WIM>`, tc.total)
+		r := mustNewReader(t, buildWIMWithXML(t, xml, images...))
+		if err := r.Image[0].VerifyDeclaredSize(); (err == nil) != tc.ok {
+			t.Errorf("TOTALBYTES %d: unexpected result %v", tc.total, err)
+		}
+	}
+}
+
+func TestTotalSize(t *testing.T) {
+	a := testRegular("a", "shared")
+	b := testRegular("b", "shared")
+	c := testRegular("c", "unique!")
+	c.streams = []testStream{{name: "ads", data: []byte("ads")}}
+	l1 := testRegular("l1", "linked")
+	l1.linkID = 1
+	l2 := testRegular("l2", "linked")
+	l2.linkID = 1
+	images := []*testImage{{name: "test", root: testDir("", a, b, testDir("d", c), l1, l2)}}
+
+	img := mustNewReader(t, buildWIM(t, images...)).Image[0]
+	if n, err := img.TotalSize(); err != nil || n != 6+6+7+3+6 {
+		t.Errorf("unexpected walked size %d: %v", n, err)
+	}
+
+	xml := `<WIM><IMAGE INDEX="1"><NAME>test</NAME><TOTALBYTES>12345</TOTALBYTES></IMAGE></WIM>`
+	img = mustNewReader(t, buildWIMWithXML(t, xml, images...)).Image[0]
+	if n, err := img.TotalSize(); err != nil || n != 12345 {
+		t.Errorf("unexpected declared size %d: %v", n, err)
+	}
+	if img.cachedStats != nil {
+		t.Error("the declared size should not walk the tree")
+	}
+}
@@ -0,0 +1,59 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// timeoutReaderAt bounds the time each ReadAt call on the underlying reader may
+// take.
+type timeoutReaderAt struct {
+	r io.ReaderAt
+	d time.Duration
+}
+
+type readAtResult struct {
+	n   int
+	err error
+}
+
+// ReadAt reads from the underlying reader on a separate goroutine into a
+// private buffer, so that a read that outlives its deadline cannot write into
+// b after ReadAt has returned. Such a read keeps running in the background
+// until the underlying reader returns.
+func (t *timeoutReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	buf := make([]byte, len(b))
+	ch := make(chan readAtResult, 1)
+	go func() {
+		n, err := t.r.ReadAt(buf, off)
+		ch <- readAtResult{n, err}
+	}()
+
+	timer := time.NewTimer(t.d)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		copy(b, buf[:res.n])
+		return res.n, res.err
+	case <-timer.C:
+		return 0, fmt.Errorf("read of %d bytes at offset %d: %w", len(b), off, os.ErrDeadlineExceeded)
+	}
+}
+
+// OpenTimeout is like Open, but each read issued against the underlying WIM
+// file while reading the contents must complete within d. A read that takes
+// longer fails with an error wrapping os.ErrDeadlineExceeded rather than
+// blocking indefinitely, which is useful when the WIM is on slow or unreliable
+// storage.
+func (f *File) OpenTimeout(d time.Duration) (io.ReadCloser, error) {
+	rc, err := f.src.resourceReaderAt(&timeoutReaderAt{r: f.src.r, d: d}, &f.offset, 0)
+	if err != nil || !f.src.opts.VerifyHashes {
+		return rc, err
+	}
+	return newVerifyReader(rc, f.Name, f.Hash, f.offset.Offset), nil
+}
@@ -0,0 +1,61 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// blockingReaderAt blocks reads at or after a given offset until unblocked.
+type blockingReaderAt struct {
+	r       *bytes.Reader
+	from    int64
+	release chan struct{}
+}
+
+func (b *blockingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= b.from {
+		<-b.release
+	}
+	return b.r.ReadAt(p, off)
+}
+
+func TestOpenTimeout(t *testing.T) {
+	data := buildWIM(t, &testImage{name: "test", root: testDir("", testRegular("file", "file content"))})
+	ra := &blockingReaderAt{r: bytes.NewReader(data), from: int64(len(data)), release: make(chan struct{})}
+	defer close(ra.release)
+
+	r, err := NewReader(ra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := mustOpenRoot(t, r.Image[0]).Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := files[0].OpenTimeout(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(rc)
+	if err != nil || string(b) != "file content" {
+		t.Fatalf("unexpected result %q, %v", b, err)
+	}
+
+	// Block all further reads.
+	ra.from = 0
+	rc, err = files[0].OpenTimeout(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(rc); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
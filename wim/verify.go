@@ -0,0 +1,318 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"crypto/sha1" //nolint:gosec // not used for secure application
+	"fmt"
+	"hash"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// HashMismatchError is returned when the SHA1 hash of data read from the WIM
+// does not match the hash recorded for it.
+type HashMismatchError struct {
+	Expected SHA1Hash
+	Actual   SHA1Hash
+	// Offset is the offset in the WIM file of the resource holding the data,
+	// or -1 if the data was not read from a WIM by this package.
+	Offset int64
+}
+
+func (e *HashMismatchError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("hash mismatch: expected %x, got %x", e.Expected, e.Actual)
+	}
+	return fmt.Sprintf("hash mismatch in resource at offset %d: expected %x, got %x", e.Offset, e.Expected, e.Actual)
+}
+
+// SizeMismatchError is returned by a reader from NewVerifyingReader when the
+// data ends after a different number of bytes than expected.
+type SizeMismatchError struct {
+	Expected int64
+	Actual   int64
+}
+
+func (e *SizeMismatchError) Error() string {
+	return fmt.Sprintf("size mismatch: expected %d bytes, got %d", e.Expected, e.Actual)
+}
+
+// verifyingReader computes the SHA1 hash and size of the data read through it
+// and checks them once the end of the data is reached.
+type verifyingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	hash SHA1Hash
+	size int64 // or -1 to not check the size
+	n    int64
+	// name and offset identify the data in errors from WIM resources; name is
+	// "" for readers returned by NewVerifyingReader.
+	name   string
+	offset int64
+	err    error
+}
+
+// NewVerifyingReader returns a reader that reads from r and, once r reports
+// io.EOF, checks that it produced size bytes whose SHA1 hash is expected. On a
+// mismatch, the final Read and all later ones return a *SizeMismatchError or a
+// *HashMismatchError in place of io.EOF. A negative size skips the size check,
+// and a zero hash, which WIMs record for empty contents, skips the hash check.
+//
+// The readers returned by File.OpenVerified and Stream.OpenVerified are built
+// on the same checks; NewVerifyingReader is for data that reaches the caller
+// some other way, such as a Stream opened without verification or contents
+// extracted earlier.
+func NewVerifyingReader(r io.Reader, expected SHA1Hash, size int64) io.Reader {
+	return &verifyingReader{
+		r:      r,
+		h:      sha1.New(), //nolint:gosec // not used for secure application
+		hash:   expected,
+		size:   size,
+		offset: -1,
+	}
+}
+
+func (v *verifyingReader) Read(b []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err := v.r.Read(b)
+	v.h.Write(b[:n])
+	v.n += int64(n)
+	if err == io.EOF { //nolint:errorlint
+		if verr := v.check(); verr != nil {
+			v.err = verr
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+// check returns an error if the data read so far does not match the expected
+// size and hash.
+func (v *verifyingReader) check() error {
+	var err error
+	if v.size >= 0 && v.n != v.size {
+		err = &SizeMismatchError{Expected: v.size, Actual: v.n}
+	} else if v.hash != (SHA1Hash{}) {
+		var actual SHA1Hash
+		copy(actual[:], v.h.Sum(nil))
+		if actual != v.hash {
+			err = &HashMismatchError{Expected: v.hash, Actual: actual, Offset: v.offset}
+		}
+	}
+	if err != nil && v.name != "" {
+		err = &ParseError{Oper: "verify", Path: v.name, Err: err}
+	}
+	return err
+}
+
+// verifyReader verifies the contents of a WIM resource against the hash
+// recorded for them as they are read.
+type verifyReader struct {
+	verifyingReader
+	c io.Closer
+}
+
+// newVerifyReader returns a reader that verifies the data read from r against
+// expected. offset is the offset of the resource in the WIM, for errors.
+func newVerifyReader(r io.ReadCloser, name string, expected SHA1Hash, offset int64) io.ReadCloser {
+	if expected == (SHA1Hash{}) {
+		// There is no hash to check against for empty contents.
+		return r
+	}
+	return &verifyReader{
+		verifyingReader: verifyingReader{
+			r:      r,
+			h:      sha1.New(), //nolint:gosec // not used for secure application
+			hash:   expected,
+			size:   -1,
+			name:   name,
+			offset: offset,
+		},
+		c: r,
+	}
+}
+
+// Close closes the underlying reader. If a hash mismatch was detected, it is
+// returned again so that callers that only check the result of Close still see
+// it.
+func (v *verifyReader) Close() error {
+	err := v.c.Close()
+	if v.err != nil {
+		return v.err
+	}
+	return err
+}
+
+// OpenVerified is like Open, but the returned reader verifies the file's
+// contents against its recorded SHA1 hash as they are read, regardless of
+// Options.VerifyHashes. Once the end of the contents is reached, a mismatch is
+// reported by Read and again by Close.
+func (f *File) OpenVerified() (io.ReadCloser, error) {
+	r, err := f.src.resourceReader(&f.offset)
+	if err != nil {
+		return nil, err
+	}
+	return newVerifyReader(r, f.Name, f.Hash, f.offset.Offset), nil
+}
+
+// OpenVerified is like Open, but the returned reader verifies the stream's
+// contents against its recorded SHA1 hash as they are read, regardless of
+// Options.VerifyHashes. Once the end of the contents is reached, a mismatch is
+// reported by Read and again by Close.
+func (s *Stream) OpenVerified() (io.ReadCloser, error) {
+	r, err := s.wim.resourceReader(&s.offset)
+	if err != nil {
+		return nil, err
+	}
+	return newVerifyReader(r, s.Name, s.Hash, s.offset.Offset), nil
+}
+
+// VerifyError describes a file or stream whose contents, as found through the
+// offset table, do not match the hash recorded in its directory entry.
+type VerifyError struct {
+	// Path is the slash-separated path of the file relative to the image
+	// root, and Stream the name of the alternate data stream, or "" for the
+	// unnamed data stream.
+	Path   string
+	Stream string
+	// Offset is the offset in the WIM file of the resource holding the data.
+	Offset   int64
+	Expected SHA1Hash
+	// Actual is the hash of the contents, or zero if Err is set.
+	Actual SHA1Hash
+	// Err is the error that stopped the contents from being read in full.
+	Err error
+}
+
+func (e *VerifyError) Error() string {
+	name := e.Path
+	if e.Stream != "" {
+		name += ":" + e.Stream
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%s: reading resource at offset %d: %s", name, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("%s: hash mismatch in resource at offset %d: expected %x, got %x", name, e.Offset, e.Expected, e.Actual)
+}
+
+func (e *VerifyError) Unwrap() error { return e.Err }
+
+// verifyJob is a resource to be hashed by VerifyContents, along with the
+// files and streams that refer to it.
+type verifyJob struct {
+	src    *Reader
+	rd     resourceDescriptor
+	hash   SHA1Hash
+	refs   []VerifyError
+	actual SHA1Hash
+	err    error
+}
+
+// VerifyContents checks the contents of every file and alternate data stream
+// in the image against the SHA1 hash recorded in its directory entry, and
+// returns the ones that do not match, in the order they were walked. Unlike
+// VerifyIntegrity, which only covers the bytes of the WIM file, this catches
+// an offset table that points entries at the wrong resources.
+//
+// Each distinct resource is read once, and resources are hashed in parallel,
+// bounded by GOMAXPROCS, as they are streamed from the WIM. Contents that
+// cannot be read, such as because they fail to decompress, are reported as a
+// VerifyError with Err set. The returned error is only for failures to walk
+// the image.
+func (img *Image) VerifyContents() ([]VerifyError, error) {
+	var jobs []*verifyJob
+	byHash := make(map[SHA1Hash]*verifyJob)
+	add := func(src *Reader, rd resourceDescriptor, hash SHA1Hash, ref VerifyError) {
+		if hash == (SHA1Hash{}) {
+			return
+		}
+		j := byHash[hash]
+		if j == nil {
+			j = &verifyJob{src: src, rd: rd, hash: hash}
+			byHash[hash] = j
+			jobs = append(jobs, j)
+		}
+		ref.Offset = rd.Offset
+		ref.Expected = hash
+		j.refs = append(j.refs, ref)
+	}
+	err := img.walk(func(p string, f *File) error {
+		add(f.src, f.offset, f.Hash, VerifyError{Path: p})
+		for _, s := range f.Streams {
+			add(s.wim, s.offset, s.Hash, VerifyError{Path: p, Stream: s.Name})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *verifyJob)
+	var wg sync.WaitGroup
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range ch {
+				j.actual, j.err = j.src.hashResource(&j.rd)
+			}
+		}()
+	}
+	for _, j := range jobs {
+		ch <- j
+	}
+	close(ch)
+	wg.Wait()
+
+	var mismatches []VerifyError
+	for _, j := range jobs {
+		if j.err == nil && j.actual == j.hash {
+			continue
+		}
+		for _, ref := range j.refs {
+			ref.Actual = j.actual
+			ref.Err = j.err
+			mismatches = append(mismatches, ref)
+		}
+	}
+	return mismatches, nil
+}
+
+// verifyResource checks the contents of the resource described by the offset
+// table entry sd against the hash recorded in the entry.
+func (r *Reader) verifyResource(sd *streamDescriptor) error {
+	actual, err := r.hashResource(&sd.resourceDescriptor)
+	if err != nil {
+		return err
+	}
+	if actual != sd.Hash {
+		return &HashMismatchError{Expected: sd.Hash, Actual: actual, Offset: sd.Offset}
+	}
+	return nil
+}
+
+// hashResource returns the SHA1 hash of the uncompressed contents of the
+// resource described by rd.
+func (r *Reader) hashResource(rd *resourceDescriptor) (SHA1Hash, error) {
+	rc, err := r.resourceReader(rd)
+	if err != nil {
+		return SHA1Hash{}, err
+	}
+	defer rc.Close()
+	h := sha1.New() //nolint:gosec // not used for secure application
+	if _, err := io.Copy(h, rc); err != nil {
+		return SHA1Hash{}, err
+	}
+	var sum SHA1Hash
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
@@ -0,0 +1,254 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestVerifyMetadata(t *testing.T) {
+	b := buildWIM(t, &testImage{name: "test", root: testDir("", testRegular("file", "data"))})
+	// Corrupt the file name, which leaves the metadata parseable.
+	i := bytes.Index(b, utf16Bytes("file"))
+	b[i] = 'F'
+
+	if _, err := mustNewReader(t, b).Image[0].Open(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReaderWithOptions(bytes.NewReader(b), &Options{VerifyMetadata: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mismatch *HashMismatchError
+	if _, err := r.Image[0].Open(); !errors.As(err, &mismatch) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestVerifyHashes(t *testing.T) {
+	b := buildWIM(t, &testImage{name: "test", root: testDir("", testRegular("file", "file contents"))})
+	i := bytes.Index(b, []byte("file contents"))
+	b[i] = 'F'
+
+	open := func(opts *Options) io.ReadCloser {
+		t.Helper()
+		r, err := NewReaderWithOptions(bytes.NewReader(b), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := r.Image[0].FindByPath("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rc
+	}
+
+	rc := open(nil)
+	if _, err := io.ReadAll(rc); err != nil {
+		t.Fatalf("unverified read failed: %v", err)
+	}
+	rc.Close()
+
+	rc = open(&Options{VerifyHashes: true})
+	_, err := io.ReadAll(rc)
+	var mismatch *HashMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if mismatch.Offset != int64(i) || mismatch.Expected != sha1Hash([]byte("file contents")) {
+		t.Errorf("unexpected mismatch %+v", mismatch)
+	}
+	if err := rc.Close(); !errors.As(err, &mismatch) {
+		t.Errorf("Close returned %v", err)
+	}
+}
+
+func TestVerifyResources(t *testing.T) {
+	b := buildWIM(t, &testImage{name: "test", root: testDir("", testRegular("file", "file contents"))})
+	off := bytes.Index(b, []byte("file contents"))
+	b[off] = 'F'
+
+	// Without the option, the WIM opens, and the entry can be found.
+	index := -1
+	for i, res := range mustNewReader(t, b).Resources() {
+		if res.Hash == sha1Hash([]byte("file contents")) {
+			index = i
+		}
+	}
+	if index < 0 {
+		t.Fatal("resource not found")
+	}
+
+	_, err := NewReaderWithOptions(bytes.NewReader(b), &Options{VerifyResources: true})
+	var perr *ParseError
+	var mismatch *HashMismatchError
+	if !errors.As(err, &perr) || !errors.As(err, &mismatch) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if mismatch.Offset != int64(off) || !strings.Contains(err.Error(), fmt.Sprintf("resource %d:", index)) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	r, err := NewReaderWithOptions(bytes.NewReader(b), &Options{VerifyResources: true, Recovery: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := r.Warnings(); len(w) != 1 || !errors.As(w[0], &mismatch) {
+		t.Errorf("unexpected warnings %v", w)
+	}
+	// The entry is dropped, so the file's data cannot be found.
+	if _, err := r.Image[0].FindByPath("file"); err == nil {
+		t.Error("expected an error for a file whose resource was dropped")
+	}
+
+	b[off] = 'f'
+	if _, err := NewReaderWithOptions(bytes.NewReader(b), &Options{VerifyResources: true}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestStreamOpenVerified(t *testing.T) {
+	f := testRegular("file", "file content")
+	f.streams = []testStream{{name: "ads", data: []byte("stream content")}}
+	b := buildWIM(t, &testImage{name: "test", root: testDir("", f)})
+
+	for _, corrupt := range []bool{false, true} {
+		data := append([]byte(nil), b...)
+		if corrupt {
+			data[bytes.Index(data, []byte("stream content"))] ^= 0xff
+		}
+		r := mustNewReader(t, data)
+		files, err := mustOpenRoot(t, r.Image[0]).Readdir()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rc, err := files[0].Streams[0].OpenVerified()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadAll(rc)
+		cerr := rc.Close()
+
+		var mismatch *HashMismatchError
+		if corrupt {
+			if !errors.As(err, &mismatch) || !errors.As(cerr, &mismatch) {
+				t.Fatalf("expected hash mismatch, got %v and %v", err, cerr)
+			}
+		} else if err != nil || cerr != nil {
+			t.Fatalf("unexpected errors %v and %v", err, cerr)
+		}
+	}
+}
+
+func TestVerifyingReader(t *testing.T) {
+	const data = "some contents"
+	hash := sha1Hash([]byte(data))
+	for _, tc := range []struct {
+		name     string
+		data     string
+		hash     SHA1Hash
+		size     int64
+		mismatch error
+	}{
+		{"match", data, hash, int64(len(data)), nil},
+		{"unchecked size", data, hash, -1, nil},
+		{"unchecked hash", data, SHA1Hash{}, int64(len(data)), nil},
+		{"hash", "Some contents", hash, int64(len(data)), &HashMismatchError{}},
+		{"short", data[:4], hash, int64(len(data)), &SizeMismatchError{}},
+		{"long", data + "!", hash, int64(len(data)), &SizeMismatchError{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewVerifyingReader(strings.NewReader(tc.data), tc.hash, tc.size)
+			b, err := io.ReadAll(r)
+			switch want := tc.mismatch.(type) {
+			case nil:
+				if err != nil || string(b) != tc.data {
+					t.Fatalf("got %q, %v", b, err)
+				}
+			case *HashMismatchError:
+				if !errors.As(err, &want) || want.Expected != hash || want.Offset != -1 {
+					t.Fatalf("unexpected error %v", err)
+				}
+			case *SizeMismatchError:
+				if !errors.As(err, &want) || want.Expected != int64(len(data)) || want.Actual != int64(len(tc.data)) {
+					t.Fatalf("unexpected error %v", err)
+				}
+			}
+			if tc.mismatch != nil {
+				if _, err2 := r.Read(make([]byte, 1)); !errors.Is(err2, err) {
+					t.Errorf("later Read returned %v", err2)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyContents(t *testing.T) {
+	a := testRegular("a", "contents of a")
+	a.streams = []testStream{{name: "ads", data: []byte("contents of b")}}
+	b := buildWIM(t, &testImage{name: "test", root: testDir("",
+		a,
+		testRegular("b", "contents of b"),
+		testRegular("c", "contents of c"),
+		testRegular("copy", "contents of c"),
+		testRegular("empty", ""),
+	)})
+	if errs, err := mustNewReader(t, b).Image[0].VerifyContents(); err != nil || len(errs) != 0 {
+		t.Fatalf("unexpected result for an intact WIM: %v %v", errs, err)
+	}
+
+	// Point the offset table entry for b's contents at a's, and corrupt c's
+	// contents.
+	var hdr wimHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	aOff := bytes.Index(b, []byte("contents of a"))
+	bOff := bytes.Index(b, []byte("contents of b"))
+	size := binary.Size(streamDescriptor{})
+	for i := 0; i < int(hdr.OffsetTable.OriginalSize)/size; i++ {
+		entry := b[int(hdr.OffsetTable.Offset)+i*size:]
+		if binary.LittleEndian.Uint64(entry[8:]) == uint64(bOff) {
+			binary.LittleEndian.PutUint64(entry[8:], uint64(aOff))
+		}
+	}
+	b[bytes.Index(b, []byte("contents of c"))] = 'C'
+
+	errs, err := mustNewReader(t, b).Image[0].VerifyContents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		path, stream string
+		actual       SHA1Hash
+	}{
+		{"a", "ads", sha1Hash([]byte("contents of a"))},
+		{"b", "", sha1Hash([]byte("contents of a"))},
+		{"c", "", sha1Hash([]byte("Contents of c"))},
+		{"copy", "", sha1Hash([]byte("Contents of c"))},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("unexpected mismatches %v", errs)
+	}
+	for i, e := range expected {
+		got := errs[i]
+		if got.Path != e.path || got.Stream != e.stream || got.Actual != e.actual || got.Err != nil {
+			t.Errorf("mismatch %d: unexpected %v", i, &got)
+		}
+	}
+	if errs[1].Expected != sha1Hash([]byte("contents of b")) || errs[1].Offset != int64(aOff) {
+		t.Errorf("unexpected mismatch %+v", errs[1])
+	}
+}
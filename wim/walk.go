@@ -0,0 +1,212 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// FileRecord is a flattened description of a single file or directory in an
+// image, suitable for export to external systems.
+type FileRecord struct {
+	// Path is the slash-separated path of the file relative to the image
+	// root. The root directory itself has the path ".".
+	Path string
+	FileHeader
+	Streams []StreamHeader
+}
+
+// Records walks the image and returns a record for every file and directory
+// in it, in depth-first order starting with the root directory.
+func (img *Image) Records() ([]FileRecord, error) {
+	var records []FileRecord
+	err := img.walk(func(p string, f *File) error {
+		rec := FileRecord{Path: p, FileHeader: f.FileHeader}
+		for _, s := range f.Streams {
+			rec.Streams = append(rec.Streams, s.StreamHeader)
+		}
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// WalkAll walks every image in the WIM, calling fn for each file and directory
+// in depth-first order. Images are walked in parallel, bounded by GOMAXPROCS,
+// so fn may be called concurrently for files of different images; calls for
+// files of the same image are never concurrent.
+//
+// The first error returned by fn or encountered while walking stops all walks
+// and is returned annotated with the index of the image it came from.
+func (r *Reader) WalkAll(fn func(img *Image, path string, f *File) error) error {
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		failed   int32
+		firstErr error
+	)
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for i, img := range r.Image {
+		sem <- struct{}{}
+		if atomic.LoadInt32(&failed) != 0 {
+			break
+		}
+		wg.Add(1)
+		go func(i int, img *Image) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := img.walk(func(p string, f *File) error {
+				if atomic.LoadInt32(&failed) != 0 {
+					return errWalkAborted
+				}
+				return fn(img, p, f)
+			})
+			if err != nil && !errors.Is(err, errWalkAborted) {
+				once.Do(func() {
+					firstErr = fmt.Errorf("image %d: %w", i+1, err)
+					atomic.StoreInt32(&failed, 1)
+				})
+			}
+		}(i, img)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+var errWalkAborted = errors.New("walk aborted")
+
+// Walk walks the image's directory tree, calling fn for each file and
+// directory in depth-first order, starting with the root directory ".". Paths
+// are slash-separated and relative to the image root.
+//
+// Walk follows the conventions of filepath.Walk. If the root cannot be opened,
+// fn is called with a nil File and the error. If a directory cannot be read,
+// fn is called for it with the error and the directory is not descended into.
+// This includes a directory whose entries are those of one of its ancestors,
+// which corrupt metadata can describe.
+// If fn returns filepath.SkipDir for a directory, its contents are skipped; for
+// any other file, the remaining files in the containing directory are skipped.
+// Any other error returned by fn stops the walk and is returned by Walk.
+//
+// Reparse points, including junctions, are visited but not descended into,
+// unless the Reader was opened with Options.FollowReparse, in which case
+// junctions whose targets lie within the image are walked as if they were the
+// target directory.
+func (img *Image) Walk(fn func(path string, f *File, err error) error) error {
+	root, err := img.Open()
+	if err != nil {
+		err = fn(".", nil, err)
+	} else {
+		err = img.newWalker(img.wim.opts.FollowReparse, fn).walk(root, ".")
+	}
+	if errors.Is(err, filepath.SkipDir) {
+		return nil
+	}
+	return err
+}
+
+// walk calls fn for every file in the image, starting with the root directory.
+// If the Reader was opened with Options.FollowReparse, junctions whose targets
+// lie within the image are walked as if they were the target directory.
+func (img *Image) walk(fn func(p string, f *File) error) error {
+	return img.walkTree(img.wim.opts.FollowReparse, fn)
+}
+
+// walkTree is like walk, but follows junctions only if follow is set. Errors
+// reading directories stop the walk.
+func (img *Image) walkTree(follow bool, fn func(p string, f *File) error) error {
+	root, err := img.Open()
+	if err != nil {
+		return err
+	}
+	return img.newWalker(follow, stopOnError(fn)).walk(root, ".")
+}
+
+// stopOnError adapts fn for use by a walker, stopping the walk at the first
+// error reading the tree.
+func stopOnError(fn func(p string, f *File) error) func(p string, f *File, err error) error {
+	return func(p string, f *File, err error) error {
+		if err != nil {
+			return err
+		}
+		return fn(p, f)
+	}
+}
+
+func (*Image) newWalker(follow bool, fn func(p string, f *File, err error) error) *walker {
+	return &walker{fn: fn, follow: follow}
+}
+
+// errDirectoryCycle is reported, in a ParseError, for a directory whose
+// subdirectory data is that of one of its ancestors, which would otherwise be
+// walked forever.
+var errDirectoryCycle = errors.New("directory contains one of its ancestors")
+
+type walker struct {
+	fn     func(p string, f *File, err error) error
+	follow bool // whether junctions are walked as their target directories
+	// active holds the subdirectory offsets of the directories currently being
+	// walked, so that neither junctions nor corrupt metadata leading back to
+	// one of them are walked again.
+	active map[int64]bool
+}
+
+// walk calls fn for f and then, if f is a directory, for each file in the tree
+// rooted at f in depth-first order. p is the path of f; the paths of its
+// descendants are formed by joining their names onto it. It returns
+// filepath.SkipDir if fn did so for a file that is not walked as a directory.
+func (w *walker) walk(f *File, p string) error {
+	d := f
+	if w.follow {
+		t, err := f.resolveJunction(0)
+		if err != nil {
+			return w.fn(p, f, err)
+		}
+		if t != nil {
+			d = t
+		}
+	}
+	if !d.IsDir() || d != f && w.active[d.subdirOffset] {
+		return w.fn(p, f, nil)
+	}
+
+	var files []*File
+	var err error
+	if w.active[d.subdirOffset] {
+		err = &ParseError{Oper: "directory entry", Path: p, Err: errDirectoryCycle}
+	} else {
+		files, err = d.Readdir()
+	}
+	if err1 := w.fn(p, f, err); err1 != nil || err != nil {
+		if errors.Is(err1, filepath.SkipDir) {
+			return nil
+		}
+		return err1
+	}
+	if w.active == nil {
+		w.active = make(map[int64]bool)
+	}
+	w.active[d.subdirOffset] = true
+	defer delete(w.active, d.subdirOffset)
+	for _, c := range files {
+		if err := w.walk(c, path.Join(p, c.Name)); err != nil {
+			if errors.Is(err, filepath.SkipDir) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
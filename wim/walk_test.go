@@ -0,0 +1,326 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRecords(t *testing.T) {
+	deep := testDir("d5", testRegular("leaf.txt", "leaf"))
+	for _, name := range []string{"d4", "d3", "d2", "d1"} {
+		deep = testDir(name, deep)
+	}
+	f := testRegular("file.txt", "data")
+	f.streams = []testStream{{name: "ads", data: []byte("stream")}}
+
+	r := mustNewReader(t, buildWIM(t, &testImage{
+		name: "test",
+		root: testDir("", deep, f),
+	}))
+	records, err := r.Image[0].Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, rec := range records {
+		paths = append(paths, rec.Path)
+	}
+	expected := []string{
+		".",
+		"d1",
+		"d1/d2",
+		"d1/d2/d3",
+		"d1/d2/d3/d4",
+		"d1/d2/d3/d4/d5",
+		"d1/d2/d3/d4/d5/leaf.txt",
+		"file.txt",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("unexpected paths %q", paths)
+	}
+
+	last := records[len(records)-1]
+	if last.Size != 4 || len(last.Streams) != 1 || last.Streams[0].Name != "ads" || last.Streams[0].Size != 6 {
+		t.Errorf("unexpected record %+v", last)
+	}
+}
+
+func TestWalkAll(t *testing.T) {
+	var images []*testImage
+	for i := 0; i < 4; i++ {
+		images = append(images, &testImage{
+			name: fmt.Sprint("image", i),
+			root: testDir("", testDir("dir", testRegular("a", "a"), testRegular("b", fmt.Sprint(i)))),
+		})
+	}
+	r := mustNewReader(t, buildWIM(t, images...))
+
+	var m sync.Mutex
+	counts := make(map[*Image]int)
+	err := r.WalkAll(func(img *Image, _ string, _ *File) error {
+		m.Lock()
+		counts[img]++
+		m.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range r.Image {
+		if counts[img] != 4 {
+			t.Errorf("image %s: visited %d files", img.Name, counts[img])
+		}
+	}
+
+	err = r.WalkAll(func(img *Image, p string, _ *File) error {
+		if img == r.Image[2] && p == "dir/b" {
+			return errBoom
+		}
+		return nil
+	})
+	if !errors.Is(err, errBoom) || !strings.HasPrefix(err.Error(), "image 3: ") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestWalkInto(t *testing.T) {
+	f := testRegular("file.txt", "data")
+	f.streams = []testStream{{name: "ads", data: []byte("stream")}}
+	img := mustNewReader(t, buildWIM(t, &testImage{
+		name: "test",
+		root: testDir("",
+			testDir("dir", testRegular("a", "a"), testDir("sub", testRegular("b", "bb"))),
+			f,
+			testRegular("日本語", "x"),
+		),
+	})).Image[0]
+
+	records, err := img.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf WalkBuffer
+	for pass := 0; pass < 2; pass++ {
+		i := 0
+		err := img.WalkInto(&buf, func(e *WalkEntry) error {
+			if i >= len(records) {
+				return errors.New("too many entries")
+			}
+			rec := records[i]
+			if string(e.Path) != rec.Path || (i > 0 && string(e.Name) != rec.Name) ||
+				e.Size != rec.Size || e.Hash != rec.Hash || e.Attributes != rec.Attributes || e.IsDir() != rec.IsDir() {
+				t.Errorf("entry %d: got %s %+v, expected %+v", i, e.Path, e, rec)
+			}
+			i++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i != len(records) {
+			t.Fatalf("visited %d entries, expected %d", i, len(records))
+		}
+	}
+
+	if err := img.WalkInto(nil, func(*WalkEntry) error { return errBoom }); !errors.Is(err, errBoom) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var paths []string
+	err = mustNewReader(t, cyclicWIM(t)).Image[0].WalkInto(&buf, func(e *WalkEntry) error {
+		paths = append(paths, string(e.Path))
+		return nil
+	})
+	if !isDirectoryCycle(err) {
+		t.Fatalf("unexpected error %v for a directory that contains itself", err)
+	}
+	if expected := []string{".", "parent", "parent/file", "parent/loop"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("unexpected paths %q", paths)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	b := buildWIM(t, &testImage{name: "test", root: testDir("",
+		testDir("a", testRegular("a1", "1"), testRegular("a2", "2")),
+		testDir("b", testRegular("b1", "1"), testRegular("b2", "2"), testRegular("b3", "3")),
+		testJunction("link", `\??\C:\a`),
+		testRegular("zfile", "z"),
+	)})
+
+	walk := func(img *Image, skip string, stop string) ([]string, error) {
+		var paths []string
+		err := img.Walk(func(p string, f *File, err error) error {
+			if err != nil {
+				return err
+			}
+			paths = append(paths, p)
+			switch p {
+			case skip:
+				return filepath.SkipDir
+			case stop:
+				return errBoom
+			}
+			return nil
+		})
+		return paths, err
+	}
+
+	img := mustNewReader(t, b).Image[0]
+	paths, err := walk(img, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{".", "a", "a/a1", "a/a2", "b", "b/b1", "b/b2", "b/b3", "link", "zfile"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("unexpected paths %q", paths)
+	}
+
+	paths, err = walk(img, "a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{".", "a", "b", "b/b1", "b/b2", "b/b3", "link", "zfile"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("skipping a directory: unexpected paths %q", paths)
+	}
+
+	paths, err = walk(img, "b/b2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{".", "a", "a/a1", "a/a2", "b", "b/b1", "b/b2", "link", "zfile"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("skipping from a file: unexpected paths %q", paths)
+	}
+
+	if paths, err := walk(img, ".", ""); err != nil || len(paths) != 1 {
+		t.Errorf("skipping the root: unexpected paths %q: %v", paths, err)
+	}
+
+	if paths, err := walk(img, "", "b/b1"); !errors.Is(err, errBoom) || paths[len(paths)-1] != "b/b1" {
+		t.Errorf("unexpected paths %q: %v", paths, err)
+	}
+
+	r, err := NewReaderWithOptions(bytes.NewReader(b), &Options{FollowReparse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err = walk(r.Image[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{".", "a", "a/a1", "a/a2", "b", "b/b1", "b/b2", "b/b3", "link", "link/a1", "link/a2", "zfile"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("following junctions: unexpected paths %q", paths)
+	}
+}
+
+// cyclicWIM returns a WIM in which the directory parent/loop has the entries
+// of its parent, so that it contains itself.
+func cyclicWIM(tb testing.TB) []byte {
+	tb.Helper()
+	b := buildWIM(tb, &testImage{name: "test", root: testDir("",
+		testDir("parent", testRegular("file", "data"), testDir("loop")),
+	)})
+	// The SubdirOffset field is 16 bytes into the entry, whose name follows
+	// the 8-byte length and the fixed fields.
+	subdirOffset := func(name string) int {
+		return bytes.Index(b, utf16Bytes(name)) - int(direntrySize) + 16
+	}
+	copy(b[subdirOffset("loop"):], b[subdirOffset("parent"):subdirOffset("parent")+8])
+	return b
+}
+
+// isDirectoryCycle reports whether err is a ParseError for a directory that
+// contains one of its ancestors.
+func isDirectoryCycle(err error) bool {
+	var perr *ParseError
+	return errors.As(err, &perr) && errors.Is(err, errDirectoryCycle)
+}
+
+func TestWalkCycle(t *testing.T) {
+	img := mustNewReader(t, cyclicWIM(t)).Image[0]
+	if _, err := img.Records(); !isDirectoryCycle(err) {
+		t.Errorf("Records: unexpected error %v", err)
+	}
+	if err := img.wim.WalkAll(func(*Image, string, *File) error { return nil }); !isDirectoryCycle(err) {
+		t.Errorf("WalkAll: unexpected error %v", err)
+	}
+	if _, err := img.FileCount(); !isDirectoryCycle(err) {
+		t.Errorf("FileCount: unexpected error %v", err)
+	}
+	if _, err := mustOpenRoot(t, img).SecurityDescriptors(); !isDirectoryCycle(err) {
+		t.Errorf("SecurityDescriptors: unexpected error %v", err)
+	}
+
+	// Walk reports the directory and carries on without descending into it.
+	var paths []string
+	err := img.Walk(func(p string, f *File, err error) error {
+		paths = append(paths, p)
+		if p == "parent/loop" && !isDirectoryCycle(err) {
+			t.Errorf("Walk: unexpected error %v for %s", err, p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{".", "parent", "parent/file", "parent/loop"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("unexpected paths %q", paths)
+	}
+}
+
+var errBoom = errors.New("boom")
+
+func largeNestedTestTree(dirs, files int) *testFile {
+	root := testDir("")
+	for i := 0; i < dirs; i++ {
+		d := testDir(fmt.Sprintf("dir%03d", i))
+		for j := 0; j < files; j++ {
+			d.children = append(d.children, testRegular(fmt.Sprintf("file%05d.txt", j), fmt.Sprint(j)))
+		}
+		root.children = append(root.children, d)
+	}
+	return root
+}
+
+func BenchmarkWalk(b *testing.B) {
+	img := mustNewReader(b, buildWIM(b, &testImage{name: "large", root: largeNestedTestTree(100, 100)})).Image[0]
+
+	b.Run("File", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			n := 0
+			if err := img.walk(func(p string, _ *File) error {
+				n += len(p)
+				return nil
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("WalkInto", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf WalkBuffer
+		for i := 0; i < b.N; i++ {
+			n := 0
+			if err := img.WalkInto(&buf, func(e *WalkEntry) error {
+				n += len(e.Path)
+				return nil
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,404 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// WalkEntry describes a file or directory visited by Image.WalkInto. The same
+// WalkEntry is reused for every call to the walk function, and Path and Name
+// refer to storage owned by the WalkBuffer, so none of its fields may be
+// retained after the walk function returns.
+type WalkEntry struct {
+	// Path is the UTF-8, slash-separated path of the file relative to the
+	// image root. The root directory itself has the path ".".
+	Path []byte
+	// Name is the final element of Path. It is empty for the root directory.
+	Name []byte
+
+	Attributes     uint32
+	CreationTime   Filetime
+	LastAccessTime Filetime
+	LastWriteTime  Filetime
+	Hash           SHA1Hash
+	Size           int64
+	LinkID         int64
+	ReparseTag     uint32
+}
+
+// IsDir returns whether the entry is a directory. It returns false when it is
+// a directory reparse point.
+func (e *WalkEntry) IsDir() bool {
+	return e.Attributes&(FILE_ATTRIBUTE_DIRECTORY|FILE_ATTRIBUTE_REPARSE_POINT) == FILE_ATTRIBUTE_DIRECTORY
+}
+
+// WalkBuffer holds the storage used by Image.WalkInto. Reusing a WalkBuffer
+// across walks avoids nearly all per-entry allocations once it has grown to
+// fit the image. The zero value is ready to use. A WalkBuffer must not be used
+// by more than one walk at a time.
+type WalkBuffer struct {
+	entry  WalkEntry
+	path   []byte
+	names  []byte
+	fixed  [94]byte // binary.Size(direntry{})
+	stream [30]byte // binary.Size(streamentry{})
+	levels []*walkLevel
+}
+
+// walkLevel holds the entries of one directory while its children are being
+// walked.
+type walkLevel struct {
+	offset  int64 // the offset of the directory's entries
+	entries []walkRecord
+	names   []byte
+}
+
+type walkRecord struct {
+	nameStart, nameEnd int
+	attributes         uint32
+	creationTime       Filetime
+	lastAccessTime     Filetime
+	lastWriteTime      Filetime
+	hash               SHA1Hash
+	size               int64
+	linkID             int64
+	reparseTag         uint32
+	subdirOffset       int64
+	unnamedStream      bool // whether a stream entry held the unnamed stream
+}
+
+// isDir returns whether e has subdirectory data to walk.
+func (e *walkRecord) isDir() bool {
+	return e.attributes&(FILE_ATTRIBUTE_DIRECTORY|FILE_ATTRIBUTE_REPARSE_POINT) == FILE_ATTRIBUTE_DIRECTORY
+}
+
+func (buf *WalkBuffer) level(depth int, offset int64) *walkLevel {
+	for len(buf.levels) <= depth {
+		buf.levels = append(buf.levels, &walkLevel{})
+	}
+	lvl := buf.levels[depth]
+	lvl.offset = offset
+	lvl.entries = lvl.entries[:0]
+	lvl.names = lvl.names[:0]
+	return lvl
+}
+
+// walking reports whether the entries at offset are those of one of the
+// directories above depth, which are being walked.
+func (buf *WalkBuffer) walking(depth int, offset int64) bool {
+	for _, lvl := range buf.levels[:depth] {
+		if lvl.offset == offset {
+			return true
+		}
+	}
+	return false
+}
+
+// WalkInto calls fn for every file and directory in the image in depth-first
+// order, starting with the root directory, in the same order as Records.
+//
+// Unlike the *File based APIs, WalkInto does not allocate a File or strings
+// for each entry: the entry passed to fn is reused and its Path and Name are
+// backed by buf. This makes it suitable for indexing very large images when
+// each entry is consumed immediately. If buf is nil, a new WalkBuffer is used.
+//
+// Named streams, security descriptors, and short names are not reported. If fn
+// returns an error, the walk stops and the error is returned. A directory
+// whose entries are those of one of its ancestors stops the walk with a
+// ParseError.
+func (img *Image) WalkInto(buf *WalkBuffer, fn func(*WalkEntry) error) error {
+	if buf == nil {
+		buf = &WalkBuffer{}
+	}
+	if err := img.load(); err != nil {
+		return err
+	}
+	root := buf.level(0, img.rootOffset)
+	if err := img.scanDir(buf, root, img.rootOffset); err != nil {
+		return err
+	}
+	if len(root.entries) != 1 {
+		return &ParseError{Oper: "root directory", Err: errors.New("expected exactly 1 root directory entry")}
+	}
+
+	buf.path = append(buf.path[:0], '.')
+	e := &root.entries[0]
+	buf.setEntry(e, nil)
+	if err := fn(&buf.entry); err != nil {
+		return err
+	}
+	if !e.isDir() {
+		return nil
+	}
+	buf.path = buf.path[:0]
+	return img.walkInto(buf, 1, e.subdirOffset, fn)
+}
+
+func (img *Image) walkInto(buf *WalkBuffer, depth int, offset int64, fn func(*WalkEntry) error) error {
+	lvl := buf.level(depth, offset)
+	if err := img.scanDir(buf, lvl, offset); err != nil {
+		return err
+	}
+	base := len(buf.path)
+	for i := range lvl.entries {
+		e := &lvl.entries[i]
+		buf.path = buf.path[:base]
+		if base > 0 {
+			buf.path = append(buf.path, '/')
+		}
+		buf.path = append(buf.path, lvl.names[e.nameStart:e.nameEnd]...)
+		buf.setEntry(e, buf.path[len(buf.path)-(e.nameEnd-e.nameStart):])
+		if err := fn(&buf.entry); err != nil {
+			return err
+		}
+		if e.isDir() {
+			if buf.walking(depth+1, e.subdirOffset) {
+				return &ParseError{Oper: "directory entry", Path: string(buf.path), Err: errDirectoryCycle}
+			}
+			if err := img.walkInto(buf, depth+1, e.subdirOffset, fn); err != nil {
+				return err
+			}
+		}
+	}
+	buf.path = buf.path[:base]
+	return nil
+}
+
+func (buf *WalkBuffer) setEntry(e *walkRecord, name []byte) {
+	buf.entry = WalkEntry{
+		Path:           buf.path,
+		Name:           name,
+		Attributes:     e.attributes,
+		CreationTime:   e.creationTime,
+		LastAccessTime: e.lastAccessTime,
+		LastWriteTime:  e.lastWriteTime,
+		Hash:           e.hash,
+		Size:           e.size,
+		LinkID:         e.linkID,
+		ReparseTag:     e.reparseTag,
+	}
+}
+
+// scanDir reads the directory entries at offset into lvl. It performs the same
+// validation as readNextEntry but decodes the entries by hand, without
+// reflection, so that it does not allocate once buf and lvl have grown.
+func (img *Image) scanDir(buf *WalkBuffer, lvl *walkLevel, offset int64) error {
+	img.m.Lock()
+	defer img.m.Unlock()
+
+	if err := img.seekDir(offset); err != nil {
+		return err
+	}
+	for {
+		n, err := img.scanEntry(buf, lvl)
+		err = atOffset("directory entry", err, img.curOffset)
+		img.curOffset += n
+		if err == io.EOF { //nolint:errorlint
+			return nil
+		}
+		if err != nil {
+			img.reset()
+			return err
+		}
+	}
+}
+
+func (img *Image) scanEntry(buf *WalkBuffer, lvl *walkLevel) (int64, error) {
+	br := img.br
+	if _, err := io.ReadFull(br, buf.fixed[:8]); err != nil {
+		return 0, &ParseError{Oper: "directory length check", Err: err}
+	}
+	length := int64(binary.LittleEndian.Uint64(buf.fixed[:8]))
+	if length == 0 {
+		return 8, io.EOF
+	}
+	left := length
+	if left < direntrySize {
+		return 0, &ParseError{Oper: "directory entry", Err: errors.New("size too short")}
+	}
+	if err := img.checkEntryLength("directory entry", img.curOffset, length); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(br, buf.fixed[:]); err != nil {
+		return 0, &ParseError{Oper: "directory entry", Err: unexpectedEOF(err)}
+	}
+	left -= direntrySize
+
+	d := buf.fixed[:]
+	le := binary.LittleEndian
+	e := walkRecord{
+		attributes:     le.Uint32(d[0:]),
+		subdirOffset:   int64(le.Uint64(d[8:])),
+		creationTime:   Filetime{le.Uint32(d[32:]), le.Uint32(d[36:])},
+		lastAccessTime: Filetime{le.Uint32(d[40:]), le.Uint32(d[44:])},
+		lastWriteTime:  Filetime{le.Uint32(d[48:]), le.Uint32(d[52:])},
+	}
+	copy(e.hash[:], d[56:76])
+	reparseHardLink := le.Uint64(d[80:])
+	streamCount := le.Uint16(d[88:])
+	shortNameLength := le.Uint16(d[90:])
+	fileNameLength := le.Uint16(d[92:])
+
+	if fileNameLength%2 != 0 || shortNameLength%2 != 0 {
+		return 0, &ParseError{Oper: "directory entry", Err: errors.New("odd name length")}
+	}
+	if left < namesLength(fileNameLength, shortNameLength) {
+		return 0, &ParseError{Oper: "directory entry", Err: errors.New("size too short for names")}
+	}
+	if cap(buf.names) < int(fileNameLength) {
+		buf.names = make([]byte, fileNameLength)
+	}
+	raw := buf.names[:fileNameLength]
+	if _, err := io.ReadFull(br, raw); err != nil {
+		return 0, &ParseError{Oper: "file name", Err: unexpectedEOF(err)}
+	}
+	left -= int64(fileNameLength)
+
+	e.nameStart = len(lvl.names)
+	lvl.names = appendUTF16(lvl.names, raw)
+	e.nameEnd = len(lvl.names)
+
+	if e.hash != (SHA1Hash{}) {
+		_, rd, ok := img.wim.lookupResource(e.hash)
+		if !ok {
+			return 0, &ParseError{
+				Oper: "directory entry",
+				Path: string(lvl.names[e.nameStart:e.nameEnd]),
+				Err:  fmt.Errorf("could not find file data matching hash %v", e.hash),
+			}
+		}
+		e.size = rd.OriginalSize
+	}
+
+	isDir := false
+	if e.attributes&FILE_ATTRIBUTE_REPARSE_POINT == 0 {
+		e.linkID = int64(reparseHardLink)
+		isDir = e.attributes&FILE_ATTRIBUTE_DIRECTORY != 0
+	} else {
+		e.reparseTag = uint32(reparseHardLink)
+	}
+	if isDir && e.subdirOffset == 0 {
+		return 0, &ParseError{Oper: "directory entry", Path: string(lvl.names[e.nameStart:e.nameEnd]), Err: errors.New("no subdirectory data for directory")}
+	} else if !isDir && e.subdirOffset != 0 {
+		return 0, &ParseError{Oper: "directory entry", Path: string(lvl.names[e.nameStart:e.nameEnd]), Err: errors.New("unexpected subdirectory data for non-directory")}
+	} else if err := img.checkSubdirOffset(e.subdirOffset); err != nil {
+		return 0, &ParseError{Oper: "directory entry", Path: string(lvl.names[e.nameStart:e.nameEnd]), Err: err}
+	}
+
+	if err := discard(br, left); err != nil {
+		return 0, err
+	}
+
+	for i := uint16(0); i < streamCount; i++ {
+		pos := img.curOffset + length
+		n, err := img.scanStream(buf, &e, pos)
+		length += n
+		if err != nil {
+			return 0, atOffset("stream entry", err, pos)
+		}
+	}
+
+	lvl.entries = append(lvl.entries, e)
+	return length, nil
+}
+
+// scanStream skips over the stream entry at offset pos of the metadata
+// resource, recording the hash and size of the entry's first unnamed stream in
+// e.
+func (img *Image) scanStream(buf *WalkBuffer, e *walkRecord, pos int64) (int64, error) {
+	br := img.br
+	if _, err := io.ReadFull(br, buf.fixed[:8]); err != nil {
+		return 0, &ParseError{Oper: "stream length check", Err: unexpectedEOF(err)}
+	}
+	length := int64(binary.LittleEndian.Uint64(buf.fixed[:8]))
+	left := length
+	if left < streamentrySize {
+		return 0, &ParseError{Oper: "stream entry", Err: errors.New("size too short")}
+	}
+	if err := img.checkEntryLength("stream entry", pos, length); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(br, buf.stream[:]); err != nil {
+		return 0, &ParseError{Oper: "stream entry", Err: unexpectedEOF(err)}
+	}
+	left -= streamentrySize
+
+	nameLength := int64(int16(binary.LittleEndian.Uint16(buf.stream[28:])))
+	if nameLength < 0 || nameLength%2 != 0 {
+		return 0, &ParseError{Oper: "stream entry", Err: fmt.Errorf("invalid name length %d", nameLength)}
+	}
+	if left < nameLength {
+		return 0, &ParseError{Oper: "stream entry", Err: errors.New("size too short for name")}
+	}
+	if !e.unnamedStream && nameLength == 0 {
+		e.unnamedStream = true
+		var hash SHA1Hash
+		copy(hash[:], buf.stream[8:28])
+		var rd resourceDescriptor
+		if hash != (SHA1Hash{}) {
+			var ok bool
+			_, rd, ok = img.wim.lookupResource(hash)
+			if !ok {
+				return 0, &ParseError{Oper: "stream entry", Err: fmt.Errorf("could not find file data matching hash %v", hash)}
+			}
+		}
+		e.hash = hash
+		e.size = rd.OriginalSize
+	}
+	if err := discard(br, left); err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+// appendUTF16 appends the UTF-8 encoding of the little-endian UTF-16 string b
+// to dst.
+func appendUTF16(dst, b []byte) []byte {
+	var enc [utf8.UTFMax]byte
+	for i := 0; i+1 < len(b); i += 2 {
+		r := rune(binary.LittleEndian.Uint16(b[i:]))
+		if utf16.IsSurrogate(r) && i+3 < len(b) {
+			r2 := rune(binary.LittleEndian.Uint16(b[i+2:]))
+			if dr := utf16.DecodeRune(r, r2); dr != utf8.RuneError {
+				r = dr
+				i += 2
+			} else {
+				r = utf8.RuneError
+			}
+		} else if utf16.IsSurrogate(r) {
+			r = utf8.RuneError
+		}
+		n := utf8.EncodeRune(enc[:], r)
+		dst = append(dst, enc[:n]...)
+	}
+	return dst
+}
+
+func discard(r *bufio.Reader, n int64) error {
+	for n > 0 {
+		m := n
+		if m > chunkSize {
+			m = chunkSize
+		}
+		if _, err := r.Discard(int(m)); err != nil {
+			return unexpectedEOF(err)
+		}
+		n -= m
+	}
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF { //nolint:errorlint
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -1,21 +1,33 @@
 //go:build windows || linux
 // +build windows linux
 
-// Package wim implements a WIM file parser.
+// Package wim implements a WIM file parser and writer.
 //
 // WIM files are used to distribute Windows file system and container images.
 // They are documented at https://msdn.microsoft.com/en-us/library/windows/desktop/dd861280.aspx.
+//
+// A Reader, its Images, and their Files and Streams may be used concurrently
+// from multiple goroutines, provided the io.ReaderAt the Reader was created
+// from may be. Reading directories of one image is serialized, since they
+// share one metadata reader, but file and stream contents are read
+// independently. The readers returned by File.Open and Stream.Open are not
+// themselves safe for concurrent use, except for their ReadAt methods.
+// Reader.Close must not be called while other operations are in progress.
 package wim
 
 import (
+	"bufio"
 	"bytes"
-	"crypto/sha1" //nolint:gosec // not used for secure application
+	"context"
 	"encoding/binary"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"unicode/utf16"
@@ -104,11 +116,15 @@ const (
 	resFlagMetadata
 	resFlagCompressed
 	resFlagSpanned
+	resFlagSolid
 )
 
-const validate = false
+const supportedResFlags = resFlagFree | resFlagMetadata | resFlagCompressed | resFlagSpanned | resFlagSolid
 
-const supportedResFlags = resFlagMetadata | resFlagCompressed
+// solidResourceMagic is the original size recorded in the offset table for the
+// entries that describe solid resources themselves, as opposed to the streams
+// packed within them.
+const solidResourceMagic = 0x100000000
 
 func (r *resourceDescriptor) Flags() resFlag {
 	return resFlag(r.FlagsAndCompressedSize >> 56)
@@ -118,6 +134,22 @@ func (r *resourceDescriptor) CompressedSize() int64 {
 	return int64(r.FlagsAndCompressedSize & 0xffffffffffffff)
 }
 
+// checkReadable returns an error if the resource is stored in a way that
+// cannot be read on its own. Streams packed in solid resources are read
+// through their solid resource instead.
+func (r *resourceDescriptor) checkReadable() error {
+	if r.Flags()&resFlagSolid != 0 {
+		return errors.New("streams in solid resources are not stored separately")
+	}
+	if r.Flags()&resFlagSpanned != 0 {
+		return errors.New("reading resources that span parts of a split WIM is not supported")
+	}
+	if r.OriginalSize < 0 {
+		return fmt.Errorf("invalid original size %d", r.OriginalSize)
+	}
+	return nil
+}
+
 func (r *resourceDescriptor) String() string {
 	s := fmt.Sprintf("%d bytes at %d", r.CompressedSize(), r.Offset)
 	if r.Flags()&4 != 0 {
@@ -155,9 +187,22 @@ const (
 	hdrFlagCompressReserved hdrFlag = 1 << (iota + 16)
 	hdrFlagCompressXpress
 	hdrFlagCompressLzx
+	hdrFlagCompressLzms
+)
+
+const supportedHdrFlags = hdrFlagRpFix | hdrFlagReadOnly | hdrFlagWriteInProgress | hdrFlagSpanned |
+	hdrFlagCompressed | hdrFlagCompressXpress | hdrFlagCompressLzx | hdrFlagCompressLzms
+
+// Known WIM format versions. Version 1.13 is written by all current versions of
+// imagex and DISM; solid (ESD) WIMs use a distinct version number.
+const (
+	wimVersionMajor = 0x10000
+	wimVersionSolid = 0xe00
 )
 
-const supportedHdrFlags = hdrFlagRpFix | hdrFlagReadOnly | hdrFlagCompressed | hdrFlagCompressLzx
+// maxImageCount bounds the number of images a header may declare before it is
+// considered implausible.
+const maxImageCount = 0xffff
 
 type wimHeader struct {
 	ImageTag        [8]byte
@@ -201,8 +246,27 @@ type direntry struct {
 	FileNameLength   uint16
 }
 
+var wimHeaderSize = uint32(binary.Size(wimHeader{}))
+
 var direntrySize = int64(binary.Size(direntry{}) + 8) // includes an 8-byte length prefix
 
+// rawDirent is a directory entry as read by readNextEntry.
+type rawDirent struct {
+	direntry
+	// Length is the entry's length prefix, excluding its streams.
+	Length int64
+	// nameBytes is the number of bytes of names and terminators read after
+	// the fixed fields, which precede extra.
+	nameBytes int64
+	// terminatedEmptyName is set if the entry has only a short name, which
+	// follows a terminator in place of the empty long name.
+	terminatedEmptyName bool
+	// extra holds the bytes between the end of the names and the end of the
+	// entry: alignment padding and any tagged items. It is reused for each
+	// entry.
+	extra bytes.Buffer
+}
+
 type streamentry struct {
 	Unused     int64
 	Hash       SHA1Hash
@@ -217,10 +281,33 @@ type Filetime struct {
 	HighDateTime uint32
 }
 
-// Time returns the time as time.Time.
+// Ticks returns the time as the number of 100-nanosecond intervals since
+// January 1, 1601 UTC, exactly as Windows APIs such as SetFileTime take it.
+func (ft *Filetime) Ticks() uint64 {
+	return uint64(ft.HighDateTime)<<32 | uint64(ft.LowDateTime)
+}
+
+// FiletimeFromTicks returns the Filetime for the given number of 100-nanosecond
+// intervals since January 1, 1601 UTC.
+func FiletimeFromTicks(ticks uint64) Filetime {
+	return Filetime{LowDateTime: uint32(ticks), HighDateTime: uint32(ticks >> 32)}
+}
+
+// IsZero reports whether ft is zero, which WIMs use for a time that was not
+// recorded.
+func (ft *Filetime) IsZero() bool {
+	return ft.LowDateTime == 0 && ft.HighDateTime == 0
+}
+
+// Time returns the time as time.Time. A zero Filetime, which means that no
+// time was recorded, returns the zero time.Time, for which IsZero is true,
+// rather than January 1, 1601.
 func (ft *Filetime) Time() time.Time {
+	if ft.IsZero() {
+		return time.Time{}
+	}
 	// 100-nanosecond intervals since January 1, 1601
-	nsec := int64(ft.HighDateTime)<<32 + int64(ft.LowDateTime)
+	nsec := int64(ft.Ticks())
 	// change starting time to the Epoch (00:00:00 UTC, January 1, 1970)
 	nsec -= 116444736000000000
 	// convert into nanoseconds
@@ -240,11 +327,11 @@ func (ft *Filetime) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 		return err
 	}
 
-	low, err := strconv.ParseUint(t.Low, 0, 32)
+	low, err := parseXMLUint32(t.Low)
 	if err != nil {
 		return err
 	}
-	high, err := strconv.ParseUint(t.High, 0, 32)
+	high, err := parseXMLUint32(t.High)
 	if err != nil {
 		return err
 	}
@@ -254,17 +341,35 @@ func (ft *Filetime) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	return nil
 }
 
+// parseXMLUint32 parses a number from the WIM XML, treating an empty or
+// missing value as zero.
+func parseXMLUint32(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(s, 0, 32)
+}
+
 type info struct {
 	Image []ImageInfo `xml:"IMAGE"`
 }
 
-// ImageInfo contains information about the image.
+// ImageInfo contains information about the image. Elements missing from the
+// XML are left as zero values.
 type ImageInfo struct {
-	Name         string       `xml:"NAME"`
-	Index        int          `xml:"INDEX,attr"`
-	CreationTime Filetime     `xml:"CREATIONTIME"`
-	ModTime      Filetime     `xml:"LASTMODIFICATIONTIME"`
-	Windows      *WindowsInfo `xml:"WINDOWS"`
+	Name               string       `xml:"NAME"`
+	Index              int          `xml:"INDEX,attr"`
+	Description        string       `xml:"DESCRIPTION"`
+	DisplayName        string       `xml:"DISPLAYNAME"`
+	DisplayDescription string       `xml:"DISPLAYDESCRIPTION"`
+	Flags              string       `xml:"FLAGS"`
+	NumDirs            int64        `xml:"DIRCOUNT"`  // directory count recorded in the XML
+	NumFiles           int64        `xml:"FILECOUNT"` // file count recorded in the XML
+	CreationTime       Filetime     `xml:"CREATIONTIME"`
+	ModTime            Filetime     `xml:"LASTMODIFICATIONTIME"`
+	TotalBytes         int64        `xml:"TOTALBYTES"`
+	Windows            *WindowsInfo `xml:"WINDOWS"`
 }
 
 // WindowsInfo contains information about the Windows installation in the image.
@@ -289,27 +394,207 @@ type Version struct {
 	SPLevel int `xml:"SPLEVEL"`
 }
 
+var (
+	// ErrNoBootMetadata is returned by Reader.BootMetadata when the WIM header
+	// does not reference a boot metadata resource.
+	ErrNoBootMetadata = errors.New("WIM has no boot metadata")
+
+	// ErrNotWIM is returned, wrapped in a *ParseError, when the file does not
+	// start with the WIM image tag.
+	ErrNotWIM = errors.New("not a WIM file")
+
+	// ErrUnsupportedCompression is returned when a WIM uses a compression
+	// format or chunk size that the Reader cannot decompress.
+	ErrUnsupportedCompression = errors.New("unsupported compression")
+
+	// ErrMultiPartUnsupported is returned by NewReader and
+	// NewReaderWithOptions for a part of a split WIM, which must be opened
+	// with NewReaderFromParts instead.
+	ErrMultiPartUnsupported = errors.New("multi-part WIM not supported; use NewReaderFromParts")
+
+	// ErrImageNotFound is returned, wrapped, by Reader.ImageByIndex and
+	// Reader.ImageByName when no image matches.
+	ErrImageNotFound = errors.New("image not found")
+
+	// ErrResourceNotFound is returned by Reader.OpenResource when no
+	// resource has the given hash.
+	ErrResourceNotFound = errors.New("resource not found")
+)
+
 // ParseError is returned when the WIM cannot be parsed.
 type ParseError struct {
 	Oper string
 	Path string
-	Err  error
+	// Offset is the position of the structure that failed to parse within
+	// the resource holding it: the offset table for offset table entries, or
+	// the image's metadata resource for directory and stream entries. It is
+	// zero if unknown.
+	Offset int64
+	Err    error
 }
 
 func (e *ParseError) Error() string {
+	oper := e.Oper
+	if e.Offset != 0 {
+		oper = fmt.Sprintf("%s (offset %d)", e.Oper, e.Offset)
+	}
 	if e.Path == "" {
-		return "WIM parse error at " + e.Oper + ": " + e.Err.Error()
+		return "WIM parse error at " + oper + ": " + e.Err.Error()
+	}
+	return fmt.Sprintf("WIM parse error: %s %s: %s", oper, e.Path, e.Err.Error())
+}
+
+// atOffset returns err with its offset set to off. A *ParseError that does
+// not already record an offset is updated in place; other errors are wrapped
+// in a ParseError for oper. io.EOF, which marks the end of a directory, is
+// returned unchanged.
+func atOffset(oper string, err error, off int64) error {
+	if err == nil || err == io.EOF { //nolint:errorlint
+		return err
+	}
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		return &ParseError{Oper: oper, Offset: off, Err: err}
 	}
-	return fmt.Sprintf("WIM parse error: %s %s: %s", e.Oper, e.Path, e.Err.Error())
+	if perr.Offset == 0 {
+		perr.Offset = off
+	}
+	return err
 }
 
 func (e *ParseError) Unwrap() error { return e.Err }
 
+// DefaultDirBufferSize is the size of the buffer used to read directory
+// entries when Options.DirBufferSize is not set. It is a multiple of the
+// compression chunk size so that buffered reads align with chunk boundaries.
+const DefaultDirBufferSize = 64 * 1024
+
+// DefaultMaxEntryLength is the maximum length of a directory or stream entry
+// when Options.MaxEntryLength is not set. Entries hold at most two names of
+// 64KB each and a few small tagged items, so real entries are far smaller.
+const DefaultMaxEntryLength = 1024 * 1024
+
+// Options controls optional behavior of a Reader.
+type Options struct {
+	// DirBufferSize is the size of the buffer used when reading directory
+	// entries from an image's metadata resource. Larger buffers reduce the
+	// number of reads issued against the underlying file for images with large
+	// directory trees. If zero, DefaultDirBufferSize is used.
+	DirBufferSize int
+
+	// Recovery relaxes validation of damaged WIMs where a reasonable default
+	// can be assumed instead, so that salvage tools can read as much of the
+	// WIM as possible. Currently this assumes the default 32KB chunk size for
+	// compressed WIMs whose header reports a chunk size of zero.
+	Recovery bool
+
+	// FollowReparse causes OpenFile and walks of an image to follow directory
+	// junctions whose targets resolve to a directory inside the same image, so
+	// that the tree is presented as Windows would present the mounted volume.
+	// Junctions that would lead back to a directory already being walked are
+	// not followed.
+	FollowReparse bool
+
+	// CollectMetrics enables the decompression counters reported by
+	// Reader.Metrics. It is off by default to avoid the cost of timing each
+	// chunk.
+	CollectMetrics bool
+
+	// VerifyMetadata causes an image's metadata resource to be checked
+	// against the SHA1 hash recorded for it in the offset table before it is
+	// first parsed, so that corrupt metadata is reported as a
+	// HashMismatchError rather than as a confusing parse error later. This
+	// requires reading the whole metadata resource an extra time.
+	VerifyMetadata bool
+
+	// VerifyHashes causes readers returned by File.Open and Stream.Open to
+	// compute the SHA1 hash of the data as it is read and to fail with a
+	// HashMismatchError at the end of the data if it does not match the hash
+	// recorded in the WIM. Verification is streaming and does not buffer the
+	// contents.
+	VerifyHashes bool
+
+	// VerifyResources causes NewReader to read every resource in the offset
+	// table and check it against the SHA1 hash recorded for it, failing with
+	// a ParseError that names the entry if they do not match. Streams packed
+	// in solid resources are not checked, since that would decompress each
+	// solid resource once for every stream in it. With Recovery set,
+	// mismatched entries other than image metadata are dropped and reported
+	// by Reader.Warnings instead. This reads the whole WIM, so it is meant for
+	// validating WIMs rather than for routine use.
+	VerifyResources bool
+
+	// CaseSensitive causes file names passed to Image.OpenFile to be matched
+	// exactly. By default they are matched case-insensitively, as on NTFS.
+	CaseSensitive bool
+
+	// CacheSize is the maximum number of bytes of decompressed chunks that
+	// the Reader keeps in a least recently used cache shared by all readers of
+	// its compressed resources, so that data that is read repeatedly, such as
+	// by reopening a file or by random access, is decompressed only once. If
+	// zero, chunks are not cached.
+	CacheSize int64
+
+	// MaxEntryLength is the maximum length of a directory or stream entry in
+	// an image's metadata. Longer entries are reported as a ParseError rather
+	// than read, so that corrupt or malicious WIMs cannot cause large
+	// allocations. If zero, DefaultMaxEntryLength is used.
+	MaxEntryLength int64
+
+	// AllowImageCountMismatch accepts WIMs whose offset table holds a
+	// different number of image metadata resources than the header declares,
+	// such as truncated or partially written captures. The images that are
+	// present are read, and the mismatch is reported by Reader.Warnings
+	// instead of failing NewReader.
+	AllowImageCountMismatch bool
+
+	// SkipSecurity skips over each image's security descriptor table rather
+	// than loading it, leaving FileHeader.SecurityDescriptor nil for every
+	// file. This saves reading the descriptors into memory when only names
+	// and other metadata are needed; the table still has to be decompressed
+	// to reach the directory entries that follow it. Security IDs are still
+	// checked against the number of descriptors. Nothing that needs the
+	// descriptors, such as ExtractOptions.RestoreSecurity or ExportImage,
+	// sees them.
+	SkipSecurity bool
+
+	// SkipStreams skips over the named alternate data streams of each file
+	// rather than parsing them, leaving File.Streams nil, for tools that only
+	// need the files' main data. The entries are not checked, and their data
+	// need not be present in the WIM. Nothing that needs the streams, such
+	// as ExtractOptions.Streams or ExportImage, sees them.
+	SkipStreams bool
+
+	decompressors map[CompressionKind]Decompressor
+}
+
+// namesEqual reports whether the file names a and b match.
+func (o *Options) namesEqual(a, b string) bool {
+	if o.CaseSensitive {
+		return a == b
+	}
+	return strings.EqualFold(a, b)
+}
+
 // Reader provides functions to read a WIM file.
+//
+// The images of a Reader are independent of each other, so different images
+// may be opened and walked concurrently from multiple goroutines.
 type Reader struct {
-	hdr      wimHeader
-	r        io.ReaderAt
-	fileData map[SHA1Hash]resourceDescriptor
+	hdr       wimHeader
+	r         io.ReaderAt
+	opts      Options
+	fileData  map[SHA1Hash]resourceDescriptor
+	refCount  map[SHA1Hash]uint32
+	resources []streamDescriptor // every entry of the offset table, for Resources
+	solid     []*solidResource   // the solid resources, in offset table order
+	metrics   *readerMetrics
+	cache     *chunkCache
+	bases     []*Reader
+	file      *os.File      // the file opened by Open, closed by Close
+	mapping   *mmapReaderAt // the mapping made by OpenMmap, unmapped by Close
+	size      int64         // size of the WIM in bytes, or -1 if unknown
+	warnings  []error
 
 	XMLInfo string   // The XML information about the WIM.
 	Image   []*Image // The WIM's images.
@@ -317,13 +602,25 @@ type Reader struct {
 
 // Image represents an image within a WIM file.
 type Image struct {
-	wim        *Reader
-	offset     resourceDescriptor
+	wim       *Reader
+	offset    resourceDescriptor
+	hash      SHA1Hash
+	r         io.ReadCloser
+	br        *bufio.Reader
+	curOffset int64
+	verified  bool       // whether Options.VerifyMetadata has been applied
+	m         sync.Mutex // guards r, br, curOffset, verified, and the assignment of sds
+
+	// sdsOnce guards the lazy parse of the security descriptor table, which
+	// sets sds, rootOffset, and sdsErr.
+	sdsOnce    sync.Once
+	sdsErr     error
 	sds        [][]byte
 	rootOffset int64
-	r          io.ReadCloser
-	curOffset  int64
-	m          sync.Mutex
+
+	statsMu     sync.Mutex
+	cachedStats *imageStats
+	cachedLinks map[int64][]*File
 
 	ImageInfo
 }
@@ -338,7 +635,7 @@ type StreamHeader struct {
 // Stream represents an alternate data stream or reparse point data stream.
 type Stream struct {
 	StreamHeader
-	wim    *Reader
+	wim    *Reader // the Reader holding the stream's data
 	offset resourceDescriptor
 }
 
@@ -356,48 +653,133 @@ type FileHeader struct {
 	LinkID             int64
 	ReparseTag         uint32
 	ReparseReserved    uint32
+
+	reserved [20]byte // the entry's unused fields; see Reserved
 }
 
 // File represents a file or directory in a WIM image.
 type File struct {
 	FileHeader
-	Streams      []*Stream
-	offset       resourceDescriptor
-	img          *Image
-	subdirOffset int64
+	// Streams holds the file's named alternate data streams. The unnamed
+	// data stream is the file's own data; see HasUnnamedStreamEntry.
+	Streams       []*Stream
+	offset        resourceDescriptor
+	img           *Image
+	subdirOffset  int64
+	securityID    uint32
+	src           *Reader // the Reader holding the file's data
+	eas           []byte  // the FILE_FULL_EA_INFORMATION list from the entry's tagged items
+	objectID      []byte  // the object ID item from the entry's tagged items
+	unnamedStream bool    // whether a stream entry, not the directory entry, held the file's data
 }
 
-// NewReader returns a Reader that can be used to read WIM file data.
-func NewReader(f io.ReaderAt) (*Reader, error) {
-	r := &Reader{r: f}
+// readHeader reads the WIM header from f into hdr and checks that it is
+// plausible.
+func readHeader(f io.ReaderAt, hdr *wimHeader) error {
 	section := io.NewSectionReader(f, 0, 0xffff)
-	err := binary.Read(section, binary.LittleEndian, &r.hdr)
+	err := binary.Read(section, binary.LittleEndian, hdr)
+	if err != nil {
+		return err
+	}
+
+	if hdr.ImageTag != wimImageTag {
+		return &ParseError{Oper: "image tag", Err: ErrNotWIM}
+	}
+
+	if err := hdr.validate(); err != nil {
+		return &ParseError{Oper: "header", Err: err}
+	}
+	return nil
+}
+
+// Open opens the named WIM file and returns a Reader for it. Unlike a Reader
+// returned by NewReader, the Reader owns the file, and Close closes it.
+func Open(name string) (*Reader, error) {
+	f, err := os.Open(name)
 	if err != nil {
 		return nil, err
 	}
+	return newFileReader(f)
+}
 
-	if r.hdr.ImageTag != wimImageTag {
-		return nil, &ParseError{Oper: "image tag", Err: errors.New("not a WIM file")}
+// newFileReader returns a Reader for f that owns it, closing f if the WIM
+// cannot be read.
+func newFileReader(f *os.File) (*Reader, error) {
+	r, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.file = f
+	return r, nil
+}
+
+// NewReader returns a Reader that can be used to read WIM file data.
+func NewReader(f io.ReaderAt) (*Reader, error) {
+	return NewReaderWithOptions(f, nil)
+}
+
+// NewReaderWithOptions returns a Reader that can be used to read WIM file data,
+// configured by opts. A nil opts is equivalent to the zero value.
+func NewReaderWithOptions(f io.ReaderAt, opts *Options) (*Reader, error) {
+	return newReader(f, opts, false)
+}
+
+// newReader reads the WIM in f. Parts of a split WIM are only accepted if split
+// is set.
+func newReader(f io.ReaderAt, opts *Options, split bool) (*Reader, error) {
+	r := &Reader{r: f, size: readerSize(f)}
+	if opts != nil {
+		r.opts = *opts
+		r.opts.decompressors = make(map[CompressionKind]Decompressor, len(opts.decompressors))
+		for k, d := range opts.decompressors {
+			r.opts.decompressors[k] = d
+		}
+	}
+	if r.opts.DirBufferSize <= 0 {
+		r.opts.DirBufferSize = DefaultDirBufferSize
+	}
+	if r.opts.MaxEntryLength <= 0 {
+		r.opts.MaxEntryLength = DefaultMaxEntryLength
+	}
+	if r.opts.CollectMetrics {
+		r.metrics = &readerMetrics{}
+	}
+	if r.opts.CacheSize > 0 {
+		r.cache = newChunkCache(r.opts.CacheSize)
+	}
+	if err := readHeader(f, &r.hdr); err != nil {
+		return nil, err
 	}
 
 	if r.hdr.Flags&^supportedHdrFlags != 0 {
 		return nil, fmt.Errorf("unsupported WIM flags %x", r.hdr.Flags&^supportedHdrFlags)
 	}
 
-	if r.hdr.CompressionSize != 0x8000 {
-		return nil, fmt.Errorf("unsupported compression size %d", r.hdr.CompressionSize)
+	if r.hdr.CompressionSize == 0 && r.hdr.Flags&hdrFlagCompressed != 0 && r.opts.Recovery {
+		r.hdr.CompressionSize = chunkSize
+	}
+
+	if err := r.opts.checkChunkSize(r.hdr.compressionKind(), r.hdr.CompressionSize); err != nil {
+		return nil, err
 	}
 
-	if r.hdr.TotalParts != 1 {
-		return nil, errors.New("multi-part WIM not supported")
+	if r.hdr.TotalParts != 1 && !split {
+		return nil, ErrMultiPartUnsupported
 	}
 
+	if err := r.checkBounds(&r.hdr.OffsetTable); err != nil {
+		return nil, &ParseError{Oper: "offset table", Err: err}
+	}
+	if err := r.checkBounds(&r.hdr.XMLData); err != nil {
+		return nil, &ParseError{Oper: "XML data", Err: err}
+	}
 	fileData, images, err := r.readOffsetTable(&r.hdr.OffsetTable)
 	if err != nil {
 		return nil, err
 	}
 
-	xmlinfo, err := r.readXML()
+	xmlinfo, err := r.readXML(r.r)
 	if err != nil {
 		return nil, err
 	}
@@ -408,13 +790,18 @@ func NewReader(f io.ReaderAt) (*Reader, error) {
 		return nil, &ParseError{Oper: "XML info", Err: err}
 	}
 
+	// Images are numbered by the order of their metadata resources in the
+	// offset table. The XML IMAGE elements may appear in any order, so match
+	// them by their INDEX attribute, falling back to element order only for
+	// elements that lack one.
 	for i, img := range images {
-		for _, imgInfo := range inf.Image {
-			if imgInfo.Index == i+1 {
+		for j, imgInfo := range inf.Image {
+			if imgInfo.Index == i+1 || (imgInfo.Index == 0 && j == i) {
 				img.ImageInfo = imgInfo
 				break
 			}
 		}
+		img.Index = i + 1
 	}
 
 	r.fileData = fileData
@@ -423,59 +810,286 @@ func NewReader(f io.ReaderAt) (*Reader, error) {
 	return r, nil
 }
 
-// Close releases resources associated with the Reader.
+// validate performs sanity checks on the header fields so that byte-swapped or
+// otherwise corrupt headers are caught before they produce confusing errors
+// further into the parse.
+func (h *wimHeader) validate() error {
+	var bad string
+	switch {
+	case h.Size != wimHeaderSize:
+		bad = fmt.Sprintf("header size %d", h.Size)
+	case h.Version&^0xffff != wimVersionMajor && h.Version != wimVersionSolid:
+		bad = fmt.Sprintf("version %#x", h.Version)
+	case h.ImageCount > maxImageCount:
+		bad = fmt.Sprintf("image count %d", h.ImageCount)
+	case h.CompressionSize&(h.CompressionSize-1) != 0:
+		bad = fmt.Sprintf("compression size %d", h.CompressionSize)
+	default:
+		return nil
+	}
+	return fmt.Errorf("header fields implausible (%s); file may be corrupt or not a WIM", bad)
+}
+
+// ImageInfo returns the information recorded in the WIM's XML data for each
+// image, in image order. Images without an IMAGE element in the XML have only
+// their Index set. XMLInfo holds the raw XML.
+func (r *Reader) ImageInfo() ([]ImageInfo, error) {
+	infos := make([]ImageInfo, len(r.Image))
+	for i, img := range r.Image {
+		infos[i] = img.ImageInfo
+	}
+	return infos, nil
+}
+
+// ImageNames returns the name of each image, in image order, so that
+// ImageNames()[i] names r.Image[i]. The names come from the XML data, which
+// NewReader has already read; images without a NAME element are named
+// "Image N", where N is the 1-based image index.
+func (r *Reader) ImageNames() ([]string, error) {
+	names := make([]string, len(r.Image))
+	for i, img := range r.Image {
+		names[i] = img.Name
+		if names[i] == "" {
+			names[i] = fmt.Sprintf("Image %d", img.Index)
+		}
+	}
+	return names, nil
+}
+
+// Close releases resources associated with the Reader. If the Reader was
+// returned by Open or OpenMmap, Close also closes or unmaps the file; a
+// caller-provided io.ReaderAt is never closed.
 func (r *Reader) Close() error {
 	for _, img := range r.Image {
+		img.m.Lock()
 		img.reset()
+		img.m.Unlock()
+	}
+	if r.mapping != nil {
+		m := r.mapping
+		r.mapping = nil
+		return m.Close()
+	}
+	if r.file != nil {
+		f := r.file
+		r.file = nil
+		return f.Close()
 	}
 	return nil
 }
 
+// Warnings returns the problems that NewReader tolerated because of Options,
+// such as AllowImageCountMismatch, rather than failing. It is empty for a
+// well-formed WIM.
+func (r *Reader) Warnings() []error {
+	return append([]error(nil), r.warnings...)
+}
+
+// BootMetadata returns an io.ReadCloser that can be used to read the raw boot
+// metadata resource referenced by the WIM header. It returns ErrNoBootMetadata
+// if the WIM does not have one.
+func (r *Reader) BootMetadata() (io.ReadCloser, error) {
+	if r.hdr.BootMetadata.CompressedSize() == 0 {
+		return nil, ErrNoBootMetadata
+	}
+	return r.resourceReader(&r.hdr.BootMetadata)
+}
+
+// ReadBootMetadata reads and returns the boot metadata resource referenced by
+// the WIM header. It returns ErrNoBootMetadata if the WIM does not have one.
+func (r *Reader) ReadBootMetadata() ([]byte, error) {
+	if r.hdr.BootMetadata.CompressedSize() == 0 {
+		return nil, ErrNoBootMetadata
+	}
+	return r.readResource(&r.hdr.BootMetadata)
+}
+
+// BootIndex returns the 1-based index of the image marked bootable in the WIM
+// header, or 0 if no image is.
+func (r *Reader) BootIndex() int {
+	return int(r.hdr.BootIndex)
+}
+
+// BootImage returns the image marked bootable in the WIM header, or nil if no
+// image is.
+func (r *Reader) BootImage() (*Image, error) {
+	i := r.BootIndex()
+	if i == 0 {
+		return nil, nil
+	}
+	if i > len(r.Image) {
+		return nil, &ParseError{Oper: "boot image", Err: fmt.Errorf("boot index %d exceeds image count %d", i, len(r.Image))}
+	}
+	return r.Image[i-1], nil
+}
+
+// ImageByIndex returns the image with the given 1-based index, as used by
+// DISM's /Index selector.
+func (r *Reader) ImageByIndex(index int) (*Image, error) {
+	if index < 1 || index > len(r.Image) {
+		return nil, fmt.Errorf("image index %d out of range [1, %d]: %w", index, len(r.Image), ErrImageNotFound)
+	}
+	return r.Image[index-1], nil
+}
+
+// ImageByName returns the image whose XML NAME matches name, compared
+// case-insensitively as DISM's /Name selector does. If several images share
+// the name, the one with the lowest index is returned.
+func (r *Reader) ImageByName(name string) (*Image, error) {
+	for _, img := range r.Image {
+		if img.Name != "" && strings.EqualFold(img.Name, name) {
+			return img, nil
+		}
+	}
+	return nil, fmt.Errorf("image %q: %w", name, ErrImageNotFound)
+}
+
+// HasSolidResources reports whether the WIM packs any of its streams into solid
+// resources. Random access to individual streams is much slower in solid
+// resources, since a whole solid block may need to be decompressed to reach
+// one stream.
+func (r *Reader) HasSolidResources() bool {
+	return len(r.solid) != 0
+}
+
+// SolidResourceCount returns the number of solid resources in the WIM.
+func (r *Reader) SolidResourceCount() int {
+	return len(r.solid)
+}
+
+// HasIntegrityTable reports whether the WIM contains an integrity table.
+func (r *Reader) HasIntegrityTable() bool {
+	return r.hdr.Integrity.CompressedSize() != 0
+}
+
 func (r *Reader) resourceReader(hdr *resourceDescriptor) (io.ReadCloser, error) {
 	return r.resourceReaderWithOffset(hdr, 0)
 }
 
 func (r *Reader) resourceReaderWithOffset(hdr *resourceDescriptor, offset int64) (io.ReadCloser, error) {
+	return r.resourceReaderAt(r.r, hdr, offset)
+}
+
+// resourceReaderAt returns a reader for the resource described by hdr, starting
+// at offset within its uncompressed data, whose contents are read through ra
+// rather than directly from the WIM file.
+func (r *Reader) resourceReaderAt(ra io.ReaderAt, hdr *resourceDescriptor, offset int64) (io.ReadCloser, error) {
+	if hdr.Flags()&resFlagSolid != 0 && hdr.OriginalSize != solidResourceMagic {
+		return r.solidStreamReader(ra, hdr, offset)
+	}
+	if err := hdr.checkReadable(); err != nil {
+		return nil, err
+	}
+
 	var sr io.ReadCloser
-	section := io.NewSectionReader(r.r, hdr.Offset, hdr.CompressedSize())
-	if hdr.Flags()&resFlagCompressed == 0 {
-		_, _ = section.Seek(offset, 0)
-		sr = io.NopCloser(section)
+	section := io.NewSectionReader(ra, hdr.Offset, hdr.CompressedSize())
+	if kind := r.compression(hdr); kind == CompressionNone {
+		_, _ = section.Seek(offset, io.SeekStart)
+		sr = newSectionReadCloser(section)
 	} else {
-		cr, err := newCompressedReader(section, hdr.OriginalSize, offset)
+		d, err := r.opts.decompressor(kind)
 		if err != nil {
 			return nil, err
 		}
+		cr, err := newCompressedReader(section, d, r.metrics, int64(r.hdr.CompressionSize), hdr.OriginalSize, offset)
+		if err != nil {
+			return nil, err
+		}
+		cr.cache = r.cache
+		cr.offset = hdr.Offset
 		sr = cr
 	}
 
 	return sr, nil
 }
 
+// maxResourcePrealloc bounds the buffer allocated up front by readResource, so
+// that a corrupt size cannot cause a huge allocation before any data is read.
+const maxResourcePrealloc = 16 * 1024 * 1024
+
+// maxInt is the largest int, which is smaller than the largest int64 on 32-bit
+// platforms. Sizes read from the WIM are checked against it before they are
+// used to allocate or index.
+const maxInt = int64(^uint(0) >> 1)
+
+// readResource reads the whole of a resource. The buffer is sized from the
+// resource's original size, so that uncompressed resources are read with a
+// single read of the WIM.
 func (r *Reader) readResource(hdr *resourceDescriptor) ([]byte, error) {
 	rsrc, err := r.resourceReader(hdr)
 	if err != nil {
 		return nil, err
 	}
 	defer rsrc.Close()
-	return io.ReadAll(rsrc)
+	var b bytes.Buffer
+	if size := hdr.OriginalSize; size > 0 && size <= maxResourcePrealloc {
+		// One byte more, so that the read reaching EOF does not grow b.
+		b.Grow(int(size) + 1)
+	}
+	_, err = b.ReadFrom(rsrc)
+	return b.Bytes(), err
 }
 
-func (r *Reader) readXML() (string, error) {
+// readerSize returns the size of the data in ra, if ra reports it as
+// *bytes.Reader, *io.SectionReader, and *os.File do, or -1.
+func readerSize(ra io.ReaderAt) int64 {
+	switch s := ra.(type) {
+	case interface{ Size() int64 }:
+		return s.Size()
+	case interface{ Stat() (os.FileInfo, error) }:
+		if fi, err := s.Stat(); err == nil && fi.Mode().IsRegular() {
+			return fi.Size()
+		}
+	}
+	return -1
+}
+
+// checkBounds returns an error if the resource described by rd does not lie
+// within the WIM. Without a known WIM size, only negative offsets are caught
+// here; reads past the end of the WIM fail with io.ErrUnexpectedEOF instead.
+func (r *Reader) checkBounds(rd *resourceDescriptor) error {
+	size := rd.CompressedSize()
+	if rd.Offset < 0 {
+		return fmt.Errorf("invalid location (%s)", rd)
+	}
+	if r.size >= 0 && (rd.Offset > r.size || size > r.size-rd.Offset) {
+		return fmt.Errorf("%s extends past the end of the %d-byte file", rd, r.size)
+	}
+	return nil
+}
+
+// maxXMLSize bounds the size of the XML data. Even WIMs with many images have
+// at most a few megabytes of it.
+const maxXMLSize = 64 * 1024 * 1024
+
+// readXML reads the XML data through ra.
+func (r *Reader) readXML(ra io.ReaderAt) (string, error) {
 	if r.hdr.XMLData.CompressedSize() == 0 {
 		return "", nil
 	}
-	rsrc, err := r.resourceReader(&r.hdr.XMLData)
+	size := r.hdr.XMLData.OriginalSize
+	if size < 2 || size > maxXMLSize {
+		return "", &ParseError{Oper: "XML data", Err: fmt.Errorf("invalid size %d", size)}
+	}
+	rsrc, err := r.resourceReaderAt(ra, &r.hdr.XMLData, 0)
 	if err != nil {
 		return "", err
 	}
 	defer rsrc.Close()
 
-	xmlData := make([]uint16, r.hdr.XMLData.OriginalSize/2)
-	err = binary.Read(rsrc, binary.LittleEndian, xmlData)
-	if err != nil {
+	// Read the data before allocating for it, so that a size that does not
+	// match the data cannot cause a large allocation.
+	var b bytes.Buffer
+	if _, err := b.ReadFrom(io.LimitReader(rsrc, size)); err != nil {
 		return "", &ParseError{Oper: "XML data", Err: err}
 	}
+	if int64(b.Len()) != size {
+		return "", &ParseError{Oper: "XML data", Err: io.ErrUnexpectedEOF}
+	}
+	xmlData := make([]uint16, size/2)
+	for i := range xmlData {
+		xmlData[i] = binary.LittleEndian.Uint16(b.Bytes()[2*i:])
+	}
 
 	// The BOM will always indicate little-endian UTF-16.
 	if xmlData[0] != 0xfeff {
@@ -486,6 +1100,7 @@ func (r *Reader) readXML() (string, error) {
 
 func (r *Reader) readOffsetTable(res *resourceDescriptor) (map[SHA1Hash]resourceDescriptor, []*Image, error) {
 	fileData := make(map[SHA1Hash]resourceDescriptor)
+	r.refCount = make(map[SHA1Hash]uint32)
 	var images []*Image
 
 	offsetTable, err := r.readResource(res)
@@ -493,63 +1108,113 @@ func (r *Reader) readOffsetTable(res *resourceDescriptor) (map[SHA1Hash]resource
 		return nil, nil, &ParseError{Oper: "offset table", Err: err}
 	}
 
+	// group holds the solid resources whose entries most recently followed
+	// each other, which hold the streams of the solid entries after them.
+	var group []*solidResource
+	groupEnded := false
 	br := bytes.NewReader(offsetTable)
 	for i := 0; ; i++ {
+		pos := int64(i) * int64(binary.Size(streamDescriptor{}))
 		var res streamDescriptor
 		err := binary.Read(br, binary.LittleEndian, &res)
 		if err == io.EOF { //nolint:errorlint
 			break
 		}
 		if err != nil {
-			return nil, nil, &ParseError{Oper: "offset table", Err: err}
+			return nil, nil, &ParseError{Oper: "offset table", Offset: pos, Err: err}
 		}
 		if res.Flags()&^supportedResFlags != 0 {
-			return nil, nil, &ParseError{Oper: "offset table", Err: errors.New("unsupported resource flag")}
+			return nil, nil, &ParseError{Oper: "offset table", Offset: pos, Err: errors.New("unsupported resource flag")}
+		}
+		r.resources = append(r.resources, res)
+		if res.Flags()&resFlagFree != 0 {
+			// The entry describes a deleted resource whose space may since
+			// have been reused, so even its offset cannot be trusted.
+			continue
+		}
+		if r.hdr.TotalParts > 1 && res.PartNumber != r.hdr.PartNumber {
+			// The resource is stored in another part of a split WIM and
+			// will be found in that part's offset table.
+			continue
 		}
 
-		// Validation for ad-hoc testing
-		if validate {
-			sec, err := r.resourceReader(&res.resourceDescriptor)
+		if res.Flags()&resFlagSolid != 0 && res.OriginalSize == solidResourceMagic {
+			s, err := r.addSolidResource(&res.resourceDescriptor)
 			if err != nil {
-				panic(fmt.Sprint(i, err))
+				return nil, nil, &ParseError{Oper: "offset table", Offset: pos, Err: fmt.Errorf("resource %d: %w", i, err)}
 			}
-			hash := sha1.New() //nolint:gosec // not used for secure application
-			_, err = io.Copy(hash, sec)
-			sec.Close()
-			if err != nil {
-				panic(fmt.Sprint(i, err))
+			if groupEnded {
+				group = nil
+				groupEnded = false
 			}
-			var cmphash SHA1Hash
-			copy(cmphash[:], hash.Sum(nil))
-			if cmphash != res.Hash {
-				panic(fmt.Sprint(i, "hash mismatch"))
+			group = append(group, s)
+			continue
+		}
+		groupEnded = true
+
+		if res.Flags()&resFlagSolid != 0 {
+			err = locateSolidStream(&res.resourceDescriptor, group)
+			if err == nil {
+				r.resources[len(r.resources)-1] = res
 			}
+		} else {
+			err = r.checkBounds(&res.resourceDescriptor)
+		}
+		if err == nil && r.opts.VerifyResources && res.checkReadable() == nil {
+			err = r.verifyResource(&res)
+		}
+		if err != nil {
+			err := &ParseError{Oper: "offset table", Offset: pos, Err: fmt.Errorf("resource %d: %w", i, err)}
+			if !r.opts.Recovery || res.Flags()&resFlagMetadata != 0 {
+				return nil, nil, err
+			}
+			// Drop the entry, so that files whose data it holds fail to open.
+			r.warnings = append(r.warnings, err)
+			continue
 		}
 
 		if res.Flags()&resFlagMetadata != 0 {
 			image := &Image{
 				wim:    r,
 				offset: res.resourceDescriptor,
+				hash:   res.Hash,
 			}
 			images = append(images, image)
 		} else {
 			fileData[res.Hash] = res.resourceDescriptor
+			r.refCount[res.Hash] = res.RefCount
 		}
 	}
 
-	if len(images) != int(r.hdr.ImageCount) {
-		return nil, nil, &ParseError{Oper: "offset table", Err: errors.New("mismatched image count")}
+	// Only the first part of a split WIM holds the image metadata.
+	if r.hdr.PartNumber <= 1 && len(images) != int(r.hdr.ImageCount) {
+		err := &ParseError{Oper: "offset table", Err: fmt.Errorf("mismatched image count: header declares %d, found %d", r.hdr.ImageCount, len(images))}
+		if !r.opts.AllowImageCountMismatch {
+			return nil, nil, err
+		}
+		r.warnings = append(r.warnings, err)
 	}
 
 	return fileData, images, nil
 }
 
-func (*Reader) readSecurityDescriptors(rsrc io.Reader) (sds [][]byte, n int64, err error) {
+// readSecurityDescriptors reads the security table at the start of a metadata
+// resource of the given size from rsrc. If Options.SkipSecurity is set, the
+// descriptors are skipped and their entries in sds left nil.
+func (r *Reader) readSecurityDescriptors(rsrc io.Reader, size int64) (sds [][]byte, n int64, err error) {
 	var secBlock securityblockDisk
 	err = binary.Read(rsrc, binary.LittleEndian, &secBlock)
 	if err != nil {
 		return sds, 0, &ParseError{Oper: "security table", Err: err}
 	}
+	// Check the table against the resource size before allocating for it.
+	secsize := int64((secBlock.TotalLength + 7) &^ 7)
+	if secsize > size || securityblockDiskSize+8*int64(secBlock.NumEntries) > secsize {
+		return sds, 0, &ParseError{Oper: "security table", Err: errors.New("security descriptor table size out of range")}
+	}
+	if secsize > maxInt {
+		return sds, 0, &ParseError{Oper: "security table", Err: fmt.Errorf("security descriptor table of %d bytes is too large for this platform", secsize)}
+	}
 
 	n += securityblockDiskSize
 
@@ -559,10 +1224,27 @@ func (*Reader) readSecurityDescriptors(rsrc io.Reader) (sds [][]byte, n int64, e
 		return sds, n, &ParseError{Oper: "security table sizes", Err: err}
 	}
 
-	n += int64(secBlock.NumEntries * 8)
+	n += 8 * int64(secBlock.NumEntries)
 
 	sds = make([][]byte, secBlock.NumEntries)
+	if r.opts.SkipSecurity {
+		var total int64
+		for _, size := range secSizes {
+			total += size & 0xffffffff
+			if total > secsize-n {
+				return sds, n, &ParseError{Oper: "security descriptor", Err: errors.New("security descriptor table too small")}
+			}
+		}
+		secSizes = nil
+		if _, err := io.CopyN(io.Discard, rsrc, total); err != nil {
+			return sds, n, &ParseError{Oper: "security descriptor", Err: err}
+		}
+		n += total
+	}
 	for i, size := range secSizes {
+		if size&0xffffffff > secsize-n {
+			return sds, n, &ParseError{Oper: "security descriptor", Err: errors.New("security descriptor table too small")}
+		}
 		sd := make([]byte, size&0xffffffff)
 		_, err = io.ReadFull(rsrc, sd)
 		if err != nil {
@@ -572,7 +1254,6 @@ func (*Reader) readSecurityDescriptors(rsrc io.Reader) (sds [][]byte, n int64, e
 		sds[i] = sd
 	}
 
-	secsize := int64((secBlock.TotalLength + 7) &^ 7)
 	if n > secsize {
 		return sds, n, &ParseError{Oper: "security descriptor", Err: errors.New("security descriptor table too small")}
 	}
@@ -588,20 +1269,15 @@ func (*Reader) readSecurityDescriptors(rsrc io.Reader) (sds [][]byte, n int64, e
 
 // Open parses the image and returns the root directory.
 func (img *Image) Open() (*File, error) {
-	if img.sds == nil {
-		rsrc, err := img.wim.resourceReaderWithOffset(&img.offset, img.rootOffset)
-		if err != nil {
-			return nil, err
-		}
-		sds, n, err := img.wim.readSecurityDescriptors(rsrc)
-		if err != nil {
-			rsrc.Close()
-			return nil, err
-		}
-		img.sds = sds
-		img.r = rsrc
-		img.rootOffset = n
-		img.curOffset = n
+	return img.OpenContext(context.Background())
+}
+
+// OpenContext is like Open, but returns ctx.Err() if ctx is done before the
+// image's metadata has been read. With Options.VerifyMetadata, the whole
+// metadata resource is read, and ctx is checked before each read from the WIM.
+func (img *Image) OpenContext(ctx context.Context) (*File, error) {
+	if err := img.loadContext(ctx); err != nil {
+		return nil, err
 	}
 
 	f, err := img.readdir(img.rootOffset)
@@ -614,18 +1290,194 @@ func (img *Image) Open() (*File, error) {
 	return f[0], err
 }
 
+// verifyMetadata reads the whole metadata resource through ra and checks it
+// against the hash recorded for it in the offset table.
+func (img *Image) verifyMetadata(ra io.ReaderAt) error {
+	rsrc, err := img.wim.resourceReaderAt(ra, &img.offset, 0)
+	if err != nil {
+		return err
+	}
+	r := newVerifyReader(rsrc, "metadata", img.hash, img.offset.Offset)
+	_, err = io.Copy(io.Discard, r)
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// load reads the image's security descriptor table if it has not already been
+// read, leaving the metadata reader positioned at the root directory.
+func (img *Image) load() error {
+	return img.loadContext(context.Background())
+}
+
+// loadContext is like load, but stops if ctx is done before the metadata has
+// been read. Cancellation is not remembered, so a later call may succeed, but
+// the result of parsing the security descriptor table is.
+func (img *Image) loadContext(ctx context.Context) error {
+	if img.wim.opts.VerifyMetadata {
+		img.m.Lock()
+		verified := img.verified
+		img.m.Unlock()
+		if !verified {
+			if err := img.verifyMetadata(&contextReaderAt{ctx: ctx, r: img.wim.r}); err != nil {
+				return err
+			}
+			img.m.Lock()
+			img.verified = true
+			img.m.Unlock()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	img.sdsOnce.Do(func() {
+		img.sdsErr = img.readSecurityTable()
+	})
+	return img.sdsErr
+}
+
+// readSecurityTable reads the image's security descriptor table and the offset
+// of the root directory that follows it.
+func (img *Image) readSecurityTable() error {
+	rsrc, err := img.wim.resourceReader(&img.offset)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(rsrc, img.wim.opts.DirBufferSize)
+	sds, n, err := img.wim.readSecurityDescriptors(br, img.offset.OriginalSize)
+	if err != nil {
+		rsrc.Close()
+		return err
+	}
+
+	img.m.Lock()
+	defer img.m.Unlock()
+	img.reset()
+	img.sds = sds
+	img.r = rsrc
+	img.br = br
+	img.rootOffset = n
+	img.curOffset = n
+	return nil
+}
+
+// SecurityDescriptorCount returns the number of security descriptors in the
+// image's security table. Unless the image has already been opened, only the
+// table header is read.
+func (img *Image) SecurityDescriptorCount() (int, error) {
+	img.m.Lock()
+	sds := img.sds
+	img.m.Unlock()
+	if sds != nil {
+		return len(sds), nil
+	}
+	rsrc, err := img.wim.resourceReader(&img.offset)
+	if err != nil {
+		return 0, err
+	}
+	defer rsrc.Close()
+
+	var secBlock securityblockDisk
+	err = binary.Read(rsrc, binary.LittleEndian, &secBlock)
+	if err != nil {
+		return 0, &ParseError{Oper: "security table", Err: err}
+	}
+	return int(secBlock.NumEntries), nil
+}
+
 func (img *Image) reset() {
 	if img.r != nil {
 		img.r.Close()
 		img.r = nil
+		img.br = nil
 	}
 	img.curOffset = -1
 }
 
 func (img *Image) readdir(offset int64) ([]*File, error) {
+	var entries []*File
+	err := img.rangeDir(offset, func(f *File) error {
+		entries = append(entries, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// rangeDir calls fn for each entry of the directory whose entries start at
+// offset, as they are read. Unlike readdirFunc, it does not hold the image
+// lock while calling fn, so fn may read other directories; the next entry is
+// then found by seeking back to it.
+func (img *Image) rangeDir(offset int64, fn func(f *File) error) error {
+	var dentry rawDirent
+	for {
+		e, next, err := img.readEntryAt(offset, &dentry)
+		if err == io.EOF { //nolint:errorlint
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+		offset = next
+	}
+}
+
+// readEntryAt reads the directory entry at offset, returning it and the offset
+// of the entry that follows it.
+func (img *Image) readEntryAt(offset int64, dentry *rawDirent) (*File, int64, error) {
 	img.m.Lock()
 	defer img.m.Unlock()
 
+	if err := img.seekDir(offset); err != nil {
+		return nil, 0, err
+	}
+	e, n, err := img.readNextEntry(img.br, dentry)
+	err = atOffset("directory entry", err, img.curOffset)
+	img.curOffset += n
+	if err != nil && err != io.EOF { //nolint:errorlint
+		img.reset()
+	}
+	return e, img.curOffset, err
+}
+
+// readdirFunc calls fn for each entry of the directory whose entries start at
+// offset, along with the raw on-disk entry. fn is called with the image lock
+// held and must not read other directories.
+func (img *Image) readdirFunc(offset int64, fn func(f *File, dentry *rawDirent) error) error {
+	img.m.Lock()
+	defer img.m.Unlock()
+
+	if err := img.seekDir(offset); err != nil {
+		return err
+	}
+
+	var dentry rawDirent
+	for {
+		e, n, err := img.readNextEntry(img.br, &dentry)
+		err = atOffset("directory entry", err, img.curOffset)
+		img.curOffset += n
+		if err == io.EOF { //nolint:errorlint
+			return nil
+		}
+		if err != nil {
+			img.reset()
+			return err
+		}
+		if err := fn(e, &dentry); err != nil {
+			return err
+		}
+	}
+}
+
+// seekDir positions the image's metadata reader at offset. The caller must
+// hold img.m.
+func (img *Image) seekDir(offset int64) error {
 	if offset < img.curOffset || offset > img.curOffset+chunkSize {
 		// Reset to seek backward or to seek forward very far.
 		img.reset()
@@ -633,39 +1485,62 @@ func (img *Image) readdir(offset int64) ([]*File, error) {
 	if img.r == nil {
 		rsrc, err := img.wim.resourceReaderWithOffset(&img.offset, offset)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		img.r = rsrc
+		img.br = bufio.NewReaderSize(rsrc, img.wim.opts.DirBufferSize)
 		img.curOffset = offset
 	}
 	if offset > img.curOffset {
-		_, err := io.CopyN(io.Discard, img.r, offset-img.curOffset)
-		if err != nil {
+		if err := discard(img.br, offset-img.curOffset); err != nil {
 			img.reset()
-			if err == io.EOF { //nolint:errorlint
-				err = io.ErrUnexpectedEOF
-			}
-			return nil, err
+			return err
 		}
+		img.curOffset = offset
 	}
+	return nil
+}
 
-	var entries []*File
-	for {
-		e, n, err := img.readNextEntry(img.r)
-		img.curOffset += n
-		if err == io.EOF { //nolint:errorlint
-			break
-		}
-		if err != nil {
-			img.reset()
-			return nil, err
-		}
-		entries = append(entries, e)
+// namesLength returns the number of bytes that the names of a directory entry
+// with the given name lengths occupy. Each name is followed by a null
+// terminator only if it is not empty; the short name's is not counted, as it
+// is not needed to read the name.
+func namesLength(fileNameLength, shortNameLength uint16) int64 {
+	n := int64(fileNameLength) + int64(shortNameLength)
+	if fileNameLength > 0 {
+		n += 2
 	}
-	return entries, nil
+	return n
 }
 
-func (img *Image) readNextEntry(r io.Reader) (*File, int64, error) {
+// checkEntryLength returns an error if a directory or stream entry of the given
+// length, starting at offset pos of the metadata resource, is longer than
+// Options.MaxEntryLength or extends past the end of the resource. This keeps
+// corrupt or malicious lengths from causing large reads and allocations.
+func (img *Image) checkEntryLength(oper string, pos, length int64) error {
+	if length > img.wim.opts.MaxEntryLength {
+		return &ParseError{Oper: oper, Err: fmt.Errorf("length %d exceeds the maximum of %d", length, img.wim.opts.MaxEntryLength)}
+	}
+	if length > img.offset.OriginalSize-pos {
+		return &ParseError{Oper: oper, Err: fmt.Errorf("length %d extends past the end of the metadata", length)}
+	}
+	return nil
+}
+
+// checkSubdirOffset returns an error if a directory entry's subdirectory
+// offset, which is stored unsigned, is negative as an int64 or lies past the
+// end of the metadata resource.
+func (img *Image) checkSubdirOffset(off int64) error {
+	if off < 0 || off >= img.offset.OriginalSize {
+		return fmt.Errorf("subdirectory offset %d out of range", uint64(off))
+	}
+	return nil
+}
+
+// readNextEntry reads the next directory entry from r, storing the raw entry in
+// dentry. The caller must hold img.m, and img.curOffset must be the offset of
+// the entry.
+func (img *Image) readNextEntry(r io.Reader, dentry *rawDirent) (*File, int64, error) {
 	var length int64
 	err := binary.Read(r, binary.LittleEndian, &length)
 	if err != nil {
@@ -680,19 +1555,30 @@ func (img *Image) readNextEntry(r io.Reader) (*File, int64, error) {
 	if left < direntrySize {
 		return nil, 0, &ParseError{Oper: "directory entry", Err: errors.New("size too short")}
 	}
+	if err := img.checkEntryLength("directory entry", img.curOffset, length); err != nil {
+		return nil, 0, err
+	}
 
-	var dentry direntry
-	err = binary.Read(r, binary.LittleEndian, &dentry)
+	err = binary.Read(r, binary.LittleEndian, &dentry.direntry)
 	if err != nil {
 		return nil, 0, &ParseError{Oper: "directory entry", Err: err}
 	}
+	dentry.Length = length
 
 	left -= direntrySize
 
-	namesLen := int64(dentry.FileNameLength + 2 + dentry.ShortNameLength)
+	if dentry.FileNameLength%2 != 0 || dentry.ShortNameLength%2 != 0 {
+		return nil, 0, &ParseError{Oper: "directory entry", Err: errors.New("odd name length")}
+	}
+	namesLen := namesLength(dentry.FileNameLength, dentry.ShortNameLength)
 	if left < namesLen {
 		return nil, 0, &ParseError{Oper: "directory entry", Err: errors.New("size too short for names")}
 	}
+	// An entry with only a short name may also have a terminator in place of
+	// the empty long name; read enough to find the short name either way.
+	if dentry.FileNameLength == 0 && dentry.ShortNameLength > 0 && left >= namesLen+2 {
+		namesLen += 2
+	}
 
 	names := make([]uint16, namesLen/2)
 	err = binary.Read(r, binary.LittleEndian, names)
@@ -701,21 +1587,33 @@ func (img *Image) readNextEntry(r io.Reader) (*File, int64, error) {
 	}
 
 	left -= namesLen
+	dentry.nameBytes = namesLen
+	dentry.terminatedEmptyName = false
 
 	var name, shortName string
 	if dentry.FileNameLength > 0 {
 		name = string(utf16.Decode(names[:dentry.FileNameLength/2]))
 	}
 
-	if dentry.ShortNameLength > 0 {
-		shortName = string(utf16.Decode(names[dentry.FileNameLength/2+1:]))
+	if n := int(dentry.ShortNameLength / 2); n > 0 {
+		start := 0
+		if dentry.FileNameLength > 0 {
+			start = int(dentry.FileNameLength/2) + 1
+		} else if names[0] == 0 {
+			// A short name cannot start with a null, so this is the
+			// terminator of the empty long name.
+			start = 1
+			dentry.terminatedEmptyName = true
+		}
+		shortName = string(utf16.Decode(names[start : start+n]))
 	}
 
+	src := img.wim
 	var offset resourceDescriptor
 	zerohash := SHA1Hash{}
 	if dentry.Hash != zerohash {
 		var ok bool
-		offset, ok = img.wim.fileData[dentry.Hash]
+		src, offset, ok = img.wim.lookupResource(dentry.Hash)
 		if !ok {
 			return nil, 0, &ParseError{
 				Oper: "directory entry",
@@ -740,8 +1638,14 @@ func (img *Image) readNextEntry(r io.Reader) (*File, int64, error) {
 		offset:       offset,
 		img:          img,
 		subdirOffset: dentry.SubdirOffset,
+		securityID:   dentry.SecurityID,
+		src:          src,
 	}
 
+	binary.LittleEndian.PutUint64(f.reserved[:], uint64(dentry.Unused1))
+	binary.LittleEndian.PutUint64(f.reserved[8:], uint64(dentry.Unused2))
+	binary.LittleEndian.PutUint32(f.reserved[16:], dentry.Padding)
+
 	isDir := false
 
 	if dentry.Attributes&FILE_ATTRIBUTE_REPARSE_POINT == 0 {
@@ -758,33 +1662,51 @@ func (img *Image) readNextEntry(r io.Reader) (*File, int64, error) {
 		return nil, 0, &ParseError{Oper: "directory entry", Path: name, Err: errors.New("no subdirectory data for directory")}
 	} else if !isDir && f.subdirOffset != 0 {
 		return nil, 0, &ParseError{Oper: "directory entry", Path: name, Err: errors.New("unexpected subdirectory data for non-directory")}
+	} else if err := img.checkSubdirOffset(f.subdirOffset); err != nil {
+		return nil, 0, &ParseError{Oper: "directory entry", Path: name, Err: err}
 	}
 
-	if dentry.SecurityID != 0xffffffff {
+	if dentry.SecurityID != noSecurityID {
+		if int64(dentry.SecurityID) >= int64(len(img.sds)) {
+			return nil, 0, &ParseError{Oper: "directory entry", Path: name, Err: fmt.Errorf("security ID %d out of range", dentry.SecurityID)}
+		}
 		f.SecurityDescriptor = img.sds[dentry.SecurityID]
 	}
 
-	_, err = io.CopyN(io.Discard, r, left)
+	dentry.extra.Reset()
+	_, err = io.CopyN(&dentry.extra, r, left)
 	if err != nil {
 		if err == io.EOF { //nolint:errorlint
 			err = io.ErrUnexpectedEOF
 		}
 		return nil, 0, err
 	}
+	if f.Attributes&FILE_ATTRIBUTE_EA != 0 {
+		f.eas = dentry.taggedItem(tagExtendedAttributes)
+	}
+	f.objectID = dentry.taggedItem(tagObjectID)
 
 	if dentry.StreamCount > 0 {
 		var streams []*Stream
 		for i := uint16(0); i < dentry.StreamCount; i++ {
-			s, n, err := img.readNextStream(r)
+			pos := img.curOffset + length
+			s, n, err := img.readNextStream(r, pos)
 			length += n
 			if err != nil {
-				return nil, 0, err
+				return nil, 0, atOffset("stream entry", err, pos)
+			}
+			if s == nil {
+				continue
 			}
-			// The first unnamed stream should be treated as the file stream.
-			if i == 0 && s.Name == "" {
+			// The first unnamed stream is the file's data, replacing any
+			// recorded in the directory entry itself. Further unnamed
+			// streams are invalid and ignored.
+			if s.Name == "" && !f.unnamedStream {
 				f.Hash = s.Hash
 				f.Size = s.Size
 				f.offset = s.offset
+				f.src = s.wim
+				f.unnamedStream = true
 			} else if s.Name != "" {
 				streams = append(streams, s)
 			}
@@ -792,7 +1714,9 @@ func (img *Image) readNextEntry(r io.Reader) (*File, int64, error) {
 		f.Streams = streams
 	}
 
-	if dentry.Attributes&FILE_ATTRIBUTE_REPARSE_POINT != 0 && f.Size == 0 {
+	// WOF-backed files may be captured without their reparse data, since
+	// they read as regular files on the system they came from.
+	if dentry.Attributes&FILE_ATTRIBUTE_REPARSE_POINT != 0 && f.Size == 0 && !f.IsWOF() {
 		return nil, 0, &ParseError{
 			Oper: "directory entry",
 			Path: name,
@@ -803,7 +1727,10 @@ func (img *Image) readNextEntry(r io.Reader) (*File, int64, error) {
 	return f, length, nil
 }
 
-func (img *Image) readNextStream(r io.Reader) (*Stream, int64, error) {
+// readNextStream reads the stream entry at offset pos of the metadata
+// resource from r. It returns a nil Stream for named streams if
+// Options.SkipStreams is set.
+func (img *Image) readNextStream(r io.Reader, pos int64) (*Stream, int64, error) {
 	var length int64
 	err := binary.Read(r, binary.LittleEndian, &length)
 	if err != nil {
@@ -817,6 +1744,9 @@ func (img *Image) readNextStream(r io.Reader) (*Stream, int64, error) {
 	if left < streamentrySize {
 		return nil, 0, &ParseError{Oper: "stream entry", Err: errors.New("size too short")}
 	}
+	if err := img.checkEntryLength("stream entry", pos, length); err != nil {
+		return nil, 0, err
+	}
 
 	var sentry streamentry
 	err = binary.Read(r, binary.LittleEndian, &sentry)
@@ -826,9 +1756,18 @@ func (img *Image) readNextStream(r io.Reader) (*Stream, int64, error) {
 
 	left -= streamentrySize
 
+	if sentry.NameLength < 0 || sentry.NameLength%2 != 0 {
+		return nil, 0, &ParseError{Oper: "stream entry", Err: fmt.Errorf("invalid name length %d", sentry.NameLength)}
+	}
 	if left < int64(sentry.NameLength) {
 		return nil, 0, &ParseError{Oper: "stream entry", Err: errors.New("size too short for name")}
 	}
+	if sentry.NameLength != 0 && img.wim.opts.SkipStreams {
+		if _, err := io.CopyN(io.Discard, r, left); err != nil {
+			return nil, 0, unexpectedEOF(err)
+		}
+		return nil, length, nil
+	}
 
 	names := make([]uint16, sentry.NameLength/2)
 	err = binary.Read(r, binary.LittleEndian, names)
@@ -839,10 +1778,11 @@ func (img *Image) readNextStream(r io.Reader) (*Stream, int64, error) {
 	left -= int64(sentry.NameLength)
 	name := string(utf16.Decode(names))
 
+	src := img.wim
 	var offset resourceDescriptor
 	if sentry.Hash != (SHA1Hash{}) {
 		var ok bool
-		offset, ok = img.wim.fileData[sentry.Hash]
+		src, offset, ok = img.wim.lookupResource(sentry.Hash)
 		if !ok {
 			return nil, 0, &ParseError{
 				Oper: "stream entry",
@@ -858,7 +1798,7 @@ func (img *Image) readNextStream(r io.Reader) (*Stream, int64, error) {
 			Size: offset.OriginalSize,
 			Name: name,
 		},
-		wim:    img.wim,
+		wim:    src,
 		offset: offset,
 	}
 
@@ -874,13 +1814,148 @@ func (img *Image) readNextStream(r io.Reader) (*Stream, int64, error) {
 }
 
 // Open returns an io.ReadCloser that can be used to read the stream's contents.
+// Unless Options.VerifyHashes is set, the returned reader also implements
+// io.Seeker and io.ReaderAt; compressed contents are decompressed one chunk at
+// a time as needed, so seeking does not require reading from the start.
 func (s *Stream) Open() (io.ReadCloser, error) {
-	return s.wim.resourceReader(&s.offset)
+	rc, err := s.wim.resourceReader(&s.offset)
+	if err != nil || !s.wim.opts.VerifyHashes {
+		return rc, err
+	}
+	return newVerifyReader(rc, s.Name, s.Hash, s.offset.Offset), nil
 }
 
 // Open returns an io.ReadCloser that can be used to read the file's contents.
+// Unless Options.VerifyHashes is set, the returned reader also implements
+// io.Seeker and io.ReaderAt; compressed contents are decompressed one chunk at
+// a time as needed, so seeking does not require reading from the start.
 func (f *File) Open() (io.ReadCloser, error) {
-	return f.img.wim.resourceReader(&f.offset)
+	rc, err := f.src.resourceReader(&f.offset)
+	if err != nil || !f.src.opts.VerifyHashes {
+		return rc, err
+	}
+	return newVerifyReader(rc, f.Name, f.Hash, f.offset.Offset), nil
+}
+
+// ReadString reads the file's entire contents and returns them as a string.
+// Contents that begin with a UTF-16 byte order mark are decoded to UTF-8, and a
+// UTF-8 byte order mark is removed; anything else is returned unchanged.
+func (f *File) ReadString() (string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return decodeText(b), nil
+}
+
+func decodeText(b []byte) string {
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(b, []byte{0xef, 0xbb, 0xbf}):
+		return string(b[3:])
+	case bytes.HasPrefix(b, []byte{0xff, 0xfe}):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(b, []byte{0xfe, 0xff}):
+		order = binary.BigEndian
+	}
+	if order == nil || len(b)%2 != 0 {
+		return string(b)
+	}
+	u := make([]uint16, len(b)/2-1)
+	for i := range u {
+		u[i] = order.Uint16(b[2+i*2:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// CompressedSize returns the number of bytes the file's unnamed data stream
+// occupies in the WIM, including the chunk table of compressed resources, so
+// that Size and CompressedSize give the file's compression ratio. WIM data is
+// deduplicated by hash, so files with identical contents share one resource
+// and each reports its full compressed size. Files without data return 0, and
+// files whose data is packed in a solid resource, which is not stored
+// separately, return their uncompressed size.
+func (f *File) CompressedSize() int64 {
+	return f.offset.CompressedSize()
+}
+
+// Compressed reports whether the file's unnamed data stream is stored
+// compressed, so that reading it requires decompression. Resources in WIMs
+// captured without compression, and files without data, are read directly
+// from the WIM.
+func (f *File) Compressed() bool {
+	return f.src.compression(&f.offset) != CompressionNone
+}
+
+// Compression returns the algorithm needed to decompress the file's unnamed
+// data stream, or CompressionNone if it is stored uncompressed or the file
+// has no data.
+func (f *File) Compression() CompressionKind {
+	return f.src.compression(&f.offset)
+}
+
+// CompressedSize returns the number of bytes the stream occupies in the WIM,
+// as File.CompressedSize does for the unnamed data stream.
+func (s *Stream) CompressedSize() int64 {
+	return s.offset.CompressedSize()
+}
+
+// Compressed reports whether the stream is stored compressed.
+func (s *Stream) Compressed() bool {
+	return s.wim.compression(&s.offset) != CompressionNone
+}
+
+// Compression returns the algorithm needed to decompress the stream.
+func (s *Stream) Compression() CompressionKind {
+	return s.wim.compression(&s.offset)
+}
+
+// HasStream reports whether the file has a named alternate data stream called
+// name. Names are compared case-insensitively, as on NTFS.
+func (f *File) HasStream(name string) bool {
+	_, ok := f.Stream(name)
+	return ok
+}
+
+// Stream returns the named alternate data stream called name, such as
+// "Zone.Identifier". Names are compared case-insensitively, as on NTFS.
+func (f *File) Stream(name string) (*Stream, bool) {
+	for _, s := range f.Streams {
+		if strings.EqualFold(s.Name, name) {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// StreamNames returns the names of the file's alternate data streams, in the
+// order they are recorded.
+func (f *File) StreamNames() []string {
+	names := make([]string, len(f.Streams))
+	for i, s := range f.Streams {
+		names[i] = s.Name
+	}
+	return names
+}
+
+// HasUnnamedStreamEntry reports whether the file's unnamed data stream was
+// recorded as a separate stream entry rather than in its directory entry.
+// WIMs do this for files that also have named streams. Either way, the
+// unnamed stream is the file's own data, available through Open, Hash, and
+// Size, and is not included in Streams.
+func (f *File) HasUnnamedStreamEntry() bool {
+	return f.unnamedStream
+}
+
+// HasShortName reports whether the file has a short (8.3) name, which is then
+// in ShortName.
+func (f *File) HasShortName() bool {
+	return f.ShortName != ""
 }
 
 // Readdir reads the directory entries.
@@ -891,8 +1966,67 @@ func (f *File) Readdir() ([]*File, error) {
 	return f.img.readdir(f.subdirOffset)
 }
 
+// Range calls fn for each entry of the directory, in the order they are
+// recorded, as each is read. Unlike Readdir, it does not hold every entry in
+// memory at once, which matters for directories with tens of thousands of
+// entries. If fn returns filepath.SkipDir, Range stops and returns nil; any
+// other error stops Range and is returned. fn may read other directories of
+// the image, though doing so makes Range seek back to its next entry.
+func (f *File) Range(fn func(*File) error) error {
+	if !f.IsDir() {
+		return errors.New("not a directory")
+	}
+	err := f.img.rangeDir(f.subdirOffset, fn)
+	if errors.Is(err, filepath.SkipDir) {
+		return nil
+	}
+	return err
+}
+
 // IsDir returns whether the given file is a directory. It returns false when it
 // is a directory reparse point.
 func (f *FileHeader) IsDir() bool {
 	return f.Attributes&(FILE_ATTRIBUTE_DIRECTORY|FILE_ATTRIBUTE_REPARSE_POINT) == FILE_ATTRIBUTE_DIRECTORY
 }
+
+// CreationFiletime returns the file's creation time as the raw number of
+// 100-nanosecond intervals since January 1, 1601 UTC recorded in the WIM.
+// Unlike CreationTime.Time, it round-trips exactly to Windows APIs, and an
+// unset time is 0.
+func (f *FileHeader) CreationFiletime() uint64 {
+	return f.CreationTime.Ticks()
+}
+
+// LastAccessFiletime is like CreationFiletime, for the last access time.
+func (f *FileHeader) LastAccessFiletime() uint64 {
+	return f.LastAccessTime.Ticks()
+}
+
+// LastWriteFiletime is like CreationFiletime, for the last write time.
+func (f *FileHeader) LastWriteFiletime() uint64 {
+	return f.LastWriteTime.Ticks()
+}
+
+// HasCreationTime reports whether the file has a creation time. Entries
+// without one record zero, for which CreationTime.Time returns the zero
+// time.Time.
+func (f *FileHeader) HasCreationTime() bool {
+	return !f.CreationTime.IsZero()
+}
+
+// HasLastAccessTime is like HasCreationTime, for the last access time.
+func (f *FileHeader) HasLastAccessTime() bool {
+	return !f.LastAccessTime.IsZero()
+}
+
+// HasLastWriteTime is like HasCreationTime, for the last write time.
+func (f *FileHeader) HasLastWriteTime() bool {
+	return !f.LastWriteTime.IsZero()
+}
+
+// IsReparsePoint returns whether the file is a reparse point, such as a
+// symbolic link or junction, whose unnamed data stream holds its reparse data
+// rather than file contents.
+func (f *FileHeader) IsReparsePoint() bool {
+	return f.Attributes&FILE_ATTRIBUTE_REPARSE_POINT != 0
+}
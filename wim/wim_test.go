@@ -0,0 +1,1215 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"crypto/sha1" //nolint:gosec // not used for secure application
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// testFile describes a file or directory used to build a synthetic WIM.
+type testFile struct {
+	name       string
+	shortName  string
+	attr       uint32
+	data       []byte
+	streams    []testStream
+	children   []*testFile
+	securityID uint32
+	linkID     int64
+	reparseTag uint32
+	// reparseReserved is the high half of ReparseHardLink for reparse points.
+	reparseReserved uint32
+	padding         uint32   // the direntry Padding field
+	unused          [2]int64 // the direntry Unused1 and Unused2 fields
+	slack           []byte   // appended to the entry after its names
+	// terminateEmptyName writes a null terminator for an empty name, as
+	// some writers do.
+	terminateEmptyName bool
+}
+
+// testStream describes a named alternate data stream of a testFile.
+type testStream struct {
+	name string
+	data []byte
+}
+
+// testImage describes an image used to build a synthetic WIM.
+type testImage struct {
+	name string
+	sds  [][]byte
+	root *testFile
+	// metadata, if set, is used as the image's metadata resource instead of
+	// one built from sds and root.
+	metadata []byte
+}
+
+func testDir(name string, children ...*testFile) *testFile {
+	return &testFile{name: name, attr: FILE_ATTRIBUTE_DIRECTORY, children: children, securityID: 0xffffffff}
+}
+
+func testRegular(name string, data string) *testFile {
+	return &testFile{name: name, attr: FILE_ATTRIBUTE_NORMAL, data: []byte(data), securityID: 0xffffffff}
+}
+
+// wimBuilder assembles a WIM in memory.
+type wimBuilder struct {
+	buf       bytes.Buffer
+	resources []streamDescriptor
+	seen      map[SHA1Hash]bool
+	// compress, if set, is used to compress each chunk of file data.
+	compress func(chunk []byte) []byte
+	// chunkSize is the size of those chunks, or chunkSize if zero.
+	chunkSize int
+	// solid, if set, causes file data to be packed into solid resources
+	// instead of being stored in resources of its own.
+	solid *solidBuilder
+}
+
+func sha1Hash(b []byte) SHA1Hash {
+	var h SHA1Hash
+	if len(b) != 0 {
+		h = sha1.Sum(b) //nolint:gosec // not used for secure application
+	}
+	return h
+}
+
+// addResource appends b to the WIM body and returns its hash, deduplicating
+// identical content.
+func (b *wimBuilder) addResource(data []byte, flags resFlag) SHA1Hash {
+	h := sha1Hash(data)
+	if h == (SHA1Hash{}) {
+		return h
+	}
+	if flags&resFlagMetadata == 0 {
+		if b.seen[h] {
+			for i := range b.resources {
+				if b.resources[i].Hash == h {
+					b.resources[i].RefCount++
+				}
+			}
+			return h
+		}
+		b.seen[h] = true
+	}
+	var rd resourceDescriptor
+	if b.solid != nil && flags&resFlagMetadata == 0 {
+		rd = b.solid.pack(data)
+	} else if b.compress != nil && flags&resFlagMetadata == 0 {
+		rd = b.write(compressChunks(data, b.chunks(), b.compress), flags|resFlagCompressed)
+		rd.OriginalSize = int64(len(data))
+	} else {
+		rd = b.write(data, flags)
+	}
+	b.resources = append(b.resources, streamDescriptor{
+		resourceDescriptor: rd,
+		PartNumber:         1,
+		RefCount:           1,
+		Hash:               h,
+	})
+	return h
+}
+
+func (b *wimBuilder) write(data []byte, flags resFlag) resourceDescriptor {
+	rd := resourceDescriptor{
+		FlagsAndCompressedSize: uint64(len(data)) | uint64(flags)<<56,
+		Offset:                 int64(b.buf.Len()),
+		OriginalSize:           int64(len(data)),
+	}
+	b.buf.Write(data)
+	return rd
+}
+
+func (b *wimBuilder) chunks() int {
+	if b.chunkSize == 0 {
+		return chunkSize
+	}
+	return b.chunkSize
+}
+
+// compressChunks returns data as the body of a compressed resource: a table
+// of the offsets of its chunks of size bytes, followed by each chunk
+// compressed with compress, or stored as is if that does not make it smaller.
+func compressChunks(data []byte, size int, compress func([]byte) []byte) []byte {
+	var table, body bytes.Buffer
+	for off := 0; off < len(data); off += size {
+		if off != 0 {
+			_ = binary.Write(&table, binary.LittleEndian, uint32(body.Len()))
+		}
+		chunk := data[off:]
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		if c := compress(chunk); len(c) < len(chunk) {
+			chunk = c
+		}
+		body.Write(chunk)
+	}
+	return append(table.Bytes(), body.Bytes()...)
+}
+
+func utf16Bytes(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2)
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[i*2:], c)
+	}
+	return b
+}
+
+func pad8(m *bytes.Buffer) {
+	for m.Len()%8 != 0 {
+		m.WriteByte(0)
+	}
+}
+
+// writeDentry writes a directory entry for f and returns the offset of its
+// SubdirOffset field.
+func (b *wimBuilder) writeDentry(m *bytes.Buffer, f *testFile) int {
+	name := utf16Bytes(f.name)
+	short := utf16Bytes(f.shortName)
+	de := direntry{
+		Attributes:      f.attr,
+		SecurityID:      f.securityID,
+		Hash:            b.addResource(f.data, 0),
+		StreamCount:     uint16(len(f.streams)),
+		ShortNameLength: uint16(len(short)),
+		FileNameLength:  uint16(len(name)),
+		ReparseHardLink: f.linkID,
+		Padding:         f.padding,
+		Unused1:         f.unused[0],
+		Unused2:         f.unused[1],
+	}
+	if f.attr&FILE_ATTRIBUTE_REPARSE_POINT != 0 {
+		de.ReparseHardLink = int64(f.reparseTag) | int64(f.reparseReserved)<<32
+	}
+
+	var e bytes.Buffer
+	_ = binary.Write(&e, binary.LittleEndian, &de)
+	if len(name) != 0 || f.terminateEmptyName {
+		e.Write(name)
+		e.Write([]byte{0, 0})
+	}
+	if len(short) != 0 {
+		e.Write(short)
+		e.Write([]byte{0, 0})
+	}
+	pad8(&e)
+	e.Write(f.slack)
+	pad8(&e)
+
+	start := m.Len()
+	_ = binary.Write(m, binary.LittleEndian, int64(e.Len()+8))
+	m.Write(e.Bytes())
+
+	for _, s := range f.streams {
+		sname := utf16Bytes(s.name)
+		var se bytes.Buffer
+		_ = binary.Write(&se, binary.LittleEndian, &streamentry{
+			Hash:       b.addResource(s.data, 0),
+			NameLength: int16(len(sname)),
+		})
+		se.Write(sname)
+		if len(sname) != 0 {
+			se.Write([]byte{0, 0})
+		}
+		pad8(&se)
+		_ = binary.Write(m, binary.LittleEndian, int64(se.Len()+8))
+		m.Write(se.Bytes())
+	}
+	return start + 16
+}
+
+// metadata builds the metadata resource for img.
+func (b *wimBuilder) metadata(img *testImage) []byte {
+	var m bytes.Buffer
+	sdLen := securityblockDiskSize + 8*len(img.sds)
+	for _, sd := range img.sds {
+		sdLen += len(sd)
+	}
+	_ = binary.Write(&m, binary.LittleEndian, &securityblockDisk{TotalLength: uint32(sdLen), NumEntries: uint32(len(img.sds))})
+	for _, sd := range img.sds {
+		_ = binary.Write(&m, binary.LittleEndian, int64(len(sd)))
+	}
+	for _, sd := range img.sds {
+		m.Write(sd)
+	}
+	pad8(&m)
+
+	type pending struct {
+		f   *testFile
+		pos int
+	}
+	queue := []pending{{img.root, b.writeDentry(&m, img.root)}}
+	m.Write(make([]byte, 8))
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		if d.f.attr&FILE_ATTRIBUTE_DIRECTORY == 0 || d.f.attr&FILE_ATTRIBUTE_REPARSE_POINT != 0 {
+			continue
+		}
+		binary.LittleEndian.PutUint64(m.Bytes()[d.pos:], uint64(m.Len()))
+		for _, c := range d.f.children {
+			queue = append(queue, pending{c, b.writeDentry(&m, c)})
+		}
+		m.Write(make([]byte, 8))
+	}
+	return m.Bytes()
+}
+
+// buildWIM returns the bytes of an uncompressed WIM containing images.
+func buildWIM(tb testing.TB, images ...*testImage) []byte {
+	tb.Helper()
+
+	xml := "<WIM>"
+	for i, img := range images {
+		xml += fmt.Sprintf(`<IMAGE INDEX="%d"><NAME>%s</NAME></IMAGE>`, i+1, img.name)
+	}
+	xml += "</WIM>"
+	return buildWIMWithXML(tb, xml, images...)
+}
+
+// buildWIMWithXML is like buildWIM but uses the given XML document.
+func buildWIMWithXML(tb testing.TB, xml string, images ...*testImage) []byte {
+	tb.Helper()
+
+	b := &wimBuilder{seen: make(map[SHA1Hash]bool)}
+	return b.build(tb, xml, images...)
+}
+
+// buildCompressedWIM is like buildWIM, but file data is compressed chunk by
+// chunk with compress and the header declares the compression kind given by
+// flag.
+func buildCompressedWIM(tb testing.TB, flag hdrFlag, compress func([]byte) []byte, images ...*testImage) []byte {
+	tb.Helper()
+
+	b := &wimBuilder{seen: make(map[SHA1Hash]bool), compress: compress}
+	out := b.build(tb, "<WIM></WIM>", images...)
+	binary.LittleEndian.PutUint32(out[16:], uint32(hdrFlagCompressed|flag))
+	return out
+}
+
+func (b *wimBuilder) build(tb testing.TB, xml string, images ...*testImage) []byte {
+	tb.Helper()
+
+	b.buf.Write(make([]byte, wimHeaderSize))
+
+	var metadata []streamDescriptor
+	for _, img := range images {
+		md := img.metadata
+		if md == nil {
+			md = b.metadata(img)
+		}
+		n := len(b.resources)
+		b.addResource(md, resFlagMetadata)
+		metadata = append(metadata, b.resources[n])
+		b.resources = b.resources[:n]
+	}
+
+	if b.solid != nil {
+		metadata = append(metadata, b.solid.write(b)...)
+	}
+	var table bytes.Buffer
+	for _, res := range append(metadata, b.resources...) {
+		_ = binary.Write(&table, binary.LittleEndian, &res)
+	}
+
+	hdr := wimHeader{
+		ImageTag:        wimImageTag,
+		Size:            wimHeaderSize,
+		Version:         0x10d00,
+		CompressionSize: uint32(b.chunks()),
+		PartNumber:      1,
+		TotalParts:      1,
+		ImageCount:      uint32(len(images)),
+	}
+	hdr.OffsetTable = b.write(table.Bytes(), 0)
+	hdr.XMLData = b.write(append([]byte{0xff, 0xfe}, utf16Bytes(xml)...), 0)
+
+	var h bytes.Buffer
+	if err := binary.Write(&h, binary.LittleEndian, &hdr); err != nil {
+		tb.Fatal(err)
+	}
+	out := b.buf.Bytes()
+	copy(out, h.Bytes())
+	return out
+}
+
+func mustNewReader(t testing.TB, b []byte) *Reader {
+	t.Helper()
+
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func mustOpenRoot(t *testing.T, img *Image) *File {
+	t.Helper()
+
+	root, err := img.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// countingReaderAt counts the number of ReadAt calls made against it.
+type countingReaderAt struct {
+	r     *bytes.Reader
+	reads int
+}
+
+func (c *countingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	c.reads++
+	return c.r.ReadAt(b, off)
+}
+
+func largeTestTree(n int) *testFile {
+	root := testDir("")
+	for i := 0; i < n; i++ {
+		root.children = append(root.children, testRegular(fmt.Sprintf("file%05d.txt", i), ""))
+	}
+	return root
+}
+
+func BenchmarkReaddir(b *testing.B) {
+	data := buildWIM(b, &testImage{name: "large", root: largeTestTree(10000)})
+
+	for _, size := range []int{4096, DefaultDirBufferSize} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			ra := &countingReaderAt{r: bytes.NewReader(data)}
+			for i := 0; i < b.N; i++ {
+				r, err := NewReaderWithOptions(ra, &Options{DirBufferSize: size})
+				if err != nil {
+					b.Fatal(err)
+				}
+				root, err := r.Image[0].Open()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := root.Readdir(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(ra.reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func BenchmarkReadSmallFiles(b *testing.B) {
+	root := testDir("")
+	for i := 0; i < 2000; i++ {
+		root.children = append(root.children, testRegular(fmt.Sprintf("file%05d.txt", i), strings.Repeat(fmt.Sprint(i%10), 3000)))
+	}
+	data := buildWIM(b, &testImage{name: "small", root: root})
+
+	ra := &countingReaderAt{r: bytes.NewReader(data)}
+	r, err := NewReader(ra)
+	if err != nil {
+		b.Fatal(err)
+	}
+	dir, err := r.Image[0].Open()
+	if err != nil {
+		b.Fatal(err)
+	}
+	files, err := dir.Readdir()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ra.reads = 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, f := range files {
+			rc, err := f.Open()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(io.Discard, rc); err != nil {
+				b.Fatal(err)
+			}
+			rc.Close()
+		}
+	}
+	b.ReportMetric(float64(ra.reads)/float64(b.N*len(files)), "reads/file")
+}
+
+func TestReadAhead(t *testing.T) {
+	data := make([]byte, 3*readAheadSize+100)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+	ra := &countingReaderAt{r: bytes.NewReader(buildWIM(t, &testImage{name: "test", root: testDir("",
+		testRegular("a", string(data)),
+	)}))}
+	r, err := NewReader(ra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := r.Image[0].OpenFile("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	ra.reads = 0
+	b := make([]byte, 1000)
+	if _, err := io.ReadFull(rc, b); err != nil || !bytes.Equal(b, data[:1000]) {
+		t.Fatalf("unexpected first read: %v", err)
+	}
+	if _, err := io.ReadFull(rc, b); err != nil || !bytes.Equal(b, data[1000:2000]) {
+		t.Fatalf("unexpected second read: %v", err)
+	}
+	if ra.reads != 1 {
+		t.Errorf("small reads took %d reads of the WIM", ra.reads)
+	}
+
+	// Seeking discards the window but accounts for its unread bytes.
+	s := rc.(io.Seeker)
+	if pos, err := s.Seek(0, io.SeekCurrent); err != nil || pos != 2000 {
+		t.Fatalf("unexpected position %d: %v", pos, err)
+	}
+	if _, err := s.Seek(-500, io.SeekCurrent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(rc, b); err != nil || !bytes.Equal(b, data[1500:2500]) {
+		t.Fatalf("unexpected read after seek: %v", err)
+	}
+
+	// Reads spanning the end of the window are not cut short.
+	if _, err := s.Seek(readAheadSize-100, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(rc, b[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := rc.Read(b); err != nil || n != len(b) || !bytes.Equal(b, data[readAheadSize-90:readAheadSize+910]) {
+		t.Fatalf("unexpected read of %d bytes across the window: %v", n, err)
+	}
+	rest, err := io.ReadAll(rc)
+	if err != nil || !bytes.Equal(rest, data[readAheadSize+910:]) {
+		t.Fatalf("unexpected remainder: %v", err)
+	}
+}
+
+func TestRecoveryZeroCompressionSize(t *testing.T) {
+	b := buildWIM(t, &testImage{name: "test", root: testDir("", testRegular("a", "a"))})
+	// Mark the WIM as compressed but clear the chunk size.
+	hdr := b[:wimHeaderSize]
+	binary.LittleEndian.PutUint32(hdr[16:], uint32(hdrFlagCompressed|hdrFlagCompressLzx))
+	binary.LittleEndian.PutUint32(hdr[20:], 0)
+
+	if _, err := NewReader(bytes.NewReader(b)); err == nil {
+		t.Fatal("expected an error without recovery")
+	}
+	r, err := NewReaderWithOptions(bytes.NewReader(b), &Options{Recovery: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustOpenRoot(t, r.Image[0])
+}
+
+func TestAllowImageCountMismatch(t *testing.T) {
+	b := buildWIM(t,
+		&testImage{name: "one", root: testDir("", testRegular("a", "a"))},
+		&testImage{name: "two", root: testDir("", testRegular("b", "b"))},
+	)
+	// Declare a third image that the offset table does not hold.
+	binary.LittleEndian.PutUint32(b[44:], 3)
+
+	if _, err := NewReader(bytes.NewReader(b)); err == nil {
+		t.Fatal("expected an error for the mismatched image count")
+	}
+	r, err := NewReaderWithOptions(bytes.NewReader(b), &Options{AllowImageCountMismatch: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Image) != 2 || r.Image[1].Name != "two" {
+		t.Fatalf("unexpected images %v", r.Image)
+	}
+	mustOpenRoot(t, r.Image[1])
+	var perr *ParseError
+	if w := r.Warnings(); len(w) != 1 || !errors.As(w[0], &perr) {
+		t.Fatalf("unexpected warnings %v", w)
+	}
+
+	r = mustNewReader(t, buildWIM(t, &testImage{name: "one", root: testDir("")}))
+	if w := r.Warnings(); len(w) != 0 {
+		t.Errorf("unexpected warnings %v", w)
+	}
+}
+
+func TestReadString(t *testing.T) {
+	utf16le := append([]byte{0xff, 0xfe}, utf16Bytes("[Section]\r\nkey=välue")...)
+	r := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		testRegular("utf16.ini", string(utf16le)),
+		testRegular("utf8.xml", "\xef\xbb\xbf<unattend/>"),
+		testRegular("plain.txt", "plain"),
+		testRegular("binary.bin", "\xff\xfe\x00"),
+	)}))
+	files, err := mustOpenRoot(t, r.Image[0]).Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"[Section]\r\nkey=välue", "<unattend/>", "plain", "\xff\xfe\x00"}
+	for i, f := range files {
+		s, err := f.ReadString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != expected[i] {
+			t.Errorf("%s: expected %q, got %q", f.Name, expected[i], s)
+		}
+	}
+}
+
+func TestImageIndexMapping(t *testing.T) {
+	images := []*testImage{
+		{name: "one", root: testDir("", testRegular("1", "one"))},
+		{name: "two", root: testDir("", testRegular("2", "two"))},
+		{name: "three", root: testDir("", testRegular("3", "three"))},
+	}
+	// The XML lists the images out of order.
+	xml := `<WIM>` +
+		`<IMAGE INDEX="3"><NAME>three</NAME></IMAGE>` +
+		`<IMAGE INDEX="1"><NAME>one</NAME></IMAGE>` +
+		`<IMAGE INDEX="2"><NAME>two</NAME></IMAGE>` +
+		`</WIM>`
+	r := mustNewReader(t, buildWIMWithXML(t, xml, images...))
+
+	for i, img := range r.Image {
+		if img.Index != i+1 || img.Name != images[i].name {
+			t.Errorf("image %d: got index %d and name %q", i+1, img.Index, img.Name)
+		}
+		files, err := mustOpenRoot(t, img).Readdir()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files[0].Name != fmt.Sprint(i+1) {
+			t.Errorf("image %d: metadata belongs to a different image", i+1)
+		}
+	}
+}
+
+func TestFileCompressedSize(t *testing.T) {
+	root := mustOpenRoot(t, mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		testRegular("empty", ""),
+		testRegular("data", "some data"),
+	)})).Image[0])
+	files, err := root.Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := files[0].CompressedSize(); n != 0 {
+		t.Errorf("empty file has compressed size %d", n)
+	}
+	// Resources are stored uncompressed by the test builder.
+	if n := files[1].CompressedSize(); n != files[1].Size {
+		t.Errorf("compressed size %d does not match size %d", n, files[1].Size)
+	}
+	if files[0].Compressed() || files[1].Compressed() {
+		t.Error("uncompressed files reported as compressed")
+	}
+}
+
+func TestFileCompressed(t *testing.T) {
+	data := bytes.Repeat([]byte{'a'}, 2*chunkSize)
+	f := &testFile{name: "data", attr: FILE_ATTRIBUTE_NORMAL, data: data, securityID: 0xffffffff,
+		streams: []testStream{{name: "ads", data: data[:100]}}}
+	b := buildCompressedWIM(t, hdrFlagCompressLzx, repeatCompress, &testImage{name: "test", root: testDir("", f)})
+	file, err := mustNewReader(t, b).Image[0].OpenFile("data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !file.Compressed() || file.CompressedSize() >= file.Size {
+		t.Errorf("file not reported as compressed: %d of %d bytes", file.CompressedSize(), file.Size)
+	}
+	if s := file.Streams[0]; !s.Compressed() || s.CompressedSize() != 1 {
+		t.Errorf("stream not reported as compressed: %d bytes", s.CompressedSize())
+	}
+}
+
+func TestHeader(t *testing.T) {
+	b := buildWIM(t, &testImage{name: "one", root: testDir("")}, &testImage{name: "two", root: testDir("")})
+	for i := 0; i < 16; i++ {
+		b[24+i] = byte(i)
+	}
+	r := mustNewReader(t, b)
+
+	const guid = "03020100-0504-0706-0809-0a0b0c0d0e0f"
+	if s := r.GUID(); s != guid {
+		t.Errorf("unexpected GUID %s", s)
+	}
+	if r.Version() != 0x10d00 || r.ImageCount() != 2 {
+		t.Errorf("unexpected version %#x or image count %d", r.Version(), r.ImageCount())
+	}
+	expected := Header{GUID: guid, Version: 0x10d00, CompressionSize: 0x8000, PartNumber: 1, TotalParts: 1, ImageCount: 2}
+	if h := r.Header(); h != expected {
+		t.Errorf("unexpected header %+v", h)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	b := buildWIM(t, &testImage{name: "test", root: testDir("")})
+
+	notWIM := append([]byte(nil), b...)
+	notWIM[0] = 'X'
+	_, err := NewReader(bytes.NewReader(notWIM))
+	var perr *ParseError
+	if !errors.Is(err, ErrNotWIM) || !errors.As(err, &perr) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// The built-in LZX decompressor only supports 32KB chunks.
+	binary.LittleEndian.PutUint32(b[16:], uint32(hdrFlagCompressed|hdrFlagCompressLzx))
+	binary.LittleEndian.PutUint32(b[20:], 0x10000)
+	if _, err := NewReader(bytes.NewReader(b)); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestReaderImageInfo(t *testing.T) {
+	xml := `<WIM>` +
+		`<IMAGE INDEX="1"><NAME>full</NAME><DESCRIPTION>desc</DESCRIPTION><DISPLAYNAME>Full</DISPLAYNAME>` +
+		`<FLAGS>Professional</FLAGS><DIRCOUNT>12</DIRCOUNT><FILECOUNT>34</FILECOUNT><TOTALBYTES>5678</TOTALBYTES>` +
+		`<CREATIONTIME><HIGHPART>0x01D00000</HIGHPART><LOWPART>0x00000010</LOWPART></CREATIONTIME>` +
+		`<LASTMODIFICATIONTIME><HIGHPART></HIGHPART><LOWPART></LOWPART></LASTMODIFICATIONTIME>` +
+		`<WINDOWS><VERSION><MAJOR>10</MAJOR><BUILD>19041</BUILD></VERSION></WINDOWS></IMAGE>` +
+		`<IMAGE INDEX="2"><NAME>sparse</NAME></IMAGE>` +
+		`</WIM>`
+	r := mustNewReader(t, buildWIMWithXML(t, xml,
+		&testImage{name: "full", root: testDir("")},
+		&testImage{name: "sparse", root: testDir("")},
+	))
+	infos, err := r.ImageInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(infos))
+	}
+	full := infos[0]
+	if full.Description != "desc" || full.DisplayName != "Full" || full.Flags != "Professional" ||
+		full.NumDirs != 12 || full.NumFiles != 34 || full.TotalBytes != 5678 {
+		t.Errorf("unexpected image info %+v", full)
+	}
+	if full.CreationTime != (Filetime{LowDateTime: 0x10, HighDateTime: 0x01d00000}) || full.ModTime != (Filetime{}) {
+		t.Errorf("unexpected times %+v %+v", full.CreationTime, full.ModTime)
+	}
+	if full.Windows == nil || full.Windows.Version.Major != 10 || full.Windows.Version.Build != 19041 {
+		t.Errorf("unexpected Windows info %+v", full.Windows)
+	}
+	if sparse := infos[1]; sparse.Index != 2 || sparse.Name != "sparse" || sparse.Windows != nil {
+		t.Errorf("unexpected image info %+v", sparse)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.wim")
+	if err := os.WriteFile(name, buildWIM(t, &testImage{name: "test", root: testDir("", testRegular("file", "data"))}), 0666); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := r.Image[0].OpenFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := f.ReadString(); err != nil || s != "data" {
+		t.Fatalf("unexpected contents %q: %v", s, err)
+	}
+	file := r.file
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("file was not closed: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("second Close failed: %v", err)
+	}
+
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.wim")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestFileStreams(t *testing.T) {
+	img := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		&testFile{name: "download.exe", attr: FILE_ATTRIBUTE_NORMAL, securityID: 0xffffffff, streams: []testStream{
+			{name: "Zone.Identifier", data: []byte("[ZoneTransfer]\r\nZoneId=3\r\n")},
+			{name: "", data: []byte("program")},
+			{name: "extra", data: []byte("more")},
+		}},
+		testRegular("plain.txt", "plain"),
+	)})).Image[0]
+
+	f, err := img.OpenFile("download.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.HasUnnamedStreamEntry() {
+		t.Error("unnamed stream entry not reported")
+	}
+	if s, err := f.ReadString(); err != nil || s != "program" {
+		t.Errorf("unexpected file contents %q: %v", s, err)
+	}
+	if names := f.StreamNames(); len(names) != 2 || names[0] != "Zone.Identifier" || names[1] != "extra" {
+		t.Errorf("unexpected stream names %q", names)
+	}
+	s, ok := f.Stream("zone.identifier")
+	if !ok || s.Name != "Zone.Identifier" || s.Size != 26 {
+		t.Fatalf("stream not found: %+v", s)
+	}
+	if _, ok := f.Stream("missing"); ok || f.HasStream("missing") || !f.HasStream("EXTRA") {
+		t.Error("unexpected stream lookup result")
+	}
+
+	plain, err := img.OpenFile("plain.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.HasUnnamedStreamEntry() || len(plain.StreamNames()) != 0 {
+		t.Error("plain file reported streams")
+	}
+}
+
+func TestHasStream(t *testing.T) {
+	withStreams := &testFile{name: "download.exe", attr: FILE_ATTRIBUTE_NORMAL, securityID: 0xffffffff, streams: []testStream{
+		{name: "Zone.Identifier", data: []byte("[ZoneTransfer]\r\nZoneId=3\r\n")},
+		{name: "", data: []byte("program")},
+		{name: "empty", data: nil},
+	}}
+	dir := testDir("dir")
+	dir.streams = []testStream{{name: "dirstream", data: []byte("on a directory")}}
+	img := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		withStreams,
+		testRegular("plain.txt", "plain"),
+		dir,
+	)})).Image[0]
+
+	for _, tc := range []struct {
+		file, stream string
+		want         bool
+	}{
+		{"download.exe", "Zone.Identifier", true},
+		{"download.exe", "ZONE.IDENTIFIER", true},
+		{"download.exe", "empty", true},
+		{"download.exe", "", false}, // the unnamed stream is the file's contents
+		{"download.exe", "Zone", false},
+		{"download.exe", "Zone.Identifier:$DATA", false},
+		{"plain.txt", "Zone.Identifier", false},
+		{"plain.txt", "", false},
+		{"dir", "DirStream", true},
+		{"dir", "missing", false},
+	} {
+		f, err := img.OpenFile(tc.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.HasStream(tc.stream); got != tc.want {
+			t.Errorf("%s: HasStream(%q) = %v", tc.file, tc.stream, got)
+		}
+	}
+}
+
+func TestSkipStreams(t *testing.T) {
+	b := buildWIM(t, &testImage{name: "test", root: testDir("",
+		&testFile{name: "download.exe", attr: FILE_ATTRIBUTE_NORMAL, securityID: 0xffffffff, streams: []testStream{
+			{name: "Zone.Identifier", data: []byte("[ZoneTransfer]\r\nZoneId=3\r\n")},
+			{name: "", data: []byte("program")},
+		}},
+		testRegular("plain.txt", "plain"),
+	)})
+	r, err := NewReaderWithOptions(bytes.NewReader(b), &Options{SkipStreams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := mustOpenRoot(t, r.Image[0]).Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("unexpected files %v", files)
+	}
+	f := files[0]
+	if f.Streams != nil || f.HasStream("Zone.Identifier") {
+		t.Errorf("streams were parsed: %v", f.StreamNames())
+	}
+	if !f.HasUnnamedStreamEntry() {
+		t.Error("unnamed stream entry not reported")
+	}
+	if s, err := f.ReadString(); err != nil || s != "program" {
+		t.Errorf("unexpected file contents %q: %v", s, err)
+	}
+	if s, err := files[1].ReadString(); err != nil || s != "plain" {
+		t.Errorf("unexpected contents of the following file %q: %v", s, err)
+	}
+}
+
+func TestRange(t *testing.T) {
+	img := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		testDir("a", testRegular("a1", "1"), testRegular("a2", "2")),
+		testDir("b", testRegular("b1", "3")),
+		testRegular("c", "4"),
+	)})).Image[0]
+	root := mustOpenRoot(t, img)
+
+	// Reading other directories from fn does not disturb the iteration.
+	var names []string
+	err := root.Range(func(f *File) error {
+		names = append(names, f.Name)
+		if f.IsDir() {
+			files, err := f.Readdir()
+			if err != nil {
+				return err
+			}
+			for _, c := range files {
+				names = append(names, c.Name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(names, ","); got != "a,a1,a2,b,b1,c" {
+		t.Errorf("unexpected names %s", got)
+	}
+
+	names = nil
+	err = root.Range(func(f *File) error {
+		names = append(names, f.Name)
+		return filepath.SkipDir
+	})
+	if err != nil || len(names) != 1 {
+		t.Errorf("SkipDir did not stop after %v: %v", names, err)
+	}
+
+	errStop := errors.New("stop")
+	if err := root.Range(func(*File) error { return errStop }); !errors.Is(err, errStop) {
+		t.Errorf("unexpected error %v", err)
+	}
+	c, err := img.OpenFile("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Range(func(*File) error { return nil }); err == nil {
+		t.Error("expected an error ranging over a file")
+	}
+}
+
+func TestResourceBounds(t *testing.T) {
+	b := buildWIM(t, &testImage{name: "test", root: testDir("",
+		testRegular("a", "contents of a"),
+		testRegular("b", "contents of b"),
+	)})
+	// Entry 0 of the offset table is the metadata resource; move the data of
+	// entry 1 to near the end of the file.
+	var hdr wimHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	entry := b[hdr.OffsetTable.Offset+int64(binary.Size(streamDescriptor{})):]
+	binary.LittleEndian.PutUint64(entry[8:], uint64(len(b)-4))
+
+	_, err := NewReader(bytes.NewReader(b))
+	var perr *ParseError
+	if !errors.As(err, &perr) || !strings.Contains(err.Error(), "resource 1") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// In recovery mode, the entry is dropped and only its file fails.
+	r, err := NewReaderWithOptions(bytes.NewReader(b), &Options{Recovery: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Warnings()) != 1 {
+		t.Errorf("unexpected warnings %v", r.Warnings())
+	}
+	root := mustOpenRoot(t, r.Image[0])
+	if _, err := root.Readdir(); err == nil {
+		t.Error("expected an error for the file whose data was dropped")
+	}
+
+	// Without a known size, reading past the end of the file fails.
+	r, err = NewReaderFromSeeker(readSeekerOnly{bytes.NewReader(b)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := mustOpenRoot(t, r.Image[0]).Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failed int
+	for _, f := range files {
+		if _, err := f.ReadString(); errors.Is(err, io.ErrUnexpectedEOF) {
+			failed++
+		} else if err != nil {
+			t.Error(err)
+		}
+	}
+	if failed != 1 {
+		t.Errorf("%d files failed to read", failed)
+	}
+}
+
+func TestShortNames(t *testing.T) {
+	both := testRegular("Long File Name.txt", "1")
+	both.shortName = "LONGFI~1.TXT"
+	shortOnly := testRegular("", "2")
+	shortOnly.shortName = "SHORT.TXT"
+	terminated := testRegular("", "3")
+	terminated.shortName = "TERM.TXT"
+	terminated.terminateEmptyName = true
+	longOnly := testRegular("long only.txt", "4")
+	root := testDir("", both, shortOnly, terminated, longOnly)
+	root.shortName = "ROOT"
+
+	img := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: root})).Image[0]
+	r := mustOpenRoot(t, img)
+	if r.Name != "" || r.ShortName != "ROOT" || !r.HasShortName() {
+		t.Errorf("unexpected root names %q %q", r.Name, r.ShortName)
+	}
+	files, err := r.Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		name, short, data string
+	}{
+		{"Long File Name.txt", "LONGFI~1.TXT", "1"},
+		{"", "SHORT.TXT", "2"},
+		{"", "TERM.TXT", "3"},
+		{"long only.txt", "", "4"},
+	}
+	if len(files) != len(expected) {
+		t.Fatalf("unexpected files %v", files)
+	}
+	for i, f := range files {
+		e := expected[i]
+		if f.Name != e.name || f.ShortName != e.short || f.HasShortName() != (e.short != "") {
+			t.Errorf("file %d: unexpected names %q %q", i, f.Name, f.ShortName)
+		}
+		// The names do not disturb the entry's other fields.
+		if s, err := f.ReadString(); err != nil || s != e.data {
+			t.Errorf("file %d: unexpected contents %q: %v", i, s, err)
+		}
+	}
+	raw, err := r.ReaddirRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range raw {
+		if e.NonzeroPadding || e.HasSlack {
+			t.Errorf("entry %d: unexpected padding or slack", i)
+		}
+	}
+}
+
+func TestParseErrorOffset(t *testing.T) {
+	b := buildWIM(t, &testImage{name: "test", root: testDir("", testRegular("file", "data"))})
+	root := mustOpenRoot(t, mustNewReader(t, b).Image[0])
+
+	// Give the file an odd name length. Its entry is the first in the root
+	// directory, and the length field immediately precedes its name.
+	entry := append([]byte(nil), b...)
+	i := bytes.Index(entry, utf16Bytes("file"))
+	binary.LittleEndian.PutUint16(entry[i-2:], 7)
+	r := mustNewReader(t, entry)
+	_, err := mustOpenRoot(t, r.Image[0]).Readdir()
+	var perr *ParseError
+	if !errors.As(err, &perr) || perr.Offset != root.subdirOffset {
+		t.Fatalf("unexpected error %v, expected offset %d", err, root.subdirOffset)
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("(offset %d)", root.subdirOffset)) {
+		t.Errorf("offset missing from %q", err)
+	}
+
+	// Set an unsupported flag on the second entry of the offset table.
+	var hdr wimHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(binary.Size(streamDescriptor{}))
+	table := append([]byte(nil), b...)
+	table[hdr.OffsetTable.Offset+size+7] |= 0x80
+	_, err = NewReader(bytes.NewReader(table))
+	if !errors.As(err, &perr) || perr.Offset != size {
+		t.Fatalf("unexpected error %v, expected offset %d", err, size)
+	}
+}
+
+func TestRefCount(t *testing.T) {
+	a := testRegular("a", "shared")
+	a.streams = []testStream{{name: "ads", data: []byte("shared")}}
+	r := mustNewReader(t, buildWIM(t,
+		&testImage{name: "one", root: testDir("", a, testRegular("b", "shared"), testRegular("c", "unique"))},
+		&testImage{name: "two", root: testDir("", testRegular("d", "shared"))},
+	))
+	if n, ok := r.ResourceRefCount(sha1Hash([]byte("shared"))); !ok || n != 4 {
+		t.Errorf("unexpected reference count %d, %v", n, ok)
+	}
+	if _, ok := r.ResourceRefCount(sha1Hash([]byte("missing"))); ok {
+		t.Error("found a reference count for a missing resource")
+	}
+	for _, tc := range []struct {
+		path string
+		n    uint32
+	}{
+		{"a", 4},
+		{"c", 1},
+	} {
+		f, err := r.Image[0].OpenFile(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := f.RefCount(); n != tc.n {
+			t.Errorf("%s: unexpected reference count %d", tc.path, n)
+		}
+	}
+	f, err := r.Image[0].OpenFile("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := f.Streams[0].RefCount(); n != 4 {
+		t.Errorf("unexpected stream reference count %d", n)
+	}
+	root := mustOpenRoot(t, r.Image[0])
+	if n := root.RefCount(); n != 0 {
+		t.Errorf("unexpected reference count %d for a directory", n)
+	}
+}
+
+func TestMalformedResourceSizes(t *testing.T) {
+	// Entry 1 of the offset table describes the data of file.
+	data := strings.Repeat("a", 3*chunkSize)
+	b := buildCompressedWIM(t, hdrFlagCompressLzx, repeatCompress, &testImage{name: "test", root: testDir("",
+		testRegular("file", data),
+	)})
+	var hdr wimHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	entry := hdr.OffsetTable.Offset + int64(binary.Size(streamDescriptor{}))
+
+	for _, tc := range []struct {
+		size int64
+		ok   func(s string, err error) bool
+	}{
+		{-1, func(s string, err error) bool { return err != nil }},
+		// A chunk table for this many chunks does not fit in the resource.
+		{1 << 50, func(s string, err error) bool { return err != nil }},
+		{0, func(s string, err error) bool { return err == nil && s == "" }},
+	} {
+		c := append([]byte(nil), b...)
+		binary.LittleEndian.PutUint64(c[entry+16:], uint64(tc.size))
+		r, err := NewReaderWithOptions(bytes.NewReader(c), new(Options).WithDecompressor(CompressionLZX, repeatDecompressor{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := r.Image[0].OpenFile("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s, err := f.ReadString(); !tc.ok(s, err) {
+			t.Errorf("size %d: unexpected result %d bytes: %v", tc.size, len(s), err)
+		}
+	}
+}
+
+func TestImageNames(t *testing.T) {
+	xml := `<WIM><IMAGE INDEX="1"><NAME>first</NAME></IMAGE><IMAGE INDEX="2"></IMAGE></WIM>`
+	r := mustNewReader(t, buildWIMWithXML(t, xml,
+		&testImage{name: "first", root: testDir("")},
+		&testImage{root: testDir("")},
+	))
+	names, err := r.ImageNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "first,Image 2" {
+		t.Errorf("unexpected names %q", names)
+	}
+}
+
+func TestImageSelection(t *testing.T) {
+	r := mustNewReader(t, buildWIM(t,
+		&testImage{name: "Windows Pro", root: testDir("")},
+		&testImage{name: "Windows Home", root: testDir("")},
+	))
+	img, err := r.ImageByIndex(2)
+	if err != nil || img != r.Image[1] {
+		t.Errorf("ImageByIndex(2) = %v, %v", img, err)
+	}
+	img, err = r.ImageByName("windows HOME")
+	if err != nil || img != r.Image[1] {
+		t.Errorf("ImageByName = %v, %v", img, err)
+	}
+	for _, i := range []int{0, 3, -1} {
+		if _, err := r.ImageByIndex(i); !errors.Is(err, ErrImageNotFound) {
+			t.Errorf("ImageByIndex(%d): unexpected error %v", i, err)
+		}
+	}
+	if _, err := r.ImageByName("Windows Enterprise"); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestFreeResource(t *testing.T) {
+	b := &wimBuilder{seen: make(map[SHA1Hash]bool)}
+	deleted := b.addResource([]byte("deleted contents"), resFlagFree)
+	// Free entries are skipped before their bounds are checked.
+	b.resources[0].Offset = 1 << 40
+	r := mustNewReader(t, b.build(t, "<WIM></WIM>", &testImage{name: "test", root: testDir("",
+		testRegular("file", "contents"),
+	)}))
+	if _, ok := r.ResourceRefCount(deleted); ok {
+		t.Error("free resource was not skipped")
+	}
+	f, err := r.Image[0].OpenFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := f.ReadString(); err != nil || s != "contents" {
+		t.Fatalf("unexpected contents %q: %v", s, err)
+	}
+}
+
+func TestSubdirOffsetRange(t *testing.T) {
+	b := buildWIM(t, &testImage{name: "test", root: testDir("", testDir("dir", testRegular("file", "data")))})
+	// The SubdirOffset field follows the length, attributes and security ID.
+	field := bytes.Index(b, utf16Bytes("dir")) - int(direntrySize) + 16
+	for _, off := range []uint64{1 << 63, 1<<64 - 8, 1 << 40} {
+		c := append([]byte(nil), b...)
+		binary.LittleEndian.PutUint64(c[field:], off)
+		img := mustNewReader(t, c).Image[0]
+		_, err := mustOpenRoot(t, img).Readdir()
+		var perr *ParseError
+		if !errors.As(err, &perr) || !strings.Contains(err.Error(), "subdirectory offset") {
+			t.Errorf("offset %#x: unexpected Readdir error %v", off, err)
+		}
+		err = img.WalkInto(new(WalkBuffer), func(*WalkEntry) error { return nil })
+		if !errors.As(err, &perr) || !strings.Contains(err.Error(), "subdirectory offset") {
+			t.Errorf("offset %#x: unexpected WalkInto error %v", off, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// reparseTagWOF is the reparse tag of files backed by the Windows Overlay
+// Filter, IO_REPARSE_TAG_WOF.
+const reparseTagWOF = 0x80000017
+
+// WOF providers, which determine where the data of a WOF-backed file is kept.
+const (
+	// WOFProviderWIM files are backed by a resource in a WIM file, as used
+	// by WIMBoot.
+	WOFProviderWIM = 1
+	// WOFProviderFile files are compressed into their own WofCompressedData
+	// alternate data stream, as used by Compact OS.
+	WOFProviderFile = 2
+)
+
+// Compression algorithms of WOFProviderFile files.
+const (
+	WOFAlgorithmXpress4K  = 0
+	WOFAlgorithmLZX       = 1
+	WOFAlgorithmXpress8K  = 2
+	WOFAlgorithmXpress16K = 3
+)
+
+// ErrWOFUnavailable is returned by File.OpenWOF when the data of a WOF-backed
+// file is not available in the WIM.
+var ErrWOFUnavailable = errors.New("WOF-backed file data not available")
+
+// WOFInfo describes the reparse data of a file backed by the Windows Overlay
+// Filter (WOF). The file system presents such a file as a regular file whose
+// contents are kept elsewhere, depending on the provider.
+type WOFInfo struct {
+	// Provider is WOFProviderWIM or WOFProviderFile.
+	Provider uint32
+	// Algorithm is the compression algorithm of a WOFProviderFile file.
+	Algorithm uint32
+	// DataSourceID identifies the WIM file backing a WOFProviderWIM file on
+	// the system it was captured from, and ResourceHash the resource in that
+	// WIM holding the file's contents.
+	DataSourceID int64
+	ResourceHash SHA1Hash
+}
+
+// decodeWOF parses the reparse data of a WOF-backed file: a WOF_EXTERNAL_INFO
+// structure followed by the provider's own structure.
+func decodeWOF(b []byte) (*WOFInfo, error) {
+	le := binary.LittleEndian
+	if len(b) < 8 {
+		return nil, errors.New("WOF reparse buffer too short")
+	}
+	w := &WOFInfo{Provider: le.Uint32(b[4:])}
+	b = b[8:]
+	switch w.Provider {
+	case WOFProviderWIM:
+		// WIM_PROVIDER_EXTERNAL_INFO: version, flags, data source ID, and
+		// resource hash.
+		if len(b) < 36 {
+			return nil, errors.New("WOF reparse buffer too short")
+		}
+		w.DataSourceID = int64(le.Uint64(b[8:]))
+		copy(w.ResourceHash[:], b[16:36])
+	case WOFProviderFile:
+		// FILE_PROVIDER_EXTERNAL_INFO_V1: version and algorithm, which may
+		// be followed by flags.
+		if len(b) < 8 {
+			return nil, errors.New("WOF reparse buffer too short")
+		}
+		w.Algorithm = le.Uint32(b[4:])
+	default:
+		return nil, fmt.Errorf("unknown WOF provider %d", w.Provider)
+	}
+	return w, nil
+}
+
+// IsWOF reports whether the file is backed by the Windows Overlay Filter. Such
+// files are captured as reparse points, but are regular files on the system
+// they were captured from; OpenWOF reads their contents.
+func (f *FileHeader) IsWOF() bool {
+	return f.IsReparsePoint() && f.ReparseTag == reparseTagWOF
+}
+
+// OpenWOF returns a reader for the contents of a WOF-backed file. Only files
+// backed by a WIM resource are supported, and only if that resource is
+// present in the WIM, or in one of its base WIMs; otherwise the error is
+// ErrWOFUnavailable. The contents are verified against the resource's hash.
+func (f *File) OpenWOF() (io.ReadCloser, error) {
+	if !f.IsWOF() {
+		return nil, &ParseError{Oper: "WOF", Path: f.Name, Err: errors.New("not a WOF-backed file")}
+	}
+	if f.Size == 0 {
+		return nil, &ParseError{Oper: "WOF", Path: f.Name, Err: ErrWOFUnavailable}
+	}
+	rp, err := f.ReparsePoint()
+	if err != nil {
+		return nil, err
+	}
+	if rp.WOF.Provider != WOFProviderWIM {
+		return nil, &ParseError{Oper: "WOF", Path: f.Name, Err: fmt.Errorf("%w: provider %d", ErrWOFUnavailable, rp.WOF.Provider)}
+	}
+	src, rd, ok := f.img.wim.lookupResource(rp.WOF.ResourceHash)
+	if !ok {
+		return nil, &ParseError{Oper: "WOF", Path: f.Name, Err: ErrWOFUnavailable}
+	}
+	rc, err := src.resourceReader(&rd)
+	if err != nil {
+		return nil, err
+	}
+	return newVerifyReader(rc, f.Name, rp.WOF.ResourceHash, rd.Offset), nil
+}
@@ -0,0 +1,106 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testWOF returns a WOF-backed file with the given reparse data, which is
+// omitted if data is nil.
+func testWOF(name string, data []byte) *testFile {
+	return &testFile{
+		name:       name,
+		attr:       FILE_ATTRIBUTE_ARCHIVE | FILE_ATTRIBUTE_REPARSE_POINT,
+		data:       data,
+		securityID: 0xffffffff,
+		reparseTag: reparseTagWOF,
+	}
+}
+
+func wofData(provider uint32, fields ...interface{}) []byte {
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.LittleEndian, []uint32{1, provider})
+	for _, f := range fields {
+		_ = binary.Write(&b, binary.LittleEndian, f)
+	}
+	return b.Bytes()
+}
+
+func TestWOF(t *testing.T) {
+	contents := []byte("contents kept in the WIM")
+	hash := sha1Hash(contents)
+	missing := sha1Hash([]byte("not in the WIM"))
+	img := mustNewReader(t, buildWIM(t, &testImage{name: "test", root: testDir("",
+		testRegular("backing", string(contents)),
+		testWOF("wim", wofData(WOFProviderWIM, uint32(1), uint32(0), int64(5), hash)),
+		testWOF("missing", wofData(WOFProviderWIM, uint32(1), uint32(0), int64(5), missing)),
+		testWOF("compact", wofData(WOFProviderFile, uint32(1), uint32(WOFAlgorithmXpress4K))),
+		testWOF("nodata", nil),
+	)})).Image[0]
+
+	for _, tc := range []struct {
+		name string
+		wof  *WOFInfo
+	}{
+		{"wim", &WOFInfo{Provider: WOFProviderWIM, DataSourceID: 5, ResourceHash: hash}},
+		{"missing", &WOFInfo{Provider: WOFProviderWIM, DataSourceID: 5, ResourceHash: missing}},
+		{"compact", &WOFInfo{Provider: WOFProviderFile, Algorithm: WOFAlgorithmXpress4K}},
+	} {
+		f, err := img.OpenFile(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !f.IsWOF() {
+			t.Errorf("%s: not a WOF-backed file", tc.name)
+		}
+		rp, err := f.ReparsePoint()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if rp.WOF == nil || *rp.WOF != *tc.wof {
+			t.Errorf("%s: unexpected WOF info %+v", tc.name, rp.WOF)
+		}
+	}
+
+	f, err := img.OpenFile("wim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := f.OpenWOF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(b, contents) {
+		t.Fatalf("unexpected contents %q: %v", b, err)
+	}
+	for _, name := range []string{"missing", "compact", "nodata"} {
+		f, err := img.OpenFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.OpenWOF(); !errors.Is(err, ErrWOFUnavailable) {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+
+	dest := t.TempDir()
+	if err := mustOpenRoot(t, img).Extract(dest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := readTestFile(t, filepath.Join(dest, "wim")); s != string(contents) {
+		t.Errorf("unexpected extracted contents %q", s)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "missing")); !os.IsNotExist(err) {
+		t.Errorf("unavailable WOF file was extracted: %v", err)
+	}
+}
@@ -0,0 +1,723 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // not used for secure application
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/Microsoft/go-winio/wim/lzx"
+	"github.com/Microsoft/go-winio/wim/xpress"
+)
+
+// WriterOptions controls optional behavior of a Writer.
+type WriterOptions struct {
+	// Compression is the algorithm used to compress the WIM's resources.
+	// CompressionNone, CompressionXpress and CompressionLZX are supported.
+	Compression CompressionKind
+}
+
+// Writer creates a WIM file. Images are added with AddImage and filled in
+// with the methods of ImageWriter, and Close writes the WIM's metadata.
+//
+// File and stream contents are written as they are added, and identical
+// contents are stored once. The metadata of all images is kept in memory until
+// Close. A Writer is not safe for concurrent use.
+type Writer struct {
+	w         io.WriteSeeker
+	base      int64 // offset of the WIM header in w
+	pos       int64 // offset of the end of the written data, relative to base
+	kind      CompressionKind
+	resources []streamDescriptor
+	byHash    map[SHA1Hash]int // index of each resource in resources
+	images    []*ImageWriter
+	buf       []byte
+	err       error // sticky error from writing to w
+	closed    bool
+}
+
+// ImageWriter adds files to an image of a Writer. Its methods return an error
+// once the Writer has been closed.
+type ImageWriter struct {
+	w       *Writer
+	name    string
+	created Filetime
+	root    *writerEntry
+	entries map[string]*writerEntry // by lower-cased path
+	sds     [][]byte
+	sdIDs   map[string]uint32
+	xml     string // contents of the IMAGE element, if copied from another WIM
+}
+
+// writerEntry is a file or directory added to an ImageWriter.
+type writerEntry struct {
+	FileHeader
+	streams  []StreamHeader // named streams; the hash locates each one's data
+	children []*writerEntry
+}
+
+// NewWriter returns a Writer that writes a WIM with XPRESS-compressed
+// resources to w, starting at its current offset.
+func NewWriter(w io.WriteSeeker) *Writer {
+	ww, err := NewWriterWithOptions(w, &WriterOptions{Compression: CompressionXpress})
+	if err != nil {
+		// Report the error from the first call on the Writer.
+		return &Writer{w: w, err: err}
+	}
+	return ww
+}
+
+// NewWriterWithOptions returns a Writer that writes a WIM to w, starting at
+// its current offset, configured by opts. A nil opts is equivalent to the
+// zero value, which stores resources uncompressed.
+func NewWriterWithOptions(w io.WriteSeeker, opts *WriterOptions) (*Writer, error) {
+	var o WriterOptions
+	if opts != nil {
+		o = *opts
+	}
+	switch o.Compression {
+	case CompressionNone, CompressionXpress, CompressionLZX:
+	default:
+		return nil, fmt.Errorf("%w: writing %s", ErrUnsupportedCompression, o.Compression)
+	}
+	base, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	ww := &Writer{
+		w:      w,
+		base:   base,
+		kind:   o.Compression,
+		byHash: make(map[SHA1Hash]int),
+	}
+	// The header is written last, once the locations of the offset table and
+	// the XML data are known.
+	ww.write(make([]byte, wimHeaderSize))
+	if ww.err != nil {
+		return nil, ww.err
+	}
+	return ww, nil
+}
+
+// write writes b at the current position, recording any error.
+func (w *Writer) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	n, err := w.w.Write(b)
+	w.pos += int64(n)
+	w.err = err
+}
+
+// seek moves the position of w to off, relative to the WIM header.
+func (w *Writer) seek(off int64) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.w.Seek(w.base+off, io.SeekStart)
+}
+
+// check returns the error to report from a Writer method.
+func (w *Writer) check() error {
+	if w.closed {
+		return errors.New("WIM writer is closed")
+	}
+	return w.err
+}
+
+// writeResource writes size bytes from r as a resource and returns its hash.
+// Identical file contents are stored once. Metadata resources are never
+// deduplicated, since each image needs its own offset table entry.
+func (w *Writer) writeResource(r io.Reader, size int64, flags resFlag) (SHA1Hash, error) {
+	return w.writeCheckedResource(r, size, flags, w.kind, nil)
+}
+
+// writeCheckedResource is like writeResource, but compresses the contents
+// with kind, which must be the WIM's compression format or CompressionNone.
+// If check is not nil, it is called with the hash of the contents before they
+// are added to the WIM, and an error it returns discards them.
+func (w *Writer) writeCheckedResource(r io.Reader, size int64, flags resFlag, kind CompressionKind, check func(SHA1Hash) error) (SHA1Hash, error) {
+	if size == 0 && flags&resFlagMetadata == 0 {
+		// Empty contents have no resource and are identified by a zero hash.
+		if n, err := io.Copy(io.Discard, io.LimitReader(r, 1)); err != nil || n != 0 {
+			return SHA1Hash{}, errWriterSize(err)
+		}
+		return SHA1Hash{}, nil
+	}
+
+	start := w.pos
+	h := sha1.New() //nolint:gosec // not used for secure application
+	if cap(w.buf) < chunkSize {
+		w.buf = make([]byte, chunkSize)
+	}
+	var compress func([]byte) []byte
+	switch kind {
+	case CompressionXpress:
+		compress = xpress.Compress
+	case CompressionLZX:
+		compress = lzx.Compress
+	}
+	var table []byte
+	if compress != nil {
+		flags |= resFlagCompressed
+		// Reserve space for the chunk table, which records the offset of
+		// each chunk after the first relative to the end of the table.
+		n := (size + chunkSize - 1) / chunkSize
+		entry := int64(4)
+		if size > 0xffffffff {
+			entry = 8
+		}
+		table = make([]byte, (n-1)*entry)
+		w.write(table)
+		table = table[:0]
+	}
+	dataStart := w.pos
+	for left := size; left > 0; {
+		chunk := w.buf[:chunkSize]
+		if left < chunkSize {
+			chunk = chunk[:left]
+		}
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			w.discard(start)
+			return SHA1Hash{}, errWriterSize(err)
+		}
+		left -= int64(len(chunk))
+		h.Write(chunk)
+		if compress != nil {
+			if w.pos != dataStart {
+				off := uint64(w.pos - dataStart)
+				if size > 0xffffffff {
+					table = append(table, 0, 0, 0, 0, 0, 0, 0, 0)
+					binary.LittleEndian.PutUint64(table[len(table)-8:], off)
+				} else {
+					table = append(table, 0, 0, 0, 0)
+					binary.LittleEndian.PutUint32(table[len(table)-4:], uint32(off))
+				}
+			}
+			// Chunks that do not compress are stored as is.
+			if c := compress(chunk); len(c) < len(chunk) {
+				chunk = c
+			}
+		}
+		w.write(chunk)
+	}
+	if n, err := io.Copy(io.Discard, io.LimitReader(r, 1)); err != nil || n != 0 {
+		w.discard(start)
+		return SHA1Hash{}, errWriterSize(err)
+	}
+	if w.err != nil {
+		return SHA1Hash{}, w.err
+	}
+
+	var hash SHA1Hash
+	copy(hash[:], h.Sum(nil))
+	if check != nil {
+		if err := check(hash); err != nil {
+			w.discard(start)
+			return SHA1Hash{}, err
+		}
+	}
+	if i, ok := w.byHash[hash]; ok && flags&resFlagMetadata == 0 {
+		w.resources[i].RefCount++
+		w.discard(start)
+		return hash, w.err
+	}
+
+	end := w.pos
+	if len(table) != 0 {
+		w.seek(start)
+		w.write(table)
+		w.pos = end
+		w.seek(end)
+	}
+	w.resources = append(w.resources, streamDescriptor{
+		resourceDescriptor: resourceDescriptor{
+			FlagsAndCompressedSize: uint64(end-start) | uint64(flags)<<56,
+			Offset:                 start,
+			OriginalSize:           size,
+		},
+		PartNumber: 1,
+		RefCount:   1,
+		Hash:       hash,
+	})
+	if flags&resFlagMetadata == 0 {
+		w.byHash[hash] = len(w.resources) - 1
+	}
+	return hash, w.err
+}
+
+// discard moves the position back to start, so that the data written after
+// it is overwritten by the next resource.
+func (w *Writer) discard(start int64) {
+	w.pos = start
+	w.seek(start)
+}
+
+// errWriterSize returns the error for contents that are not the declared
+// size.
+func errWriterSize(err error) error {
+	if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF { //nolint:errorlint
+		return errors.New("contents do not match the declared size")
+	}
+	return err
+}
+
+// AddImage adds an image with the given name to the WIM. The image initially
+// holds only a root directory, whose metadata may be set by passing an empty
+// path to ImageWriter.AddDir.
+func (w *Writer) AddImage(name string) (*ImageWriter, error) {
+	if err := w.check(); err != nil {
+		return nil, err
+	}
+	now := timeToFiletime(time.Now())
+	img := &ImageWriter{
+		w:       w,
+		name:    name,
+		created: now,
+		root: &writerEntry{FileHeader: FileHeader{
+			Attributes:     FILE_ATTRIBUTE_DIRECTORY,
+			CreationTime:   now,
+			LastAccessTime: now,
+			LastWriteTime:  now,
+		}},
+		entries: make(map[string]*writerEntry),
+		sdIDs:   make(map[string]uint32),
+	}
+	img.entries[""] = img.root
+	w.images = append(w.images, img)
+	return img, nil
+}
+
+// timeToFiletime converts t to a Windows time. The zero time.Time converts to
+// the zero Filetime, which means that no time was recorded.
+func timeToFiletime(t time.Time) Filetime {
+	if t.IsZero() {
+		return Filetime{}
+	}
+	return FiletimeFromTicks(uint64(t.UnixNano()/100 + 116444736000000000))
+}
+
+// splitWriterPath splits the slash- or backslash-separated path p into the
+// lookup key of its parent directory and its final component.
+func splitWriterPath(p string) (string, string) {
+	elems := strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' })
+	if len(elems) == 0 {
+		return "", ""
+	}
+	return strings.ToLower(strings.Join(elems[:len(elems)-1], "/")), elems[len(elems)-1]
+}
+
+// add adds an entry with header hdr at path p, whose parent directory must
+// already have been added. For files, data is called once the path has been
+// checked to store the contents and return their hash.
+func (img *ImageWriter) add(p string, hdr *FileHeader, data func() (SHA1Hash, error)) error {
+	if err := img.w.check(); err != nil {
+		return err
+	}
+	dir, name := splitWriterPath(p)
+	parent := img.entries[dir]
+	if parent == nil || !parent.IsDir() {
+		return &ParseError{Oper: "add", Path: p, Err: errors.New("parent is not a directory in the image")}
+	}
+	key := strings.ToLower(name)
+	if dir != "" {
+		key = dir + "/" + key
+	}
+	if img.entries[key] != nil {
+		return &ParseError{Oper: "add", Path: p, Err: errors.New("file already exists")}
+	}
+	e := &writerEntry{FileHeader: *hdr}
+	e.Name = name
+	e.Hash = SHA1Hash{}
+	if data != nil {
+		var err error
+		if e.Hash, err = data(); err != nil {
+			return &ParseError{Oper: "add", Path: p, Err: err}
+		}
+	}
+	parent.children = append(parent.children, e)
+	img.entries[key] = e
+	return nil
+}
+
+// AddDir adds the directory at the slash- or backslash-separated path p, whose
+// parent must already have been added, with the metadata in hdr. The name in
+// hdr is ignored in favor of the last component of p, and the directory
+// attribute is always set. If p is empty, the metadata of the root directory
+// is replaced instead.
+func (img *ImageWriter) AddDir(p string, hdr *FileHeader) error {
+	h := *hdr
+	h.Attributes |= FILE_ATTRIBUTE_DIRECTORY
+	h.Size = 0
+	if !h.IsDir() {
+		return &ParseError{Oper: "add", Path: p, Err: errors.New("directory reparse points must be added with AddFile")}
+	}
+	if _, name := splitWriterPath(p); name == "" {
+		if err := img.w.check(); err != nil {
+			return err
+		}
+		img.root.FileHeader = h
+		img.root.Name = ""
+		img.root.Hash = SHA1Hash{}
+		return nil
+	}
+	return img.add(p, &h, nil)
+}
+
+// AddFile adds the file at the slash- or backslash-separated path p, whose
+// parent directory must already have been added, with the metadata in hdr and
+// the contents read from r, which must be exactly hdr.Size bytes. The name in
+// hdr is ignored in favor of the last component of p, and the hash is
+// computed. For a reparse point, r holds the reparse data and hdr.ReparseTag
+// its tag; otherwise, files that share a nonzero hdr.LinkID are hard links to
+// each other.
+func (img *ImageWriter) AddFile(p string, hdr *FileHeader, r io.Reader) error {
+	if hdr.IsDir() {
+		return &ParseError{Oper: "add", Path: p, Err: errors.New("directories must be added with AddDir")}
+	}
+	if hdr.Size < 0 {
+		return &ParseError{Oper: "add", Path: p, Err: fmt.Errorf("invalid size %d", hdr.Size)}
+	}
+	if hdr.Attributes&FILE_ATTRIBUTE_REPARSE_POINT != 0 && hdr.Size == 0 {
+		return &ParseError{Oper: "add", Path: p, Err: errors.New("reparse point has no reparse data")}
+	}
+	if _, name := splitWriterPath(p); name == "" {
+		return &ParseError{Oper: "add", Path: p, Err: errors.New("empty file name")}
+	}
+	if r == nil {
+		r = bytes.NewReader(nil)
+	}
+	return img.add(p, hdr, func() (SHA1Hash, error) {
+		return img.w.writeResource(r, hdr.Size, 0)
+	})
+}
+
+// AddStream adds the alternate data stream with the given name to the file
+// or directory at path p, which must already have been added, with size bytes
+// of contents read from r.
+func (img *ImageWriter) AddStream(p, name string, size int64, r io.Reader) error {
+	return img.addStream(p, name, size, func() (SHA1Hash, error) {
+		return img.w.writeResource(r, size, 0)
+	})
+}
+
+// addStream is like add, for an alternate data stream.
+func (img *ImageWriter) addStream(p, name string, size int64, data func() (SHA1Hash, error)) error {
+	if err := img.w.check(); err != nil {
+		return err
+	}
+	dir, base := splitWriterPath(p)
+	key := strings.ToLower(base)
+	if dir != "" {
+		key = dir + "/" + key
+	}
+	e := img.entries[key]
+	switch {
+	case e == nil:
+		return &ParseError{Oper: "add stream", Path: p, Err: errors.New("file not found in the image")}
+	case name == "":
+		return &ParseError{Oper: "add stream", Path: p, Err: errors.New("empty stream name")}
+	case size < 0:
+		return &ParseError{Oper: "add stream", Path: p, Err: fmt.Errorf("invalid size %d", size)}
+	}
+	for _, s := range e.streams {
+		if strings.EqualFold(s.Name, name) {
+			return &ParseError{Oper: "add stream", Path: p + ":" + name, Err: errors.New("stream already exists")}
+		}
+	}
+	hash, err := data()
+	if err != nil {
+		return &ParseError{Oper: "add stream", Path: p + ":" + name, Err: err}
+	}
+	e.streams = append(e.streams, StreamHeader{Name: name, Hash: hash, Size: size})
+	return nil
+}
+
+// securityID returns the index of sd in the image's security table, adding
+// it if it is new.
+func (img *ImageWriter) securityID(sd []byte) uint32 {
+	if sd == nil {
+		return noSecurityID
+	}
+	id, ok := img.sdIDs[string(sd)]
+	if !ok {
+		id = uint32(len(img.sds))
+		img.sds = append(img.sds, sd)
+		img.sdIDs[string(sd)] = id
+	}
+	return id
+}
+
+// writeDentry appends the directory entry for e and its streams to m and
+// returns the offset of its SubdirOffset field.
+func (img *ImageWriter) writeDentry(m *bytes.Buffer, e *writerEntry) int {
+	name := utf16LE(e.Name)
+	short := utf16LE(e.ShortName)
+	de := direntry{
+		Attributes:      e.Attributes,
+		SecurityID:      img.securityID(e.SecurityDescriptor),
+		CreationTime:    e.CreationTime,
+		LastAccessTime:  e.LastAccessTime,
+		LastWriteTime:   e.LastWriteTime,
+		Hash:            e.Hash,
+		ReparseHardLink: e.LinkID,
+		ShortNameLength: uint16(len(short)),
+		FileNameLength:  uint16(len(name)),
+	}
+	if e.Attributes&FILE_ATTRIBUTE_REPARSE_POINT != 0 {
+		de.ReparseHardLink = int64(e.ReparseTag) | int64(e.ReparseReserved)<<32
+	}
+	if len(e.streams) != 0 {
+		// The unnamed stream is listed first among the streams instead.
+		de.Hash = SHA1Hash{}
+		de.StreamCount = uint16(len(e.streams) + 1)
+	}
+
+	start := m.Len()
+	length := direntrySize
+	if len(name) != 0 {
+		length += int64(len(name)) + 2
+	}
+	if len(short) != 0 {
+		length += int64(len(short)) + 2
+	}
+	length = (length + 7) &^ 7
+	_ = binary.Write(m, binary.LittleEndian, length)
+	_ = binary.Write(m, binary.LittleEndian, &de)
+	// Names are only null-terminated if they are not empty.
+	if len(name) != 0 {
+		m.Write(name)
+		m.Write([]byte{0, 0})
+	}
+	if len(short) != 0 {
+		m.Write(short)
+		m.Write([]byte{0, 0})
+	}
+	writerPad8(m)
+
+	if len(e.streams) != 0 {
+		writeStreamEntry(m, StreamHeader{Hash: e.Hash})
+		for _, s := range e.streams {
+			writeStreamEntry(m, s)
+		}
+	}
+	return start + 16
+}
+
+func writeStreamEntry(m *bytes.Buffer, s StreamHeader) {
+	name := utf16LE(s.Name)
+	length := streamentrySize + int64(len(name))
+	if len(name) != 0 {
+		length += 2
+	}
+	length = (length + 7) &^ 7
+	_ = binary.Write(m, binary.LittleEndian, length)
+	_ = binary.Write(m, binary.LittleEndian, &streamentry{Hash: s.Hash, NameLength: int16(len(name))})
+	m.Write(name)
+	if len(name) != 0 {
+		m.Write([]byte{0, 0})
+	}
+	writerPad8(m)
+}
+
+func utf16LE(s string) []byte {
+	b := new(bytes.Buffer)
+	_ = binary.Write(b, binary.LittleEndian, utf16.Encode([]rune(s)))
+	return b.Bytes()
+}
+
+func writerPad8(m *bytes.Buffer) {
+	for m.Len()%8 != 0 {
+		m.WriteByte(0)
+	}
+}
+
+// metadata returns the image's metadata resource: the security table followed
+// by the directory tree, with the entries of each directory stored together in
+// breadth-first order.
+func (img *ImageWriter) metadata() []byte {
+	img.sds = nil
+	img.sdIDs = make(map[string]uint32)
+	img.walk(func(e *writerEntry) { img.securityID(e.SecurityDescriptor) })
+
+	var m bytes.Buffer
+	length := securityblockDiskSize + 8*len(img.sds)
+	for _, sd := range img.sds {
+		length += len(sd)
+	}
+	length = (length + 7) &^ 7
+	_ = binary.Write(&m, binary.LittleEndian, &securityblockDisk{TotalLength: uint32(length), NumEntries: uint32(len(img.sds))})
+	for _, sd := range img.sds {
+		_ = binary.Write(&m, binary.LittleEndian, int64(len(sd)))
+	}
+	for _, sd := range img.sds {
+		m.Write(sd)
+	}
+	writerPad8(&m)
+
+	type pending struct {
+		e   *writerEntry
+		pos int
+	}
+	queue := []pending{{img.root, img.writeDentry(&m, img.root)}}
+	m.Write(make([]byte, 8))
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		if !d.e.IsDir() {
+			continue
+		}
+		binary.LittleEndian.PutUint64(m.Bytes()[d.pos:], uint64(m.Len()))
+		for _, c := range d.e.children {
+			queue = append(queue, pending{c, img.writeDentry(&m, c)})
+		}
+		m.Write(make([]byte, 8))
+	}
+	return m.Bytes()
+}
+
+// walk calls fn for each entry of the image in breadth-first order.
+func (img *ImageWriter) walk(fn func(e *writerEntry)) {
+	queue := []*writerEntry{img.root}
+	for len(queue) > 0 {
+		e := queue[0]
+		queue = queue[1:]
+		fn(e)
+		if e.IsDir() {
+			queue = append(queue, e.children...)
+		}
+	}
+}
+
+// info returns the XML information for the image.
+func (img *ImageWriter) info() ImageInfo {
+	inf := ImageInfo{Name: img.name, CreationTime: img.created, ModTime: img.created}
+	links := make(map[int64]bool)
+	img.walk(func(e *writerEntry) {
+		if e.IsDir() {
+			inf.NumDirs++
+		} else {
+			inf.NumFiles++
+		}
+		// Hard-linked contents are counted once.
+		if e.LinkID != 0 && links[e.LinkID] {
+			return
+		}
+		links[e.LinkID] = true
+		inf.TotalBytes += e.Size
+		for _, s := range e.streams {
+			inf.TotalBytes += s.Size
+		}
+	})
+	return inf
+}
+
+// Close writes the metadata of each image, the offset table, the XML data,
+// and finally the header. It does not close the underlying writer. If w
+// supports truncation, as *os.File does, any data left after the WIM by
+// discarded duplicate contents is removed.
+func (w *Writer) Close() error {
+	if err := w.check(); err != nil {
+		return err
+	}
+	w.closed = true
+
+	var metadata []streamDescriptor
+	for _, img := range w.images {
+		md := img.metadata()
+		n := len(w.resources)
+		if _, err := w.writeResource(bytes.NewReader(md), int64(len(md)), resFlagMetadata); err != nil {
+			return err
+		}
+		metadata = append(metadata, w.resources[n])
+		w.resources = w.resources[:n]
+	}
+
+	hdr := wimHeader{
+		ImageTag:        wimImageTag,
+		Size:            wimHeaderSize,
+		Version:         0x10d00,
+		CompressionSize: chunkSize,
+		PartNumber:      1,
+		TotalParts:      1,
+		ImageCount:      uint32(len(w.images)),
+	}
+	switch w.kind {
+	case CompressionXpress:
+		hdr.Flags = hdrFlagCompressed | hdrFlagCompressXpress
+	case CompressionLZX:
+		hdr.Flags = hdrFlagCompressed | hdrFlagCompressLzx
+	}
+	if _, err := rand.Read(hdr.WIMGuid.Data4[:]); err != nil {
+		return err
+	}
+	var g [8]byte
+	if _, err := rand.Read(g[:]); err != nil {
+		return err
+	}
+	hdr.WIMGuid.Data1 = binary.LittleEndian.Uint32(g[:])
+	hdr.WIMGuid.Data2 = binary.LittleEndian.Uint16(g[4:])
+	hdr.WIMGuid.Data3 = binary.LittleEndian.Uint16(g[6:])
+
+	var table bytes.Buffer
+	for _, res := range append(metadata, w.resources...) {
+		_ = binary.Write(&table, binary.LittleEndian, &res)
+	}
+	hdr.OffsetTable = w.writeRaw(table.Bytes())
+
+	var x bytes.Buffer
+	fmt.Fprintf(&x, "<WIM><TOTALBYTES>%d</TOTALBYTES>", w.pos)
+	for i, img := range w.images {
+		if img.xml != "" {
+			fmt.Fprintf(&x, `<IMAGE INDEX="%d">%s</IMAGE>`, i+1, img.xml)
+			continue
+		}
+		inf := img.info()
+		fmt.Fprintf(&x, `<IMAGE INDEX="%d"><DIRCOUNT>%d</DIRCOUNT><FILECOUNT>%d</FILECOUNT><TOTALBYTES>%d</TOTALBYTES>`,
+			i+1, inf.NumDirs, inf.NumFiles, inf.TotalBytes)
+		writeXMLTime(&x, "CREATIONTIME", inf.CreationTime)
+		writeXMLTime(&x, "LASTMODIFICATIONTIME", inf.ModTime)
+		x.WriteString("<NAME>")
+		_ = xml.EscapeText(&x, []byte(inf.Name))
+		x.WriteString("</NAME></IMAGE>")
+	}
+	x.WriteString("</WIM>")
+	hdr.XMLData = w.writeRaw(append([]byte{0xff, 0xfe}, utf16LE(x.String())...))
+
+	end := w.pos
+	var h bytes.Buffer
+	_ = binary.Write(&h, binary.LittleEndian, &hdr)
+	w.seek(0)
+	w.write(h.Bytes())
+	w.pos = end
+	w.seek(end)
+	if t, ok := w.w.(interface{ Truncate(int64) error }); ok && w.err == nil {
+		w.err = t.Truncate(w.base + end)
+	}
+	return w.err
+}
+
+// writeRaw writes b uncompressed and returns its resource descriptor.
+func (w *Writer) writeRaw(b []byte) resourceDescriptor {
+	rd := resourceDescriptor{
+		FlagsAndCompressedSize: uint64(len(b)),
+		Offset:                 w.pos,
+		OriginalSize:           int64(len(b)),
+	}
+	w.write(b)
+	return rd
+}
+
+func writeXMLTime(x *bytes.Buffer, tag string, ft Filetime) {
+	fmt.Fprintf(x, "<%s><HIGHPART>0x%08X</HIGHPART><LOWPART>0x%08X</LOWPART></%s>", tag, ft.HighDateTime, ft.LowDateTime, tag)
+}
@@ -0,0 +1,269 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	data := bytes.Repeat([]byte("compressible file contents. "), 5000)
+	sd := sdBytes(0, sidBytes(5, 18), nil, nil, nil)
+	mtime := timeToFiletime(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	junction := testJunction("", `\??\C:\dir`).data
+
+	for _, kind := range []CompressionKind{CompressionNone, CompressionXpress, CompressionLZX} {
+		t.Run(kind.String(), func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "test.wim")
+			out, err := os.Create(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+			w, err := NewWriterWithOptions(out, &WriterOptions{Compression: kind})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			img, err := w.AddImage("first & <best>")
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := func(size int64) *FileHeader {
+				return &FileHeader{Attributes: FILE_ATTRIBUTE_ARCHIVE, LastWriteTime: mtime, Size: size}
+			}
+			for _, err := range []error{
+				img.AddDir("", &FileHeader{SecurityDescriptor: sd}),
+				img.AddDir("dir", &FileHeader{LastWriteTime: mtime, SecurityDescriptor: sd}),
+				img.AddFile(`dir\a.txt`, file(int64(len(data))), bytes.NewReader(data)),
+				img.AddFile("dir/b.txt", file(int64(len(data))), bytes.NewReader(data)),
+				img.AddStream("dir/a.txt", "ads", 3, strings.NewReader("ads")),
+				img.AddFile("empty", file(0), strings.NewReader("")),
+				img.AddFile("link1", &FileHeader{LinkID: 7, Size: 4}, strings.NewReader("link")),
+				img.AddFile("link2", &FileHeader{LinkID: 7, Size: 4}, strings.NewReader("link")),
+				img.AddFile("junction", &FileHeader{
+					Attributes: FILE_ATTRIBUTE_DIRECTORY | FILE_ATTRIBUTE_REPARSE_POINT,
+					ReparseTag: reparseTagMountPoint,
+					Size:       int64(len(junction)),
+				}, bytes.NewReader(junction)),
+			} {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			img2, err := w.AddImage("second")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := img2.AddFile("copy.txt", file(int64(len(data))), bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			st, err := out.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kind != CompressionNone && st.Size() > int64(len(data))/4 {
+				t.Errorf("compressed WIM is %d bytes", st.Size())
+			}
+
+			r, err := Open(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if k, err := SniffCompression(out); err != nil || k != kind {
+				t.Fatalf("compression %s: %v", k, err)
+			}
+			if len(r.Image) != 2 || r.Image[0].Name != "first & <best>" || r.Image[1].Name != "second" {
+				t.Fatalf("unexpected images %+v", r.Image)
+			}
+			first := r.Image[0]
+			if first.NumDirs != 2 || first.NumFiles != 6 || first.CreationTime == (Filetime{}) {
+				t.Errorf("unexpected image info %+v", first.ImageInfo)
+			}
+			if err := first.VerifyDeclaredSize(); err != nil {
+				t.Error(err)
+			}
+
+			root := mustOpenRoot(t, first)
+			if !bytes.Equal(root.SecurityDescriptor, sd) {
+				t.Error("root security descriptor not preserved")
+			}
+			a, err := first.OpenFile("dir/a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s, err := a.ReadString(); err != nil || s != string(data) {
+				t.Fatalf("unexpected contents of a.txt: %v", err)
+			}
+			if a.LastWriteTime != mtime || a.Attributes != FILE_ATTRIBUTE_ARCHIVE || a.Size != int64(len(data)) {
+				t.Errorf("unexpected header %+v", a.FileHeader)
+			}
+			if len(a.Streams) != 1 || a.Streams[0].Name != "ads" {
+				t.Fatalf("unexpected streams %+v", a.Streams)
+			}
+			rc, err := a.Streams[0].Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || string(b) != "ads" {
+				t.Fatalf("unexpected stream contents %q: %v", b, err)
+			}
+
+			bf, err := first.OpenFile("dir/b.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cp, err := r.Image[1].OpenFile("copy.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bf.offset != a.offset || cp.offset != a.offset {
+				t.Error("identical contents were not deduplicated")
+			}
+			if n := w.resources[w.byHash[a.Hash]].RefCount; n != 3 {
+				t.Errorf("unexpected reference count %d", n)
+			}
+
+			dir, err := first.OpenFile("dir")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !dir.IsDir() || dir.LastWriteTime != mtime || !bytes.Equal(dir.SecurityDescriptor, sd) {
+				t.Errorf("unexpected directory header %+v", dir.FileHeader)
+			}
+			j, err := first.OpenFile("junction")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if j.ReparseTag != reparseTagMountPoint || !j.isJunction() {
+				t.Errorf("unexpected junction header %+v", j.FileHeader)
+			}
+			l1, err := first.OpenFile("link1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l1.LinkID != 7 {
+				t.Errorf("unexpected link ID %d", l1.LinkID)
+			}
+		})
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "test.wim")
+	out, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	if _, err := NewWriterWithOptions(out, &WriterOptions{Compression: CompressionLZMS}); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	w := NewWriter(out)
+	img, err := w.AddImage("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{"missing parent", img.AddFile("missing/file", &FileHeader{}, strings.NewReader(""))},
+		{"short contents", img.AddFile("short", &FileHeader{Size: 10}, strings.NewReader("abc"))},
+		{"long contents", img.AddFile("long", &FileHeader{Size: 1}, strings.NewReader("abc"))},
+		{"directory as file", img.AddFile("dir", &FileHeader{Attributes: FILE_ATTRIBUTE_DIRECTORY}, strings.NewReader(""))},
+		{"missing stream target", img.AddStream("missing", "ads", 0, strings.NewReader(""))},
+	} {
+		if tc.err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+	if err := img.AddFile("FILE", &FileHeader{Size: 1}, strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.AddFile("file", &FileHeader{}, strings.NewReader("")); err == nil {
+		t.Error("expected an error for a duplicate name")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.AddImage("late"); err == nil {
+		t.Error("expected an error adding an image after Close")
+	}
+
+	// The failed additions leave nothing behind.
+	r, err := Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	files, err := mustOpenRoot(t, r.Image[0]).Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "FILE" {
+		t.Fatalf("unexpected files %v", files)
+	}
+	if s, err := files[0].ReadString(); err != nil || s != "x" {
+		t.Fatalf("unexpected contents %q: %v", s, err)
+	}
+}
+
+func TestFiletimeTicks(t *testing.T) {
+	// A time with a sub-microsecond component.
+	const ticks = 132223104001234567
+	ft := FiletimeFromTicks(ticks)
+	if ft.Ticks() != ticks {
+		t.Fatalf("got %d ticks", ft.Ticks())
+	}
+	if ft.Time().UnixNano()%1000 != 700 {
+		t.Errorf("unexpected time %v", ft.Time())
+	}
+
+	p := filepath.Join(t.TempDir(), "test.wim")
+	out, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	w := NewWriter(out)
+	img, err := w.AddImage("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := &FileHeader{LastWriteTime: ft, LastAccessTime: FiletimeFromTicks(ticks + 1)}
+	if err := img.AddFile("file", hdr, strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	f, err := r.Image[0].OpenFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.CreationFiletime() != 0 || f.LastAccessFiletime() != ticks+1 || f.LastWriteFiletime() != ticks {
+		t.Errorf("unexpected times %d %d %d", f.CreationFiletime(), f.LastAccessFiletime(), f.LastWriteFiletime())
+	}
+}
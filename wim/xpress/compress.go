@@ -0,0 +1,312 @@
+package xpress
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sort"
+)
+
+const (
+	hashBits      = 15
+	maxChainDepth = 32
+)
+
+// item is a literal, if length is 0, or a match.
+type item struct {
+	length uint32
+	offset uint32 // or the literal byte
+}
+
+// Compress compresses src with greedy LZ77 parsing. The result may be larger
+// than src, in which case WIM writers store the chunk uncompressed instead.
+func Compress(src []byte) []byte {
+	var out []byte
+	items := parse(src)
+	pos := 0
+	for start := 0; start < len(src) || start == 0; start += blockSize {
+		end := start + blockSize
+		if end > len(src) {
+			end = len(src)
+		}
+		// Gather the items that produce this block's output.
+		n := 0
+		for covered := start; covered < end; n++ {
+			if items[pos+n].length == 0 {
+				covered++
+			} else {
+				covered += int(items[pos+n].length)
+			}
+		}
+		out = writeBlock(out, items[pos:pos+n], end == len(src))
+		pos += n
+		if end == len(src) {
+			break
+		}
+	}
+	return out
+}
+
+// parse splits src into literals and matches, finding matches with hash
+// chains. Matches do not cross block boundaries.
+func parse(src []byte) []item {
+	var head [1 << hashBits]int32
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(src))
+	hash := func(i int) uint32 {
+		v := uint32(src[i]) | uint32(src[i+1])<<8 | uint32(src[i+2])<<16
+		return (v * 0x9e3779b1) >> (32 - hashBits)
+	}
+	insert := func(i int) {
+		if i+minMatchLen <= len(src) {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+
+	var items []item
+	for i := 0; i < len(src); {
+		limit := len(src) - i
+		if blockEnd := (i/blockSize + 1) * blockSize; blockEnd-i < limit {
+			limit = blockEnd - i
+		}
+		if limit > maxMatchLen {
+			limit = maxMatchLen
+		}
+		bestLen, bestOff := 0, 0
+		if limit >= minMatchLen {
+			cand := head[hash(i)]
+			for depth := 0; cand >= 0 && depth < maxChainDepth; depth++ {
+				off := i - int(cand)
+				if off > maxOffset {
+					break
+				}
+				n := 0
+				for n < limit && src[int(cand)+n] == src[i+n] {
+					n++
+				}
+				if n > bestLen {
+					bestLen, bestOff = n, off
+					if n == limit {
+						break
+					}
+				}
+				cand = prev[cand]
+			}
+		}
+		if bestLen >= minMatchLen {
+			items = append(items, item{length: uint32(bestLen), offset: uint32(bestOff)})
+			for j := 0; j < bestLen; j++ {
+				insert(i + j)
+			}
+			i += bestLen
+		} else {
+			items = append(items, item{offset: uint32(src[i])})
+			insert(i)
+			i++
+		}
+	}
+	return items
+}
+
+// matchSymbol returns the symbol of a match, its offset bits, and their
+// count.
+func matchSymbol(it item) (sym int, offsetBits uint32, n uint) {
+	n = uint(bits.Len32(it.offset) - 1)
+	header := int(it.length - minMatchLen)
+	if header > 0xf {
+		header = 0xf
+	}
+	return 256 + int(n)<<4 + header, it.offset - 1<<n, n
+}
+
+// writeBlock appends a block holding items to out. The final block also
+// holds an end-of-data symbol, which decompressors that know the output size
+// never read.
+func writeBlock(out []byte, items []item, final bool) []byte {
+	var freqs [numSymbols]uint32
+	for _, it := range items {
+		if it.length == 0 {
+			freqs[it.offset]++
+		} else {
+			sym, _, _ := matchSymbol(it)
+			freqs[sym]++
+		}
+	}
+	if final {
+		freqs[endOfData]++
+	}
+	lens := codeLengths(freqs[:], maxCodeLen)
+	codes := canonicalCodes(lens)
+
+	for i := 0; i < tableSize; i++ {
+		out = append(out, lens[2*i]|lens[2*i+1]<<4)
+	}
+	bw := newBitWriter(out)
+	for _, it := range items {
+		if it.length == 0 {
+			bw.writeBits(uint32(codes[it.offset]), uint(lens[it.offset]))
+			continue
+		}
+		sym, offsetBits, n := matchSymbol(it)
+		bw.writeBits(uint32(codes[sym]), uint(lens[sym]))
+		if l := it.length - minMatchLen; l >= 0xf {
+			if l-0xf < 0xff {
+				bw.writeByte(byte(l - 0xf))
+			} else {
+				bw.writeByte(0xff)
+				bw.writeUint16(uint16(l))
+			}
+		}
+		bw.writeBits(offsetBits, n)
+	}
+	if final {
+		bw.writeBits(uint32(codes[endOfData]), uint(lens[endOfData]))
+	}
+	return bw.flush()
+}
+
+// bitWriter writes a block's bitstream in the order the decompressor reads
+// it. Space for the word being filled and the one after it is reserved ahead
+// of the bytes of long match lengths, since the decompressor has already read
+// both words when it reads those bytes.
+type bitWriter struct {
+	out       []byte
+	bitbuf    uint32
+	bitcount  uint
+	nextBits  int
+	nextBits2 int
+}
+
+func newBitWriter(out []byte) *bitWriter {
+	n := len(out)
+	return &bitWriter{out: append(out, 0, 0, 0, 0), nextBits: n, nextBits2: n + 2}
+}
+
+func (bw *bitWriter) writeBits(v uint32, n uint) {
+	bw.bitbuf = bw.bitbuf<<n | v
+	bw.bitcount += n
+	if bw.bitcount > 16 {
+		bw.bitcount -= 16
+		binary.LittleEndian.PutUint16(bw.out[bw.nextBits:], uint16(bw.bitbuf>>bw.bitcount))
+		bw.nextBits = bw.nextBits2
+		bw.nextBits2 = len(bw.out)
+		bw.out = append(bw.out, 0, 0)
+	}
+}
+
+func (bw *bitWriter) writeByte(b byte) {
+	bw.out = append(bw.out, b)
+}
+
+func (bw *bitWriter) writeUint16(v uint16) {
+	bw.out = append(bw.out, byte(v), byte(v>>8))
+}
+
+func (bw *bitWriter) flush() []byte {
+	binary.LittleEndian.PutUint16(bw.out[bw.nextBits:], uint16(bw.bitbuf<<(16-bw.bitcount)))
+	return bw.out
+}
+
+// canonicalCodes assigns canonical codewords to the symbols with the given
+// lengths, in the order the decompressor's table expects: by length, then by
+// symbol.
+func canonicalCodes(lens []uint8) []uint16 {
+	codes := make([]uint16, len(lens))
+	next := 0
+	for n := uint8(1); n <= maxCodeLen; n++ {
+		for sym, l := range lens {
+			if l == n {
+				codes[sym] = uint16(next >> (maxCodeLen - n))
+				next += 1 << (maxCodeLen - n)
+			}
+		}
+	}
+	return codes
+}
+
+// codeLengths returns Huffman codeword lengths of at most maxLen bits for
+// symbols with the given frequencies. If the lengths of an optimal code are
+// too long, the frequencies are flattened and the code rebuilt. At least two
+// symbols are always given codewords, so that the code is complete.
+func codeLengths(freqs []uint32, maxLen uint8) []uint8 {
+	f := append([]uint32(nil), freqs...)
+	used := 0
+	for _, v := range f {
+		if v != 0 {
+			used++
+		}
+	}
+	for i := 0; used < 2; i++ {
+		if f[i] == 0 {
+			f[i] = 1
+			used++
+		}
+	}
+	for {
+		lens, ok := huffmanLengths(f, maxLen)
+		if ok {
+			return lens
+		}
+		for i, v := range f {
+			if v != 0 {
+				f[i] = v>>1 | 1
+			}
+		}
+	}
+}
+
+// huffmanLengths returns the codeword lengths of an optimal Huffman code for
+// the symbols with nonzero frequencies, and whether all are at most maxLen.
+func huffmanLengths(freqs []uint32, maxLen uint8) ([]uint8, bool) {
+	type node struct {
+		freq   uint64
+		parent int
+	}
+	var leaves []int
+	for sym, v := range freqs {
+		if v != 0 {
+			leaves = append(leaves, sym)
+		}
+	}
+	sort.SliceStable(leaves, func(i, j int) bool { return freqs[leaves[i]] < freqs[leaves[j]] })
+
+	// Leaves are nodes 0..n-1 in order of frequency, and internal nodes are
+	// created in order of nondecreasing frequency, so two queues suffice.
+	n := len(leaves)
+	nodes := make([]node, n, 2*n-1)
+	for i, sym := range leaves {
+		nodes[i] = node{freq: uint64(freqs[sym]), parent: -1}
+	}
+	nextLeaf, nextInternal := 0, n
+	pick := func() int {
+		if nextLeaf < n && (nextInternal >= len(nodes) || nodes[nextLeaf].freq <= nodes[nextInternal].freq) {
+			nextLeaf++
+			return nextLeaf - 1
+		}
+		nextInternal++
+		return nextInternal - 1
+	}
+	for len(nodes) < 2*n-1 {
+		a, b := pick(), pick()
+		nodes = append(nodes, node{freq: nodes[a].freq + nodes[b].freq, parent: -1})
+		nodes[a].parent = len(nodes) - 1
+		nodes[b].parent = len(nodes) - 1
+	}
+
+	depth := make([]uint8, len(nodes))
+	for i := len(nodes) - 2; i >= 0; i-- {
+		depth[i] = depth[nodes[i].parent] + 1
+	}
+	lens := make([]uint8, len(freqs))
+	ok := true
+	for i, sym := range leaves {
+		lens[sym] = depth[i]
+		if depth[i] > maxLen {
+			ok = false
+		}
+	}
+	return lens, ok
+}
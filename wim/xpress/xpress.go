@@ -0,0 +1,247 @@
+// Package xpress implements a compressor and a decompressor for the XPRESS
+// Huffman compression format as used in WIM files, which is documented in
+// [MS-XCA] section 2.1.
+//
+// Data is compressed in blocks of 64 KiB. Each block starts with a table of
+// the 4-bit codeword lengths of 512 Huffman symbols: 256 literals and 256
+// match headers, each of which holds the low bits of a match length and the
+// number of bits in the match offset. The codewords and offset bits follow in
+// a stream of little-endian 16-bit words, read from the most significant bit
+// down, and the bytes of long match lengths are interleaved with those words.
+// WIM chunks are at most 64 KiB, so each holds a single block.
+package xpress
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	numSymbols    = 512
+	tableSize     = numSymbols / 2
+	maxCodeLen    = 15
+	minMatchLen   = 3
+	maxMatchLen   = 0xffff
+	maxOffset     = 0xffff
+	blockSize     = 0x10000
+	endOfData     = 256 // a match symbol that the compressor appends as an end marker
+	invalidSymbol = 0xffff
+)
+
+var errCorrupt = errors.New("XPRESS data corrupt")
+
+// Decompress decompresses src, which must expand to exactly uncompressedSize
+// bytes.
+func Decompress(src []byte, uncompressedSize int) ([]byte, error) {
+	if uncompressedSize < 0 {
+		return nil, errors.New("invalid uncompressed size")
+	}
+	out := make([]byte, uncompressedSize)
+	var d decoder
+	for pos := 0; pos < len(out); {
+		end := pos + blockSize
+		if end > len(out) {
+			end = len(out)
+		}
+		var err error
+		if src, pos, err = d.decodeBlock(src, out, pos, end); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+type decoder struct {
+	lens  [numSymbols]uint8
+	table [1 << maxCodeLen]uint16
+}
+
+// decodeBlock decodes the block at the start of in, which produces the output
+// from pos up to at least end, and returns the input following it and the new
+// output position.
+func (d *decoder) decodeBlock(in, out []byte, pos, end int) ([]byte, int, error) {
+	if len(in) < tableSize {
+		return nil, 0, errCorrupt
+	}
+	for i, b := range in[:tableSize] {
+		d.lens[2*i] = b & 0xf
+		d.lens[2*i+1] = b >> 4
+	}
+	if err := d.buildTable(); err != nil {
+		return nil, 0, err
+	}
+
+	br := newBitReader(in[tableSize:])
+	for pos < end {
+		sym := d.table[br.peek()]
+		if sym == invalidSymbol {
+			return nil, 0, errCorrupt
+		}
+		br.consume(uint(d.lens[sym]))
+		if sym < 256 {
+			out[pos] = byte(sym)
+			pos++
+			if br.overrun() {
+				return nil, 0, errCorrupt
+			}
+			continue
+		}
+
+		sym -= 256
+		length := int(sym & 0xf)
+		offsetBits := uint(sym >> 4)
+		if length == 0xf {
+			b, err := br.readByte()
+			if err != nil {
+				return nil, 0, err
+			}
+			length = int(b)
+			if length == 0xff {
+				v, err := br.readUint16()
+				if err != nil {
+					return nil, 0, err
+				}
+				length = int(v)
+				if length == 0 {
+					v, err := br.readUint32()
+					if err != nil {
+						return nil, 0, err
+					}
+					if uint64(v) > uint64(len(out)) {
+						return nil, 0, errCorrupt
+					}
+					length = int(v)
+				}
+				if length < 0xf {
+					return nil, 0, errCorrupt
+				}
+				length -= 0xf
+			}
+			length += 0xf
+		}
+		length += minMatchLen
+		offset := int(br.readBits(offsetBits)) + 1<<offsetBits
+
+		if offset > pos || length > len(out)-pos {
+			return nil, 0, errCorrupt
+		}
+		for i := 0; i < length; i++ {
+			out[pos+i] = out[pos+i-offset]
+		}
+		pos += length
+		if br.overrun() {
+			return nil, 0, errCorrupt
+		}
+	}
+	return in[tableSize+br.pos:], pos, nil
+}
+
+// buildTable fills d.table, which maps each 15-bit prefix of the bitstream
+// to the symbol whose canonical codeword it starts with.
+func (d *decoder) buildTable() error {
+	next := 0
+	for n := uint8(1); n <= maxCodeLen; n++ {
+		span := 1 << (maxCodeLen - n)
+		for sym, l := range d.lens {
+			if l != n {
+				continue
+			}
+			if next+span > len(d.table) {
+				return errCorrupt
+			}
+			for i := next; i < next+span; i++ {
+				d.table[i] = uint16(sym)
+			}
+			next += span
+		}
+	}
+	for i := next; i < len(d.table); i++ {
+		d.table[i] = invalidSymbol
+	}
+	return nil
+}
+
+// bitReader reads the bitstream of a block. It holds 32 bits, of which the
+// top 16+extra are valid, and reads the next word once fewer than 16 remain.
+// Bytes of long match lengths are read from the position following the last
+// word read. Past the end of the input, the bitstream reads as zeros so that
+// the lookahead can be filled, but consuming those bits is an error.
+type bitReader struct {
+	in    []byte
+	pos   int
+	bits  uint32
+	extra int
+	past  int // words read past the end of the input
+}
+
+func newBitReader(in []byte) *bitReader {
+	br := &bitReader{in: in}
+	br.bits = uint32(br.word())<<16 | uint32(br.word())
+	br.extra = 16
+	return br
+}
+
+func (br *bitReader) word() uint16 {
+	if br.pos+2 > len(br.in) {
+		br.pos = len(br.in)
+		br.past++
+		return 0
+	}
+	w := binary.LittleEndian.Uint16(br.in[br.pos:])
+	br.pos += 2
+	return w
+}
+
+// overrun reports whether bits past the end of the input have been consumed.
+func (br *bitReader) overrun() bool {
+	return 16*br.past > 16+br.extra
+}
+
+func (br *bitReader) peek() uint32 {
+	return br.bits >> (32 - maxCodeLen)
+}
+
+func (br *bitReader) consume(n uint) {
+	br.bits <<= n
+	br.extra -= int(n)
+	if br.extra < 0 {
+		br.bits |= uint32(br.word()) << uint(-br.extra)
+		br.extra += 16
+	}
+}
+
+func (br *bitReader) readBits(n uint) uint32 {
+	if n == 0 {
+		return 0
+	}
+	v := br.bits >> (32 - n)
+	br.consume(n)
+	return v
+}
+
+func (br *bitReader) readByte() (byte, error) {
+	if br.pos >= len(br.in) {
+		return 0, errCorrupt
+	}
+	b := br.in[br.pos]
+	br.pos++
+	return b, nil
+}
+
+func (br *bitReader) readUint16() (uint16, error) {
+	if br.pos+2 > len(br.in) {
+		return 0, errCorrupt
+	}
+	v := binary.LittleEndian.Uint16(br.in[br.pos:])
+	br.pos += 2
+	return v, nil
+}
+
+func (br *bitReader) readUint32() (uint32, error) {
+	if br.pos+4 > len(br.in) {
+		return 0, errCorrupt
+	}
+	v := binary.LittleEndian.Uint32(br.in[br.pos:])
+	br.pos += 4
+	return v, nil
+}
@@ -0,0 +1,112 @@
+package xpress
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func roundTrip(t *testing.T, name string, data []byte) []byte {
+	t.Helper()
+	c := Compress(data)
+	got, err := Decompress(c, len(data))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("%s: round trip mismatch", name)
+	}
+	return c
+}
+
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 100000)
+	rng.Read(random)
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 2000)
+	skewed := make([]byte, 40000)
+	for i := range skewed {
+		// Very uneven frequencies force codeword lengths to be limited.
+		skewed[i] = byte(bitsSet(rng.Uint32() | rng.Uint32()<<8))
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"one byte", []byte{'x'}},
+		{"zeros", make([]byte, 70000)},
+		{"text", text},
+		{"random", random},
+		{"skewed", skewed},
+		{"long match", append(append([]byte("abc"), make([]byte, 300)...), random[:500]...)},
+	} {
+		c := roundTrip(t, tc.name, tc.data)
+		if tc.name == "text" && len(c) > len(tc.data)/10 {
+			t.Errorf("text compressed poorly: %d bytes to %d", len(tc.data), len(c))
+		}
+	}
+}
+
+func bitsSet(v uint32) int {
+	n := 0
+	for ; v != 0; v &= v - 1 {
+		n++
+	}
+	return n
+}
+
+func TestCodeLengthsLimited(t *testing.T) {
+	freqs := make([]uint32, numSymbols)
+	f := uint32(1)
+	for i := 0; i < 30; i++ {
+		freqs[i] = f
+		f += f/2 + 1
+	}
+	lens := codeLengths(freqs, maxCodeLen)
+	var kraft float64
+	for i, l := range lens {
+		if (freqs[i] != 0) != (l != 0) || l > maxCodeLen {
+			t.Fatalf("symbol %d: frequency %d, length %d", i, freqs[i], l)
+		}
+		if l != 0 {
+			kraft += 1 / float64(uint(1)<<l)
+		}
+	}
+	if kraft != 1 {
+		t.Fatalf("code is not complete: %v", kraft)
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefgh"), 1000)
+	c := Compress(data)
+	if _, err := Decompress(c[:tableSize-1], len(data)); err == nil {
+		t.Error("expected an error for a truncated table")
+	}
+	bad := append([]byte(nil), c...)
+	for i := 0; i < tableSize; i++ {
+		bad[i] = 0x11 // every symbol has a 1-bit codeword
+	}
+	if _, err := Decompress(bad, len(data)); err == nil {
+		t.Error("expected an error for an oversubscribed code")
+	}
+	if _, err := Decompress(c, len(data)+100); err == nil {
+		t.Error("expected an error when the data ends early")
+	}
+
+	// A match referring to before the start of the output.
+	out := writeBlock(nil, []item{{length: 3, offset: 8}}, true)
+	if _, err := Decompress(out, 3); err == nil {
+		t.Error("expected an error for an out of range offset")
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		src := make([]byte, tableSize+rng.Intn(300))
+		rng.Read(src)
+		// Errors are expected; the decoder must not panic or overrun.
+		_, _ = Decompress(src, rng.Intn(2*blockSize))
+	}
+}